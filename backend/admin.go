@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// requireAdmin only calls next for requests carrying the ADMIN_TOKEN as a bearer token.
+// Admin endpoints are unavailable while ADMIN_TOKEN is unset.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if checkAdmin(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// checkAdmin reports whether r carries the ADMIN_TOKEN, responding with an error otherwise.
+// It guards admin-only options of public endpoints.
+func checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		respondWithError(w, "Admin endpoints are disabled", http.StatusForbidden)
+		return false
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		respondWithError(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// registerAdminRoutes adds the /api/v1/admin endpoints to mux, each wrapped in guard
+func registerAdminRoutes(mux *http.ServeMux, guard func(http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("GET /api/v1/admin/users", guard(GetUsersHandler))
+	mux.HandleFunc("PUT /api/v1/admin/users/{id}", guard(PutUserHandler))
+	mux.HandleFunc("DELETE /api/v1/admin/users/{id}", guard(DeleteUserHandler))
+	mux.HandleFunc("GET /api/v1/admin/teams", guard(GetTeamsHandler))
+	mux.HandleFunc("PUT /api/v1/admin/teams/{name}", guard(PutTeamHandler))
+	mux.HandleFunc("DELETE /api/v1/admin/teams/{name}", guard(DeleteTeamHandler))
+	mux.HandleFunc("GET /api/v1/admin/maintenance", guard(GetMaintenanceHandler))
+	mux.HandleFunc("PUT /api/v1/admin/maintenance", guard(PutMaintenanceHandler))
+	mux.HandleFunc("GET /api/v1/admin/usage", guard(GetUsageHandler))
+	mux.HandleFunc("GET /api/v1/admin/failed-requests", guard(GetFailedRequestsHandler))
+	mux.HandleFunc("POST /api/v1/admin/failed-requests/{id}/replay", guard(ReplayFailedRequestHandler))
+	mux.HandleFunc("GET /api/v1/admin/retention", guard(GetRetentionSettingsHandler))
+	mux.HandleFunc("PUT /api/v1/admin/retention", guard(PutRetentionSettingsHandler))
+	mux.HandleFunc("GET /api/v1/admin/slo", guard(GetSLOHandler))
+	mux.HandleFunc("POST /api/v1/admin/sources/discover", guard(DiscoverSourcesHandler))
+	mux.HandleFunc("GET /api/v1/admin/schema", guard(GetSchemaHandler))
+}
+
+// serveAdminPort serves the admin endpoints, metrics, pprof and the health check on ADMIN_PORT of
+// ADMIN_ADDR, the loopback interface unless set. The port must only be reachable from inside the
+// deployment: it skips the origin check, CORS and the admin token of the public listener.
+func serveAdminPort(port string) {
+	api := http.NewServeMux()
+	registerAdminRoutes(api, func(next http.HandlerFunc) http.HandlerFunc { return next })
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/admin/", requestLimitsMiddleware(readOnlyMiddleware(queryTimeoutMiddleware(api))))
+	mux.HandleFunc("GET /healthz", HealthHandler)
+	mux.HandleFunc("GET /metrics", MetricsHandler)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	addr := net.JoinHostPort(getEnvOrDefault("ADMIN_ADDR", "127.0.0.1"), port)
+	log.Info().Msgf("Admin server starting on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatal().Err(err).Msg("Admin server failed to start")
+	}
+}
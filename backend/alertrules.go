@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// alertRulesCheckpoint names the progress of the rule watcher in the checkpoint table
+	alertRulesCheckpoint = "alert-rules"
+	// maxAlertWindow is the longest window a rule can count matches over
+	maxAlertWindow = 7 * 24 * time.Hour
+	// maxAlertSamples is the number of matching messages listed in an alert
+	maxAlertSamples = 5
+)
+
+var errAlertRuleNotFound = errors.New("alert rule not found")
+
+// AlertRule raises an alert when at least Threshold new messages matching its conditions arrive
+// within Window. Filter takes the filter parameters of the chat listing as a query string, such
+// as tag=vip&hasInvalidToolCalls=true, and Pattern a regular expression on the message content.
+// Rules without actions notify the default alert channels.
+type AlertRule struct {
+	ID              int64         `json:"id"`
+	Name            string        `json:"name"`
+	Filter          string        `json:"filter"`
+	Pattern         string        `json:"pattern"`
+	Threshold       int           `json:"threshold"`
+	Window          string        `json:"window"`
+	Actions         []AlertAction `json:"actions"`
+	Enabled         bool          `json:"enabled"`
+	CreatedAt       time.Time     `json:"createdAt"`
+	UpdatedAt       time.Time     `json:"updatedAt"`
+	LastTriggeredAt *time.Time    `json:"lastTriggeredAt,omitempty"`
+
+	window time.Duration
+	filter ChatFilter
+}
+
+// validate checks the rule and fills in its defaults and parsed fields
+func (rule *AlertRule) validate() error {
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		return errors.New("name is required")
+	}
+	if rule.Filter == "" && rule.Pattern == "" {
+		return errors.New("a rule needs a filter or a pattern")
+	}
+
+	query, err := url.ParseQuery(rule.Filter)
+	if err != nil {
+		return errors.New("filter must be a query string")
+	}
+	if rule.filter, err = parseChatFilter(query); err != nil {
+		return fmt.Errorf("filter: %w", err)
+	}
+	if rule.Pattern != "" {
+		// Patterns run in Postgres, whose regular expressions accept the common subset of Go's
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+
+	if rule.Threshold == 0 {
+		rule.Threshold = 1
+	}
+	if rule.Threshold < 0 {
+		return errors.New("threshold must be positive")
+	}
+	if rule.Window == "" {
+		rule.Window = "5m"
+	}
+	if rule.window, err = time.ParseDuration(rule.Window); err != nil || rule.window < time.Minute || rule.window > maxAlertWindow {
+		return fmt.Errorf("window must be a duration between 1m and %s", maxAlertWindow)
+	}
+	rule.Window = rule.window.String()
+
+	if rule.Actions == nil {
+		rule.Actions = []AlertAction{}
+	}
+	for _, action := range rule.Actions {
+		if _, err := newAlertChannel(action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// channels returns the channels of the rule's actions, or the default ones when it has none
+func (rule AlertRule) channels() []alertChannel {
+	if len(rule.Actions) == 0 {
+		return alertChannels
+	}
+	var channels []alertChannel
+	for _, action := range rule.Actions {
+		channel, err := newAlertChannel(action)
+		if err != nil {
+			log.Err(err).Int64("rule", rule.ID).Msg("Skipping invalid alert action")
+			continue
+		}
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+const alertRuleColumns = `id, name, filter, pattern, threshold, window_seconds, actions, enabled, created_at, updated_at, last_triggered_at`
+
+// scanAlertRule reads a row of alertRuleColumns
+func scanAlertRule(row interface{ Scan(...interface{}) error }) (AlertRule, error) {
+	var rule AlertRule
+	var windowSeconds int64
+	var actions []byte
+	var lastTriggeredAt sql.NullTime
+	if err := row.Scan(&rule.ID, &rule.Name, &rule.Filter, &rule.Pattern, &rule.Threshold, &windowSeconds, &actions,
+		&rule.Enabled, &rule.CreatedAt, &rule.UpdatedAt, &lastTriggeredAt); err != nil {
+		return rule, err
+	}
+	if err := json.Unmarshal(actions, &rule.Actions); err != nil {
+		return rule, err
+	}
+	if lastTriggeredAt.Valid {
+		rule.LastTriggeredAt = &lastTriggeredAt.Time
+	}
+	rule.window = time.Duration(windowSeconds) * time.Second
+	rule.Window = rule.window.String()
+	return rule, nil
+}
+
+// loadAlertRules returns the rules in creation order, only the enabled ones when enabledOnly is set
+func loadAlertRules(ctx context.Context, enabledOnly bool) ([]AlertRule, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+alertRuleColumns+` FROM chat_history_alert_rules WHERE enabled OR NOT $1 ORDER BY id`, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func loadAlertRule(ctx context.Context, id string) (AlertRule, error) {
+	rule, err := scanAlertRule(db.QueryRowContext(ctx, `SELECT `+alertRuleColumns+` FROM chat_history_alert_rules WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return rule, errAlertRuleNotFound
+	}
+	return rule, err
+}
+
+func GetAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := loadAlertRules(r.Context(), false)
+	if err != nil {
+		log.Err(err).Msg("Failed to load alert rules")
+		respondWithQueryError(w, err)
+		return
+	}
+	respondWithJSON(w, DataResponse{Data: rules})
+}
+
+func GetAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := strconv.ParseInt(r.PathValue("id"), 10, 64); err != nil {
+		respondWithError(w, "Invalid alert rule ID", http.StatusBadRequest)
+		return
+	}
+	rule, err := loadAlertRule(r.Context(), r.PathValue("id"))
+	if errors.Is(err, errAlertRuleNotFound) {
+		respondWithError(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to load alert rule")
+		respondWithQueryError(w, err)
+		return
+	}
+	respondWithJSON(w, DataResponse{Data: rule})
+}
+
+// CreateAlertRuleHandler adds a rule, enabled unless the body says otherwise
+func CreateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule := AlertRule{Enabled: true}
+	if !decodeJSONBody(w, r, &rule) {
+		return
+	}
+	if err := rule.validate(); err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	actions, _ := json.Marshal(rule.Actions)
+	err := db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_alert_rules (name, filter, pattern, threshold, window_seconds, actions, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, updated_at
+	`, rule.Name, rule.Filter, rule.Pattern, rule.Threshold, int64(rule.window.Seconds()), string(actions), rule.Enabled).
+		Scan(&rule.ID, &rule.CreatedAt, &rule.UpdatedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to create alert rule")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := recordAudit(db, r, "alerts.create", rule); err != nil {
+		log.Err(err).Msg("Failed to record alert rule audit entry")
+	}
+
+	respondWithJSONStatus(w, DataResponse{Data: rule}, http.StatusCreated)
+}
+
+// UpdateAlertRuleHandler replaces the settings of a rule
+func UpdateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, "Invalid alert rule ID", http.StatusBadRequest)
+		return
+	}
+
+	rule := AlertRule{Enabled: true}
+	if !decodeJSONBody(w, r, &rule) {
+		return
+	}
+	if err := rule.validate(); err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = id
+
+	var lastTriggeredAt sql.NullTime
+	actions, _ := json.Marshal(rule.Actions)
+	err = db.QueryRowContext(r.Context(), `
+		UPDATE chat_history_alert_rules
+		SET name = $2, filter = $3, pattern = $4, threshold = $5, window_seconds = $6, actions = $7, enabled = $8, updated_at = now()
+		WHERE id = $1
+		RETURNING created_at, updated_at, last_triggered_at
+	`, id, rule.Name, rule.Filter, rule.Pattern, rule.Threshold, int64(rule.window.Seconds()), string(actions), rule.Enabled).
+		Scan(&rule.CreatedAt, &rule.UpdatedAt, &lastTriggeredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to update alert rule")
+		respondWithQueryError(w, err)
+		return
+	}
+	if lastTriggeredAt.Valid {
+		rule.LastTriggeredAt = &lastTriggeredAt.Time
+	}
+	if err := recordAudit(db, r, "alerts.update", rule); err != nil {
+		log.Err(err).Msg("Failed to record alert rule audit entry")
+	}
+
+	respondWithJSON(w, DataResponse{Data: rule})
+}
+
+func DeleteAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, "Invalid alert rule ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM chat_history_alert_rules WHERE id = $1`, id)
+	if err != nil {
+		log.Err(err).Msg("Failed to delete alert rule")
+		respondWithQueryError(w, err)
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		respondWithError(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	if err := recordAudit(db, r, "alerts.delete", map[string]interface{}{"id": id}); err != nil {
+		log.Err(err).Msg("Failed to record alert rule audit entry")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// alertRuleJob evaluates the enabled rules against the messages added since its checkpoint. The
+// matches of every run are recorded, so thresholds count over the rule's window; matches that
+// already raised an alert are not counted again.
+type alertRuleJob struct{}
+
+// ruleTrigger is an alert to send once the run has committed
+type ruleTrigger struct {
+	rule  AlertRule
+	alert Alert
+}
+
+func (alertRuleJob) run(ctx context.Context) error {
+	rules, err := loadAlertRules(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var checkpoint, lastID int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT last_id FROM chat_history_publish_checkpoints WHERE publisher = $1 FOR UPDATE
+	`, alertRulesCheckpoint).Scan(&checkpoint); err != nil {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), $1) FROM n8n_chat_histories`, checkpoint).Scan(&lastID); err != nil {
+		return err
+	}
+
+	var triggers []ruleTrigger
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			log.Warn().Err(err).Int64("rule", rule.ID).Msg("Skipping invalid alert rule")
+			continue
+		}
+		trigger, err := evaluateAlertRule(ctx, tx, rule, checkpoint, lastID)
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", rule.ID, err)
+		}
+		if trigger != nil {
+			triggers = append(triggers, *trigger)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM chat_history_alert_rule_hits WHERE evaluated_at < now() - make_interval(secs => $1)
+	`, maxAlertWindow.Seconds()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE chat_history_publish_checkpoints SET last_id = $2, updated_at = now() WHERE publisher = $1
+	`, alertRulesCheckpoint, lastID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, trigger := range triggers {
+		sendAlertTo(ctx, trigger.rule.channels(), trigger.alert)
+	}
+	return nil
+}
+
+// evaluateAlertRule records the matches of rule among the rows in (after, upTo] and returns the
+// alert to send when the threshold is reached
+func evaluateAlertRule(ctx context.Context, tx *sql.Tx, rule AlertRule, after, upTo int64) (*ruleTrigger, error) {
+	if upTo > after {
+		var args queryArgs
+		conditions := append(rule.filter.conditions(&args), "id > "+args.add(after), "id <= "+args.add(upTo))
+		if rule.Pattern != "" {
+			conditions = append(conditions, "COALESCE(message->>'content', '') ~ "+args.add(rule.Pattern))
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
+			INSERT INTO chat_history_alert_rule_hits (rule_id, matches, message_ids, session_ids)
+			SELECT %s::bigint, COUNT(*), (array_agg(id ORDER BY id DESC))[1:%d], (array_agg(session_id ORDER BY id DESC))[1:%d]
+			FROM n8n_chat_histories
+			%s
+			HAVING COUNT(*) > 0
+		`, args.add(rule.ID), maxAlertSamples, maxAlertSamples, joinWhere(conditions)), args...); err != nil {
+			return nil, err
+		}
+	}
+
+	// Matches count from the window start or the last alert, whichever is later
+	var matches int
+	var messageIDs []int64
+	var sessionIDs []string
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(matches), 0),
+			COALESCE((array_agg(message_ids ORDER BY id DESC))[1], '{}'),
+			COALESCE((array_agg(session_ids ORDER BY id DESC))[1], '{}')
+		FROM chat_history_alert_rule_hits
+		WHERE rule_id = $1
+			AND evaluated_at >= now() - make_interval(secs => $2)
+			AND evaluated_at > COALESCE($3, '-infinity'::timestamptz)
+	`, rule.ID, rule.window.Seconds(), rule.LastTriggeredAt).Scan(&matches, pgArray(&messageIDs), pgArray(&sessionIDs)); err != nil {
+		return nil, err
+	}
+	if matches < rule.Threshold {
+		return nil, nil
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE chat_history_alert_rules SET last_triggered_at = now() WHERE id = $1`, rule.ID); err != nil {
+		return nil, err
+	}
+	links := make([]string, len(messageIDs))
+	for i, id := range messageIDs {
+		links[i] = messagePermalink(id)
+	}
+
+	return &ruleTrigger{rule: rule, alert: Alert{
+		Kind:    "rule:" + rule.Name,
+		Message: fmt.Sprintf("%d messages matched alert rule %q within %s", matches, rule.Name, rule.Window),
+		Details: map[string]interface{}{
+			"ruleId":     rule.ID,
+			"matches":    matches,
+			"messageIds": messageIDs,
+			"sessionIds": sessionIDs,
+			"links":      links,
+		},
+	}}, nil
+}
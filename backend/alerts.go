@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Alert is a notification raised by one of the background detectors
+type Alert struct {
+	Kind     string                 `json:"kind"`
+	Message  string                 `json:"message"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+	RaisedAt time.Time              `json:"raisedAt"`
+}
+
+// alertChannel delivers alerts to an external service
+type alertChannel interface {
+	Name() string
+	Send(ctx context.Context, alert Alert) error
+}
+
+// alertChannels are the configured destinations of alerts
+var alertChannels []alertChannel
+
+// alertClient is shared by the channels posting to webhooks
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// AlertAction names a channel and its destination: a URL for webhook and slack, and
+// comma-separated addresses for email
+type AlertAction struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+}
+
+// newAlertChannel returns the channel delivering to the destination of action
+func newAlertChannel(action AlertAction) (alertChannel, error) {
+	target := strings.TrimSpace(action.Target)
+	if target == "" {
+		return nil, fmt.Errorf("%s action needs a target", action.Type)
+	}
+	switch action.Type {
+	case "webhook":
+		return webhookChannel{url: target}, nil
+	case "slack":
+		return slackChannel{url: target}, nil
+	case "email":
+		if os.Getenv("SMTP_HOST") == "" {
+			return nil, errors.New("email actions need SMTP_HOST")
+		}
+		addresses, err := mail.ParseAddressList(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid email target: %w", err)
+		}
+		channel := emailChannel{}
+		for _, address := range addresses {
+			channel.to = append(channel.to, address.Address)
+		}
+		return channel, nil
+	default:
+		return nil, fmt.Errorf("unknown action type %q", action.Type)
+	}
+}
+
+// loadAlertChannels reads the default destinations of alerts: ALERT_WEBHOOK_URL, which receives
+// every alert as JSON, ALERT_SLACK_WEBHOOK_URL, a Slack incoming webhook, and ALERT_EMAIL_TO
+func loadAlertChannels() error {
+	actions := []AlertAction{
+		{Type: "webhook", Target: os.Getenv("ALERT_WEBHOOK_URL")},
+		{Type: "slack", Target: os.Getenv("ALERT_SLACK_WEBHOOK_URL")},
+		{Type: "email", Target: os.Getenv("ALERT_EMAIL_TO")},
+	}
+	for _, action := range actions {
+		if action.Target == "" {
+			continue
+		}
+		channel, err := newAlertChannel(action)
+		if err != nil {
+			return err
+		}
+		alertChannels = append(alertChannels, channel)
+	}
+	return nil
+}
+
+// sendAlert delivers alert to the default channels
+func sendAlert(ctx context.Context, alert Alert) {
+	sendAlertTo(ctx, alertChannels, alert)
+}
+
+// sendAlertTo delivers alert to every channel. Failures are logged, as a broken channel must not
+// keep the others from being notified.
+func sendAlertTo(ctx context.Context, channels []alertChannel, alert Alert) {
+	if alert.RaisedAt.IsZero() {
+		alert.RaisedAt = time.Now().UTC()
+	}
+	for _, channel := range channels {
+		if err := channel.Send(ctx, alert); err != nil {
+			log.Err(err).Str("channel", channel.Name()).Str("kind", alert.Kind).Msg("Failed to send alert")
+		}
+	}
+	log.Warn().Str("kind", alert.Kind).Msg(alert.Message)
+}
+
+// webhookChannel posts the alert as JSON
+type webhookChannel struct {
+	url string
+}
+
+func (c webhookChannel) Name() string {
+	return "webhook"
+}
+
+func (c webhookChannel) Send(ctx context.Context, alert Alert) error {
+	return postAlertJSON(ctx, c.url, alert)
+}
+
+// slackChannel posts the alert message to a Slack incoming webhook
+type slackChannel struct {
+	url string
+}
+
+func (c slackChannel) Name() string {
+	return "slack"
+}
+
+func (c slackChannel) Send(ctx context.Context, alert Alert) error {
+	return postAlertJSON(ctx, c.url, map[string]string{"text": fmt.Sprintf(":rotating_light: *%s*: %s", alert.Kind, alert.Message)})
+}
+
+// emailChannel sends the alert as a plain text email through the SMTP server configured with
+// SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM
+type emailChannel struct {
+	to []string
+}
+
+func (c emailChannel) Name() string {
+	return "email"
+}
+
+func (c emailChannel) Send(_ context.Context, alert Alert) error {
+	host := os.Getenv("SMTP_HOST")
+	from := getEnvOrDefault("SMTP_FROM", "n8n-chat-history@"+host)
+
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	// Kinds of rule alerts carry the rule name, which must not break out of the header
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(alert.Kind)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: [n8n chat history] %s\r\n", from, strings.Join(c.to, ", "), subject)
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", alert.Message)
+	if len(alert.Details) > 0 {
+		details, _ := json.MarshalIndent(alert.Details, "", "  ")
+		fmt.Fprintf(&body, "\r\n%s\r\n", details)
+	}
+
+	return smtp.SendMail(host+":"+getEnvOrDefault("SMTP_PORT", "587"), auth, from, c.to, []byte(body.String()))
+}
+
+// postAlertJSON posts body as JSON to url, failing on any status other than 2xx
+func postAlertJSON(ctx context.Context, url string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := alertClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
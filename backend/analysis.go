@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxToolFailureSamples is the number of offending messages listed for each failure group
+const maxToolFailureSamples = 5
+
+// ToolFailureGroup aggregates invalid tool calls sharing the same tool name and error text
+type ToolFailureGroup struct {
+	ToolName    string              `json:"toolName"`
+	Error       string              `json:"error"`
+	Occurrences int                 `json:"occurrences"`
+	Sessions    int                 `json:"sessions"`
+	Samples     []ToolFailureSample `json:"samples"`
+}
+
+// ToolFailureSample points to a message containing a failed tool call
+type ToolFailureSample struct {
+	MessageID int    `json:"messageId"`
+	SessionID string `json:"sessionId"`
+	Link      string `json:"link"`
+}
+
+// DataResponse is the envelope for non-paginated responses
+type DataResponse struct {
+	Data interface{} `json:"data"`
+}
+
+func GetToolFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args queryArgs
+	whereClause := filter.whereClause(&args)
+
+	failuresQuery := fmt.Sprintf(`
+		SELECT
+			COALESCE(failure->>'name', '') AS tool_name,
+			COALESCE(failure->>'error', '') AS error,
+			COUNT(*) AS occurrences,
+			COUNT(DISTINCT session_id) AS sessions,
+			(array_agg(id ORDER BY id DESC))[1:%d],
+			(array_agg(session_id ORDER BY id DESC))[1:%d]
+		FROM n8n_chat_histories, jsonb_array_elements(%s) AS failure
+		%s
+		GROUP BY 1, 2
+		ORDER BY occurrences DESC, tool_name
+		LIMIT %s
+	`, maxToolFailureSamples, maxToolFailureSamples, jsonbArray("message->'invalid_tool_calls'"), whereClause, args.add(limit))
+
+	rows, err := db.QueryContext(r.Context(), failuresQuery, args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query tool failures")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	groups := []ToolFailureGroup{}
+	for rows.Next() {
+		var group ToolFailureGroup
+		var messageIDs []int64
+		var sessionIDs []string
+
+		if err := rows.Scan(&group.ToolName, &group.Error, &group.Occurrences, &group.Sessions,
+			pgArray(&messageIDs), pgArray(&sessionIDs)); err != nil {
+			log.Err(err).Msg("Failed to scan tool failure row")
+			respondWithQueryError(w, err)
+			return
+		}
+
+		for i := range messageIDs {
+			group.Samples = append(group.Samples, ToolFailureSample{
+				MessageID: int(messageIDs[i]),
+				SessionID: sessionIDs[i],
+				Link:      messagePermalink(messageIDs[i]),
+			})
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate tool failure rows")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: groups})
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// annotationsVersion is the version of the annotation bundle format
+const annotationsVersion = 1
+
+// annotationKinds lists the human-added data an annotation bundle can carry
+var annotationKinds = []string{"tags", "notes", "pins", "feedback", "reviews", "archived"}
+
+// AnnotatedTag is a tag of a session
+type AnnotatedTag struct {
+	SessionID string    `json:"sessionId"`
+	Tag       string    `json:"tag"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AnnotatedPin is a pinned message of a session
+type AnnotatedPin struct {
+	SessionID string    `json:"sessionId"`
+	MessageID int64     `json:"messageId"`
+	PinnedBy  string    `json:"pinnedBy"`
+	PinnedAt  time.Time `json:"pinnedAt"`
+}
+
+// AnnotationBundle carries what people added to sessions, to move it between deployments of the
+// viewer. Pins and message feedback refer to message ids, so they only keep their meaning where
+// the same history table is read.
+type AnnotationBundle struct {
+	Version    int              `json:"version"`
+	ExportedAt time.Time        `json:"exportedAt"`
+	Tags       []AnnotatedTag   `json:"tags,omitempty"`
+	Notes      []SessionNote    `json:"notes,omitempty"`
+	Pins       []AnnotatedPin   `json:"pins,omitempty"`
+	Feedback   []Feedback       `json:"feedback,omitempty"`
+	Reviews    []SessionReview  `json:"reviews,omitempty"`
+	Archived   []SessionArchive `json:"archived,omitempty"`
+}
+
+// AnnotationImport counts the entries an import added; entries already present are skipped
+type AnnotationImport struct {
+	Tags     int64 `json:"tags"`
+	Notes    int64 `json:"notes"`
+	Pins     int64 `json:"pins"`
+	Feedback int64 `json:"feedback"`
+	Reviews  int64 `json:"reviews"`
+	Archived int64 `json:"archived"`
+}
+
+// parseAnnotationKinds reads the include parameter, a comma-separated list of annotationKinds that
+// defaults to all of them
+func parseAnnotationKinds(value string) (map[string]bool, error) {
+	kinds := map[string]bool{}
+	if value == "" {
+		for _, kind := range annotationKinds {
+			kinds[kind] = true
+		}
+		return kinds, nil
+	}
+	for _, kind := range strings.Split(value, ",") {
+		kind = strings.TrimSpace(kind)
+		if !slices.Contains(annotationKinds, kind) {
+			return nil, fmt.Errorf("include must list some of %s", strings.Join(annotationKinds, ", "))
+		}
+		kinds[kind] = true
+	}
+	return kinds, nil
+}
+
+// ExportAnnotationsHandler downloads the annotations of the sessions matching the listing filters
+// as a bundle for ImportAnnotationsHandler. Archived sessions are included unless the archived
+// filter says otherwise.
+func ExportAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	kinds, err := parseAnnotationKinds(query.Get("include"))
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.Archived == "" {
+		filter.Archived = "all"
+	}
+
+	bundle, err := loadAnnotations(r.Context(), filter, kinds)
+	if err != nil {
+		log.Err(err).Msg("Failed to export annotations")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	filename := "annotations-" + bundle.ExportedAt.Format("20060102") + ".json"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	json.NewEncoder(w).Encode(bundle)
+}
+
+// loadAnnotations reads the annotations of the given kinds on the sessions matching filter
+func loadAnnotations(ctx context.Context, filter ChatFilter, kinds map[string]bool) (AnnotationBundle, error) {
+	bundle := AnnotationBundle{Version: annotationsVersion, ExportedAt: time.Now().UTC()}
+
+	var args queryArgs
+	sessions := "true"
+	if where := filter.whereClause(&args); where != "" {
+		sessions = "session_id IN (SELECT session_id FROM n8n_chat_histories " + where + ")"
+	}
+	query := func(kind, columns, table, order string, scan func(*sql.Rows) error) error {
+		if !kinds[kind] {
+			return nil
+		}
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE %s ORDER BY %s`, columns, table, sessions, order), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
+	err := query("tags", "session_id, tag, created_at", "chat_history_session_tags", "session_id, tag", func(rows *sql.Rows) error {
+		var tag AnnotatedTag
+		err := rows.Scan(&tag.SessionID, &tag.Tag, &tag.CreatedAt)
+		bundle.Tags = append(bundle.Tags, tag)
+		return err
+	})
+	if err != nil {
+		return bundle, err
+	}
+	err = query("notes", "id, session_id, author, body, created_at, updated_at", "chat_history_session_notes", "id", func(rows *sql.Rows) error {
+		var note SessionNote
+		err := rows.Scan(&note.ID, &note.SessionID, &note.Author, &note.Body, &note.CreatedAt, &note.UpdatedAt)
+		bundle.Notes = append(bundle.Notes, note)
+		return err
+	})
+	if err != nil {
+		return bundle, err
+	}
+	err = query("pins", "session_id, message_id, pinned_by, pinned_at", "chat_history_pinned_messages", "session_id, message_id", func(rows *sql.Rows) error {
+		var pin AnnotatedPin
+		err := rows.Scan(&pin.SessionID, &pin.MessageID, &pin.PinnedBy, &pin.PinnedAt)
+		bundle.Pins = append(bundle.Pins, pin)
+		return err
+	})
+	if err != nil {
+		return bundle, err
+	}
+	err = query("feedback", "id, session_id, message_id, rating, reason, source, created_at", "chat_history_feedback", "id", func(rows *sql.Rows) error {
+		var feedback Feedback
+		var messageID sql.NullInt64
+		if err := rows.Scan(&feedback.ID, &feedback.SessionID, &messageID, &feedback.Rating, &feedback.Reason, &feedback.Source, &feedback.CreatedAt); err != nil {
+			return err
+		}
+		if messageID.Valid {
+			id := int(messageID.Int64)
+			feedback.MessageID = &id
+		}
+		bundle.Feedback = append(bundle.Feedback, feedback)
+		return nil
+	})
+	if err != nil {
+		return bundle, err
+	}
+	err = query("reviews", reviewColumns, "chat_history_reviews", "session_id", func(rows *sql.Rows) error {
+		review, err := scanReview(rows)
+		bundle.Reviews = append(bundle.Reviews, review)
+		return err
+	})
+	if err != nil {
+		return bundle, err
+	}
+	err = query("archived", "session_id, archived_by, archived_at", "chat_history_archived_sessions", "session_id", func(rows *sql.Rows) error {
+		archive := SessionArchive{Archived: true}
+		err := rows.Scan(&archive.SessionID, &archive.ArchivedBy, &archive.ArchivedAt)
+		bundle.Archived = append(bundle.Archived, archive)
+		return err
+	})
+	return bundle, err
+}
+
+// ImportAnnotationsHandler merges a bundle from ExportAnnotationsHandler into this deployment, in
+// one transaction. Entries already present are kept: tags, pins and archived states by session,
+// notes and feedback when an identical entry exists, and reviews unless the imported one is newer.
+// The include parameter limits the kinds imported. Bundles are bounded by MAX_BODY_BYTES.
+func ImportAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	kinds, err := parseAnnotationKinds(r.URL.Query().Get("include"))
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var bundle AnnotationBundle
+	if !decodeJSONBody(w, r, &bundle) {
+		return
+	}
+	if bundle.Version != annotationsVersion {
+		respondWithError(w, fmt.Sprintf("Unsupported annotation bundle version %d", bundle.Version), http.StatusBadRequest)
+		return
+	}
+	if err := bundle.validate(); err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Err(err).Msg("Failed to begin annotation import transaction")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := importAnnotations(r.Context(), tx, bundle, kinds)
+	if err != nil {
+		log.Err(err).Msg("Failed to import annotations")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := recordAudit(tx, r, "annotations.import", result); err != nil {
+		log.Err(err).Msg("Failed to record annotation import audit entry")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Err(err).Msg("Failed to commit annotation import")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: result})
+}
+
+// validate checks the entries of a bundle the way the endpoints creating them do. Entries without
+// a time are dated to the export.
+func (b *AnnotationBundle) validate() error {
+	if b.ExportedAt.IsZero() {
+		b.ExportedAt = time.Now().UTC()
+	}
+	for _, at := range b.times() {
+		if at.IsZero() {
+			*at = b.ExportedAt
+		}
+	}
+	for i := range b.Tags {
+		tags := normalizeTags([]string{b.Tags[i].Tag})
+		if b.Tags[i].SessionID == "" || len(tags) == 0 {
+			return fmt.Errorf("tags[%d] needs a sessionId and a tag", i)
+		}
+		b.Tags[i].Tag = tags[0]
+	}
+	for i := range b.Notes {
+		if err := b.Notes[i].validate(); err != nil || b.Notes[i].SessionID == "" {
+			return fmt.Errorf("notes[%d] needs a sessionId and a body of at most %d characters", i, maxNoteLength)
+		}
+	}
+	for i, pin := range b.Pins {
+		if pin.SessionID == "" || pin.MessageID < 1 {
+			return fmt.Errorf("pins[%d] needs a sessionId and a messageId", i)
+		}
+	}
+	for i := range b.Feedback {
+		feedback := &b.Feedback[i]
+		if feedback.Source == "" {
+			feedback.Source = "user"
+		}
+		if feedback.SessionID == "" || !validFeedbackRatings[feedback.Rating] || (feedback.Source != "user" && feedback.Source != "reviewer") {
+			return fmt.Errorf("feedback[%d] needs a sessionId, a rating of positive or negative and a source of user or reviewer", i)
+		}
+	}
+	for i, review := range b.Reviews {
+		if review.SessionID == "" || !validReviewStatuses[review.Status] {
+			return fmt.Errorf("reviews[%d] needs a sessionId and a valid status", i)
+		}
+	}
+	for i, archive := range b.Archived {
+		if archive.SessionID == "" {
+			return fmt.Errorf("archived[%d] needs a sessionId", i)
+		}
+	}
+	return nil
+}
+
+// times returns the creation times of the entries of a bundle
+func (b *AnnotationBundle) times() []*time.Time {
+	var times []*time.Time
+	for i := range b.Tags {
+		times = append(times, &b.Tags[i].CreatedAt)
+	}
+	for i := range b.Notes {
+		times = append(times, &b.Notes[i].CreatedAt, &b.Notes[i].UpdatedAt)
+	}
+	for i := range b.Pins {
+		times = append(times, &b.Pins[i].PinnedAt)
+	}
+	for i := range b.Feedback {
+		times = append(times, &b.Feedback[i].CreatedAt)
+	}
+	return times
+}
+
+// importAnnotations inserts the entries of the given kinds that are not present yet
+func importAnnotations(ctx context.Context, tx *sql.Tx, bundle AnnotationBundle, kinds map[string]bool) (AnnotationImport, error) {
+	var result AnnotationImport
+	exec := func(count *int64, query string, args ...interface{}) error {
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		affected, _ := res.RowsAffected()
+		*count += affected
+		return nil
+	}
+
+	if kinds["tags"] {
+		for _, tag := range bundle.Tags {
+			if err := exec(&result.Tags, `
+				INSERT INTO chat_history_session_tags (session_id, tag, created_at) VALUES ($1, $2, $3)
+				ON CONFLICT DO NOTHING
+			`, tag.SessionID, tag.Tag, tag.CreatedAt); err != nil {
+				return result, err
+			}
+		}
+	}
+	if kinds["notes"] {
+		for _, note := range bundle.Notes {
+			if err := exec(&result.Notes, `
+				INSERT INTO chat_history_session_notes (session_id, author, body, created_at, updated_at)
+				SELECT $1, $2, $3, $4, $5
+				WHERE NOT EXISTS (
+					SELECT 1 FROM chat_history_session_notes
+					WHERE session_id = $1 AND author = $2 AND body = $3 AND created_at = $4
+				)
+			`, note.SessionID, note.Author, note.Body, note.CreatedAt, note.UpdatedAt); err != nil {
+				return result, err
+			}
+		}
+	}
+	if kinds["pins"] {
+		for _, pin := range bundle.Pins {
+			if err := exec(&result.Pins, `
+				INSERT INTO chat_history_pinned_messages (session_id, message_id, pinned_by, pinned_at) VALUES ($1, $2, $3, $4)
+				ON CONFLICT DO NOTHING
+			`, pin.SessionID, pin.MessageID, pin.PinnedBy, pin.PinnedAt); err != nil {
+				return result, err
+			}
+		}
+	}
+	if kinds["feedback"] {
+		for _, feedback := range bundle.Feedback {
+			if err := exec(&result.Feedback, `
+				INSERT INTO chat_history_feedback (session_id, message_id, rating, reason, source, created_at)
+				SELECT $1, $2, $3, $4, $5, $6
+				WHERE NOT EXISTS (
+					SELECT 1 FROM chat_history_feedback
+					WHERE session_id = $1 AND message_id IS NOT DISTINCT FROM $2 AND rating = $3 AND reason = $4
+						AND source = $5 AND created_at = $6
+				)
+			`, feedback.SessionID, feedback.MessageID, feedback.Rating, feedback.Reason, feedback.Source, feedback.CreatedAt); err != nil {
+				return result, err
+			}
+		}
+	}
+	if kinds["reviews"] {
+		for _, review := range bundle.Reviews {
+			updatedAt := review.UpdatedAt
+			if updatedAt == nil {
+				updatedAt = &bundle.ExportedAt
+			}
+			if err := exec(&result.Reviews, `
+				INSERT INTO chat_history_reviews (session_id, status, assignee, started_at, completed_at, updated_at)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (session_id) DO UPDATE
+				SET status = EXCLUDED.status, assignee = EXCLUDED.assignee, started_at = EXCLUDED.started_at,
+					completed_at = EXCLUDED.completed_at, updated_at = EXCLUDED.updated_at
+				WHERE chat_history_reviews.updated_at < EXCLUDED.updated_at
+			`, review.SessionID, review.Status, review.Assignee, review.StartedAt, review.CompletedAt, *updatedAt); err != nil {
+				return result, err
+			}
+		}
+	}
+	if kinds["archived"] {
+		for _, archive := range bundle.Archived {
+			archivedAt := archive.ArchivedAt
+			if archivedAt == nil {
+				archivedAt = &bundle.ExportedAt
+			}
+			if err := exec(&result.Archived, `
+				INSERT INTO chat_history_archived_sessions (session_id, archived_by, archived_at) VALUES ($1, $2, $3)
+				ON CONFLICT DO NOTHING
+			`, archive.SessionID, archive.ArchivedBy, *archivedAt); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// trafficMetrics are the rates watched by the anomaly detector, as columns of the samples table
+var trafficMetrics = []string{"messages", "sessions"}
+
+// anomalyJob compares the traffic since its previous run against a rolling baseline of earlier
+// runs. Chat rows carry no timestamps, so every run records a sample of the rows added since the
+// last one, and rates are taken per minute of the time between samples.
+type anomalyJob struct {
+	baseline   time.Duration
+	threshold  float64
+	minSamples int
+	silenceMin float64
+}
+
+// newAnomalyJob reads ANOMALY_BASELINE, ANOMALY_THRESHOLD, ANOMALY_MIN_SAMPLES and
+// ANOMALY_SILENCE_MIN_RATE from the environment
+func newAnomalyJob() anomalyJob {
+	job := anomalyJob{
+		baseline:   getEnvDuration("ANOMALY_BASELINE", 24*time.Hour),
+		threshold:  4,
+		minSamples: 12,
+		silenceMin: 1,
+	}
+	if threshold, err := strconv.ParseFloat(os.Getenv("ANOMALY_THRESHOLD"), 64); err == nil && threshold > 0 {
+		job.threshold = threshold
+	}
+	if minSamples, err := strconv.Atoi(os.Getenv("ANOMALY_MIN_SAMPLES")); err == nil && minSamples > 1 {
+		job.minSamples = minSamples
+	}
+	if silenceMin, err := strconv.ParseFloat(os.Getenv("ANOMALY_SILENCE_MIN_RATE"), 64); err == nil && silenceMin > 0 {
+		job.silenceMin = silenceMin
+	}
+	return job
+}
+
+// trafficBaseline summarizes the per-minute rate of a metric over the baseline window
+type trafficBaseline struct {
+	samples int
+	mean    float64
+	stddev  float64
+}
+
+// run records a sample and alerts on the metrics that left their baseline
+func (j anomalyJob) run(ctx context.Context) error {
+	var previousAt time.Time
+	var previousID int64
+	err := db.QueryRowContext(ctx, `
+		SELECT sampled_at, last_id FROM chat_history_traffic_samples ORDER BY sampled_at DESC LIMIT 1
+	`).Scan(&previousAt, &previousID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The first run only records where the chat table stands
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO chat_history_traffic_samples (last_id, messages, sessions, seconds)
+			SELECT COALESCE(MAX(id), 0), 0, 0, 0 FROM n8n_chat_histories
+		`)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	baselines := make(map[string]trafficBaseline, len(trafficMetrics))
+	for _, metric := range trafficMetrics {
+		var baseline trafficBaseline
+		var mean, stddev sql.NullFloat64
+		if err := db.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT COUNT(*), AVG(%[1]s * 60.0 / seconds), STDDEV_SAMP(%[1]s * 60.0 / seconds)
+			FROM chat_history_traffic_samples
+			WHERE seconds > 0 AND sampled_at >= now() - make_interval(secs => $1)
+		`, metric), j.baseline.Seconds()).Scan(&baseline.samples, &mean, &stddev); err != nil {
+			return err
+		}
+		baseline.mean, baseline.stddev = mean.Float64, stddev.Float64
+		baselines[metric] = baseline
+	}
+
+	var sampledAt time.Time
+	var messages, sessions int64
+	var seconds float64
+	if err := db.QueryRowContext(ctx, `
+		WITH added AS (
+			SELECT id, session_id FROM n8n_chat_histories WHERE id > $1
+		)
+		INSERT INTO chat_history_traffic_samples (last_id, messages, sessions, seconds)
+		SELECT COALESCE(MAX(id), $1), COUNT(*), COUNT(DISTINCT session_id), EXTRACT(EPOCH FROM now() - $2::timestamptz)
+		FROM added
+		RETURNING sampled_at, messages, sessions, seconds
+	`, previousID, previousAt).Scan(&sampledAt, &messages, &sessions, &seconds); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `
+		DELETE FROM chat_history_traffic_samples WHERE sampled_at < now() - make_interval(secs => $1)
+	`, 2*j.baseline.Seconds()); err != nil {
+		return err
+	}
+	if seconds <= 0 {
+		return nil
+	}
+
+	counts := map[string]int64{"messages": messages, "sessions": sessions}
+	for _, metric := range trafficMetrics {
+		rate := float64(counts[metric]) * 60 / seconds
+		state := j.classify(metric, rate, baselines[metric])
+		j.notify(ctx, metric, state, rate, baselines[metric])
+	}
+	return nil
+}
+
+// classify returns "spike", "silence" or "normal" for the rate of metric. Spikes are rates more
+// than threshold standard deviations above the mean; the deviation is floored at a tenth of the
+// mean so steady traffic does not alert on small bumps. Silence is no traffic at all where the
+// baseline expects at least the minimum rate.
+func (j anomalyJob) classify(metric string, rate float64, baseline trafficBaseline) string {
+	if baseline.samples < j.minSamples {
+		return "normal"
+	}
+	deviation := math.Max(baseline.stddev, math.Max(baseline.mean/10, 0.1))
+	switch {
+	case rate > baseline.mean+j.threshold*deviation:
+		return "spike"
+	case rate == 0 && metric == "messages" && baseline.mean >= j.silenceMin:
+		return "silence"
+	default:
+		return "normal"
+	}
+}
+
+// notify alerts when a metric enters or leaves an anomaly. The state is kept in the shared store,
+// so a lasting anomaly alerts once however many runs it spans.
+func (j anomalyJob) notify(ctx context.Context, metric, state string, rate float64, baseline trafficBaseline) {
+	key := "anomaly:" + metric
+	previous, _, err := sharedState.Get(ctx, key)
+	if err != nil {
+		log.Err(err).Str("metric", metric).Msg("Failed to read anomaly state")
+		return
+	}
+	if err := sharedState.Set(ctx, key, []byte(state), j.baseline); err != nil {
+		log.Err(err).Str("metric", metric).Msg("Failed to store anomaly state")
+	}
+
+	previousState := string(previous)
+	if previousState == "" {
+		previousState = "normal"
+	}
+	if state == previousState {
+		return
+	}
+
+	details := map[string]interface{}{
+		"metric":       metric,
+		"ratePerMin":   rate,
+		"baselineMean": baseline.mean,
+		"baselineStd":  baseline.stddev,
+	}
+	var message string
+	switch state {
+	case "spike":
+		message = fmt.Sprintf("%s spiked to %.1f per minute against a baseline of %.1f", metric, rate, baseline.mean)
+	case "silence":
+		message = fmt.Sprintf("no %s were logged since the last check against a baseline of %.1f per minute, a workflow may have stopped logging", metric, baseline.mean)
+	default:
+		message = fmt.Sprintf("%s are back to normal at %.1f per minute after a %s", metric, rate, previousState)
+	}
+	sendAlert(ctx, Alert{Kind: "traffic-" + state, Message: message, Details: details})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SessionArchive tells whether a session is archived. Archived sessions are left out of listings
+// and statistics unless asked for with archived=true or archived=all; their messages are kept.
+type SessionArchive struct {
+	SessionID  string     `json:"sessionId"`
+	Archived   bool       `json:"archived"`
+	ArchivedAt *time.Time `json:"archivedAt,omitempty"`
+	ArchivedBy string     `json:"archivedBy,omitempty"`
+}
+
+// validArchivedFilters lists the accepted values of the archived filter
+var validArchivedFilters = map[string]bool{"true": true, "false": true, "all": true}
+
+// ArchiveSessionHandler archives a session. Archiving an archived session keeps its original time.
+func ArchiveSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	var exists bool
+	if err := db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM n8n_chat_histories WHERE session_id = $1)`, sessionID).Scan(&exists); err != nil {
+		log.Err(err).Msg("Failed to check session")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !exists {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	archive := SessionArchive{SessionID: sessionID, Archived: true}
+	var archivedAt time.Time
+	err := db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_archived_sessions (session_id, archived_by) VALUES ($1, $2)
+		ON CONFLICT (session_id) DO UPDATE SET session_id = EXCLUDED.session_id
+		RETURNING archived_at, archived_by
+	`, sessionID, auditActor(r)).Scan(&archivedAt, &archive.ArchivedBy)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to archive session")
+		respondWithQueryError(w, err)
+		return
+	}
+	archive.ArchivedAt = &archivedAt
+	if err := recordAudit(db, r, "sessions.archive", map[string]string{"sessionId": sessionID}); err != nil {
+		log.Err(err).Msg("Failed to record archive audit entry")
+	}
+
+	respondWithJSON(w, DataResponse{Data: archive})
+}
+
+// UnarchiveSessionHandler returns a session to the listings
+func UnarchiveSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM chat_history_archived_sessions WHERE session_id = $1`, sessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to unarchive session")
+		respondWithQueryError(w, err)
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed > 0 {
+		if err := recordAudit(db, r, "sessions.unarchive", map[string]string{"sessionId": sessionID}); err != nil {
+			log.Err(err).Msg("Failed to record unarchive audit entry")
+		}
+	}
+
+	respondWithJSON(w, DataResponse{Data: SessionArchive{SessionID: sessionID}})
+}
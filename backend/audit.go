@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// sqlExecer is implemented by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordAudit stores an audit log entry through tx so the entry commits together with the change it describes
+func recordAudit(tx sqlExecer, r *http.Request, action string, details interface{}) error {
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO chat_history_audit_log (action, actor, details) VALUES ($1, $2, $3)`,
+		action, auditActor(r), string(detailsJSON))
+	return err
+}
+
+// auditActor identifies who made a request: the authenticated identity when known, and the
+// client address as a last resort
+func auditActor(r *http.Request) string {
+	if identity := requestIdentity(r); identity != "" {
+		return identity
+	}
+	return r.RemoteAddr
+}
+
+// requestIdentity returns the SSO user of a request, then its API key, and an empty string for
+// anonymous requests. Unlike the client address it stays the same across connections and differs
+// between users behind a proxy.
+func requestIdentity(r *http.Request) string {
+	if user := requestUser(r); user != "" {
+		return user
+	}
+	if key, ok := r.Context().Value(usageRowsKey{}).(string); ok && key != anonymousUsage {
+		return "api-key:" + key
+	}
+	return ""
+}
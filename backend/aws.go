@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+var (
+	awsConfigOnce sync.Once
+	awsConfigData aws.Config
+	awsConfigErr  error
+)
+
+// loadAWSConfig resolves the AWS configuration once from the default chain: environment, shared
+// files, and the ECS task or EC2 instance role
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	awsConfigOnce.Do(func() {
+		awsConfigData, awsConfigErr = config.LoadDefaultConfig(ctx)
+	})
+	return awsConfigData, awsConfigErr
+}
+
+// awsKMSKey generates and unwraps artifact data keys with an AWS KMS key
+type awsKMSKey struct {
+	keyID  string
+	client *kms.Client
+}
+
+// newAWSKMSKey creates the provider for the key id, ARN or alias of an aws-kms:// reference
+func newAWSKMSKey(keyID string) (*awsKMSKey, error) {
+	cfg, err := loadAWSConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &awsKMSKey{keyID: keyID, client: kms.NewFromConfig(cfg)}, nil
+}
+
+func (k *awsKMSKey) newDataKey(ctx context.Context) ([]byte, []byte, byte, error) {
+	output, err := k.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(k.keyID),
+		KeySpec: kmstypes.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return output.Plaintext, output.CiphertextBlob, keyModeKMS, nil
+}
+
+func (k *awsKMSKey) dataKey(ctx context.Context, wrapped []byte, mode byte) ([]byte, error) {
+	if mode != keyModeKMS {
+		return nil, errLocalKeyArtifact
+	}
+	output, err := k.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(k.keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Plaintext, nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/rs/zerolog/log"
+)
+
+// backupVersion is the version of the backup archive format
+const backupVersion = 1
+
+// createTablePattern finds the tables created by schemaStatements
+var createTablePattern = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS (\w+)`)
+
+// BackupManifest describes a backup archive. Every table is stored as <table>.csv with a header
+// row, in the order of the manifest, which restores referenced tables first.
+type BackupManifest struct {
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Tables    []BackupTable `json:"tables"`
+}
+
+// BackupTable is a table of a backup archive
+type BackupTable struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+}
+
+// sidecarTables lists the tables owned by this service in the order they are created
+func sidecarTables() []string {
+	var tables []string
+	for _, statement := range schemaStatements {
+		if match := createTablePattern.FindStringSubmatch(statement); match != nil {
+			tables = append(tables, match[1])
+		}
+	}
+	return tables
+}
+
+// selectTables returns the sidecar tables named in list, a comma-separated list of table names
+// with or without their chat_history_ prefix, or all of them when list is empty
+func selectTables(list string) ([]string, error) {
+	tables := sidecarTables()
+	if list == "" {
+		return tables, nil
+	}
+	wanted := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if !strings.HasPrefix(name, "chat_history_") {
+			name = "chat_history_" + name
+		}
+		wanted[name] = true
+	}
+	var selected []string
+	for _, table := range tables {
+		if wanted[table] {
+			selected = append(selected, table)
+			delete(wanted, table)
+		}
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("unknown table %s", name)
+	}
+	return selected, nil
+}
+
+// backupLocation returns where the archive argument of a command is kept: a local path, or with
+// -store a name under backups/ in the artifact storage
+func backupLocation(archive string, inStore bool) (blobStore, string, error) {
+	if !inStore {
+		return &localBlobStore{root: filepath.Dir(archive)}, filepath.Base(archive), nil
+	}
+	if !filepath.IsLocal(archive) {
+		return nil, "", fmt.Errorf("invalid archive name %q", archive)
+	}
+	return artifactStore, "backups/" + filepath.ToSlash(archive), nil
+}
+
+// runBackupCommand dumps the sidecar tables into a zip archive from one snapshot, leaving the
+// n8n_chat_histories table out. The archive is sealed with the artifact key when encryption is
+// configured.
+func runBackupCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	tableList := flags.String("tables", "", "comma-separated tables to back up instead of all")
+	inStore := flags.Bool("store", false, "keep the archive in the artifact storage under backups/ instead of a local path")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: backup [flags] <archive>\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("the archive path is required")
+	}
+	tables, err := selectTables(*tableList)
+	if err != nil {
+		return err
+	}
+	store, key, err := backupLocation(flags.Arg(0), *inStore)
+	if err != nil {
+		return err
+	}
+
+	var manifest BackupManifest
+	size, err := writeBlob(ctx, store, key, func(w io.Writer) error {
+		manifest, err = writeBackup(ctx, w, tables)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Str("archive", flags.Arg(0)).Bool("store", *inStore).Int("tables", len(manifest.Tables)).Int64("bytes", size).Msg("Backup completed")
+	return nil
+}
+
+// writeBackup writes the archive of tables to w
+func writeBackup(ctx context.Context, w io.Writer, tables []string) (BackupManifest, error) {
+	manifest := BackupManifest{Version: backupVersion, CreatedAt: time.Now().UTC(), Tables: []BackupTable{}}
+	output := w
+	var encrypter *encryptingWriter
+	if artifactKeys != nil {
+		var err error
+		if encrypter, err = newEncryptingWriter(ctx, w, artifactKeys); err != nil {
+			return manifest, err
+		}
+		output = encrypter
+	}
+	archive := zip.NewWriter(output)
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return manifest, err
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn interface{}) error {
+		tx, err := driverConn.(*stdlib.Conn).Conn().BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		for _, table := range tables {
+			entry, err := archive.Create(table + ".csv")
+			if err != nil {
+				return err
+			}
+			tag, err := tx.Conn().PgConn().CopyTo(ctx, entry, `COPY `+pgx.Identifier{table}.Sanitize()+` TO STDOUT WITH (FORMAT csv, HEADER true)`)
+			if err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+			manifest.Tables = append(manifest.Tables, BackupTable{Name: table, Rows: tag.RowsAffected()})
+			log.Info().Str("table", table).Int64("rows", tag.RowsAffected()).Msg("Table backed up")
+		}
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := writeZipJSON(archive, "manifest.json", manifest); err != nil {
+		return manifest, err
+	}
+	if err := archive.Close(); err != nil {
+		return manifest, err
+	}
+	if encrypter != nil {
+		return manifest, encrypter.Close()
+	}
+	return manifest, nil
+}
+
+// runRestoreCommand replaces the sidecar tables with the contents of a backup archive, in one
+// transaction. Only the tables in the archive are replaced; -tables narrows them further. Tables
+// referencing a restored table, such as the hits of alert rules, are emptied along with it.
+func runRestoreCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	tableList := flags.String("tables", "", "comma-separated tables to restore instead of all in the archive")
+	inStore := flags.Bool("store", false, "read the archive from the artifact storage under backups/ instead of a local path")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: restore [flags] <archive>\n\nThe tables restored, and those referencing them, are emptied first.\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("the archive path is required")
+	}
+	if readOnly {
+		return errors.New("restore cannot run in read-only mode")
+	}
+	selected, err := selectTables(*tableList)
+	if err != nil {
+		return err
+	}
+
+	store, key, err := backupLocation(flags.Arg(0), *inStore)
+	if err != nil {
+		return err
+	}
+	archive, err := openBackupArchive(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	var manifest BackupManifest
+	manifestFile, err := archive.Open("manifest.json")
+	if err != nil {
+		return errors.New("not a backup archive: manifest.json is missing")
+	}
+	err = json.NewDecoder(manifestFile).Decode(&manifest)
+	manifestFile.Close()
+	if err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Version != backupVersion {
+		return fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	var tables []string
+	for _, table := range manifest.Tables {
+		if slices.Contains(selected, table.Name) {
+			tables = append(tables, table.Name)
+		}
+	}
+	if len(tables) == 0 {
+		return errors.New("the archive holds none of the selected tables")
+	}
+
+	// Tables missing from the database are created, so a backup can seed a fresh one
+	if err := ensureSchema(); err != nil {
+		return err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn interface{}) error {
+		tx, err := driverConn.(*stdlib.Conn).Conn().Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		identifiers := make([]string, len(tables))
+		for i, table := range tables {
+			identifiers[i] = pgx.Identifier{table}.Sanitize()
+		}
+		if _, err := tx.Exec(ctx, `TRUNCATE `+strings.Join(identifiers, ", ")+` CASCADE`); err != nil {
+			return err
+		}
+
+		for _, table := range tables {
+			rows, err := restoreTable(ctx, tx, archive, table)
+			if err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+			log.Info().Str("table", table).Int64("rows", rows).Msg("Table restored")
+		}
+		return tx.Commit(ctx)
+	})
+}
+
+// restoreTable copies the CSV file of table into it and moves its id sequence past the restored
+// rows. The columns are taken from the header row, so archives survive columns added since.
+func restoreTable(ctx context.Context, tx pgx.Tx, archive *zip.ReadCloser, table string) (int64, error) {
+	file, err := archive.Open(table + ".csv")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	headerLine, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("reading the header: %w", err)
+	}
+	columns, err := csv.NewReader(strings.NewReader(headerLine)).Read()
+	if err != nil {
+		return 0, fmt.Errorf("reading the header: %w", err)
+	}
+	hasID := false
+	for i, column := range columns {
+		if !columnNamePattern.MatchString(column) {
+			return 0, fmt.Errorf("invalid column %q", column)
+		}
+		hasID = hasID || column == "id"
+		columns[i] = pgx.Identifier{column}.Sanitize()
+	}
+
+	tag, err := tx.Conn().PgConn().CopyFrom(ctx, reader, fmt.Sprintf(`COPY %s (%s) FROM STDIN WITH (FORMAT csv)`,
+		pgx.Identifier{table}.Sanitize(), strings.Join(columns, ", ")))
+	if err != nil {
+		return 0, err
+	}
+
+	if hasID {
+		// pg_get_serial_sequence is NULL for ids without a sequence, which setval passes through
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`
+			SELECT setval(pg_get_serial_sequence($1, 'id'), COALESCE(MAX(id), 1), MAX(id) IS NOT NULL) FROM %s
+		`, pgx.Identifier{table}.Sanitize()), table); err != nil {
+			return 0, err
+		}
+	}
+	return tag.RowsAffected(), nil
+}
+
+// openBackupArchive opens a backup archive. Archives in a cloud store are downloaded to a
+// temporary file first, as reading a zip file needs random access.
+func openBackupArchive(ctx context.Context, store blobStore, key string) (*zip.ReadCloser, error) {
+	if local, ok := store.(*localBlobStore); ok {
+		return openBackupFile(ctx, local.path(key))
+	}
+
+	object, err := openBlob(ctx, store, key)
+	if errors.Is(err, errBlobNotFound) {
+		return nil, fmt.Errorf("archive %s not found", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	downloaded, err := os.CreateTemp("", "n8n-chat-history-restore-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(downloaded.Name())
+	defer downloaded.Close()
+	if _, err := io.Copy(downloaded, object); err != nil {
+		return nil, err
+	}
+	return openBackupFile(ctx, downloaded.Name())
+}
+
+// openBackupFile opens a local backup archive, first decrypting it into a temporary file when it
+// was sealed with the artifact key
+func openBackupFile(ctx context.Context, path string) (*zip.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(file, magic); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if !bytes.Equal(magic, []byte(encryptionMagic)) {
+		return zip.OpenReader(path)
+	}
+	if artifactKeys == nil {
+		return nil, errors.New("the archive is encrypted but ARTIFACT_ENCRYPTION_KEY is not set")
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	decrypted, err := os.CreateTemp("", "n8n-chat-history-restore-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(decrypted.Name())
+	defer decrypted.Close()
+	if err := decryptArtifact(ctx, decrypted, file, artifactKeys); err != nil {
+		return nil, err
+	}
+	// The reader keeps the file open, so it stays readable after being unlinked on Unix
+	return zip.OpenReader(decrypted.Name())
+}
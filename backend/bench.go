@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchScenarios are the request kinds of the default mix, named for the -mix flag
+var benchScenarios = map[string]string{
+	"chats":         "/api/v1/chats?page=1&pageSize=10",
+	"chats-deep":    "/api/v1/chats?page=50&pageSize=100",
+	"sessions":      "/api/v1/chats?groupBy=session&page=1&pageSize=10",
+	"search":        "/api/v1/chats?page=1&pageSize=10&search={search}",
+	"facets":        "/api/v1/facets?field=type",
+	"tool-failures": "/api/v1/analysis/tool-failures",
+}
+
+// benchResult is the outcome of one request
+type benchResult struct {
+	scenario string
+	latency  time.Duration
+	failed   bool
+}
+
+// runBenchCommand implements `bench`, which sends a weighted mix of requests to a running
+// instance from concurrent clients and reports latency percentiles per request kind. Comparing
+// the reports of two releases against the same database shows performance regressions.
+func runBenchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	baseURL := flags.String("url", "http://localhost:"+getEnvOrDefault("PORT", "8080"), "base URL of the instance")
+	concurrency := flags.Int("concurrency", 10, "number of concurrent clients")
+	duration := flags.Duration("duration", 30*time.Second, "how long to send requests")
+	mix := flags.String("mix", "chats=5,sessions=3,search=2", "comma-separated scenario=weight pairs")
+	search := flags.String("search", "hello", "search term of the search scenario")
+	token := flags.String("token", "", "bearer token sent with every request")
+	flags.Func("request", "adds a scenario as name=path, usable in -mix (repeatable)", func(value string) error {
+		name, path, found := strings.Cut(value, "=")
+		if !found || !strings.HasPrefix(path, "/") {
+			return errors.New("expected name=/path")
+		}
+		benchScenarios[name] = path
+		return nil
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: bench [flags]\n\nscenarios: %s\n\n", strings.Join(sortedKeys(benchScenarios), ", "))
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if *concurrency < 1 {
+		return errors.New("-concurrency must be at least 1")
+	}
+
+	// Each scenario appears in the draw as often as its weight
+	var draw []string
+	for _, entry := range strings.Split(*mix, ",") {
+		name, weightText, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if _, known := benchScenarios[name]; !known {
+			return fmt.Errorf("unknown scenario %q", name)
+		}
+		weight := 1
+		if weightText != "" {
+			var err error
+			if weight, err = strconv.Atoi(weightText); err != nil || weight < 1 {
+				return fmt.Errorf("invalid weight of scenario %s", name)
+			}
+		}
+		for range weight {
+			draw = append(draw, name)
+		}
+	}
+
+	client := &http.Client{Timeout: time.Minute, Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}}
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	fmt.Printf("Sending %s to %s from %d clients for %s\n", *mix, *baseURL, *concurrency, *duration)
+	results := make([][]benchResult, *concurrency)
+	var wg sync.WaitGroup
+	for worker := range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				scenario := draw[rand.IntN(len(draw))]
+				path := strings.ReplaceAll(benchScenarios[scenario], "{search}", url.QueryEscape(*search))
+				result, ok := benchRequest(ctx, client, *baseURL+path, *token)
+				if !ok {
+					// Cut short by the end of the run
+					return
+				}
+				result.scenario = scenario
+				results[worker] = append(results[worker], result)
+			}
+		}()
+	}
+	wg.Wait()
+
+	printBenchReport(os.Stdout, slices.Concat(results...), *duration)
+	return nil
+}
+
+// benchRequest times one request including reading the body. ok is false when the run ended
+// while the request was in flight.
+func benchRequest(ctx context.Context, client *http.Client, target, token string) (result benchResult, ok bool) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return benchResult{failed: true}, true
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	started := time.Now()
+	response, err := client.Do(request)
+	if err == nil {
+		_, err = io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}
+	if ctx.Err() != nil {
+		return benchResult{}, false
+	}
+	return benchResult{
+		latency: time.Since(started),
+		failed:  err != nil || response.StatusCode >= 300,
+	}, true
+}
+
+// printBenchReport writes a table of throughput and latency percentiles per scenario
+func printBenchReport(w io.Writer, results []benchResult, duration time.Duration) {
+	byScenario := map[string][]benchResult{"total": results}
+	for _, result := range results {
+		byScenario[result.scenario] = append(byScenario[result.scenario], result)
+	}
+	names := sortedKeys(byScenario)
+	names = append(slices.DeleteFunc(names, func(name string) bool { return name == "total" }), "total")
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "scenario\trequests\terrors\treq/s\tp50\tp90\tp99\tmax\t")
+	for _, name := range names {
+		scenario := byScenario[name]
+		latencies := make([]time.Duration, 0, len(scenario))
+		errorCount := 0
+		for _, result := range scenario {
+			latencies = append(latencies, result.latency)
+			if result.failed {
+				errorCount++
+			}
+		}
+		slices.Sort(latencies)
+		fmt.Fprintf(table, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n", name, len(scenario), errorCount,
+			float64(len(scenario))/duration.Seconds(),
+			percentile(latencies, 0.5), percentile(latencies, 0.9), percentile(latencies, 0.99), percentile(latencies, 1))
+	}
+	table.Flush()
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted)) + 0.5)
+	return sorted[min(max(rank, 1), len(sorted))-1].Round(100 * time.Microsecond)
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog/log"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobStore keeps the files produced by the service, such as export files and backup archives.
+// Objects are written once under a key of slash-separated names and never modified.
+type blobStore interface {
+	// Put stores size bytes read from content under key, replacing any object there
+	Put(ctx context.Context, key string, content io.Reader, size int64) error
+	// Size returns the size of the object under key, or errBlobNotFound
+	Size(ctx context.Context, key string) (int64, error)
+	// Get returns the content of the object under key from offset on, or errBlobNotFound
+	Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	// Delete removes the object under key. Removing a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// artifactStore is the storage shared by every feature keeping files, chosen at startup
+var artifactStore blobStore
+
+// loadArtifactStorage reads ARTIFACT_STORAGE_URL, the location of the stored files: a local
+// directory, s3://bucket/prefix, gs://bucket/prefix or azblob://container/prefix. Without it files
+// are kept in EXPORT_DIR, or in a directory of the system temporary directory.
+func loadArtifactStorage() error {
+	location := os.Getenv("ARTIFACT_STORAGE_URL")
+	if location == "" {
+		location = getEnvOrDefault("EXPORT_DIR", filepath.Join(os.TempDir(), "n8n-chat-history-exports"))
+	}
+	store, err := newBlobStore(context.Background(), location)
+	if err != nil {
+		return fmt.Errorf("ARTIFACT_STORAGE_URL: %w", err)
+	}
+	artifactStore = store
+	return nil
+}
+
+// newBlobStore creates the store of a location. The query string of a cloud location holds the
+// options of its provider:
+//
+//	s3://bucket/prefix?region=eu-west-1&endpoint=https://minio.internal:9000
+//	gs://bucket/prefix
+//	azblob://container/prefix?account=name
+//
+// S3 and GCS use the default credentials of their SDK. Azure uses AZURE_STORAGE_CONNECTION_STRING
+// when set, and the default Azure credential of the account otherwise.
+func newBlobStore(ctx context.Context, location string) (blobStore, error) {
+	parsed, err := url.Parse(location)
+	if err != nil || parsed.Scheme == "" || len(parsed.Scheme) == 1 {
+		// Plain paths, including Windows drive letters, are local directories
+		return &localBlobStore{root: location}, nil
+	}
+	prefix := strings.Trim(parsed.Path, "/")
+	options := parsed.Query()
+
+	switch parsed.Scheme {
+	case "file":
+		return &localBlobStore{root: parsed.Path}, nil
+
+	case "s3":
+		if parsed.Host == "" {
+			return nil, errors.New("the bucket is missing")
+		}
+		cfg, err := loadAWSConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		endpoint := options.Get("endpoint")
+		client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+			if region := options.Get("region"); region != "" {
+				o.Region = region
+			}
+			// S3-compatible stores such as MinIO address buckets by path and rarely check the region
+			if endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+				o.UsePathStyle = true
+				if o.Region == "" {
+					o.Region = "us-east-1"
+				}
+			}
+		})
+		log.Info().Str("bucket", parsed.Host).Str("prefix", prefix).Str("endpoint", endpoint).Msg("Storing artifacts in S3")
+		return &s3BlobStore{client: client, bucket: parsed.Host, prefix: prefix}, nil
+
+	case "gs":
+		if parsed.Host == "" {
+			return nil, errors.New("the bucket is missing")
+		}
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Str("bucket", parsed.Host).Str("prefix", prefix).Msg("Storing artifacts in Google Cloud Storage")
+		return &gcsBlobStore{bucket: client.Bucket(parsed.Host), prefix: prefix}, nil
+
+	case "azblob":
+		if parsed.Host == "" {
+			return nil, errors.New("the container is missing")
+		}
+		var client *azblob.Client
+		if connectionString := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); connectionString != "" {
+			client, err = azblob.NewClientFromConnectionString(connectionString, nil)
+		} else {
+			account := options.Get("account")
+			if account == "" {
+				return nil, errors.New("the account is required without AZURE_STORAGE_CONNECTION_STRING")
+			}
+			var credential *azidentity.DefaultAzureCredential
+			if credential, err = azidentity.NewDefaultAzureCredential(nil); err == nil {
+				client, err = azblob.NewClient("https://"+account+".blob.core.windows.net/", credential, nil)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Str("container", parsed.Host).Str("prefix", prefix).Msg("Storing artifacts in Azure Blob Storage")
+		return &azureBlobStore{client: client, container: parsed.Host, prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("unsupported storage %q, expected a path or an s3, gs or azblob URL", parsed.Scheme)
+}
+
+// writeBlob stores under key what write produces and returns its size. The content is spooled
+// to a temporary file first, so a failed write leaves no object behind and cloud stores receive
+// a known length. Local stores spool next to the object and move the file in place.
+func writeBlob(ctx context.Context, store blobStore, key string, write func(w io.Writer) error) (size int64, err error) {
+	local, isLocal := store.(*localBlobStore)
+	spoolDir := ""
+	if isLocal {
+		if spoolDir, err = local.dir(key); err != nil {
+			return 0, err
+		}
+	}
+	file, err := os.CreateTemp(spoolDir, ".spool-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := write(file); err != nil {
+		return 0, err
+	}
+	if size, err = file.Seek(0, io.SeekCurrent); err != nil {
+		return 0, err
+	}
+	if isLocal {
+		if err := file.Sync(); err != nil {
+			return 0, err
+		}
+		return size, os.Rename(file.Name(), local.path(key))
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, store.Put(ctx, key, file, size)
+}
+
+// blobReader reads an object as an io.ReadSeeker, so it can be served with http.ServeContent.
+// Seeking is free; the object is fetched from the current offset on the next read.
+type blobReader struct {
+	ctx    context.Context
+	store  blobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// openBlob returns a reader of the object under key, or errBlobNotFound
+func openBlob(ctx context.Context, store blobStore, key string) (*blobReader, error) {
+	size, err := store.Size(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{ctx: ctx, store: store, key: key, size: size}, nil
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.store.Get(r.ctx, r.key, r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the object")
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *blobReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// localBlobStore keeps objects as files under a directory. With several replicas it must be a
+// shared volume, as any replica may write or serve an object.
+type localBlobStore struct {
+	root string
+}
+
+// path returns the file of key
+func (s *localBlobStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// dir creates the directory of the file of key and returns it
+func (s *localBlobStore) dir(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid object name %q", key)
+	}
+	dir := filepath.Dir(s.path(key))
+	return dir, os.MkdirAll(dir, 0o750)
+}
+
+func (s *localBlobStore) Put(ctx context.Context, key string, content io.Reader, size int64) error {
+	_, err := writeBlob(ctx, s, key, func(w io.Writer) error {
+		_, err := io.CopyN(w, content, size)
+		return err
+	})
+	return err
+}
+
+func (s *localBlobStore) Size(_ context.Context, key string) (int64, error) {
+	info, err := os.Stat(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, errBlobNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *localBlobStore) Get(_ context.Context, key string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *localBlobStore) Delete(_ context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// s3BlobStore keeps objects in an S3 bucket or an S3-compatible store
+type s3BlobStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// s3NotFound tells whether err is the 404 of a missing object
+func s3NotFound(err error) bool {
+	var responseErr *awshttp.ResponseError
+	return errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == 404
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, content io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(path.Join(s.prefix, key)),
+		Body:          content,
+		ContentLength: aws.Int64(size),
+	})
+	return err
+}
+
+func (s *s3BlobStore) Size(ctx context.Context, key string) (int64, error) {
+	output, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(path.Join(s.prefix, key))})
+	if s3NotFound(err) {
+		return 0, errBlobNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return aws.ToInt64(output.ContentLength), nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, key)),
+		Range:  aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-"),
+	})
+	if s3NotFound(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(path.Join(s.prefix, key))})
+	return err
+}
+
+// gcsBlobStore keeps objects in a Google Cloud Storage bucket
+type gcsBlobStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func (s *gcsBlobStore) Put(ctx context.Context, key string, content io.Reader, size int64) error {
+	writer := s.bucket.Object(path.Join(s.prefix, key)).NewWriter(ctx)
+	if _, err := io.CopyN(writer, content, size); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (s *gcsBlobStore) Size(ctx context.Context, key string) (int64, error) {
+	attrs, err := s.bucket.Object(path.Join(s.prefix, key)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return 0, errBlobNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Size, nil
+}
+
+func (s *gcsBlobStore) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	reader, err := s.bucket.Object(path.Join(s.prefix, key)).NewRangeReader(ctx, offset, -1)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, errBlobNotFound
+	}
+	return reader, err
+}
+
+func (s *gcsBlobStore) Delete(ctx context.Context, key string) error {
+	err := s.bucket.Object(path.Join(s.prefix, key)).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+// azureBlobStore keeps objects in an Azure Blob Storage container
+type azureBlobStore struct {
+	client    *azblob.Client
+	container string
+	prefix    string
+}
+
+func (s *azureBlobStore) Put(ctx context.Context, key string, content io.Reader, _ int64) error {
+	_, err := s.client.UploadStream(ctx, s.container, path.Join(s.prefix, key), content, nil)
+	return err
+}
+
+func (s *azureBlobStore) Size(ctx context.Context, key string) (int64, error) {
+	properties, err := s.client.ServiceClient().NewContainerClient(s.container).NewBlobClient(path.Join(s.prefix, key)).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return 0, errBlobNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return *properties.ContentLength, nil
+}
+
+func (s *azureBlobStore) Get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	response, err := s.client.DownloadStream(ctx, s.container, path.Join(s.prefix, key), &azblob.DownloadStreamOptions{
+		Range: azblob.HTTPRange{Offset: offset},
+	})
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (s *azureBlobStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteBlob(ctx, s.container, path.Join(s.prefix, key), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return err
+}
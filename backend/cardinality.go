@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hllPrecision is the number of hash bits that pick a HyperLogLog register. 2^11 registers keep
+// the standard error around 2.3% while the aggregation stays a small hash table.
+const hllPrecision = 11
+
+// CardinalityStats is the response of the cardinality endpoint
+type CardinalityStats struct {
+	Total    int64 `json:"total"`
+	Matching int64 `json:"matching"`
+	Exact    bool  `json:"exact"`
+	// StandardError is the relative error of approximate counts
+	StandardError float64 `json:"standardError,omitempty"`
+}
+
+// GetCardinalityHandler counts distinct sessions overall, archived ones included, and matching the
+// listing filters.
+// COUNT(DISTINCT) has to sort or hash every session ID, so by default the counts are estimated
+// with HyperLogLog; exact=true falls back to the exact count.
+func GetCardinalityHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exact := query.Get("exact") == "true"
+
+	count := estimateSessions
+	stats := CardinalityStats{Exact: exact, StandardError: 1.04 / math.Sqrt(1<<hllPrecision)}
+	if exact {
+		count = countSessions
+		stats.StandardError = 0
+	}
+
+	if stats.Total, err = count(r.Context(), ChatFilter{Archived: "all"}); err != nil {
+		log.Err(err).Msg("Failed to count sessions")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	stats.Matching = stats.Total
+	var args queryArgs
+	if filter.whereClause(&args) != "" {
+		if stats.Matching, err = count(r.Context(), filter); err != nil {
+			log.Err(err).Msg("Failed to count matching sessions")
+			respondWithQueryError(w, err)
+			return
+		}
+	}
+
+	respondWithJSON(w, DataResponse{Data: stats})
+}
+
+// countSessions counts the distinct sessions matching filter exactly
+func countSessions(ctx context.Context, filter ChatFilter) (int64, error) {
+	var args queryArgs
+	var count int64
+	err := db.QueryRowContext(ctx, `SELECT COUNT(DISTINCT session_id) FROM n8n_chat_histories `+filter.whereClause(&args), args...).Scan(&count)
+	return count, err
+}
+
+// estimateSessions estimates the distinct sessions matching filter with HyperLogLog. The database
+// reduces the rows to the registers, the highest rank seen per bucket of the 32-bit session ID
+// hash, and the estimate is computed from those.
+func estimateSessions(ctx context.Context, filter ChatFilter) (int64, error) {
+	var args queryArgs
+	// The rank is the position of the first set bit in the hash bits after the bucket
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT h & %[1]d, MAX(%[2]d - length(ltrim((h >> %[3]d)::bit(%[4]d)::text, '0')))
+		FROM (
+			SELECT hashtext(session_id)::bigint & 4294967295 AS h
+			FROM n8n_chat_histories
+			%[5]s
+		) hashed
+		GROUP BY 1
+	`, 1<<hllPrecision-1, 32-hllPrecision+1, hllPrecision, 32-hllPrecision, filter.whereClause(&args)), args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	registers := make([]int, 1<<hllPrecision)
+	for rows.Next() {
+		var bucket, rank int
+		if err := rows.Scan(&bucket, &rank); err != nil {
+			return 0, err
+		}
+		registers[bucket] = rank
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return hllEstimate(registers), nil
+}
+
+// hllEstimate computes the HyperLogLog estimate of a set of registers, with the small and large
+// range corrections of the original paper for a 32-bit hash
+func hllEstimate(registers []int) int64 {
+	m := float64(len(registers))
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum, zeros := 0.0, 0
+	for _, rank := range registers {
+		sum += math.Ldexp(1, -rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+
+	switch {
+	case estimate <= 2.5*m && zeros > 0:
+		estimate = m * math.Log(m/float64(zeros))
+	case estimate > math.Exp2(32)/30:
+		estimate = -math.Exp2(32) * math.Log(1-estimate/math.Exp2(32))
+	}
+	return int64(math.Round(estimate))
+}
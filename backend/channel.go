@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ChannelCount is a row of the channel breakdown. Sessions whose channel cannot be extracted are
+// counted under an empty channel.
+type ChannelCount struct {
+	Channel  string `json:"channel"`
+	Sessions int    `json:"sessions"`
+	Messages int    `json:"messages"`
+}
+
+// channelConfig locates the channel a session came in through, such as telegram or web
+var channelConfig DimensionConfig
+
+// loadChannelConfig reads CHANNEL_METADATA_PATH and CHANNEL_SESSION_PATTERN from the environment
+func loadChannelConfig() (err error) {
+	channelConfig, err = loadDimensionConfig("CHANNEL")
+	return err
+}
+
+// GetChannelStatsHandler breaks the filtered sessions and their messages down by channel
+func GetChannelStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !channelConfig.enabled() {
+		respondWithError(w, "Channel extraction is not configured", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseChatFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A session belongs to the channel found on any of its messages
+	var args queryArgs
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT COALESCE(channel, ''), COUNT(*), SUM(messages)
+		FROM (
+			SELECT MAX(%s) AS channel, COUNT(*) AS messages
+			FROM n8n_chat_histories
+			%s
+			GROUP BY session_id
+		) AS sessions
+		GROUP BY channel
+		ORDER BY COUNT(*) DESC, channel
+	`, channelConfig.rowExpr(&args), filter.whereClause(&args)), args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query channel stats")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	counts := []ChannelCount{}
+	for rows.Next() {
+		var count ChannelCount
+		if err := rows.Scan(&count.Channel, &count.Sessions, &count.Messages); err != nil {
+			log.Err(err).Msg("Failed to scan channel stats")
+			respondWithQueryError(w, err)
+			return
+		}
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate channel stats")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: counts})
+}
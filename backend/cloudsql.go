@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/rs/zerolog/log"
+)
+
+// cloudSQL dials Cloud SQL through the Go connector, nil when connecting to DATABASE_URL directly
+var cloudSQL *cloudSQLDialer
+
+// cloudSQLDialer connects to a Cloud SQL instance by its connection name. The connector
+// authorizes the client with the service account of the environment and encrypts the connection
+// itself, so no authorized networks or server certificates need to be configured.
+type cloudSQLDialer struct {
+	dialer   *cloudsqlconn.Dialer
+	instance string // project:region:instance
+}
+
+// initCloudSQL sets up the connector when CLOUD_SQL_INSTANCE is set. CLOUD_SQL_IAM_AUTH=true logs
+// in as the IAM user or service account named in the connection string instead of using a
+// password, and CLOUD_SQL_PRIVATE_IP=true connects over the private IP of the instance.
+func initCloudSQL(ctx context.Context) error {
+	instance := os.Getenv("CLOUD_SQL_INSTANCE")
+	if instance == "" {
+		return nil
+	}
+	if os.Getenv("DB_IAM_AUTH") != "" {
+		return errors.New("DB_IAM_AUTH cannot be combined with CLOUD_SQL_INSTANCE, use CLOUD_SQL_IAM_AUTH")
+	}
+
+	var options []cloudsqlconn.Option
+	if getEnvOrDefault("CLOUD_SQL_IAM_AUTH", "false") == "true" {
+		options = append(options, cloudsqlconn.WithIAMAuthN())
+	}
+	if getEnvOrDefault("CLOUD_SQL_PRIVATE_IP", "false") == "true" {
+		options = append(options, cloudsqlconn.WithDefaultDialOptions(cloudsqlconn.WithPrivateIP()))
+	}
+
+	dialer, err := cloudsqlconn.NewDialer(ctx, options...)
+	if err != nil {
+		return err
+	}
+	cloudSQL = &cloudSQLDialer{dialer: dialer, instance: instance}
+	log.Info().Str("instance", instance).Msg("Connecting through the Cloud SQL connector")
+	return nil
+}
+
+// DialContext is the dial function of the driver. The address of the connection string is
+// ignored, every connection goes to the configured instance.
+func (d *cloudSQLDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	return d.dialer.Dial(ctx, d.instance)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// MappedColumn exposes a physical column that deployments added to the history table, such as
+// user_id or channel, under a logical field name
+type MappedColumn struct {
+	Field  string
+	Column string
+}
+
+// FieldFilter matches messages whose mapped column or virtual field, compared as text, equals Value
+type FieldFilter struct {
+	Expr  string
+	Value string
+}
+
+// columnMapping holds the mapped columns sorted by field name
+var columnMapping []MappedColumn
+
+// coreColumns are the columns n8n creates, which every query of the service relies on
+var coreColumns = map[string]string{"id": "id", "sessionId": "session_id", "message": "message"}
+
+var (
+	fieldNamePattern  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+	columnNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+)
+
+// loadColumnMapping reads COLUMN_MAPPING, a JSON object of field names to column names. The core
+// fields may be listed, but only with the column names n8n gives them.
+func loadColumnMapping() error {
+	raw := os.Getenv("COLUMN_MAPPING")
+	if raw == "" {
+		return nil
+	}
+	var mapping map[string]string
+	if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+		return fmt.Errorf("COLUMN_MAPPING must be a JSON object of field names to columns: %w", err)
+	}
+
+	columns := make(map[string]string, len(mapping))
+	for field, column := range mapping {
+		if core, ok := coreColumns[field]; ok {
+			if column != core {
+				return fmt.Errorf("COLUMN_MAPPING: field %q must stay in column %q", field, core)
+			}
+			continue
+		}
+		if !fieldNamePattern.MatchString(field) {
+			return fmt.Errorf("COLUMN_MAPPING: invalid field name %q", field)
+		}
+		if !columnNamePattern.MatchString(column) {
+			return fmt.Errorf("COLUMN_MAPPING: invalid column name %q for field %q", column, field)
+		}
+		if previous, ok := columns[column]; ok {
+			return fmt.Errorf("COLUMN_MAPPING: column %q is mapped to both %q and %q", column, previous, field)
+		}
+		columns[column] = field
+		columnMapping = append(columnMapping, MappedColumn{Field: field, Column: column})
+	}
+	sort.Slice(columnMapping, func(i, j int) bool { return columnMapping[i].Field < columnMapping[j].Field })
+	return nil
+}
+
+// verifyColumnMapping checks that the mapped columns exist, so that a typo fails at startup
+// rather than on every listing
+func verifyColumnMapping(ctx context.Context) error {
+	if len(columnMapping) == 0 {
+		return nil
+	}
+	names := make([]string, len(columnMapping))
+	for i, mapped := range columnMapping {
+		names[i] = mapped.Column
+	}
+
+	var missing []string
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(array_agg(name ORDER BY name), '{}')
+		FROM unnest($1::text[]) AS name
+		WHERE NOT EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'n8n_chat_histories' AND column_name = name
+		)
+	`, names).Scan(pgArray(&missing))
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("mapped columns missing from n8n_chat_histories: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// mappedColumn returns the column of a field, if the field is mapped
+func mappedColumn(field string) (string, bool) {
+	for _, mapped := range columnMapping {
+		if mapped.Field == field {
+			return mapped.Column, true
+		}
+	}
+	return "", false
+}
+
+// mappedFieldNames returns the names of the mapped fields
+func mappedFieldNames() []string {
+	names := make([]string, len(columnMapping))
+	for i, mapped := range columnMapping {
+		names[i] = mapped.Field
+	}
+	return names
+}
+
+// chatColumns is the select list of queries scanned with scanChat
+func chatColumns() string {
+	columns := "id, session_id, message"
+	for i, mapped := range columnMapping {
+		columns += fmt.Sprintf(", to_jsonb(%s) AS mapped_%d", pgx.Identifier{mapped.Column}.Sanitize(), i)
+	}
+	for i, field := range virtualFields {
+		if field.sql != "" {
+			columns += fmt.Sprintf(", to_jsonb(%s) AS virtual_%d", field.sql, i)
+		}
+	}
+	return columns
+}
+
+// chatResultFormats requests the columns of chatColumns in binary format, so messages are decoded
+// from the JSONB representation straight into their struct. With PGBOUNCER_MODE results always
+// come as text, which scans the same way.
+var chatResultFormats = pgx.QueryResultFormatsByOID{
+	pgtype.Int4OID:  pgx.BinaryFormatCode,
+	pgtype.Int8OID:  pgx.BinaryFormatCode,
+	pgtype.TextOID:  pgx.BinaryFormatCode,
+	pgtype.JSONBOID: pgx.BinaryFormatCode,
+}
+
+// queryChats runs a query selecting chatColumns and calls visit with every row. The rows are read
+// with pgx directly rather than through database/sql, which would hand over every JSONB value as
+// text to be copied and decoded again.
+func queryChats(ctx context.Context, query string, args []interface{}, visit func(Chat) error) error {
+	// Chat rows never leave the history database for work labeled for another region
+	if err := checkRegion(contextRegion(ctx)); err != nil {
+		return err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		rows, err := driverConn.(*stdlib.Conn).Conn().Query(ctx, query, append([]interface{}{chatResultFormats}, args...)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var chat Chat
+			if err := scanChat(ctx, rows, &chat); err != nil {
+				return err
+			}
+			for _, value := range rows.RawValues() {
+				chat.size += len(value)
+			}
+			if err := visit(chat); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// loadChats returns every row of a query selecting chatColumns
+func loadChats(ctx context.Context, query string, args ...interface{}) ([]Chat, error) {
+	var chats []Chat
+	err := queryChats(ctx, query, args, func(chat Chat) error {
+		chats = append(chats, chat)
+		return nil
+	})
+	return chats, err
+}
+
+// scanChat reads a row selected with chatColumns, decoding the message and the mapped and
+// virtual fields
+func scanChat(ctx context.Context, row pgx.Row, chat *Chat) error {
+	var names []string
+	for _, mapped := range columnMapping {
+		names = append(names, mapped.Field)
+	}
+	for _, field := range virtualFields {
+		if field.sql != "" {
+			names = append(names, field.Name)
+		}
+	}
+	fields := make([]interface{}, len(names))
+	dest := []interface{}{&chat.ID, &chat.SessionID, &chat.Message}
+	for i := range fields {
+		dest = append(dest, &fields[i])
+	}
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	if err := readMessage(ctx, chat.SessionID, &chat.Message); err != nil {
+		return err
+	}
+
+	if len(names) > 0 {
+		chat.Fields = make(map[string]interface{}, len(names))
+		for i, name := range names {
+			chat.Fields[name] = fields[i]
+		}
+	}
+	if computedFields() {
+		return computeFields(chat)
+	}
+	return nil
+}
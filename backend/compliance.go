@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SubjectAccessRequest asks for everything stored about an end user
+type SubjectAccessRequest struct {
+	EndUser string `json:"endUser"`
+	Reason  string `json:"reason"`
+}
+
+// SubjectAccessManifest is manifest.json of a subject access archive
+type SubjectAccessManifest struct {
+	EndUser     string                 `json:"endUser"`
+	Reason      string                 `json:"reason,omitempty"`
+	GeneratedAt time.Time              `json:"generatedAt"`
+	GeneratedBy string                 `json:"generatedBy"`
+	Sessions    []SubjectAccessSession `json:"sessions"`
+	Messages    int                    `json:"messages"`
+}
+
+// SubjectAccessSession is a session listed in the manifest, with the file holding it
+type SubjectAccessSession struct {
+	EndUserSession
+	File string `json:"file"`
+}
+
+// SubjectAccessFile is a session file of the archive
+type SubjectAccessFile struct {
+	SessionID string     `json:"sessionId"`
+	Messages  []Chat     `json:"messages"`
+	Tags      []string   `json:"tags"`
+	Feedback  []Feedback `json:"feedback"`
+}
+
+// unsafeFilenameChars are replaced in the end user identifier when naming the archive
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// SubjectAccessHandler packages every session of an end user, with its tags and feedback, into a
+// zip archive with a manifest. The archive is assembled in a temporary file first, so a failure
+// is reported as an error rather than as a truncated download.
+func SubjectAccessHandler(w http.ResponseWriter, r *http.Request) {
+	if !endUserConfig.enabled() {
+		respondWithError(w, "End user extraction is not configured", http.StatusBadRequest)
+		return
+	}
+	var request SubjectAccessRequest
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+	if request.EndUser == "" {
+		respondWithError(w, "endUser is required", http.StatusBadRequest)
+		return
+	}
+
+	history, err := queryEndUserHistory(r.Context(), request.EndUser, 0)
+	if err != nil {
+		log.Err(err).Msg("Failed to query end user sessions")
+		respondWithQueryError(w, err)
+		return
+	}
+	if len(history.Sessions) == 0 {
+		respondWithError(w, "End user not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.CreateTemp("", "subject-access-*.zip")
+	if err != nil {
+		log.Err(err).Msg("Failed to create subject access archive")
+		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	manifest := SubjectAccessManifest{
+		EndUser:     request.EndUser,
+		Reason:      request.Reason,
+		GeneratedAt: time.Now().UTC(),
+		GeneratedBy: auditActor(r),
+		Sessions:    make([]SubjectAccessSession, 0, len(history.Sessions)),
+		Messages:    history.Messages,
+	}
+	if err := writeSubjectAccessArchive(r.Context(), file, history, &manifest); err != nil {
+		log.Err(err).Msg("Failed to write subject access archive")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	if err := recordAudit(db, r, "compliance.sar", map[string]interface{}{
+		"endUser":  request.EndUser,
+		"reason":   request.Reason,
+		"sessions": len(manifest.Sessions),
+		"messages": manifest.Messages,
+	}); err != nil {
+		log.Err(err).Msg("Failed to record subject access audit entry")
+	}
+
+	filename := fmt.Sprintf("subject-access-%s-%s.zip", unsafeFilenameChars.ReplaceAllString(request.EndUser, "_"),
+		manifest.GeneratedAt.Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeContent(w, r, filename, manifest.GeneratedAt, file)
+}
+
+// writeSubjectAccessArchive writes one file per session and then the manifest listing them
+func writeSubjectAccessArchive(ctx context.Context, file *os.File, history EndUserHistory, manifest *SubjectAccessManifest) error {
+	archive := zip.NewWriter(file)
+	for i, session := range history.Sessions {
+		content := SubjectAccessFile{SessionID: session.SessionID, Messages: []Chat{}}
+		chats, err := loadSessionMessages(ctx, session.SessionID)
+		if err != nil {
+			return err
+		}
+		if chats != nil {
+			content.Messages = chats
+		}
+		if content.Tags, err = loadSessionTags(ctx, session.SessionID); err != nil {
+			return err
+		}
+		if content.Feedback, err = loadSessionFeedback(ctx, session.SessionID); err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("sessions/%04d.json", i+1)
+		if err := writeZipJSON(archive, name, content); err != nil {
+			return err
+		}
+		manifest.Sessions = append(manifest.Sessions, SubjectAccessSession{EndUserSession: session, File: name})
+	}
+
+	if err := writeZipJSON(archive, "manifest.json", manifest); err != nil {
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	_, err := file.Seek(0, 0)
+	return err
+}
+
+// writeZipJSON adds an indented JSON document to a zip archive
+func writeZipJSON(archive *zip.Writer, name string, value interface{}) error {
+	entry, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// loadSessionFeedback returns every feedback entry of a session, oldest first
+func loadSessionFeedback(ctx context.Context, sessionID string) ([]Feedback, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, session_id, message_id, rating, reason, source, created_at
+		FROM chat_history_feedback
+		WHERE session_id = $1
+		ORDER BY id
+	`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feedback := []Feedback{}
+	for rows.Next() {
+		var entry Feedback
+		if err := rows.Scan(&entry.ID, &entry.SessionID, &entry.MessageID, &entry.Rating, &entry.Reason, &entry.Source, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		feedback = append(feedback, entry)
+	}
+	return feedback, rows.Err()
+}
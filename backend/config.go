@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+)
+
+// RuntimeConfig describes the non-secret settings of this deployment that the frontend relies on
+type RuntimeConfig struct {
+	AuthMode   string           `json:"authMode"`
+	Features   map[string]bool  `json:"features"`
+	Pagination PaginationLimits `json:"pagination"`
+	GroupBy    []string         `json:"groupBy"`
+	Sources    []DataSourceInfo `json:"sources"`
+	Fields     []string         `json:"fields"`
+}
+
+// PaginationLimits are the page size bounds of the listing endpoints
+type PaginationLimits struct {
+	DefaultPageSize int `json:"defaultPageSize"`
+	MaxPageSize     int `json:"maxPageSize"`
+}
+
+// DataSourceInfo identifies a table the chats are read from. Tables found by source discovery
+// carry their schema.
+type DataSourceInfo struct {
+	Name       string `json:"name"`
+	Schema     string `json:"schema,omitempty"`
+	Table      string `json:"table"`
+	Region     string `json:"region,omitempty"`
+	Discovered bool   `json:"discovered,omitempty"`
+}
+
+// GetConfigHandler returns the runtime configuration. It must never expose secrets.
+func GetConfigHandler(w http.ResponseWriter, r *http.Request) {
+	groupBy := []string{"simple", "session"}
+	if workflowConfig.enabled() {
+		groupBy = append(groupBy, "workflow")
+	}
+
+	// Feature flags, plus features that are switched on by their own configuration
+	features := make(map[string]bool, len(featureFlags)+4)
+	for name, enabled := range featureFlags {
+		features[name] = enabled
+	}
+	features["sharing"] = featureEnabled("sharing") && len(shareSecret()) > 0
+	features["workflows"] = workflowConfig.enabled()
+	features["channels"] = channelConfig.enabled()
+	features["endUsers"] = endUserConfig.enabled()
+	features["leaderElection"] = leader != nil
+	features["readOnly"] = readOnly
+	features["sources"] = len(currentDataSources()) > 1
+
+	config := RuntimeConfig{
+		AuthMode:   "origin",
+		Features:   features,
+		Pagination: PaginationLimits{DefaultPageSize: defaultPageSize, MaxPageSize: maxPageSize},
+		GroupBy:    groupBy,
+		Sources:    dataSourceInfos(),
+		Fields:     fieldNames(),
+	}
+
+	respondWithJSON(w, DataResponse{Data: config})
+}
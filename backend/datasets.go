@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EvalMessage is a chat message in the OpenAI role/content format
+type EvalMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// EvalSample is one line of an OpenAI evals style JSONL dataset
+type EvalSample struct {
+	Input    []EvalMessage  `json:"input"`
+	Ideal    string         `json:"ideal,omitempty"`
+	Metadata EvalSampleMeta `json:"metadata"`
+}
+
+// EvalSampleMeta carries the label and provenance of an eval sample
+type EvalSampleMeta struct {
+	SessionID  string    `json:"sessionId"`
+	MessageID  int       `json:"messageId"`
+	Completion string    `json:"completion"`
+	Label      string    `json:"label"`
+	Reason     string    `json:"reason,omitempty"`
+	Tags       []string  `json:"tags"`
+	LabeledAt  time.Time `json:"labeledAt"`
+}
+
+// evalRoles maps n8n/LangChain message types to OpenAI chat roles; other types are left out
+var evalRoles = map[string]string{"system": "system", "human": "user", "ai": "assistant"}
+
+// GetEvalDatasetHandler streams feedback-labeled messages as JSONL. Each sample holds the conversation
+// leading up to the rated AI message as input; positively rated answers are also set as the ideal.
+func GetEvalDatasetHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	location, err := parseTimezone(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseTimeRange(query, location)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rating := query.Get("rating")
+	if rating != "" && !validFeedbackRatings[rating] {
+		respondWithError(w, "rating must be positive or negative", http.StatusBadRequest)
+		return
+	}
+	contextSize, _ := strconv.Atoi(query.Get("context"))
+	if contextSize < 1 || contextSize > 100 {
+		contextSize = 10
+	}
+
+	var args queryArgs
+	var conditions []string
+	if tags := normalizeTags([]string{query.Get("tag")}); len(tags) > 0 {
+		conditions = append(conditions, "f.session_id IN (SELECT session_id FROM chat_history_session_tags WHERE tag = "+args.add(tags[0])+")")
+	}
+	if rating != "" {
+		conditions = append(conditions, "f.rating = "+args.add(rating))
+	}
+	if from != nil {
+		conditions = append(conditions, "f.created_at >= "+args.add(*from))
+	}
+	if to != nil {
+		conditions = append(conditions, "f.created_at < "+args.add(*to))
+	}
+
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT f.session_id, f.message_id, f.rating, f.reason, f.created_at
+		FROM chat_history_feedback f
+		%s
+		ORDER BY f.session_id, f.id
+	`, joinWhere(conditions)), args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query labeled feedback")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	var labels []Feedback
+	for rows.Next() {
+		var feedback Feedback
+		var messageID *int64
+		if err := rows.Scan(&feedback.SessionID, &messageID, &feedback.Rating, &feedback.Reason, &feedback.CreatedAt); err != nil {
+			log.Err(err).Msg("Failed to scan labeled feedback")
+			respondWithQueryError(w, err)
+			return
+		}
+		if messageID != nil {
+			id := int(*messageID)
+			feedback.MessageID = &id
+		}
+		labels = append(labels, feedback)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate labeled feedback")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="eval-dataset.jsonl"`)
+	writer := bufio.NewWriter(w)
+	defer writer.Flush()
+	encoder := json.NewEncoder(writer)
+
+	// Labels are ordered by session, so each session is loaded once
+	var sessionID string
+	var chats []Chat
+	var tags []string
+	for _, feedback := range labels {
+		if feedback.SessionID != sessionID {
+			sessionID = feedback.SessionID
+			if chats, err = loadSessionMessages(r.Context(), sessionID); err == nil {
+				tags, err = loadSessionTags(r.Context(), sessionID)
+			}
+			if err != nil {
+				// Headers are already sent, so the dataset is cut short rather than turned into an error response
+				log.Err(err).Str("sessionId", sessionID).Msg("Failed to load session for eval dataset")
+				return
+			}
+		}
+
+		sample, ok := buildEvalSample(chats, feedback, contextSize)
+		if !ok {
+			continue
+		}
+		sample.Metadata.Tags = tags
+		if err := encoder.Encode(sample); err != nil {
+			log.Err(err).Msg("Failed to write eval sample")
+			return
+		}
+	}
+}
+
+// buildEvalSample pairs the rated AI message with its preceding context. Session-level feedback rates
+// the last AI message of the session. It reports false when there is no AI message to label.
+func buildEvalSample(chats []Chat, feedback Feedback, contextSize int) (EvalSample, bool) {
+	target := -1
+	for i, chat := range chats {
+		if chat.Message.Type != "ai" || chat.Message.Content == "" {
+			continue
+		}
+		if feedback.MessageID == nil || chat.ID == *feedback.MessageID {
+			target = i
+		}
+	}
+	if target < 0 {
+		return EvalSample{}, false
+	}
+
+	input := []EvalMessage{}
+	for _, chat := range chats[:target] {
+		if role, ok := evalRoles[chat.Message.Type]; ok && chat.Message.Content != "" {
+			input = append(input, EvalMessage{Role: role, Content: chat.Message.Content})
+		}
+	}
+	if len(input) > contextSize {
+		input = input[len(input)-contextSize:]
+	}
+
+	sample := EvalSample{
+		Input: input,
+		Metadata: EvalSampleMeta{
+			SessionID:  feedback.SessionID,
+			MessageID:  chats[target].ID,
+			Completion: chats[target].Message.Content,
+			Label:      feedback.Rating,
+			Reason:     feedback.Reason,
+			LabeledAt:  feedback.CreatedAt,
+		},
+	}
+	if feedback.Rating == "positive" {
+		sample.Ideal = chats[target].Message.Content
+	}
+	return sample, true
+}
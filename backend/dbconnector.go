@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/rs/zerolog/log"
+)
+
+// dbCredentialSource supplies the user name and password of new database connections when they
+// are issued dynamically instead of being part of the configured connection string
+type dbCredentialSource interface {
+	credentials(ctx context.Context) (user, password string, err error)
+}
+
+// dbCredentials is the configured source, nil when the connection string carries static credentials
+var dbCredentials dbCredentialSource
+
+// dbConnector opens connections with the current credentials, so rotated credentials apply to
+// every connection opened afterwards without replacing the pools
+type dbConnector struct{}
+
+func (dbConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	config, err := pgx.ParseConfig(databaseURL())
+	if err != nil {
+		return nil, err
+	}
+	if cloudSQL != nil {
+		// The connector encrypts the connection, so the driver must not negotiate TLS on top
+		config.TLSConfig = nil
+		config.Fallbacks = nil
+		config.DialFunc = cloudSQL.DialContext
+	}
+	if pgbouncerMode() {
+		// pgx prepares and caches a named statement per query on every connection, which a
+		// transaction pooler may not run on the connection that prepared it. Queries are sent and
+		// executed in a single batch instead, with text results.
+		config.DefaultQueryExecMode = pgx.QueryExecModeExec
+	}
+	if readOnly && !pgbouncerMode() {
+		// pgbouncer refuses unknown startup parameters, there the role has to carry the setting
+		config.RuntimeParams["default_transaction_read_only"] = "on"
+	}
+	if dbCredentials != nil {
+		if config.User, config.Password, err = dbCredentials.credentials(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return stdlib.GetConnector(*config).Connect(ctx)
+}
+
+func (dbConnector) Driver() driver.Driver {
+	return stdlib.GetDefaultDriver()
+}
+
+// pgbouncerMode reports whether PGBOUNCER_MODE=true, for databases reached through pgbouncer or
+// another pooler in transaction mode, where consecutive statements outside a transaction may
+// run on different server connections
+func pgbouncerMode() bool {
+	return getEnvOrDefault("PGBOUNCER_MODE", "false") == "true"
+}
+
+// pgArray scans a PostgreSQL array into a pointer to a slice. Slices are passed as query arguments
+// directly.
+func pgArray(dest interface{}) sql.Scanner {
+	// A type map caches the Go types it has seen and is not safe for concurrent use
+	return pgtype.NewMap().SQLScanner(dest)
+}
+
+// openDB returns a pool of the history database
+func openDB() *sql.DB {
+	return sql.OpenDB(dbConnector{})
+}
+
+// parseDSN returns the settings of a connection string, which may be a URL or key/value pairs
+func parseDSN(dsn string) (map[string]string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return parseDSNURL(dsn)
+	}
+
+	values := map[string]string{}
+	for rest := strings.TrimSpace(dsn); rest != ""; rest = strings.TrimSpace(rest) {
+		key, remainder, found := strings.Cut(rest, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid connection string near %q", rest)
+		}
+		key, remainder = strings.TrimSpace(key), strings.TrimLeft(remainder, " ")
+
+		var value strings.Builder
+		if strings.HasPrefix(remainder, "'") {
+			i := 1
+			for ; i < len(remainder) && remainder[i] != '\''; i++ {
+				if remainder[i] == '\\' && i+1 < len(remainder) {
+					i++
+				}
+				value.WriteByte(remainder[i])
+			}
+			if i >= len(remainder) {
+				return nil, fmt.Errorf("unterminated quote in connection string")
+			}
+			rest = remainder[i+1:]
+		} else {
+			end := strings.IndexAny(remainder, " \t\n")
+			if end < 0 {
+				end = len(remainder)
+			}
+			value.WriteString(remainder[:end])
+			rest = remainder[end:]
+		}
+		values[key] = value.String()
+	}
+	return values, nil
+}
+
+// parseDSNURL returns the settings of a connection URL under the names of the key/value form
+func parseDSNURL(dsn string) (map[string]string, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for key, value := range parsed.Query() {
+		values[key] = value[0]
+	}
+	if parsed.User != nil {
+		values["user"] = parsed.User.Username()
+		if password, ok := parsed.User.Password(); ok {
+			values["password"] = password
+		}
+	}
+	// Only the first of several comma-separated hosts is reported
+	host, _, _ := strings.Cut(parsed.Host, ",")
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		values["host"], values["port"] = h, port
+	} else if host != "" {
+		values["host"] = host
+	}
+	if dbname := strings.TrimPrefix(parsed.Path, "/"); dbname != "" {
+		values["dbname"] = dbname
+	}
+	return values, nil
+}
+
+// checkDBCertificates verifies that the certificate files named by the connection string can be
+// read. The driver only reads them when connecting, so a typo would otherwise surface much later.
+func checkDBCertificates() error {
+	values, err := parseDSN(databaseURL())
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{"sslrootcert", "sslcert", "sslkey"} {
+		path := values[key]
+		if path == "" {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		file.Close()
+	}
+	if (values["sslcert"] == "") != (values["sslkey"] == "") {
+		return errors.New("a client certificate needs both sslcert and sslkey")
+	}
+	return nil
+}
+
+// quoteDSNValue quotes a value of a key/value connection string
+func quoteDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// recycleIdleConnections closes the idle connections of a pool, so the next queries connect with
+// freshly issued credentials. Connections in use are closed when returned after ConnMaxLifetime.
+func recycleIdleConnections(pool *sql.DB, maxIdle int) {
+	pool.SetMaxIdleConns(0)
+	pool.SetMaxIdleConns(maxIdle)
+}
+
+// initDBCredentials sets up dynamic database credentials when a provider is configured:
+// RDS IAM auth with DB_IAM_AUTH=aws, or Vault when VAULT_DB_ROLE is set
+func initDBCredentials(ctx context.Context) error {
+	vault, err := newVaultCredentials()
+	if err != nil {
+		return err
+	}
+
+	switch iamAuth := os.Getenv("DB_IAM_AUTH"); {
+	case iamAuth == "aws" && vault != nil:
+		return errors.New("DB_IAM_AUTH and VAULT_DB_ROLE cannot be combined")
+	case iamAuth == "aws":
+		rds, err := newRDSIAMCredentials(ctx)
+		if err != nil {
+			return err
+		}
+		dbCredentials = rds
+		log.Info().Str("endpoint", rds.endpoint).Str("user", rds.user).Msg("Using RDS IAM authentication")
+		return nil
+	case iamAuth != "":
+		return fmt.Errorf("unsupported DB_IAM_AUTH %q", iamAuth)
+	case vault == nil:
+		return nil
+	}
+
+	if err := vault.issue(ctx); err != nil {
+		return err
+	}
+	dbCredentials = vault
+	go vault.maintain(ctx)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// QueryPlan is the EXPLAIN output of one query of a request made with ?debug=explain
+type QueryPlan struct {
+	Name  string          `json:"name"`
+	Query string          `json:"query"`
+	Plan  json.RawMessage `json:"plan,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// DebugInfo is added to listing responses in debug mode
+type DebugInfo struct {
+	Plans []QueryPlan `json:"plans"`
+}
+
+// queryPlans collects the plans of a request in debug mode
+type queryPlans struct {
+	mu    sync.Mutex
+	plans []QueryPlan
+}
+
+type queryPlansKey struct{}
+
+// withQueryPlans enables plan collection for the queries run with ctx
+func withQueryPlans(ctx context.Context) (context.Context, *queryPlans) {
+	plans := &queryPlans{}
+	return context.WithValue(ctx, queryPlansKey{}, plans), plans
+}
+
+// debugInfo returns the collected plans, nil when debug mode is off
+func (p *queryPlans) debugInfo() *DebugInfo {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &DebugInfo{Plans: append([]QueryPlan{}, p.plans...)}
+}
+
+// explainQuery records the plan of query when ctx is in debug mode, and does nothing otherwise.
+// It must be called before the query itself, as a pool of one connection is busy while the
+// rows of the query are open. EXPLAIN ANALYZE executes the query, so this is only used for reads.
+func explainQuery(ctx context.Context, name, query string, args ...interface{}) {
+	plans, _ := ctx.Value(queryPlansKey{}).(*queryPlans)
+	if plans == nil {
+		return
+	}
+
+	plan := QueryPlan{Name: name, Query: query}
+	var output []byte
+	if err := db.QueryRowContext(ctx, `EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) `+query, args...).Scan(&output); err != nil {
+		plan.Error = err.Error()
+	} else {
+		plan.Plan = output
+	}
+
+	plans.mu.Lock()
+	plans.plans = append(plans.plans, plan)
+	plans.mu.Unlock()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sourceDiscovery finds chat memory tables in the databases of the configured sources, so new
+// agents with their own memory table show up as sources without a restart
+type sourceDiscovery struct {
+	// patterns limit discovery to tables whose schema-qualified name matches one of them
+	patterns []*regexp.Regexp
+}
+
+// discovery is the configured discovery, nil unless SOURCE_DISCOVERY is true
+var discovery *sourceDiscovery
+
+// discoverTablesQuery lists the tables with the columns n8n's Postgres chat memory creates: an
+// integer id, a text session_id and a JSONB message
+const discoverTablesQuery = `
+	SELECT c.table_schema, c.table_name
+	FROM information_schema.columns c
+	JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+	WHERE t.table_type = 'BASE TABLE' AND c.table_schema NOT IN ('pg_catalog', 'information_schema')
+	GROUP BY c.table_schema, c.table_name
+	HAVING bool_or(c.column_name = 'id' AND c.data_type IN ('integer', 'bigint'))
+		AND bool_or(c.column_name = 'session_id' AND c.data_type IN ('character varying', 'text'))
+		AND bool_or(c.column_name = 'message' AND c.data_type = 'jsonb')
+	ORDER BY c.table_schema, c.table_name
+`
+
+// loadSourceDiscovery reads SOURCE_DISCOVERY and SOURCE_DISCOVERY_PATTERNS, comma-separated
+// regular expressions matched against schema.table. Without patterns every table with the
+// columns of a chat memory table is a source.
+func loadSourceDiscovery() error {
+	if os.Getenv("SOURCE_DISCOVERY") != "true" {
+		return nil
+	}
+	discovery = &sourceDiscovery{}
+	for _, pattern := range strings.Split(os.Getenv("SOURCE_DISCOVERY_PATTERNS"), ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("SOURCE_DISCOVERY_PATTERNS: %w", err)
+		}
+		discovery.patterns = append(discovery.patterns, re)
+	}
+	return nil
+}
+
+// startSourceDiscovery discovers the tables once and then every SOURCE_DISCOVERY_INTERVAL. Every
+// replica keeps its own list of sources, so discovery runs on all of them.
+func startSourceDiscovery(ctx context.Context) {
+	discovery.run(ctx)
+
+	interval := getEnvDuration("SOURCE_DISCOVERY_INTERVAL", 10*time.Minute)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				discovery.run(ctx)
+			}
+		}
+	}()
+}
+
+// run replaces the discovered sources. A database that cannot be scanned keeps the tables found
+// there before.
+func (d *sourceDiscovery) run(ctx context.Context) {
+	discoveredSourcesMu.RLock()
+	previous := discoveredSources
+	discoveredSourcesMu.RUnlock()
+
+	var found []dataSource
+	for _, source := range dataSources {
+		tables, err := d.discover(ctx, source)
+		if err != nil {
+			log.Err(err).Str("source", source.Name).Msg("Failed to discover chat memory tables")
+			for _, table := range previous {
+				if table.parent == source.Name {
+					found = append(found, table)
+				}
+			}
+			continue
+		}
+		found = append(found, tables...)
+	}
+
+	discoveredSourcesMu.Lock()
+	discoveredSources = found
+	discoveredSourcesMu.Unlock()
+	log.Debug().Int("tables", len(found)).Msg("Discovered chat memory tables")
+}
+
+// discover returns the chat memory tables in the database of source, other than the configured one
+func (d *sourceDiscovery) discover(ctx context.Context, source dataSource) ([]dataSource, error) {
+	ctx, cancel := context.WithTimeout(ctx, source.timeout)
+	defer cancel()
+
+	rows, err := source.pool.QueryContext(ctx, discoverTablesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []dataSource
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			return nil, err
+		}
+		if schema == "public" && table == source.Table {
+			continue
+		}
+		if !d.matches(schema + "." + table) {
+			continue
+		}
+
+		name := schema + "." + table
+		if source.Name != "default" {
+			name = source.Name + "/" + name
+		}
+		tables = append(tables, dataSource{
+			DataSourceInfo: DataSourceInfo{Name: name, Schema: schema, Table: table, Region: source.Region, Discovered: true},
+			pool:           source.pool,
+			timeout:        source.timeout,
+			parent:         source.Name,
+		})
+	}
+	return tables, rows.Err()
+}
+
+// matches reports whether a schema-qualified table name matches the discovery patterns
+func (d *sourceDiscovery) matches(name string) bool {
+	if len(d.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range d.patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSourcesHandler lists the sources the fan-out listing can read, discovered ones included
+func GetSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, DataResponse{Data: dataSourceInfos()})
+}
+
+// DiscoverSourcesHandler runs source discovery now rather than at its next interval
+func DiscoverSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if discovery == nil {
+		respondWithError(w, "Source discovery is not enabled", http.StatusBadRequest)
+		return
+	}
+	discovery.run(r.Context())
+	respondWithJSON(w, DataResponse{Data: dataSourceInfos()})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DuplicateGroup is a set of sessions whose opening human messages are near-identical
+type DuplicateGroup struct {
+	OpeningMessage string    `json:"openingMessage"`
+	Sessions       []string  `json:"sessions"`
+	Count          int       `json:"count"`
+	DetectedAt     time.Time `json:"detectedAt"`
+}
+
+// duplicateJob finds sessions with similar opening messages using the pg_trgm similarity operator
+type duplicateJob struct {
+	threshold   float64
+	maxSessions int
+}
+
+// newDuplicateJob reads DUPLICATES_THRESHOLD and DUPLICATES_MAX_SESSIONS from the environment
+func newDuplicateJob() duplicateJob {
+	job := duplicateJob{threshold: 0.6, maxSessions: 2000}
+	if threshold, err := strconv.ParseFloat(os.Getenv("DUPLICATES_THRESHOLD"), 64); err == nil && threshold > 0 && threshold <= 1 {
+		job.threshold = threshold
+	}
+	if maxSessions, err := strconv.Atoi(os.Getenv("DUPLICATES_MAX_SESSIONS")); err == nil && maxSessions > 0 {
+		job.maxSessions = maxSessions
+	}
+	return job
+}
+
+// ensureDuplicateDetection installs pg_trgm at startup, so the job itself needs no rights to
+// create extensions. Without it the duplicates feature is switched off rather than failing startup,
+// as managed databases often deny CREATE EXTENSION to the service role.
+func ensureDuplicateDetection(ctx context.Context) error {
+	if _, err := db.ExecContext(ctx, `CREATE EXTENSION IF NOT EXISTS pg_trgm`); err != nil {
+		return fmt.Errorf("duplicate detection needs the pg_trgm extension: %w", err)
+	}
+	return nil
+}
+
+// run recomputes the duplicate groups of the most recent sessions and replaces the stored results.
+// The threshold is set for the transaction only, as the % operator reads it from the session and
+// the pooled connection is shared.
+func (j duplicateJob) run(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT set_config('pg_trgm.similarity_threshold', $1, true)`,
+		strconv.FormatFloat(j.threshold, 'f', -1, 64)); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH openings AS (
+			SELECT * FROM (
+				SELECT DISTINCT ON (session_id) session_id, id, message->>'content' AS content
+				FROM n8n_chat_histories
+				WHERE message->>'type' = 'human' AND COALESCE(message->>'content', '') <> ''
+				ORDER BY session_id, id
+			) AS first_messages
+			ORDER BY id DESC
+			LIMIT $1
+		)
+		SELECT a.session_id, b.session_id
+		FROM openings a
+		JOIN openings b ON a.session_id < b.session_id
+		WHERE a.content % b.content
+	`, j.maxSessions)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// Similar pairs are merged into groups with a union-find keyed by session id
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(id string) string {
+		if parent[id] == "" || parent[id] == id {
+			parent[id] = id
+			return id
+		}
+		parent[id] = find(parent[id])
+		return parent[id]
+	}
+	for rows.Next() {
+		var a, b string
+		if err := rows.Scan(&a, &b); err != nil {
+			return err
+		}
+		rootA, rootB := find(a), find(b)
+		if rootA != rootB {
+			if rootB < rootA {
+				rootA, rootB = rootB, rootA
+			}
+			parent[rootB] = rootA
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM chat_history_duplicates`); err != nil {
+		return err
+	}
+	for sessionID := range parent {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO chat_history_duplicates (session_id, group_id) VALUES ($1, $2)`,
+			sessionID, find(sessionID)); err != nil {
+			return err
+		}
+	}
+
+	log.Info().Int("sessions", len(parent)).Msg("Duplicate sessions detected")
+	return tx.Commit()
+}
+
+func GetDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT
+			(SELECT message->>'content' FROM n8n_chat_histories h
+				WHERE h.session_id = d.group_id AND h.message->>'type' = 'human'
+				ORDER BY h.id LIMIT 1),
+			array_agg(d.session_id ORDER BY d.session_id),
+			COUNT(*),
+			MAX(d.detected_at)
+		FROM chat_history_duplicates d
+		GROUP BY d.group_id
+		ORDER BY COUNT(*) DESC, d.group_id
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		log.Err(err).Msg("Failed to query duplicate sessions")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	groups := []DuplicateGroup{}
+	for rows.Next() {
+		var group DuplicateGroup
+		var openingMessage *string
+		if err := rows.Scan(&openingMessage, pgArray(&group.Sessions), &group.Count, &group.DetectedAt); err != nil {
+			log.Err(err).Msg("Failed to scan duplicate group")
+			respondWithQueryError(w, err)
+			return
+		}
+		if openingMessage != nil {
+			group.OpeningMessage = *openingMessage
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate duplicate groups")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: groups})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// embedTemplate renders a shared session as a self-contained page without external assets
+var embedTemplate = template.Must(template.New("embed").Funcs(template.FuncMap{
+	"json": func(value interface{}) string {
+		encoded, _ := json.MarshalIndent(value, "", "  ")
+		return string(encoded)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Conversation {{.SessionID}}</title>
+<style>
+body { margin: 0; padding: 16px; font-family: system-ui, -apple-system, sans-serif; font-size: 14px; background: #f8fafc; color: #0f172a; }
+header { margin-bottom: 16px; color: #64748b; font-size: 12px; }
+.message { max-width: 80%; margin: 8px 0; padding: 10px 14px; border-radius: 12px; white-space: pre-wrap; word-wrap: break-word; }
+.human { margin-left: auto; background: #2563eb; color: #fff; }
+.ai { background: #fff; border: 1px solid #e2e8f0; }
+.other { background: #f1f5f9; color: #475569; font-size: 12px; }
+.role { display: block; margin-bottom: 4px; font-size: 11px; font-weight: 600; text-transform: uppercase; opacity: .7; }
+details { margin-top: 6px; font-size: 12px; }
+pre { margin: 4px 0 0; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<header>Session {{.SessionID}} &middot; link expires {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}</header>
+{{range .Messages}}
+<div class="message {{if eq .Type "human"}}human{{else if eq .Type "ai"}}ai{{else}}other{{end}}">
+<span class="role">{{.Type}}</span>{{.Content}}
+{{if .ToolCalls}}<details><summary>{{len .ToolCalls}} tool call(s)</summary>{{range .ToolCalls}}<pre>{{json .}}</pre>{{end}}</details>{{end}}
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+// GetEmbedHandler renders a shared session as HTML suitable for iframes. Like the shared JSON
+// endpoint it is authorized by the share token alone.
+func GetEmbedHandler(w http.ResponseWriter, r *http.Request) {
+	payload, err := verifyShareToken(r.PathValue("token"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	chats, err := loadSessionMessages(r.Context(), payload.SessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", payload.SessionID).Msg("Failed to load embedded session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(chats) == 0 {
+		http.Error(w, errInvalidShareToken.Error(), http.StatusNotFound)
+		return
+	}
+
+	session := SharedSession{SessionID: payload.SessionID, ExpiresAt: time.Unix(payload.ExpiresAt, 0)}
+	for _, chat := range chats {
+		session.Messages = append(session.Messages, chat.Message)
+	}
+
+	frameAncestors := getEnvOrDefault("EMBED_FRAME_ANCESTORS", "*")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors "+frameAncestors)
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := embedTemplate.Execute(w, session); err != nil {
+		log.Err(err).Msg("Failed to render embedded session")
+	}
+}
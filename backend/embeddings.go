@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"time"
+)
+
+// embeddingClient computes text embeddings through an OpenAI-compatible embeddings API
+type embeddingClient struct {
+	url    string
+	key    string
+	model  string
+	client *http.Client
+}
+
+// embeddings is the configured client, nil when no embedding model is set
+var embeddings *embeddingClient
+
+// loadEmbeddingConfig reads EMBEDDING_MODEL, which enables embeddings, EMBEDDING_API_URL, an
+// OpenAI-compatible endpoint defaulting to OpenAI's, and EMBEDDING_API_KEY
+func loadEmbeddingConfig() error {
+	model := os.Getenv("EMBEDDING_MODEL")
+	if model == "" {
+		return nil
+	}
+	embeddings = &embeddingClient{
+		url:    getEnvOrDefault("EMBEDDING_API_URL", "https://api.openai.com/v1/embeddings"),
+		key:    os.Getenv("EMBEDDING_API_KEY"),
+		model:  model,
+		client: &http.Client{Timeout: getEnvDuration("EMBEDDING_TIMEOUT", 30*time.Second)},
+	}
+	return nil
+}
+
+// embed returns the embedding of every text, in order
+func (c *embeddingClient) embed(ctx context.Context, texts []string) ([][]float64, error) {
+	payload, err := json.Marshal(map[string]interface{}{"model": c.model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if c.key != "" {
+		request.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return nil, fmt.Errorf("embedding API responded with status %d: %s", response.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	vectors := make([][]float64, len(texts))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding API returned unexpected index %d", item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	for i, vector := range vectors {
+		if vector == nil {
+			return nil, fmt.Errorf("embedding API returned no embedding for input %d", i)
+		}
+	}
+	return vectors, nil
+}
+
+// cosineSimilarity of two vectors, 0 when either is zero
+func cosineSimilarity(a, b []float64) float64 {
+	var dot, normA, normB float64
+	for i := range min(len(a), len(b)) {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
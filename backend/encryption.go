@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted artifacts use a chunked AES-256-GCM format, so files of any size can be written and
+// read as streams:
+//
+//	magic "N8NCHENC1" | key mode (1 byte) | wrapped key length (uint16) | wrapped key | nonce prefix (4 bytes)
+//	then chunks of:   sealed length (uint32) | sealed chunk
+//
+// Every chunk holds up to encryptionChunkSize bytes of plaintext and is sealed with a nonce made of
+// the prefix and its 8-byte index. The additional data marks the final chunk, so a truncated file
+// fails to decrypt instead of yielding a shorter plaintext. Every artifact has its own data key,
+// so nonce prefixes only have to be unique within one artifact: with a local key it is derived
+// with HKDF-SHA256 from the key and a random salt stored in place of the wrapped key, and with a
+// KMS key it is generated by KMS and stored wrapped. Artifacts of keyModeLocal, written before
+// keys were derived, used the local key itself and can still be read.
+const (
+	encryptionMagic     = "N8NCHENC1"
+	encryptionChunkSize = 64 * 1024
+
+	keyModeLocal        = 1
+	keyModeKMS          = 2
+	keyModeLocalDerived = 3
+
+	derivedKeySaltSize = 32
+	derivedKeyInfo     = "n8n-chat-history artifact key"
+)
+
+var (
+	errKMSKeyArtifact   = errors.New("artifact was encrypted with a KMS key")
+	errLocalKeyArtifact = errors.New("artifact was encrypted with a local key")
+)
+
+// artifactKeyProvider supplies the data keys of encrypted artifacts
+type artifactKeyProvider interface {
+	// newDataKey returns a key for a new artifact along with the form stored in its header
+	newDataKey(ctx context.Context) (key, wrapped []byte, mode byte, err error)
+	// dataKey recovers the key of an artifact from its header
+	dataKey(ctx context.Context, wrapped []byte, mode byte) ([]byte, error)
+}
+
+// localKey encrypts artifacts with a key from the environment
+type localKey []byte
+
+func (k localKey) newDataKey(context.Context) ([]byte, []byte, byte, error) {
+	salt := make([]byte, derivedKeySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, 0, err
+	}
+	key, err := k.derive(salt)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return key, salt, keyModeLocalDerived, nil
+}
+
+func (k localKey) dataKey(_ context.Context, wrapped []byte, mode byte) ([]byte, error) {
+	switch mode {
+	case keyModeLocal:
+		return k, nil
+	case keyModeLocalDerived:
+		if len(wrapped) != derivedKeySaltSize {
+			return nil, errors.New("artifact header holds an invalid key salt")
+		}
+		return k.derive(wrapped)
+	default:
+		return nil, errKMSKeyArtifact
+	}
+}
+
+// derive returns the data key of the artifact with the given salt
+func (k localKey) derive(salt []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k, salt, []byte(derivedKeyInfo)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// artifactKeys is the configured key provider, nil when artifacts are stored unencrypted
+var artifactKeys artifactKeyProvider
+
+// loadArtifactEncryption reads ARTIFACT_ENCRYPTION_KEY, either a base64 encoded 32-byte key or a
+// reference to a KMS key such as aws-kms://arn:aws:kms:...
+func loadArtifactEncryption() error {
+	value := strings.TrimSpace(os.Getenv("ARTIFACT_ENCRYPTION_KEY"))
+	if value == "" {
+		return nil
+	}
+
+	if scheme, reference, found := strings.Cut(value, "://"); found {
+		switch scheme {
+		case "aws-kms":
+			provider, err := newAWSKMSKey(reference)
+			if err != nil {
+				return err
+			}
+			artifactKeys = provider
+			return nil
+		default:
+			return fmt.Errorf("ARTIFACT_ENCRYPTION_KEY: unsupported key reference %q", scheme)
+		}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return errors.New("ARTIFACT_ENCRYPTION_KEY must be a base64 encoded 32-byte key")
+	}
+	artifactKeys = localKey(key)
+	return nil
+}
+
+// encryptingWriter seals everything written to it into the chunked format
+type encryptingWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint64
+	buf    []byte
+}
+
+// newEncryptingWriter writes the header to w and returns the writer for the plaintext. Close must
+// be called to write the final chunk.
+func newEncryptingWriter(ctx context.Context, w io.Writer, keys artifactKeyProvider) (*encryptingWriter, error) {
+	key, wrapped, mode, err := keys.newDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newArtifactAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, 4)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	header := []byte(encryptionMagic)
+	header = append(header, mode)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+func (e *encryptingWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := min(len(data), encryptionChunkSize-len(e.buf))
+		e.buf = append(e.buf, data[:n]...)
+		data = data[n:]
+		written += n
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close seals the remaining plaintext as the final chunk
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptingWriter) seal(final bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.index), e.buf, chunkAdditionalData(final))
+	e.index++
+	e.buf = e.buf[:0]
+
+	if _, err := e.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptArtifact streams the plaintext of an encrypted artifact from r to w
+func decryptArtifact(ctx context.Context, w io.Writer, r io.Reader, keys artifactKeyProvider) error {
+	header := make([]byte, len(encryptionMagic)+3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], []byte(encryptionMagic)) {
+		return errors.New("not an encrypted artifact")
+	}
+	mode := header[len(encryptionMagic)]
+	wrapped := make([]byte, binary.BigEndian.Uint16(header[len(encryptionMagic)+1:]))
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return err
+	}
+
+	key, err := keys.dataKey(ctx, wrapped, mode)
+	if err != nil {
+		return err
+	}
+	aead, err := newArtifactAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	// A chunk is only known to be the final one once the end of the file is reached, so each
+	// chunk is opened after the length of the next one has been read
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return err
+	}
+	for index := uint64(0); ; index++ {
+		sealed := make([]byte, binary.BigEndian.Uint32(length))
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return err
+		}
+
+		_, err := io.ReadFull(r, length)
+		final := errors.Is(err, io.EOF)
+		if err != nil && !final {
+			return err
+		}
+
+		plaintext, err := aead.Open(nil, chunkNonce(prefix, index), sealed, chunkAdditionalData(final))
+		if err != nil {
+			return errors.New("artifact is corrupted, truncated or encrypted with another key")
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func newArtifactAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, prefix...), index)
+}
+
+func chunkAdditionalData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// runDecryptCommand implements `decrypt-artifact <input> <output>`, which restores the plaintext
+// of a downloaded artifact with the key configured in the environment
+func runDecryptCommand(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: decrypt-artifact <input> <output>")
+	}
+	if err := loadArtifactEncryption(); err != nil {
+		return err
+	}
+	if artifactKeys == nil {
+		return errors.New("ARTIFACT_ENCRYPTION_KEY is not set")
+	}
+
+	input, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	if err := decryptArtifact(context.Background(), output, input, artifactKeys); err != nil {
+		output.Close()
+		os.Remove(args[1])
+		return err
+	}
+	return output.Close()
+}
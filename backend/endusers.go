@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxEndUserSessions bounds the sessions listed for an end user
+const maxEndUserSessions = 1000
+
+// EndUserSession is a session of an end user
+type EndUserSession struct {
+	SessionID      string `json:"sessionId"`
+	Channel        string `json:"channel,omitempty"`
+	Messages       int    `json:"messages"`
+	HumanMessages  int    `json:"humanMessages"`
+	FirstMessageID int64  `json:"firstMessageId"`
+	LastMessageID  int64  `json:"lastMessageId"`
+}
+
+// EndUserHistory aggregates what is stored about an end user, the person chatting with a workflow.
+// Sessions are listed oldest first; Truncated is set when there were more than maxEndUserSessions.
+type EndUserHistory struct {
+	ID        string           `json:"id"`
+	Sessions  []EndUserSession `json:"sessions"`
+	Messages  int              `json:"messages"`
+	Truncated bool             `json:"truncated"`
+}
+
+// endUserConfig locates the identifier of the end user of a session
+var endUserConfig DimensionConfig
+
+// loadEndUserConfig reads END_USER_FIELD, END_USER_METADATA_PATH and END_USER_SESSION_PATTERN from
+// the environment
+func loadEndUserConfig() (err error) {
+	endUserConfig, err = loadDimensionConfig("END_USER")
+	return err
+}
+
+// endUserSessionsQuery selects the sessions in which any message carries the end user's identifier
+func endUserSessionsQuery(args *queryArgs, id string) string {
+	return "SELECT session_id FROM n8n_chat_histories WHERE " + endUserConfig.rowExpr(args) + " = " + args.add(id)
+}
+
+// GetEndUserHandler lists the sessions of an end user with their totals, for support lookups and
+// subject access requests
+func GetEndUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !endUserConfig.enabled() {
+		respondWithError(w, "End user extraction is not configured", http.StatusBadRequest)
+		return
+	}
+
+	history, err := queryEndUserHistory(r.Context(), r.PathValue("id"), maxEndUserSessions)
+	if err != nil {
+		log.Err(err).Msg("Failed to query end user sessions")
+		respondWithQueryError(w, err)
+		return
+	}
+	if len(history.Sessions) == 0 {
+		respondWithError(w, "End user not found", http.StatusNotFound)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: history})
+}
+
+// queryEndUserHistory returns the sessions of an end user, up to limit sessions unless limit is 0
+func queryEndUserHistory(ctx context.Context, id string, limit int) (EndUserHistory, error) {
+	history := EndUserHistory{ID: id, Sessions: []EndUserSession{}}
+
+	var args queryArgs
+	channel := "''"
+	if channelConfig.enabled() {
+		channel = "COALESCE(MAX(" + channelConfig.rowExpr(&args) + "), '')"
+	}
+	limitClause := ""
+	if limit > 0 {
+		limitClause = "LIMIT " + args.add(limit+1)
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT session_id, %s, COUNT(*), COUNT(*) FILTER (WHERE message->>'type' = 'human'), MIN(id), MAX(id)
+		FROM n8n_chat_histories
+		WHERE session_id IN (%s)
+		GROUP BY session_id
+		ORDER BY MIN(id)
+		%s
+	`, channel, endUserSessionsQuery(&args, id), limitClause), args...)
+	if err != nil {
+		return history, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session EndUserSession
+		if err := rows.Scan(&session.SessionID, &session.Channel, &session.Messages, &session.HumanMessages, &session.FirstMessageID, &session.LastMessageID); err != nil {
+			return history, err
+		}
+		if limit > 0 && len(history.Sessions) == limit {
+			history.Truncated = true
+			break
+		}
+		history.Sessions = append(history.Sessions, session)
+		history.Messages += session.Messages
+	}
+	return history, rows.Err()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// eventBatchSize is the maximum number of rows published per worker run
+const eventBatchSize = 500
+
+// ChatEvent is the payload published for every new chat row
+type ChatEvent struct {
+	ID        int             `json:"id"`
+	SessionID string          `json:"sessionId"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// eventSink delivers chat events to an external system. Publish must only return once the
+// events are acknowledged, as the checkpoint advances right after it.
+type eventSink interface {
+	Name() string
+	Publish(ctx context.Context, events []ChatEvent) error
+	Close() error
+}
+
+// eventPublisher streams new chat rows to a sink. Progress is stored per sink in a checkpoint
+// table only after a batch has been acknowledged, giving at-least-once delivery.
+//
+// Ids are handed out before their rows commit, so a row can become visible after rows with higher
+// ids were published. Every run therefore also reads the rows within lagWindow ids below the
+// checkpoint and publishes those it has not published yet. The published ids are only known to
+// the instance that published them, so another instance taking over publishes the window again.
+type eventPublisher struct {
+	sink      eventSink
+	lagWindow int64
+	// published holds the ids published within the lag window
+	published map[int64]bool
+}
+
+// newEventPublisher reads EVENTS_LAG_WINDOW from the environment
+func newEventPublisher(sink eventSink) *eventPublisher {
+	p := &eventPublisher{sink: sink, lagWindow: 1000, published: map[int64]bool{}}
+	if window, err := strconv.ParseInt(os.Getenv("EVENTS_LAG_WINDOW"), 10, 64); err == nil && window >= 0 {
+		p.lagWindow = window
+	}
+	return p
+}
+
+// newEventSinks creates a sink for every configured event stream
+func newEventSinks() ([]eventSink, error) {
+	var sinks []eventSink
+
+	// The constructors return typed nil pointers when unconfigured, so they are checked before boxing
+	ks, err := newKafkaSink()
+	if err != nil {
+		return nil, err
+	}
+	if ks != nil {
+		sinks = append(sinks, ks)
+	}
+
+	ns, err := newNATSSink()
+	if err != nil {
+		return nil, err
+	}
+	if ns != nil {
+		sinks = append(sinks, ns)
+	}
+
+	return sinks, nil
+}
+
+// run publishes the rows inserted since the last checkpoint, and the rows of the lag window that
+// were not visible when it passed them
+func (p *eventPublisher) run(ctx context.Context) error {
+	checkpointName := p.sink.Name()
+
+	var lastID int64
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE((SELECT last_id FROM chat_history_publish_checkpoints WHERE publisher = $1), 0)
+	`, checkpointName).Scan(&lastID)
+	if err != nil {
+		return err
+	}
+
+	windowStart := lastID - p.lagWindow
+	published := make([]int64, 0, len(p.published))
+	for id := range p.published {
+		if id <= windowStart {
+			delete(p.published, id)
+			continue
+		}
+		published = append(published, id)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, session_id, message
+		FROM n8n_chat_histories
+		WHERE id > $1 OR (id > $3 AND NOT id = ANY($4))
+		ORDER BY id ASC
+		LIMIT $2
+	`, lastID, eventBatchSize, windowStart, published)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var events []ChatEvent
+	for rows.Next() {
+		var event ChatEvent
+		if err := rows.Scan(&event.ID, &event.SessionID, &event.Message); err != nil {
+			return err
+		}
+		processed, err := processRawMessage(ctx, ReadStage, event.SessionID, event.Message)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", event.ID, err)
+		}
+		redacted, err := redactRawMessage(processed)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", event.ID, err)
+		}
+		event.Message = redacted
+		events = append(events, event)
+		lastID = max(lastID, int64(event.ID))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := p.sink.Publish(ctx, events); err != nil {
+		return err
+	}
+	for _, event := range events {
+		p.published[int64(event.ID)] = true
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO chat_history_publish_checkpoints (publisher, last_id, updated_at)
+		VALUES ($1, $2, now())
+		ON CONFLICT (publisher) DO UPDATE SET last_id = EXCLUDED.last_id, updated_at = EXCLUDED.updated_at
+	`, checkpointName, lastID)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("sink", checkpointName).Int("events", len(events)).Int64("lastId", lastID).Msg("Published chat events")
+	return nil
+}
+
+// kafkaSink publishes chat events to a Kafka topic
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+// newKafkaSink configures the sink from KAFKA_* variables. It returns nil when KAFKA_BROKERS is unset.
+func newKafkaSink() (*kafkaSink, error) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		return nil, nil
+	}
+	topic := os.Getenv("KAFKA_TOPIC")
+	if topic == "" {
+		return nil, fmt.Errorf("KAFKA_TOPIC is required when KAFKA_BROKERS is set")
+	}
+
+	transport := &kafka.Transport{}
+	if os.Getenv("KAFKA_TLS") == "true" {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	username, password := os.Getenv("KAFKA_USERNAME"), os.Getenv("KAFKA_PASSWORD")
+	var mechanism sasl.Mechanism
+	var err error
+	switch strings.ToLower(os.Getenv("KAFKA_SASL_MECHANISM")) {
+	case "":
+	case "plain":
+		mechanism = plain.Mechanism{Username: username, Password: password}
+	case "scram-sha-256":
+		mechanism, err = scram.Mechanism(scram.SHA256, username, password)
+	case "scram-sha-512":
+		mechanism, err = scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, fmt.Errorf("unsupported KAFKA_SASL_MECHANISM %q", os.Getenv("KAFKA_SASL_MECHANISM"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	transport.SASL = mechanism
+
+	return &kafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{}, // keyed by session id, so a conversation stays ordered within a partition
+			RequiredAcks: kafka.RequireAll,
+			Transport:    transport,
+		},
+	}, nil
+}
+
+func (s *kafkaSink) Name() string {
+	return "kafka"
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, events []ChatEvent) error {
+	messages := make([]kafka.Message, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, kafka.Message{Key: []byte(event.SessionID), Value: value, Time: time.Now()})
+	}
+	return s.writer.WriteMessages(ctx, messages...)
+}
+
+// Close flushes and closes the Kafka writer
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// natsSink publishes chat events to a NATS JetStream subject. Message ids are set to the row id,
+// so redeliveries after a failed checkpoint are dropped by JetStream's duplicate window.
+type natsSink struct {
+	conn    *nats.Conn
+	js      jetstream.JetStream
+	subject string
+}
+
+// newNATSSink configures the sink from NATS_* variables. It returns nil when NATS_URL is unset.
+func newNATSSink() (*natsSink, error) {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	options := []nats.Option{nats.Name("n8n-chat-history")}
+	if creds := os.Getenv("NATS_CREDS"); creds != "" {
+		options = append(options, nats.UserCredentials(creds))
+	}
+	if user := os.Getenv("NATS_USER"); user != "" {
+		options = append(options, nats.UserInfo(user, os.Getenv("NATS_PASSWORD")))
+	}
+	if token := os.Getenv("NATS_TOKEN"); token != "" {
+		options = append(options, nats.Token(token))
+	}
+
+	conn, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &natsSink{
+		conn:    conn,
+		js:      js,
+		subject: getEnvOrDefault("NATS_SUBJECT", "n8n.chat.history"),
+	}, nil
+}
+
+func (s *natsSink) Name() string {
+	return "nats"
+}
+
+func (s *natsSink) Publish(ctx context.Context, events []ChatEvent) error {
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		message := &nats.Msg{Subject: s.subject, Data: data, Header: nats.Header{}}
+		message.Header.Set("Session-Id", event.SessionID)
+		if _, err := s.js.PublishMsg(ctx, message, jetstream.WithMsgID(strconv.Itoa(event.ID))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close drains pending messages and closes the connection
+func (s *natsSink) Close() error {
+	return s.conn.Drain()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ExecutionLink ties a message to the n8n execution that stored it. URL is only set when N8N_URL
+// is, and points into the workflow when its id is known from the WORKFLOW_* settings.
+type ExecutionLink struct {
+	MessageID   int    `json:"messageId"`
+	ExecutionID string `json:"executionId"`
+	WorkflowID  string `json:"workflowId,omitempty"`
+	URL         string `json:"url,omitempty"`
+}
+
+// SessionExecutions is the response of the session executions endpoint
+type SessionExecutions struct {
+	SessionID  string          `json:"sessionId"`
+	Executions []ExecutionLink `json:"executions"`
+}
+
+// executionConfig locates the id of the n8n execution that stored a message, which workflows add
+// to the message metadata, e.g. from {{ $execution.id }}
+var executionConfig DimensionConfig
+
+// n8nURL is the base URL of the n8n editor, without a trailing slash
+var n8nURL string
+
+// loadExecutionConfig reads EXECUTION_FIELD, EXECUTION_METADATA_PATH, EXECUTION_SESSION_PATTERN
+// and N8N_URL from the environment
+func loadExecutionConfig() (err error) {
+	if executionConfig, err = loadDimensionConfig("EXECUTION"); err != nil {
+		return err
+	}
+	if raw := os.Getenv("N8N_URL"); raw != "" {
+		parsed, err := url.Parse(raw)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("N8N_URL must be an http or https URL")
+		}
+		n8nURL = strings.TrimRight(raw, "/")
+	}
+	return nil
+}
+
+// executionURL returns the editor URL of an execution, or an empty string without N8N_URL
+func executionURL(workflowID, executionID string) string {
+	if n8nURL == "" {
+		return ""
+	}
+	if workflowID != "" {
+		return n8nURL + "/workflow/" + url.PathEscape(workflowID) + "/executions/" + url.PathEscape(executionID)
+	}
+	return n8nURL + "/executions/" + url.PathEscape(executionID)
+}
+
+// GetSessionExecutionsHandler lists the messages of a session that carry an execution id, with a
+// link to the execution in n8n, so debugging can jump from the transcript to the workflow run
+func GetSessionExecutionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !executionConfig.enabled() {
+		respondWithError(w, "Execution ids are not configured", http.StatusBadRequest)
+		return
+	}
+	sessionID := r.PathValue("id")
+
+	var args queryArgs
+	workflow := "NULL::text"
+	if workflowConfig.enabled() {
+		workflow = workflowConfig.rowExpr(&args)
+	}
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT id, COALESCE(%s, ''), COALESCE(%s, '')
+		FROM n8n_chat_histories
+		WHERE session_id = %s
+		ORDER BY id
+	`, executionConfig.rowExpr(&args), workflow, args.add(sessionID)), args...)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to query session executions")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	response := SessionExecutions{SessionID: sessionID, Executions: []ExecutionLink{}}
+	found := false
+	for rows.Next() {
+		var link ExecutionLink
+		if err := rows.Scan(&link.MessageID, &link.ExecutionID, &link.WorkflowID); err != nil {
+			log.Err(err).Msg("Failed to scan session execution")
+			respondWithQueryError(w, err)
+			return
+		}
+		found = true
+		if link.ExecutionID == "" {
+			continue
+		}
+		link.URL = executionURL(link.WorkflowID, link.ExecutionID)
+		response.Executions = append(response.Executions, link)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate session executions")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !found {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: response})
+}
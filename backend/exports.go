@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Export is a background export of the chats matching a filter. The finished file is kept for
+// EXPORT_RETENTION and served with Range support, so interrupted downloads can resume.
+type Export struct {
+	ID          string     `json:"id"`
+	Format      string     `json:"format"`
+	Query       string     `json:"query"`
+	Status      string     `json:"status"` // pending, running, completed or failed
+	Error       string     `json:"error,omitempty"`
+	Encrypted   bool       `json:"encrypted"`
+	Rows        int64      `json:"rows"`
+	SizeBytes   int64      `json:"sizeBytes"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	DownloadURL string     `json:"downloadUrl,omitempty"`
+}
+
+// exportExtensions lists the file extension of every format an export can be written in
+var exportExtensions = map[string]string{
+	formatJSON:     "json",
+	formatNDJSON:   "ndjson",
+	formatCSV:      "csv",
+	formatMsgpack:  "msgpack",
+	formatProtobuf: "pb",
+}
+
+var errExportNotFound = errors.New("export not found")
+
+// A running export refreshes its heartbeat every exportHeartbeatInterval. One whose heartbeat is
+// older than exportStaleAfter was left by a replica that stopped, and is queued again, or failed
+// once it has been claimed exportMaxAttempts times.
+const (
+	exportHeartbeatInterval = time.Minute
+	exportStaleAfter        = 5 * time.Minute
+	exportMaxAttempts       = 3
+)
+
+// exportFilename returns the name of the finished file of an export
+func exportFilename(export Export) string {
+	name := export.ID + "." + exportExtensions[export.Format]
+	if export.Encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+// exportKey returns the key of the finished file of an export in the artifact storage
+func exportKey(export Export) string {
+	return "exports/" + exportFilename(export)
+}
+
+// CreateExportHandler queues an export of the chats matching the listing filters in the query string.
+// The format parameter picks the file format and defaults to ndjson.
+func CreateExportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if _, err := parseChatFilter(query); err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = formatNDJSON
+	}
+	if _, ok := exportExtensions[format]; !ok {
+		respondWithError(w, "format must be one of json, ndjson, csv, msgpack or protobuf", http.StatusBadRequest)
+		return
+	}
+	query.Del("format")
+	query.Del("timeoutMs")
+	// The region label is kept with the export, which is checked again when the job runs
+	if region := requestRegion(r); region != "" {
+		query.Set("region", region)
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		log.Err(err).Msg("Failed to generate export id")
+		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	export := Export{ID: hex.EncodeToString(idBytes), Format: format, Query: query.Encode(), Status: "pending", Encrypted: artifactKeys != nil}
+	err := db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_exports (id, format, query, encrypted)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at
+	`, export.ID, export.Format, export.Query, export.Encrypted).Scan(&export.CreatedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to create export")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	log.Info().Str("export", export.ID).Str("format", format).Msg("Export queued")
+	respondWithJSONStatus(w, DataResponse{Data: export}, http.StatusAccepted)
+}
+
+// loadExport returns an export by id, or errExportNotFound
+func loadExport(ctx context.Context, id string) (Export, error) {
+	var export Export
+	var completedAt, expiresAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT id, format, query, status, error, encrypted, rows, size_bytes, created_at, completed_at, expires_at
+		FROM chat_history_exports
+		WHERE id = $1
+	`, id).Scan(&export.ID, &export.Format, &export.Query, &export.Status, &export.Error, &export.Encrypted, &export.Rows,
+		&export.SizeBytes, &export.CreatedAt, &completedAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return export, errExportNotFound
+	}
+	if err != nil {
+		return export, err
+	}
+
+	if completedAt.Valid {
+		export.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		if time.Now().After(expiresAt.Time) {
+			return export, errExportNotFound
+		}
+		export.ExpiresAt = &expiresAt.Time
+	}
+	if export.Status == "completed" {
+		export.DownloadURL = "/api/v1/exports/" + export.ID + "/download"
+	}
+	return export, nil
+}
+
+func GetExportHandler(w http.ResponseWriter, r *http.Request) {
+	export, err := loadExport(r.Context(), r.PathValue("id"))
+	if errors.Is(err, errExportNotFound) {
+		respondWithError(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to load export")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: export})
+}
+
+// DownloadExportHandler serves a finished export. http.ServeContent answers Range and If-Range
+// requests, and the ETag never changes as the file is immutable once written. The route is exempt
+// from the query timeout, so the file streams for as long as the client reads it.
+func DownloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	export, err := loadExport(r.Context(), r.PathValue("id"))
+	if errors.Is(err, errExportNotFound) {
+		respondWithError(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to load export")
+		respondWithQueryError(w, err)
+		return
+	}
+	if export.Status != "completed" {
+		respondWithError(w, "Export is "+export.Status, http.StatusConflict)
+		return
+	}
+
+	file, err := openBlob(r.Context(), artifactStore, exportKey(export))
+	if errors.Is(err, errBlobNotFound) {
+		respondWithError(w, "Export file is no longer available", http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Err(err).Str("export", export.ID).Msg("Failed to open export file")
+		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	filename := "chats-" + exportFilename(export)
+	if export.Encrypted {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	} else {
+		w.Header().Set("Content-Type", listingContentType(export.Format))
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("ETag", `"`+export.ID+`"`)
+	http.ServeContent(w, r, filename, *export.CompletedAt, file)
+}
+
+// exportJob runs queued exports and removes expired ones
+type exportJob struct {
+	retention time.Duration
+}
+
+// newExportJob reads EXPORT_RETENTION from the environment
+func newExportJob() exportJob {
+	return exportJob{retention: getEnvDuration("EXPORT_RETENTION", 24*time.Hour)}
+}
+
+// run recovers abandoned exports, claims pending exports one at a time until none are left, then
+// cleans up expired files
+func (j exportJob) run(ctx context.Context) error {
+	if err := j.recoverStale(ctx); err != nil {
+		return err
+	}
+
+	for {
+		var export Export
+		err := db.QueryRowContext(ctx, `
+			UPDATE chat_history_exports SET status = 'running', heartbeat_at = now(), attempts = attempts + 1
+			WHERE id = (
+				SELECT id FROM chat_history_exports
+				WHERE status = 'pending'
+				ORDER BY created_at
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, format, query, encrypted
+		`).Scan(&export.ID, &export.Format, &export.Query, &export.Encrypted)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		stopHeartbeat := j.heartbeat(ctx, export.ID)
+		rows, size, err := j.write(ctx, export)
+		stopHeartbeat()
+		if err != nil {
+			log.Err(err).Str("export", export.ID).Msg("Export failed")
+			if _, err := db.ExecContext(ctx, `
+				UPDATE chat_history_exports SET status = 'failed', error = $2, completed_at = now()
+				WHERE id = $1
+			`, export.ID, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, `
+			UPDATE chat_history_exports
+			SET status = 'completed', rows = $2, size_bytes = $3, completed_at = now(), expires_at = now() + $4 * interval '1 second'
+			WHERE id = $1
+		`, export.ID, rows, size, j.retention.Seconds())
+		if err != nil {
+			return err
+		}
+		log.Info().Str("export", export.ID).Int64("rows", rows).Int64("bytes", size).Msg("Export completed")
+	}
+
+	return j.cleanup(ctx)
+}
+
+// recoverStale queues again the running exports whose heartbeat stopped, and fails those that
+// were interrupted too often to be worth another attempt
+func (j exportJob) recoverStale(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE chat_history_exports
+		SET status = CASE WHEN attempts >= $2 THEN 'failed' ELSE 'pending' END,
+			error = CASE WHEN attempts >= $2 THEN 'export was interrupted too often' ELSE error END,
+			completed_at = CASE WHEN attempts >= $2 THEN now() END,
+			heartbeat_at = NULL
+		WHERE status = 'running' AND COALESCE(heartbeat_at, created_at) < now() - $1 * interval '1 second'
+		RETURNING id, status
+	`, exportStaleAfter.Seconds(), exportMaxAttempts)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, status string
+		if err := rows.Scan(&id, &status); err != nil {
+			return err
+		}
+		log.Warn().Str("export", id).Str("status", status).Msg("Recovered interrupted export")
+	}
+	return rows.Err()
+}
+
+// heartbeat refreshes the heartbeat of a running export until the returned function is called
+func (j exportJob) heartbeat(ctx context.Context, id string) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(exportHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := db.ExecContext(ctx, `UPDATE chat_history_exports SET heartbeat_at = now() WHERE id = $1 AND status = 'running'`, id); err != nil && ctx.Err() == nil {
+					log.Err(err).Str("export", id).Msg("Failed to refresh export heartbeat")
+				}
+			}
+		}
+	}()
+	return cancel
+}
+
+// write produces the export file and stores it once complete, so a download never sees a partial
+// file. Exports queued while encryption was configured are sealed with the artifact key.
+func (j exportJob) write(ctx context.Context, export Export) (rows int64, size int64, err error) {
+	query, err := url.ParseQuery(export.Query)
+	if err != nil {
+		return 0, 0, err
+	}
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		return 0, 0, err
+	}
+	ctx = withRegion(ctx, query.Get("region"))
+	if err := checkRegion(contextRegion(ctx)); err != nil {
+		return 0, 0, err
+	}
+
+	// The listing writers abort a started response by panicking, which here just fails the export
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			err = errors.New("failed to encode export")
+		}
+	}()
+
+	var total int
+	var countArgs queryArgs
+	countQuery := `SELECT COUNT(*) FROM n8n_chat_histories ` + filter.whereClause(&countArgs)
+	if err := db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+		return 0, 0, err
+	}
+	if export.Encrypted && artifactKeys == nil {
+		return 0, 0, errors.New("export must be encrypted but ARTIFACT_ENCRYPTION_KEY is not set")
+	}
+
+	size, err = writeBlob(ctx, artifactStore, exportKey(export), func(file io.Writer) error {
+		rows, err = j.encode(ctx, file, export, filter, total)
+		return err
+	})
+	return rows, size, err
+}
+
+// encode writes the chats matching filter to file in the format of the export
+func (j exportJob) encode(ctx context.Context, file io.Writer, export Export, filter ChatFilter, total int) (rows int64, err error) {
+	output := &exportResponseWriter{w: file, header: http.Header{}}
+	var encrypter *encryptingWriter
+	if export.Encrypted {
+		if encrypter, err = newEncryptingWriter(ctx, file, artifactKeys); err != nil {
+			return 0, err
+		}
+		output.w = encrypter
+	}
+
+	listing := newListingWriter(output, export.Format, "simple", nil)
+	listing.begin(PaginationResponse{Page: 1, PageSize: total, Total: total, TotalPages: 1, GroupBy: "simple"})
+
+	var args queryArgs
+	err = queryChats(ctx, `
+		SELECT `+chatColumns()+`
+		FROM n8n_chat_histories
+		`+filter.whereClause(&args)+`
+		ORDER BY id ASC
+	`, args, func(chat Chat) error {
+		listing.chat(chat)
+		rows++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	listing.finish()
+	if output.err != nil {
+		return 0, output.err
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return rows, nil
+}
+
+// cleanup deletes expired exports along with their files
+func (j exportJob) cleanup(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+		DELETE FROM chat_history_exports
+		WHERE expires_at < now() OR (status = 'failed' AND completed_at < now() - $1 * interval '1 second')
+		RETURNING id, format, encrypted
+	`, j.retention.Seconds())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var export Export
+		if err := rows.Scan(&export.ID, &export.Format, &export.Encrypted); err != nil {
+			return err
+		}
+		if err := artifactStore.Delete(ctx, exportKey(export)); err != nil {
+			log.Err(err).Str("export", export.ID).Msg("Failed to remove expired export file")
+		}
+	}
+	return rows.Err()
+}
+
+// exportResponseWriter lets the listing writers write an export file
+type exportResponseWriter struct {
+	w      io.Writer
+	header http.Header
+	err    error
+}
+
+func (w *exportResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *exportResponseWriter) WriteHeader(int) {}
+
+func (w *exportResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FacetValue is a distinct value of a metadata field with the number of messages and sessions using it
+type FacetValue struct {
+	Value    string `json:"value"`
+	Count    int    `json:"count"`
+	Sessions int    `json:"sessions"`
+}
+
+// FacetResponse lists the distinct values found for a metadata field
+type FacetResponse struct {
+	Field  string       `json:"field"`
+	Values []FacetValue `json:"values"`
+}
+
+func GetFacetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	field := query.Get("field")
+	path, err := parseJSONPath(field)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if overlapsRedactedPath(path) {
+		respondWithError(w, "field covers a redacted path", http.StatusBadRequest)
+		return
+	}
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 500 {
+		limit = 100
+	}
+
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args queryArgs
+	valueExpr := "message #>> " + args.add(path)
+	conditions := append(filter.conditions(&args), valueExpr+" IS NOT NULL")
+
+	facetsQuery := fmt.Sprintf(`
+		SELECT %s AS value, COUNT(*) AS count, COUNT(DISTINCT session_id) AS sessions
+		FROM n8n_chat_histories
+		WHERE %s
+		GROUP BY 1
+		ORDER BY count DESC, value
+		LIMIT %s
+	`, valueExpr, strings.Join(conditions, " AND "), args.add(limit))
+
+	rows, err := db.QueryContext(r.Context(), facetsQuery, args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query facets")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	response := FacetResponse{Field: field, Values: []FacetValue{}}
+	for rows.Next() {
+		var value FacetValue
+		if err := rows.Scan(&value.Value, &value.Count, &value.Sessions); err != nil {
+			log.Err(err).Msg("Failed to scan facet row")
+			respondWithQueryError(w, err)
+			return
+		}
+		response.Values = append(response.Values, value)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate facet rows")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: response})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Feedback is a rating left by an end user or reviewer on a session or a single message
+type Feedback struct {
+	ID        int       `json:"id"`
+	SessionID string    `json:"sessionId"`
+	MessageID *int      `json:"messageId,omitempty"`
+	Rating    string    `json:"rating"` // positive or negative
+	Reason    string    `json:"reason,omitempty"`
+	Source    string    `json:"source"` // user or reviewer
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// validFeedbackRatings lists the accepted values for Feedback.Rating
+var validFeedbackRatings = map[string]bool{"positive": true, "negative": true}
+
+func CreateFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	var feedback Feedback
+	if !decodeJSONBody(w, r, &feedback) {
+		return
+	}
+
+	feedback.SessionID = strings.TrimSpace(feedback.SessionID)
+	if feedback.SessionID == "" {
+		respondWithError(w, "sessionId is required", http.StatusBadRequest)
+		return
+	}
+	if !validFeedbackRatings[feedback.Rating] {
+		respondWithError(w, "rating must be positive or negative", http.StatusBadRequest)
+		return
+	}
+	if feedback.Source == "" {
+		feedback.Source = "user"
+	}
+	if feedback.Source != "user" && feedback.Source != "reviewer" {
+		respondWithError(w, "source must be user or reviewer", http.StatusBadRequest)
+		return
+	}
+
+	// The target must exist, and a message must belong to the given session
+	var exists bool
+	var err error
+	if feedback.MessageID != nil {
+		err = db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM n8n_chat_histories WHERE id = $1 AND session_id = $2)`,
+			*feedback.MessageID, feedback.SessionID).Scan(&exists)
+	} else {
+		err = db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM n8n_chat_histories WHERE session_id = $1)`,
+			feedback.SessionID).Scan(&exists)
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to check feedback target")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !exists {
+		respondWithError(w, "Session or message not found", http.StatusNotFound)
+		return
+	}
+
+	err = db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_feedback (session_id, message_id, rating, reason, source)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, feedback.SessionID, feedback.MessageID, feedback.Rating, feedback.Reason, feedback.Source).Scan(&feedback.ID, &feedback.CreatedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to insert feedback")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSONStatus(w, DataResponse{Data: feedback}, http.StatusCreated)
+}
+
+func GetFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var args queryArgs
+	var conditions []string
+	if sessionID := query.Get("sessionId"); sessionID != "" {
+		conditions = append(conditions, "session_id = "+args.add(sessionID))
+	}
+	if messageID := query.Get("messageId"); messageID != "" {
+		conditions = append(conditions, "message_id::text = "+args.add(messageID))
+	}
+	if rating := query.Get("rating"); rating != "" {
+		conditions = append(conditions, "rating = "+args.add(rating))
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, session_id, message_id, rating, reason, source, created_at
+		FROM chat_history_feedback
+		`+joinWhere(conditions)+`
+		ORDER BY id DESC
+		LIMIT 500
+	`, args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query feedback")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	feedbacks := []Feedback{}
+	for rows.Next() {
+		var feedback Feedback
+		var messageID sql.NullInt64
+		if err := rows.Scan(&feedback.ID, &feedback.SessionID, &messageID, &feedback.Rating,
+			&feedback.Reason, &feedback.Source, &feedback.CreatedAt); err != nil {
+			log.Err(err).Msg("Failed to scan feedback row")
+			respondWithQueryError(w, err)
+			return
+		}
+		if messageID.Valid {
+			id := int(messageID.Int64)
+			feedback.MessageID = &id
+		}
+		feedbacks = append(feedbacks, feedback)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate feedback rows")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: feedbacks})
+}
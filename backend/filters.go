@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ChatFilter holds the optional filters that can be applied to chat listings
+type ChatFilter struct {
+	SessionID   string
+	Search      string
+	MinMessages int
+	MaxMessages int
+
+	HasToolCalls        bool
+	HasInvalidToolCalls bool
+
+	Metadata []MetadataFilter
+	Fields   []FieldFilter
+	Workflow string
+	Channel  string
+	EndUser  string
+	Feedback string
+	Tag      string
+	Language string
+	Policy   string
+	Review   string
+	Assignee string
+	Team     string
+	Archived string
+
+	// PlainSearch matches Search without SEARCH_UNACCENT, whose function only exists in the
+	// history database
+	PlainSearch bool
+}
+
+// MetadataFilter matches messages whose JSONB value at Path equals Value
+type MetadataFilter struct {
+	Path  []string
+	Value string
+}
+
+// queryArgs collects positional query arguments and hands out their placeholders
+type queryArgs []interface{}
+
+// add appends a value to the argument list and returns its placeholder (e.g. "$3")
+func (a *queryArgs) add(value interface{}) string {
+	*a = append(*a, value)
+	return fmt.Sprintf("$%d", len(*a))
+}
+
+// parseMessageBound reads a message count bound, 0 when it is not set
+func parseMessageBound(query url.Values, name string) (int, error) {
+	raw := query.Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return value, nil
+}
+
+// parseChatFilter reads the filter parameters from the request query string
+func parseChatFilter(query url.Values) (ChatFilter, error) {
+	filter := ChatFilter{
+		SessionID: strings.TrimSpace(query.Get("sessionId")),
+		Search:    strings.TrimSpace(query.Get("search")),
+	}
+
+	if utf8.RuneCountInString(filter.Search) > limits.MaxSearchLength {
+		return filter, fmt.Errorf("search must be at most %d characters", limits.MaxSearchLength)
+	}
+
+	var err error
+	if filter.MinMessages, err = parseMessageBound(query, "minMessages"); err != nil {
+		return filter, err
+	}
+	if filter.MaxMessages, err = parseMessageBound(query, "maxMessages"); err != nil {
+		return filter, err
+	}
+	if filter.MaxMessages > 0 && filter.MinMessages > filter.MaxMessages {
+		return filter, errors.New("minMessages must not be greater than maxMessages")
+	}
+
+	filter.HasToolCalls = query.Get("hasToolCalls") == "true"
+	filter.HasInvalidToolCalls = query.Get("hasInvalidToolCalls") == "true"
+
+	filter.Workflow = strings.TrimSpace(query.Get("workflow"))
+	if filter.Workflow != "" && !workflowConfig.enabled() {
+		return filter, errors.New("workflow filter is not configured")
+	}
+
+	filter.Channel = strings.TrimSpace(query.Get("channel"))
+	if filter.Channel != "" && !channelConfig.enabled() {
+		return filter, errors.New("channel filter is not configured")
+	}
+
+	filter.EndUser = strings.TrimSpace(query.Get("endUser"))
+	if filter.EndUser != "" && !endUserConfig.enabled() {
+		return filter, errors.New("endUser filter is not configured")
+	}
+
+	filter.Feedback = query.Get("feedback")
+	if filter.Feedback != "" && !validFeedbackRatings[filter.Feedback] {
+		return filter, errors.New("feedback must be positive or negative")
+	}
+
+	if tags := normalizeTags([]string{query.Get("tag")}); len(tags) > 0 {
+		filter.Tag = tags[0]
+	}
+
+	filter.Review = query.Get("review")
+	if filter.Review != "" && !validReviewStatuses[filter.Review] {
+		return filter, errors.New("review must be unreviewed, in_review or done")
+	}
+	filter.Assignee = strings.TrimSpace(query.Get("assignee"))
+	filter.Team = strings.TrimSpace(query.Get("team"))
+
+	filter.Archived = query.Get("archived")
+	if filter.Archived != "" && !validArchivedFilters[filter.Archived] {
+		return filter, errors.New("archived must be true, false or all")
+	}
+
+	filter.Language = strings.ToLower(strings.TrimSpace(query.Get("lang")))
+	if filter.Language != "" && !validLanguage(filter.Language) {
+		return filter, fmt.Errorf("lang must be one of %s", strings.Join(supportedLanguages(), ", "))
+	}
+
+	filter.Policy = strings.TrimSpace(query.Get("policy"))
+
+	// Metadata filters use the meta[path.to.key]=value form; keys are sorted to keep queries stable
+	var metaKeys []string
+	for key := range query {
+		if strings.HasPrefix(key, "meta[") && strings.HasSuffix(key, "]") {
+			metaKeys = append(metaKeys, key)
+		}
+	}
+	sort.Strings(metaKeys)
+	for _, key := range metaKeys {
+		path, err := parseJSONPath(strings.TrimSuffix(strings.TrimPrefix(key, "meta["), "]"))
+		if err != nil {
+			return filter, fmt.Errorf("invalid metadata filter %q", key)
+		}
+		if overlapsRedactedPath(path) {
+			return filter, fmt.Errorf("metadata filter %q covers a redacted path", key)
+		}
+		for _, value := range query[key] {
+			filter.Metadata = append(filter.Metadata, MetadataFilter{Path: path, Value: value})
+		}
+	}
+
+	// Mapped column and virtual field filters use the field[name]=value form
+	var fieldKeys []string
+	for key := range query {
+		if strings.HasPrefix(key, "field[") && strings.HasSuffix(key, "]") {
+			fieldKeys = append(fieldKeys, key)
+		}
+	}
+	sort.Strings(fieldKeys)
+	for _, key := range fieldKeys {
+		expr, ok := fieldExpr(strings.TrimSuffix(strings.TrimPrefix(key, "field["), "]"))
+		if !ok {
+			return filter, fmt.Errorf("unknown field filter %q", key)
+		}
+		for _, value := range query[key] {
+			filter.Fields = append(filter.Fields, FieldFilter{Expr: expr, Value: value})
+		}
+	}
+
+	return filter, nil
+}
+
+// whereClause builds the WHERE clause for the filter, registering its values in args.
+// It returns an empty string when no filter is set.
+func (f ChatFilter) whereClause(args *queryArgs) string {
+	return joinWhere(f.conditions(args))
+}
+
+// joinWhere combines conditions into a WHERE clause, or an empty string when there are none
+func joinWhere(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conditions, " AND ")
+}
+
+// conditions returns the individual SQL conditions of the filter, for queries that need to combine them with their own
+func (f ChatFilter) conditions(args *queryArgs) []string {
+	var conditions []string
+
+	if f.SessionID != "" {
+		conditions = append(conditions, "session_id = "+args.add(f.SessionID))
+	}
+
+	if f.Search != "" {
+		conditions = append(conditions, searchCondition(args, f.Search, searchUnaccent && !f.PlainSearch))
+	}
+
+	// Message count limits apply to whole sessions, so they are resolved with a grouped subquery
+	var having []string
+	if f.MinMessages > 0 {
+		having = append(having, "COUNT(*) >= "+args.add(f.MinMessages))
+	}
+	if f.MaxMessages > 0 {
+		having = append(having, "COUNT(*) <= "+args.add(f.MaxMessages))
+	}
+	if len(having) > 0 {
+		conditions = append(conditions, fmt.Sprintf(
+			"session_id IN (SELECT session_id FROM n8n_chat_histories GROUP BY session_id HAVING %s)",
+			strings.Join(having, " AND ")))
+	}
+
+	// Tool call filters also match whole sessions: any message with a non-empty array qualifies
+	if f.HasToolCalls {
+		conditions = append(conditions, sessionHasMessage(`message->'tool_calls' @> '[{}]'::jsonb`))
+	}
+	if f.HasInvalidToolCalls {
+		conditions = append(conditions, sessionHasMessage(`message->'invalid_tool_calls' @> '[{}]'::jsonb`))
+	}
+
+	// Metadata usually sits on AI messages only, so a match selects the whole session
+	for _, meta := range f.Metadata {
+		var alternatives []string
+		for _, document := range meta.documents() {
+			alternatives = append(alternatives, "message @> "+args.add(document)+"::jsonb")
+		}
+		conditions = append(conditions, sessionHasMessage(strings.Join(alternatives, " OR ")))
+	}
+
+	// Fields are compared per message, as deployments fill mapped columns on every row they write
+	for _, field := range f.Fields {
+		conditions = append(conditions, "("+field.Expr+")::text = "+args.add(field.Value))
+	}
+
+	if f.Workflow != "" {
+		conditions = append(conditions, sessionHasMessage(workflowConfig.rowExpr(args)+" = "+args.add(f.Workflow)))
+	}
+
+	if f.Channel != "" {
+		conditions = append(conditions, sessionHasMessage(channelConfig.rowExpr(args)+" = "+args.add(f.Channel)))
+	}
+
+	if f.EndUser != "" {
+		conditions = append(conditions, "session_id IN ("+endUserSessionsQuery(args, f.EndUser)+")")
+	}
+
+	if f.Feedback != "" {
+		conditions = append(conditions, "session_id IN (SELECT session_id FROM chat_history_feedback WHERE rating = "+args.add(f.Feedback)+")")
+	}
+
+	if f.Tag != "" {
+		conditions = append(conditions, "session_id IN (SELECT session_id FROM chat_history_session_tags WHERE tag = "+args.add(f.Tag)+")")
+	}
+
+	// Sessions without a review record are unreviewed
+	if f.Review == "unreviewed" {
+		conditions = append(conditions, "session_id NOT IN (SELECT session_id FROM chat_history_reviews WHERE status <> 'unreviewed')")
+	} else if f.Review != "" {
+		conditions = append(conditions, "session_id IN (SELECT session_id FROM chat_history_reviews WHERE status = "+args.add(f.Review)+")")
+	}
+
+	if f.Assignee != "" {
+		conditions = append(conditions, "session_id IN (SELECT session_id FROM chat_history_reviews WHERE assignee = "+args.add(f.Assignee)+")")
+	}
+
+	if f.Team != "" {
+		conditions = append(conditions, `session_id IN (
+			SELECT r.session_id FROM chat_history_reviews r JOIN chat_history_users u ON u.id = r.assignee WHERE u.team = `+args.add(f.Team)+`)`)
+	}
+
+	if archived := f.archivedCondition(); archived != "" {
+		conditions = append(conditions, archived)
+	}
+
+	if f.Language != "" {
+		conditions = append(conditions, "session_id IN (SELECT session_id FROM chat_history_session_languages WHERE language = "+args.add(f.Language)+")")
+	}
+
+	if f.Policy != "" {
+		conditions = append(conditions, policyFlagCondition(args, f.Policy))
+	}
+
+	return conditions
+}
+
+// archivedCondition returns the condition on the archived state of sessions. Archived sessions are
+// hidden by default, unless a single session is asked for.
+func (f ChatFilter) archivedCondition() string {
+	if f.Archived == "true" {
+		return "session_id IN (SELECT session_id FROM chat_history_archived_sessions)"
+	}
+	if f.Archived == "false" || (f.Archived == "" && f.SessionID == "") {
+		return "session_id NOT IN (SELECT session_id FROM chat_history_archived_sessions)"
+	}
+	return ""
+}
+
+// onlyArchived reports whether the filter sets nothing but the archived state, so that queries
+// over all sessions can be answered from per-session tables with archivedCondition alone
+func (f ChatFilter) onlyArchived() bool {
+	var args queryArgs
+	f.Archived = "all"
+	return f.whereClause(&args) == ""
+}
+
+// documents returns the JSONB documents to test for containment. The value is always matched as a
+// string, and additionally as a JSON literal when it parses as one, so meta[x]=123 matches both "123" and 123.
+func (m MetadataFilter) documents() []string {
+	values := []interface{}{m.Value}
+	var literal interface{}
+	if err := json.Unmarshal([]byte(m.Value), &literal); err == nil {
+		if _, isString := literal.(string); !isString {
+			values = append(values, literal)
+		}
+	}
+
+	var documents []string
+	for _, value := range values {
+		for i := len(m.Path) - 1; i >= 0; i-- {
+			value = map[string]interface{}{m.Path[i]: value}
+		}
+		document, _ := json.Marshal(value)
+		documents = append(documents, string(document))
+	}
+	return documents
+}
+
+// sessionHasMessage returns a condition matching every row of sessions containing a message that satisfies condition
+func sessionHasMessage(condition string) string {
+	return fmt.Sprintf("session_id IN (SELECT session_id FROM n8n_chat_histories WHERE %s)", condition)
+}
+
+// jsonbArray guards a JSONB expression so that only arrays reach functions like jsonb_array_elements
+func jsonbArray(expr string) string {
+	return fmt.Sprintf("(CASE WHEN jsonb_typeof(%s) = 'array' THEN %s END)", expr, expr)
+}
+
+// parseJSONPath splits a dotted JSONB path such as "response_metadata.model" into its keys
+func parseJSONPath(field string) ([]string, error) {
+	if strings.TrimSpace(field) == "" {
+		return nil, errors.New("field is required")
+	}
+
+	path := strings.Split(field, ".")
+	for _, key := range path {
+		if key == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+	}
+	return path, nil
+}
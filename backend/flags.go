@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// featureDefaults lists every feature flag with its default state. Features that only read the
+// n8n table and keep derived state in the service's tables, such as duplicate groups, languages or
+// traffic samples, start enabled. Features that write to the n8n table, hold connections open or
+// copy message content into the service's tables start disabled and are switched on per
+// deployment through FEATURE_FLAGS.
+var featureDefaults = map[string]bool{
+	"compare":    true,
+	"merge":      false,
+	"duplicates": true,
+	"feedback":   true,
+	"tags":       true,
+	"datasets":   true,
+	"sharing":    true,
+	"tail":       false,
+	"exports":    true,
+	"summary":    true,
+	"languages":  true,
+	"anomalies":  true,
+	"alerts":     true,
+	"review":     true,
+	"replays":    false,
+	"secrets":    false,
+	"policy":     false,
+}
+
+// featureFlags holds the resolved state of every flag
+var featureFlags = map[string]bool{}
+
+// loadFeatureFlags applies FEATURE_FLAGS on top of the defaults. The variable is a comma-separated
+// list where "name" or "+name" enables a feature and "-name" disables it.
+func loadFeatureFlags() {
+	for name, enabled := range featureDefaults {
+		featureFlags[name] = enabled
+	}
+
+	for _, entry := range strings.Split(os.Getenv("FEATURE_FLAGS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		enabled := !strings.HasPrefix(entry, "-")
+		name := strings.TrimLeft(entry, "+-")
+		if _, known := featureDefaults[name]; !known {
+			log.Warn().Str("flag", name).Msg("Ignoring unknown feature flag")
+			continue
+		}
+		featureFlags[name] = enabled
+	}
+}
+
+// featureEnabled reports whether the named feature is switched on
+func featureEnabled(name string) bool {
+	return featureFlags[name]
+}
+
+// requireFeature responds with 404 instead of calling next while the feature is disabled
+func requireFeature(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !featureEnabled(name) {
+			respondWithError(w, "Feature "+name+" is disabled", http.StatusNotFound)
+			return
+		}
+		next(w, r)
+	}
+}
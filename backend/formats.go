@@ -0,0 +1,205 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response formats of the chat listing, chosen through the Accept header
+const (
+	formatJSON     = "json"
+	formatProtobuf = "protobuf"
+	formatMsgpack  = "msgpack"
+	formatCSV      = "csv"
+	formatNDJSON   = "ndjson"
+)
+
+// listingMediaTypes maps every accepted media type to its format. The first entry of each format
+// is the Content-Type it is served with.
+var listingMediaTypes = []struct {
+	mediaType string
+	format    string
+}{
+	{"application/json", formatJSON},
+	{"application/x-protobuf", formatProtobuf},
+	{"application/protobuf", formatProtobuf},
+	{"application/vnd.msgpack", formatMsgpack},
+	{"application/msgpack", formatMsgpack},
+	{"application/x-msgpack", formatMsgpack},
+	{"text/csv", formatCSV},
+	{"application/x-ndjson", formatNDJSON},
+	{"application/jsonl", formatNDJSON},
+}
+
+// listingContentType returns the Content-Type a format is served with
+func listingContentType(format string) string {
+	for _, entry := range listingMediaTypes {
+		if entry.format == format {
+			return entry.mediaType
+		}
+	}
+	return "application/json"
+}
+
+// listingContentTypes lists the Content-Type of every format, for error messages
+func listingContentTypes() []string {
+	var types []string
+	seen := map[string]bool{}
+	for _, entry := range listingMediaTypes {
+		if !seen[entry.format] {
+			seen[entry.format] = true
+			types = append(types, entry.mediaType)
+		}
+	}
+	return types
+}
+
+// negotiateListingFormat picks the format with the highest quality in the Accept header, preferring
+// earlier entries on ties. Wildcards and a missing header select JSON; ok is false when nothing matches.
+func negotiateListingFormat(accept string) (format string, ok bool) {
+	if strings.TrimSpace(accept) == "" {
+		return formatJSON, true
+	}
+
+	type candidate struct {
+		format  string
+		quality float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		if mediaType == "*/*" || mediaType == "application/*" {
+			candidates = append(candidates, candidate{formatJSON, quality})
+			continue
+		}
+		for _, entry := range listingMediaTypes {
+			if entry.mediaType == mediaType {
+				candidates = append(candidates, candidate{entry.format, quality})
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+	return candidates[0].format, true
+}
+
+// newListingWriter returns the writer for a negotiated format. plans is only set in debug mode,
+// which is limited to JSON.
+func newListingWriter(w http.ResponseWriter, format, groupBy string, plans *queryPlans) listingWriter {
+	switch format {
+	case formatProtobuf:
+		return newProtobufListing(w, groupBy)
+	case formatMsgpack:
+		return newMsgpackListing(w, groupBy)
+	case formatCSV:
+		return newCSVListing(w)
+	case formatNDJSON:
+		return newNDJSONListing(w)
+	default:
+		return newJSONListing(w, groupBy, plans)
+	}
+}
+
+// msgpackListing encodes the same document as the JSON listing. MessagePack prefixes arrays and
+// maps with their length, so the page is collected before it is written.
+type msgpackListing struct {
+	*responseStream
+	groupBy    string
+	pagination PaginationResponse
+	chats      []interface{}
+	sessions   msgpackObject
+	messages   []interface{} // messages of the last session
+	details    map[string]SessionDetails
+}
+
+func newMsgpackListing(w http.ResponseWriter, groupBy string) *msgpackListing {
+	return &msgpackListing{
+		responseStream: newResponseStream(w, listingContentType(formatMsgpack)),
+		groupBy:        groupBy,
+		chats:          []interface{}{},
+		sessions:       msgpackObject{},
+	}
+}
+
+func (l *msgpackListing) begin(pagination PaginationResponse) {
+	l.pagination = pagination
+}
+
+func (l *msgpackListing) chat(chat Chat) {
+	object := msgpackObject{
+		{"id", chat.ID},
+		{"sessionId", chat.SessionID},
+		{"message", msgpackMessage(chat.Message)},
+	}
+	if len(chat.Fields) > 0 {
+		object = append(object, msgpackField{"fields", chat.Fields})
+	}
+	l.chats = append(l.chats, object)
+}
+
+func (l *msgpackListing) sessionDetails(details map[string]SessionDetails) {
+	l.details = details
+}
+
+func (l *msgpackListing) sessionMessage(chat Chat) {
+	if n := len(l.sessions); n == 0 || l.sessions[n-1].key != chat.SessionID {
+		l.sessions = append(l.sessions, msgpackField{key: chat.SessionID})
+		l.messages = []interface{}{}
+	}
+	l.messages = append(l.messages, msgpackMessage(chat.Message))
+	details := l.details[chat.SessionID]
+	pinned := []interface{}{}
+	for _, pin := range details.Pinned {
+		pinned = append(pinned, msgpackObject{
+			{"messageId", pin.MessageID},
+			{"index", pin.Index},
+			{"pinnedBy", pin.PinnedBy},
+			{"pinnedAt", pin.PinnedAt.Format(time.RFC3339Nano)},
+		})
+	}
+	session := msgpackObject{{"sessionId", chat.SessionID}, {"pinned", pinned}}
+	if details.Omitted > 0 {
+		session = append(session, msgpackField{"omittedMessages", details.Omitted})
+	}
+	l.sessions[len(l.sessions)-1].value = append(session, msgpackField{"messages", l.messages})
+}
+
+func (l *msgpackListing) truncate(cursor string) {
+	l.pagination.Partial, l.pagination.Cursor = true, cursor
+}
+
+func (l *msgpackListing) finish() {
+	var data interface{} = l.chats
+	if l.groupBy == "session" {
+		data = l.sessions
+	}
+
+	encoded, err := appendMsgpack(nil, msgpackObject{{"data", data}, {"pagination", msgpackPagination(l.pagination)}})
+	if err != nil {
+		l.fail(err, "Failed to encode MessagePack response")
+		return
+	}
+	l.write(encoded)
+	l.flush()
+}
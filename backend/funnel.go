@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FunnelOutcome is a configured outcome bucket. A session matches when every condition that is
+// set holds: a message containing Contains (case-insensitive, limited to messages of type Role
+// when set), a successful call of Tool without a failed one, and a last message of type LastMessage.
+type FunnelOutcome struct {
+	Name        string `json:"name"`
+	Contains    string `json:"contains,omitempty"`
+	Role        string `json:"role,omitempty"`
+	Tool        string `json:"tool,omitempty"`
+	LastMessage string `json:"lastMessage,omitempty"`
+	// Contained marks outcomes resolved by the bot, which add up to the containment rate
+	Contained bool `json:"contained,omitempty"`
+}
+
+// FunnelStage reports one outcome of the funnel. Sessions counts the sessions classified into the
+// outcome, being the first in order they match; Matching counts every session it matches.
+type FunnelStage struct {
+	Name      string  `json:"name"`
+	Contained bool    `json:"contained"`
+	Sessions  int     `json:"sessions"`
+	Matching  int     `json:"matching"`
+	Ratio     float64 `json:"ratio"`
+}
+
+// FunnelResponse is the response of the funnel endpoint
+type FunnelResponse struct {
+	Total        int           `json:"total"`
+	Stages       []FunnelStage `json:"stages"`
+	Unclassified int           `json:"unclassified"`
+	Containment  float64       `json:"containment"`
+}
+
+var funnelOutcomes []FunnelOutcome
+
+// loadFunnelConfig reads FUNNEL_OUTCOMES, a JSON array of outcomes in classification order
+func loadFunnelConfig() error {
+	value := strings.TrimSpace(os.Getenv("FUNNEL_OUTCOMES"))
+	if value == "" {
+		return nil
+	}
+
+	var outcomes []FunnelOutcome
+	if err := json.Unmarshal([]byte(value), &outcomes); err != nil {
+		return fmt.Errorf("FUNNEL_OUTCOMES: %w", err)
+	}
+	names := make(map[string]bool)
+	for _, outcome := range outcomes {
+		if outcome.Name == "" || names[outcome.Name] {
+			return errors.New("FUNNEL_OUTCOMES: every outcome needs a unique name")
+		}
+		names[outcome.Name] = true
+		if outcome.Contains == "" && outcome.Tool == "" && outcome.LastMessage == "" {
+			return fmt.Errorf("FUNNEL_OUTCOMES: outcome %q has no condition", outcome.Name)
+		}
+		if outcome.Role != "" && outcome.Contains == "" {
+			return fmt.Errorf("FUNNEL_OUTCOMES: outcome %q sets role without contains", outcome.Name)
+		}
+	}
+	funnelOutcomes = outcomes
+	return nil
+}
+
+// sessionCondition returns an aggregate expression over the rows of a session that holds when
+// the session matches the outcome
+func (o FunnelOutcome) sessionCondition(args *queryArgs) string {
+	var conditions []string
+	if o.Contains != "" {
+		match := "message->>'content' ILIKE " + args.add("%"+escapeLike(o.Contains)+"%")
+		if o.Role != "" {
+			match += " AND message->>'type' = " + args.add(o.Role)
+		}
+		conditions = append(conditions, "bool_or("+match+")")
+	}
+	if o.Tool != "" {
+		call, _ := json.Marshal([]map[string]string{{"name": o.Tool}})
+		placeholder := args.add(string(call))
+		conditions = append(conditions,
+			"bool_or(message->'tool_calls' @> "+placeholder+"::jsonb)",
+			"NOT COALESCE(bool_or(message->'invalid_tool_calls' @> "+placeholder+"::jsonb), false)")
+	}
+	if o.LastMessage != "" {
+		conditions = append(conditions, "(array_agg(message->>'type' ORDER BY id DESC))[1] = "+args.add(o.LastMessage))
+	}
+	return "COALESCE(" + strings.Join(conditions, " AND ") + ", false)"
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// GetFunnelHandler classifies the sessions matching the filters into the configured outcomes
+func GetFunnelHandler(w http.ResponseWriter, r *http.Request) {
+	if len(funnelOutcomes) == 0 {
+		respondWithError(w, "Funnel outcomes are not configured", http.StatusNotFound)
+		return
+	}
+
+	filter, err := parseChatFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Every session gets one row of match flags, which are counted both per outcome and by the
+	// first outcome matched
+	var args queryArgs
+	whereClause := filter.whereClause(&args)
+	var flags, matching, classification []string
+	for i, outcome := range funnelOutcomes {
+		flags = append(flags, fmt.Sprintf("%s AS o%d", outcome.sessionCondition(&args), i))
+		matching = append(matching, fmt.Sprintf("COUNT(*) FILTER (WHERE o%d)", i))
+		classification = append(classification, fmt.Sprintf("COUNT(*) FILTER (WHERE o%d%s)", i, notMatchedBefore(i)))
+	}
+
+	funnelQuery := fmt.Sprintf(`
+		WITH sessions AS (
+			SELECT session_id, %s
+			FROM n8n_chat_histories
+			%s
+			GROUP BY session_id
+		)
+		SELECT COUNT(*), %s, %s FROM sessions
+	`, strings.Join(flags, ", "), whereClause, strings.Join(matching, ", "), strings.Join(classification, ", "))
+
+	counts := make([]int, 1+2*len(funnelOutcomes))
+	targets := make([]interface{}, len(counts))
+	for i := range counts {
+		targets[i] = &counts[i]
+	}
+	if err := db.QueryRowContext(r.Context(), funnelQuery, args...).Scan(targets...); err != nil {
+		log.Err(err).Msg("Failed to query funnel")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	response := FunnelResponse{Total: counts[0], Stages: []FunnelStage{}, Unclassified: counts[0]}
+	contained := 0
+	for i, outcome := range funnelOutcomes {
+		stage := FunnelStage{
+			Name:      outcome.Name,
+			Contained: outcome.Contained,
+			Matching:  counts[1+i],
+			Sessions:  counts[1+len(funnelOutcomes)+i],
+		}
+		if response.Total > 0 {
+			stage.Ratio = float64(stage.Sessions) / float64(response.Total)
+		}
+		if outcome.Contained {
+			contained += stage.Sessions
+		}
+		response.Unclassified -= stage.Sessions
+		response.Stages = append(response.Stages, stage)
+	}
+	if response.Total > 0 {
+		response.Containment = float64(contained) / float64(response.Total)
+	}
+
+	respondWithJSON(w, DataResponse{Data: response})
+}
+
+// notMatchedBefore returns the condition excluding sessions classified into an earlier outcome
+func notMatchedBefore(index int) string {
+	var condition string
+	for i := 0; i < index; i++ {
+		condition += fmt.Sprintf(" AND NOT o%d", i)
+	}
+	return condition
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// messageTimestampPath is the JSONB path inside the message holding when it was sent, set by
+// MESSAGE_TIMESTAMP_PATH. n8n stores no timestamps itself, so workflows have to add one.
+var messageTimestampPath []string
+
+// loadTimestampConfig reads MESSAGE_TIMESTAMP_PATH, e.g. additional_kwargs.timestamp
+func loadTimestampConfig() error {
+	field := os.Getenv("MESSAGE_TIMESTAMP_PATH")
+	if field == "" {
+		return nil
+	}
+	path, err := parseJSONPath(field)
+	if err != nil {
+		return fmt.Errorf("MESSAGE_TIMESTAMP_PATH: %w", err)
+	}
+	messageTimestampPath = path
+	return nil
+}
+
+// messageTimestampExpr returns the SQL expression reading the timestamp of a message, NULL when
+// it is missing or not understood. ISO 8601 strings and Unix times in seconds or milliseconds are
+// accepted; the guards keep a malformed value from failing the whole query.
+func messageTimestampExpr(column string, args *queryArgs) string {
+	value := column + " #>> " + args.add(messageTimestampPath)
+	return fmt.Sprintf(`(CASE
+		WHEN %[1]s ~ '^\d{4}-\d{2}-\d{2}([T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?)?(Z|[+-]\d{2}(:?\d{2})?)?$' THEN (%[1]s)::timestamptz
+		WHEN %[1]s ~ '^\d{13}$' THEN to_timestamp((%[1]s)::bigint / 1000.0)
+		WHEN %[1]s ~ '^\d{10}$' THEN to_timestamp((%[1]s)::bigint)
+	END)`, value)
+}
+
+// Heatmap holds message counts by weekday and hour. Counts[0] is Sunday, each row holding the 24
+// hours of the day in the requested timezone.
+type Heatmap struct {
+	Timezone string     `json:"timezone"`
+	Source   string     `json:"source"`
+	Counts   [7][24]int `json:"counts"`
+	Total    int        `json:"total"`
+	Max      int        `json:"max"`
+}
+
+// GetHeatmapHandler counts messages by weekday and hour. Messages are placed by the timestamp at
+// MESSAGE_TIMESTAMP_PATH; without one, the traffic samples of the anomaly detector place them by
+// when they were first seen, which leaves filters unsupported.
+func GetHeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	location, err := parseTimezone(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseTimeRange(query, location)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	heatmap := Heatmap{Timezone: location.String()}
+	var args queryArgs
+	var source string
+	var conditions []string
+	if len(messageTimestampPath) > 0 {
+		heatmap.Source = "messages"
+		source = fmt.Sprintf(`(SELECT %s AS ts, 1 AS messages FROM n8n_chat_histories %s) AS timed`,
+			messageTimestampExpr("message", &args), filter.whereClause(&args))
+		conditions = append(conditions, "ts IS NOT NULL")
+	} else {
+		if len(filter.conditions(&queryArgs{})) > 0 {
+			respondWithError(w, "Filters need MESSAGE_TIMESTAMP_PATH", http.StatusBadRequest)
+			return
+		}
+		heatmap.Source = "samples"
+		source = `(SELECT sampled_at AS ts, messages FROM chat_history_traffic_samples) AS timed`
+	}
+	if from != nil {
+		conditions = append(conditions, "ts >= "+args.add(*from))
+	}
+	if to != nil {
+		conditions = append(conditions, "ts < "+args.add(*to))
+	}
+
+	tz := args.add(location.String())
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT EXTRACT(DOW FROM ts AT TIME ZONE %[1]s)::int, EXTRACT(HOUR FROM ts AT TIME ZONE %[1]s)::int, SUM(messages)
+		FROM %[2]s
+		%[3]s
+		GROUP BY 1, 2
+	`, tz, source, joinWhere(conditions)), args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query heatmap")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var weekday, hour, count int
+		if err := rows.Scan(&weekday, &hour, &count); err != nil {
+			log.Err(err).Msg("Failed to scan heatmap cell")
+			respondWithQueryError(w, err)
+			return
+		}
+		heatmap.Counts[weekday][hour] = count
+		heatmap.Total += count
+		heatmap.Max = max(heatmap.Max, count)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate heatmap cells")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: heatmap})
+}
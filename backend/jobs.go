@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// startWorker runs fn immediately and then every interval in the background until ctx is done.
+// Failures are logged and retried on the next tick. Runs are coordinated through a lock in the
+// shared state store, so with several replicas a worker runs about once per interval overall.
+func startWorker(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			runWorker(ctx, name, interval, fn)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	log.Info().Str("worker", name).Dur("interval", interval).Msg("Worker started")
+}
+
+// runWorker performs a single locked run of a worker. A successful run keeps the lock until it
+// expires, shortly before the next tick, so other replicas skip their runs in between.
+func runWorker(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	if !leader.isLeader() {
+		return
+	}
+
+	unlock, acquired, err := sharedState.TryLock(ctx, "lock:worker:"+name, interval*9/10)
+	if err != nil {
+		log.Err(err).Str("worker", name).Msg("Failed to acquire worker lock")
+		return
+	}
+	if !acquired {
+		log.Debug().Str("worker", name).Msg("Worker run skipped, another instance holds the lock")
+		return
+	}
+
+	started := time.Now()
+	err = fn(ctx)
+	recordWorkerRun(name, time.Since(started), err)
+	if err != nil {
+		unlock()
+		log.Err(err).Str("worker", name).Msg("Worker run failed")
+	} else {
+		log.Info().Str("worker", name).Dur("duration", time.Since(started)).Msg("Worker run completed")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// languageCheckpoint names the progress of the language worker in the checkpoint table
+	languageCheckpoint = "session-languages"
+	// languageProfileSize is the number of ranked trigrams kept per language and per text
+	languageProfileSize = 300
+	// undeterminedLanguage is stored for sessions with too little text to tell
+	undeterminedLanguage = "und"
+	// minLanguageTrigrams is the number of distinct trigrams a text needs to be classified
+	minLanguageTrigrams = 20
+)
+
+// languageSamples are short texts in the style of chat transcripts from which the trigram profile
+// of every supported language is built at startup, keyed by ISO 639-1 code
+var languageSamples = map[string]string{
+	"en": `Hello, I would like to check the status of my order. It was supposed to arrive yesterday but
+		I have not received anything yet. Can you tell me where the package is right now? Thank you for
+		your help. What is the best way to change my password? I forgot it and the reset email never
+		came. Please let me know if there is anything else you need from me. The product works well
+		but the battery does not last very long. How much does the premium plan cost per month and
+		which features are included? I want to cancel my subscription and get a refund for this month.`,
+	"id": `Halo, saya ingin menanyakan status pesanan saya. Seharusnya sudah sampai kemarin tetapi sampai
+		sekarang belum saya terima. Bisakah kamu memberi tahu di mana paket saya sekarang? Terima kasih
+		atas bantuannya. Bagaimana cara mengganti kata sandi saya? Saya lupa dan email untuk mengatur
+		ulang tidak pernah datang. Tolong beri tahu jika ada hal lain yang dibutuhkan dari saya. Produk
+		ini berfungsi dengan baik tetapi baterainya tidak tahan lama. Berapa biaya paket premium per
+		bulan dan fitur apa saja yang termasuk? Saya mau membatalkan langganan dan meminta pengembalian dana.`,
+	"es": `Hola, me gustaría consultar el estado de mi pedido. Tenía que llegar ayer pero todavía no he
+		recibido nada. ¿Puede decirme dónde está el paquete ahora mismo? Gracias por su ayuda. ¿Cuál es
+		la mejor manera de cambiar mi contraseña? La olvidé y el correo para restablecerla nunca llegó.
+		Por favor, avíseme si necesita algo más de mi parte. El producto funciona bien pero la batería no
+		dura mucho tiempo. ¿Cuánto cuesta el plan premium al mes y qué funciones incluye? Quiero cancelar
+		mi suscripción y recibir un reembolso de este mes.`,
+	"pt": `Olá, gostaria de verificar o estado da minha encomenda. Devia ter chegado ontem mas ainda não
+		recebi nada. Pode dizer-me onde está o pacote neste momento? Obrigado pela sua ajuda. Qual é a
+		melhor forma de mudar a minha senha? Esqueci-me dela e o e-mail de recuperação nunca chegou. Por
+		favor, avise-me se precisar de mais alguma coisa da minha parte. O produto funciona bem mas a
+		bateria não dura muito tempo. Quanto custa o plano premium por mês e quais são as funções
+		incluídas? Quero cancelar a minha assinatura e receber o reembolso deste mês.`,
+	"fr": `Bonjour, je voudrais connaître le statut de ma commande. Elle devait arriver hier mais je n'ai
+		encore rien reçu. Pouvez-vous me dire où se trouve le colis en ce moment? Merci pour votre aide.
+		Quelle est la meilleure façon de changer mon mot de passe? Je l'ai oublié et le courriel de
+		réinitialisation n'est jamais arrivé. Dites-moi s'il vous faut autre chose de ma part. Le produit
+		fonctionne bien mais la batterie ne dure pas très longtemps. Combien coûte l'offre premium par
+		mois et quelles fonctionnalités sont incluses? Je veux annuler mon abonnement et être remboursé.`,
+	"de": `Hallo, ich möchte den Status meiner Bestellung prüfen. Sie sollte gestern ankommen, aber ich
+		habe noch nichts erhalten. Können Sie mir sagen, wo sich das Paket gerade befindet? Vielen Dank
+		für Ihre Hilfe. Wie kann ich am besten mein Passwort ändern? Ich habe es vergessen und die E-Mail
+		zum Zurücksetzen ist nie angekommen. Bitte sagen Sie mir, wenn Sie noch etwas von mir brauchen.
+		Das Produkt funktioniert gut, aber der Akku hält nicht sehr lange. Wie viel kostet der Premium
+		Tarif pro Monat und welche Funktionen sind enthalten? Ich will mein Abonnement kündigen.`,
+	"it": `Ciao, vorrei controllare lo stato del mio ordine. Doveva arrivare ieri ma non ho ancora
+		ricevuto niente. Può dirmi dove si trova il pacco in questo momento? Grazie per il suo aiuto.
+		Qual è il modo migliore per cambiare la mia password? L'ho dimenticata e l'email per reimpostarla
+		non è mai arrivata. Mi faccia sapere se ha bisogno di qualcos'altro da parte mia. Il prodotto
+		funziona bene ma la batteria non dura molto. Quanto costa il piano premium al mese e quali
+		funzioni sono incluse? Voglio annullare il mio abbonamento e ricevere un rimborso per questo mese.`,
+	"nl": `Hallo, ik wil graag de status van mijn bestelling controleren. Die had gisteren moeten komen
+		maar ik heb nog niets ontvangen. Kunt u mij vertellen waar het pakket nu is? Bedankt voor uw
+		hulp. Wat is de beste manier om mijn wachtwoord te wijzigen? Ik ben het vergeten en de e-mail om
+		het te herstellen is nooit gekomen. Laat het mij weten als u nog iets van mij nodig heeft. Het
+		product werkt goed maar de batterij gaat niet lang mee. Hoeveel kost het premium abonnement per
+		maand en welke functies zijn inbegrepen? Ik wil mijn abonnement opzeggen en mijn geld terug.`,
+}
+
+// languageProfiles maps every supported language to the rank of its most frequent trigrams
+var languageProfiles = buildLanguageProfiles()
+
+func buildLanguageProfiles() map[string]map[string]int {
+	profiles := make(map[string]map[string]int, len(languageSamples))
+	for language, sample := range languageSamples {
+		profiles[language] = trigramProfile(sample)
+	}
+	return profiles
+}
+
+// trigramProfile ranks the character trigrams of text by frequency. Words are lowercased, stripped
+// of digits and punctuation and padded with spaces, so word beginnings and endings count as well.
+func trigramProfile(text string) map[string]int {
+	counts := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		runes := []rune(" " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			counts[string(runes[i:i+3])]++
+		}
+	}
+
+	trigrams := make([]string, 0, len(counts))
+	for trigram := range counts {
+		trigrams = append(trigrams, trigram)
+	}
+	sort.Slice(trigrams, func(i, j int) bool {
+		if counts[trigrams[i]] != counts[trigrams[j]] {
+			return counts[trigrams[i]] > counts[trigrams[j]]
+		}
+		return trigrams[i] < trigrams[j]
+	})
+	if len(trigrams) > languageProfileSize {
+		trigrams = trigrams[:languageProfileSize]
+	}
+
+	profile := make(map[string]int, len(trigrams))
+	for rank, trigram := range trigrams {
+		profile[trigram] = rank
+	}
+	return profile
+}
+
+// detectLanguage returns the language whose profile is closest to text with the out-of-place
+// measure, and a confidence between 0 and 1 from its lead over the runner-up
+func detectLanguage(text string) (string, float64) {
+	profile := trigramProfile(text)
+	if len(profile) < minLanguageTrigrams {
+		return undeterminedLanguage, 0
+	}
+
+	best, bestDistance, secondDistance := undeterminedLanguage, -1, -1
+	for language, reference := range languageProfiles {
+		distance := 0
+		for trigram, rank := range profile {
+			if referenceRank, ok := reference[trigram]; ok {
+				distance += abs(rank - referenceRank)
+			} else {
+				distance += languageProfileSize
+			}
+		}
+		switch {
+		case bestDistance < 0 || distance < bestDistance || (distance == bestDistance && language < best):
+			best, bestDistance, secondDistance = language, distance, bestDistance
+		case secondDistance < 0 || distance < secondDistance:
+			secondDistance = distance
+		}
+	}
+
+	if secondDistance <= 0 {
+		return best, 1
+	}
+	return best, float64(secondDistance-bestDistance) / float64(secondDistance)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// validLanguage reports whether code can be stored by the detector
+func validLanguage(code string) bool {
+	_, supported := languageProfiles[code]
+	return supported || code == undeterminedLanguage
+}
+
+// supportedLanguages lists the codes accepted by ?lang= in alphabetical order
+func supportedLanguages() []string {
+	codes := []string{undeterminedLanguage}
+	for code := range languageProfiles {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// languageJob detects the language of the sessions that received messages since its checkpoint
+type languageJob struct {
+	batchSize int
+	maxChars  int
+}
+
+// newLanguageJob reads LANGUAGE_BATCH_SIZE and LANGUAGE_MAX_CHARS from the environment
+func newLanguageJob() languageJob {
+	job := languageJob{batchSize: 5000, maxChars: 4000}
+	if batchSize, err := strconv.Atoi(os.Getenv("LANGUAGE_BATCH_SIZE")); err == nil && batchSize > 0 {
+		job.batchSize = batchSize
+	}
+	if maxChars, err := strconv.Atoi(os.Getenv("LANGUAGE_MAX_CHARS")); err == nil && maxChars > 0 {
+		job.maxChars = maxChars
+	}
+	return job
+}
+
+// run catches up with the chat table, one batch of rows at a time
+func (j languageJob) run(ctx context.Context) error {
+	for {
+		processed, err := j.detectBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if processed < j.batchSize {
+			return nil
+		}
+	}
+}
+
+// detectBatch classifies the sessions touched by the next batch of chat rows. Only human messages
+// are read, as the replies follow the language of the user or the prompt. Up to maxChars of the
+// earliest text of a session are enough to tell the language of the conversation.
+func (j languageJob) detectBatch(ctx context.Context) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var checkpoint int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT last_id FROM chat_history_publish_checkpoints WHERE publisher = $1 FOR UPDATE
+	`, languageCheckpoint).Scan(&checkpoint); err != nil {
+		return 0, err
+	}
+
+	var lastID int64
+	var processed int
+	var sessionIDs []string
+	if err := tx.QueryRowContext(ctx, `
+		WITH batch AS (
+			SELECT id, session_id FROM n8n_chat_histories WHERE id > $1 ORDER BY id LIMIT $2
+		)
+		SELECT COALESCE(MAX(id), $1), COUNT(*), COALESCE(array_agg(DISTINCT session_id), '{}') FROM batch
+	`, checkpoint, j.batchSize).Scan(&lastID, &processed, pgArray(&sessionIDs)); err != nil {
+		return 0, err
+	}
+	if processed == 0 {
+		return 0, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT session_id, left(string_agg(message->>'content', ' ' ORDER BY id), $2)
+		FROM n8n_chat_histories
+		WHERE session_id = ANY($1) AND message->>'type' = 'human'
+		GROUP BY session_id
+	`, sessionIDs, j.maxChars)
+	if err != nil {
+		return 0, err
+	}
+	texts := make(map[string]string)
+	for rows.Next() {
+		var sessionID string
+		var text *string
+		if err := rows.Scan(&sessionID, &text); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if text != nil {
+			texts[sessionID] = *text
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for sessionID, text := range texts {
+		language, confidence := detectLanguage(text)
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO chat_history_session_languages (session_id, language, confidence, detected_at)
+			VALUES ($1, $2, $3, now())
+			ON CONFLICT (session_id) DO UPDATE SET
+				language = EXCLUDED.language,
+				confidence = EXCLUDED.confidence,
+				detected_at = EXCLUDED.detected_at
+		`, sessionID, language, confidence); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE chat_history_publish_checkpoints SET last_id = $2, updated_at = now() WHERE publisher = $1
+	`, languageCheckpoint, lastID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	log.Info().Int("sessions", len(texts)).Int64("lastId", lastID).Msg("Detected session languages")
+	return processed, nil
+}
+
+// LanguageCount is the number of sessions detected in a language
+type LanguageCount struct {
+	Language string `json:"language"`
+	Sessions int    `json:"sessions"`
+}
+
+// GetLanguageStatsHandler counts the sessions matching the filters per detected language
+func GetLanguageStatsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseChatFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Filter conditions refer to chat columns, so they select sessions from the chat table
+	var args queryArgs
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT language, COUNT(*)
+		FROM chat_history_session_languages
+		WHERE session_id IN (SELECT session_id FROM n8n_chat_histories %s)
+		GROUP BY language
+		ORDER BY COUNT(*) DESC, language
+	`, filter.whereClause(&args)), args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query language stats")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	counts := []LanguageCount{}
+	for rows.Next() {
+		var count LanguageCount
+		if err := rows.Scan(&count.Language, &count.Sessions); err != nil {
+			log.Err(err).Msg("Failed to scan language stats")
+			respondWithQueryError(w, err)
+			return
+		}
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate language stats")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: counts})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// leaderElector decides which replica runs the background workers. Leadership is a session-level
+// Postgres advisory lock held on a dedicated connection, so it is released automatically when the
+// leader exits or loses its connection, and another replica takes over on its next check.
+type leaderElector struct {
+	lockDB  *sql.DB
+	lockKey int64
+	leader  atomic.Bool
+
+	conn *sql.Conn // connection holding the advisory lock while leading
+}
+
+// leader is nil when leader election is disabled, in which case every replica runs the workers
+var leader *leaderElector
+
+// initLeaderElection starts the election unless LEADER_ELECTION=none
+func initLeaderElection(ctx context.Context) error {
+	if getEnvOrDefault("LEADER_ELECTION", "postgres") == "none" {
+		log.Info().Msg("Leader election disabled, workers run on every instance")
+		return nil
+	}
+
+	if pgbouncerMode() {
+		log.Warn().Msg("Session advisory locks are not reliable behind a transaction pooler; set LEADER_ELECTION=none and run the workers on a single instance")
+	}
+
+	// The lock needs its own pool, as it permanently occupies a connection
+	lockDB := openDB()
+	lockDB.SetMaxOpenConns(1)
+
+	hash := fnv.New64a()
+	hash.Write([]byte(getEnvOrDefault("LEADER_LOCK_NAME", "n8n-chat-history-workers")))
+	leader = &leaderElector{lockDB: lockDB, lockKey: int64(hash.Sum64())}
+
+	// The first check runs before the workers start, so a sole instance leads from its first run
+	leader.check(ctx)
+
+	interval := getEnvDuration("LEADER_CHECK_INTERVAL", 10*time.Second)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				leader.resign()
+				lockDB.Close()
+				return
+			case <-ticker.C:
+				leader.check(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// isLeader reports whether this instance should run the background workers
+func (e *leaderElector) isLeader() bool {
+	return e == nil || e.leader.Load()
+}
+
+// check tries to acquire leadership, or verifies that the lock connection is still alive
+func (e *leaderElector) check(ctx context.Context) {
+	if e.conn != nil {
+		if err := e.conn.PingContext(ctx); err != nil {
+			log.Err(err).Msg("Lost leader lock connection")
+			e.resign()
+		}
+		return
+	}
+
+	conn, err := e.lockDB.Conn(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to open leader lock connection")
+		return
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, e.lockKey).Scan(&acquired); err != nil || !acquired {
+		if err != nil {
+			log.Err(err).Msg("Failed to try leader lock")
+		}
+		conn.Close()
+		return
+	}
+
+	e.conn = conn
+	e.leader.Store(true)
+	log.Info().Msg("Became leader, background workers will run on this instance")
+}
+
+// resign gives up leadership by closing the lock connection
+func (e *leaderElector) resign() {
+	if e.conn == nil {
+		return
+	}
+	e.leader.Store(false)
+	e.conn.Close()
+	e.conn = nil
+	log.Info().Msg("Resigned leadership")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// requestLimits bounds the size of what clients can send and of listing responses
+type requestLimits struct {
+	MaxBodyBytes    int64
+	MaxQueryLength  int
+	MaxQueryParams  int
+	MaxSearchLength int
+	// MaxSessionMessages is the number of newest messages the session listing returns per session
+	MaxSessionMessages int
+	// MaxResponseRows and MaxResponseBytes bound the messages of one listing response and their
+	// stored size; a response reaching either is cut short with a continuation cursor
+	MaxResponseRows  int
+	MaxResponseBytes int
+}
+
+// limits holds the configured request limits
+var limits = requestLimits{
+	MaxBodyBytes:    1 << 20,
+	MaxQueryLength:  8192,
+	MaxQueryParams:  50,
+	MaxSearchLength: 200,
+
+	MaxSessionMessages: 200,
+	MaxResponseRows:    5000,
+	MaxResponseBytes:   16 << 20,
+}
+
+// loadRequestLimits reads MAX_BODY_BYTES, MAX_QUERY_LENGTH, MAX_QUERY_PARAMS, MAX_SEARCH_LENGTH,
+// MAX_SESSION_MESSAGES, MAX_RESPONSE_ROWS and MAX_RESPONSE_BYTES
+func loadRequestLimits() {
+	if value, err := strconv.ParseInt(os.Getenv("MAX_BODY_BYTES"), 10, 64); err == nil && value > 0 {
+		limits.MaxBodyBytes = value
+	}
+	for key, target := range map[string]*int{
+		"MAX_QUERY_LENGTH":  &limits.MaxQueryLength,
+		"MAX_QUERY_PARAMS":  &limits.MaxQueryParams,
+		"MAX_SEARCH_LENGTH": &limits.MaxSearchLength,
+
+		"MAX_SESSION_MESSAGES": &limits.MaxSessionMessages,
+		"MAX_RESPONSE_ROWS":    &limits.MaxResponseRows,
+		"MAX_RESPONSE_BYTES":   &limits.MaxResponseBytes,
+	} {
+		if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+			*target = value
+		}
+	}
+}
+
+// requestLimitsMiddleware rejects oversized query strings and caps request bodies
+func requestLimitsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.RawQuery) > limits.MaxQueryLength {
+			respondWithError(w, "Query string too long", http.StatusRequestURITooLong)
+			return
+		}
+
+		query, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			respondWithError(w, "Invalid query string", http.StatusBadRequest)
+			return
+		}
+		count := 0
+		for _, values := range query {
+			count += len(values)
+		}
+		if count > limits.MaxQueryParams {
+			respondWithError(w, "Too many query parameters", http.StatusBadRequest)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeJSONBody decodes the request body into target. On failure it writes the error
+// response (413 for oversized bodies, 400 otherwise) and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, target interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(target)
+	if err == nil {
+		return true
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	} else {
+		respondWithError(w, "Invalid request body", http.StatusBadRequest)
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// setupLogging applies LOG_LEVEL (debug, info, warn or error; info by default) and LOG_FORMAT, json
+// by default or console for readable output during development. It directs the log to LOG_OUTPUT:
+// stderr (the default), file, or both. The file is LOG_FILE, rotated once it reaches
+// LOG_FILE_MAX_SIZE_MB; rotated files are deleted after LOG_FILE_MAX_AGE_DAYS or beyond
+// LOG_FILE_MAX_BACKUPS, and gzipped with LOG_FILE_COMPRESS.
+func setupLogging() error {
+	level := zerolog.InfoLevel
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		parsed, err := zerolog.ParseLevel(strings.ToLower(value))
+		if err != nil || parsed == zerolog.NoLevel {
+			return fmt.Errorf("LOG_LEVEL must be a level such as debug, info, warn or error, got %q", value)
+		}
+		level = parsed
+	}
+	zerolog.SetGlobalLevel(level)
+
+	format := os.Getenv("LOG_FORMAT")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "console" {
+		return fmt.Errorf("LOG_FORMAT must be json or console, got %q", format)
+	}
+
+	output := os.Getenv("LOG_OUTPUT")
+	if output == "" {
+		output = "stderr"
+	}
+	if output != "stderr" && output != "file" && output != "both" {
+		return fmt.Errorf("LOG_OUTPUT must be stderr, file or both, got %q", output)
+	}
+
+	var writers []io.Writer
+	if output != "file" {
+		writers = append(writers, formatLog(os.Stderr, format, false))
+	}
+	if output != "stderr" {
+		file, err := openLogFile()
+		if err != nil {
+			return err
+		}
+		writers = append(writers, formatLog(file, format, true))
+	}
+	log.Logger = log.Output(zerolog.MultiLevelWriter(writers...))
+	return nil
+}
+
+// formatLog writes JSON log lines to w as is, or rendered for reading with the console format
+func formatLog(w io.Writer, format string, noColor bool) io.Writer {
+	if format == "console" {
+		return zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339, NoColor: noColor}
+	}
+	return w
+}
+
+// openLogFile opens LOG_FILE with its rotation settings
+func openLogFile() (*lumberjack.Logger, error) {
+	path := os.Getenv("LOG_FILE")
+	if path == "" {
+		return nil, errors.New("LOG_FILE is required when the log is written to a file")
+	}
+	file := &lumberjack.Logger{
+		Filename: path,
+		MaxSize:  100,
+	}
+	for key, target := range map[string]*int{
+		"LOG_FILE_MAX_SIZE_MB":  &file.MaxSize,
+		"LOG_FILE_MAX_AGE_DAYS": &file.MaxAge,
+		"LOG_FILE_MAX_BACKUPS":  &file.MaxBackups,
+	} {
+		if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+			*target = value
+		}
+	}
+	file.Compress, _ = strconv.ParseBool(os.Getenv("LOG_FILE_COMPRESS"))
+
+	// Open the file now, so an unwritable path fails at startup rather than dropping the log
+	if _, err := file.Write(nil); err != nil {
+		return nil, fmt.Errorf("LOG_FILE: %w", err)
+	}
+	return file, nil
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq" // PostgreSQL driver
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -32,6 +34,10 @@ type Chat struct {
 	ID        int     `json:"id" db:"id"`
 	SessionID string  `json:"sessionId" db:"session_id"`
 	Message   Message `json:"message" db:"message"`
+	// Fields holds the columns mapped with COLUMN_MAPPING
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	// size is the stored size of the row, counted against MAX_RESPONSE_BYTES
+	size int
 }
 
 // ChatConversation represents a conversation with messages grouped by type
@@ -52,12 +58,16 @@ type PaginationResponse struct {
 	Total      int    `json:"total"`
 	TotalPages int    `json:"totalPages"`
 	GroupBy    string `json:"groupBy"`
+	// Partial is set when the response stopped at the response limits; Cursor continues it
+	Partial bool   `json:"partial,omitempty"`
+	Cursor  string `json:"cursor,omitempty"`
 }
 
 // APIResponse represents the API response structure
 type APIResponse struct {
 	Data       interface{}        `json:"data"`
 	Pagination PaginationResponse `json:"pagination"`
+	Debug      *DebugInfo         `json:"debug,omitempty"`
 }
 
 // ErrorResponse represents error response
@@ -65,18 +75,16 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// Page size limits of the listing endpoints
+const (
+	defaultPageSize = 10
+	maxPageSize     = 100
+)
+
 // Database connection
 var db *sql.DB
 
 func GetChatsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Info().
-		Str("method", r.Method).
-		Str("path", r.URL.Path).
-		Str("query", r.URL.RawQuery).
-		Str("referer", r.Referer()).
-		Str("origin", r.Header.Get("Origin")).
-		Msg("Request received")
-
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -89,252 +97,246 @@ func GetChatsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pageSize, _ := strconv.Atoi(query.Get("pageSize"))
-	if pageSize < 1 || pageSize > 100 {
-		pageSize = 10
+	if pageSize < 1 || pageSize > maxPageSize {
+		pageSize = defaultPageSize
 	}
 
-	sortOrder := query.Get("sortOrder")
-	if sortOrder != "asc" && sortOrder != "desc" {
-		sortOrder = "asc"
-	}
+	sortOrder := parseSortDirection(query.Get("sortOrder"))
 
 	groupBy := query.Get("groupBy")
 	if groupBy == "" {
 		groupBy = "simple"
 	}
 
-	searchTerm := strings.TrimSpace(query.Get("search"))
-	offset := (page - 1) * pageSize
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if groupBy == "session" {
-		handleSessionGrouping(w, page, pageSize, sortOrder, offset, searchTerm)
-	} else {
-		handleSimplePagination(w, page, pageSize, sortOrder, offset, searchTerm)
+	// sortBy orders the rows by a mapped or virtual field, with the id breaking ties
+	var sortField string
+	if name := query.Get("sortBy"); name != "" && name != "id" {
+		if groupBy != "simple" {
+			respondWithError(w, "sortBy only applies to ungrouped listings", http.StatusBadRequest)
+			return
+		}
+		var ok bool
+		if sortField, ok = fieldExpr(name); !ok {
+			respondWithError(w, fmt.Sprintf("unknown sortBy field %q", name), http.StatusBadRequest)
+			return
+		}
 	}
-}
 
-func handleSimplePagination(w http.ResponseWriter, page, pageSize int, sortOrder string, offset int, searchTerm string) {
-	orderClause := "id ASC"
-	if sortOrder == "desc" {
-		orderClause = "id DESC"
-	}
-
-	var chatsQuery string
-	var args []interface{}
-	if searchTerm != "" {
-		chatsQuery = fmt.Sprintf(`
-			SELECT id, session_id, message
-			FROM n8n_chat_histories
-			WHERE message::text ILIKE $3 OR session_id ILIKE $3
-			ORDER BY %s
-			LIMIT $1 OFFSET $2
-		`, orderClause)
-		args = []interface{}{pageSize, offset, "%" + searchTerm + "%"}
-	} else {
-		chatsQuery = fmt.Sprintf(`
-			SELECT id, session_id, message
-			FROM n8n_chat_histories
-			ORDER BY %s
-			LIMIT $1 OFFSET $2
-		`, orderClause)
-		args = []interface{}{pageSize, offset}
+	window := listingCursor{Offset: (page - 1) * pageSize, Limit: pageSize}
+	if value := query.Get("cursor"); value != "" {
+		if groupBy == "workflow" {
+			respondWithError(w, "Workflow grouping takes no cursor", http.StatusBadRequest)
+			return
+		}
+		if window, err = parseListingCursor(value); err != nil {
+			respondWithError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	rows, err := db.Query(chatsQuery, args...)
-	if err != nil {
-		log.Err(err).Msg("Failed to query chats")
-		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+	format, ok := negotiateListingFormat(r.Header.Get("Accept"))
+	if !ok {
+		respondWithError(w, "Supported formats are "+strings.Join(listingContentTypes(), ", "), http.StatusNotAcceptable)
+		return
+	}
+	if groupBy == "workflow" && format != formatJSON {
+		respondWithError(w, "Workflow grouping is only available as JSON", http.StatusNotAcceptable)
 		return
 	}
-	defer rows.Close()
-
-	var chats []Chat
-	for rows.Next() {
-		var chat Chat
-		var messageJSON []byte
 
-		if err := rows.Scan(&chat.ID, &chat.SessionID, &messageJSON); err != nil {
-			log.Err(err).Msg("Failed to scan chat row")
-			respondWithError(w, "Internal server error", http.StatusInternalServerError)
+	// ?debug=explain adds the plan of every query to the response, for admins only as it reveals
+	// the generated SQL and runs each query twice
+	var plans *queryPlans
+	if debug := query.Get("debug"); debug != "" {
+		if debug != "explain" {
+			respondWithError(w, "debug must be explain", http.StatusBadRequest)
 			return
 		}
-
-		if err := json.Unmarshal(messageJSON, &chat.Message); err != nil {
-			log.Err(err).Msg("Failed to unmarshal message JSON")
-			respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		if !checkAdmin(w, r) {
 			return
 		}
-
-		chats = append(chats, chat)
+		if format != formatJSON {
+			respondWithError(w, "Query plans are only available as JSON", http.StatusNotAcceptable)
+			return
+		}
+		var ctx context.Context
+		ctx, plans = withQueryPlans(r.Context())
+		r = r.WithContext(ctx)
 	}
 
-	var totalCount int
-	var countQuery string
-	if searchTerm != "" {
-		countQuery = `SELECT COUNT(*) FROM n8n_chat_histories WHERE message::text ILIKE $1 OR session_id ILIKE $1`
-		err = db.QueryRow(countQuery, "%"+searchTerm+"%").Scan(&totalCount)
-	} else {
-		countQuery = `SELECT COUNT(*) FROM n8n_chat_histories`
-		err = db.QueryRow(countQuery).Scan(&totalCount)
-	}
-	if err != nil {
-		log.Err(err).Msg("Failed to count chats")
-		respondWithError(w, "Internal server error", http.StatusInternalServerError)
-		return
+	switch groupBy {
+	case "session":
+		handleSessionGrouping(w, r, newListingWriter(w, format, groupBy, plans), page, pageSize, sortOrder, window, filter)
+	case "workflow":
+		handleWorkflowGrouping(w, r, page, pageSize, sortOrder, window.Offset, filter, plans)
+	default:
+		handleSimplePagination(w, r, newListingWriter(w, format, groupBy, plans), page, pageSize, sortOrder, sortField, window, filter)
 	}
+}
 
-	totalPages := (totalCount + pageSize - 1) / pageSize
+// handleSimplePagination lists the rows of window, which is the requested page unless a cursor
+// continues a truncated response. Rows are sorted by sortField first when it is set.
+func handleSimplePagination(w http.ResponseWriter, r *http.Request, listing listingWriter, page, pageSize int, sortOrder sortDirection, sortField string, window listingCursor, filter ChatFilter) {
+	var countArgs queryArgs
+	countQuery := selectFrom(&countArgs, "n8n_chat_histories", "COUNT(*)").filter(filter).sql()
 
-	response := APIResponse{
-		Data: chats,
-		Pagination: PaginationResponse{
+	var args queryArgs
+	chats := selectFrom(&args, "n8n_chat_histories", chatColumns()).filter(filter)
+	if sortField != "" {
+		chats.orderNullsLast(sortField, sortOrder)
+	}
+	chatsQuery := chats.
+		order("id", sortOrder).
+		page(window.Limit, window.Offset).
+		sql()
+
+	served := 0
+	var budget responseBudget
+	err := countAndQueryChats(r.Context(), countQuery, countArgs, chatsQuery, args, func(totalCount int) {
+		totalPages := (totalCount + pageSize - 1) / pageSize
+		listing.begin(PaginationResponse{
 			Page:       page,
 			PageSize:   pageSize,
 			Total:      totalCount,
 			TotalPages: totalPages,
 			GroupBy:    "simple",
-		},
+		})
+	}, func(chat Chat) error {
+		if !budget.spend(chat) {
+			listing.truncate(listingCursor{Offset: window.Offset + served, Limit: window.Limit - served}.encode())
+			return errResponseLimit
+		}
+		listing.chat(chat)
+		served++
+		return nil
+	})
+	if err != nil && !errors.Is(err, errResponseLimit) {
+		listing.fail(err, "Failed to query chats")
+		return
 	}
-	respondWithJSON(w, response)
+
+	countRowsServed(r.Context(), served)
+	listing.finish()
 }
 
-func handleSessionGrouping(w http.ResponseWriter, page, pageSize int, sortOrder string, offset int, searchTerm string) {
-	orderClause := "id ASC"
-	if sortOrder == "desc" {
-		orderClause = "id DESC"
-	}
-
-	var sessionQuery string
-	var args []interface{}
-	if searchTerm != "" {
-		sessionQuery = fmt.Sprintf(`
-			SELECT DISTINCT ON (session_id) session_id
-			FROM n8n_chat_histories
-			WHERE message::text ILIKE $1 OR session_id ILIKE $1
-			ORDER BY session_id, %s
-			LIMIT $2 OFFSET $3
-		`, orderClause)
-		args = []interface{}{"%" + searchTerm + "%", pageSize, offset}
-	} else {
-		sessionQuery = fmt.Sprintf(`
-			SELECT DISTINCT ON (session_id) session_id
-			FROM n8n_chat_histories
-			ORDER BY session_id, %s
-			LIMIT $1 OFFSET $2
-		`, orderClause)
-		args = []interface{}{pageSize, offset}
+// handleSessionGrouping lists the sessions of window with their newest messages. A cursor may
+// continue a truncated response partway through its first session.
+func handleSessionGrouping(w http.ResponseWriter, r *http.Request, listing listingWriter, page, pageSize int, sortOrder sortDirection, window listingCursor, filter ChatFilter) {
+	messageLimit := limits.MaxSessionMessages
+	if value := r.URL.Query().Get("messagesPerSession"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > limits.MaxSessionMessages {
+			respondWithError(w, fmt.Sprintf("messagesPerSession must be between 1 and %d", limits.MaxSessionMessages), http.StatusBadRequest)
+			return
+		}
+		messageLimit = limit
 	}
 
-	rows, err := db.Query(sessionQuery, args...)
+	totalSessions, sessionIDs, err := querySessionPage(r.Context(), filter, sortOrder, window.Limit, window.Offset)
 	if err != nil {
 		log.Err(err).Msg("Failed to query sessions")
-		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		respondWithQueryError(w, err)
 		return
 	}
-	defer rows.Close()
 
-	var sessionIDs []string
-	for rows.Next() {
-		var sessionID string
-		if err := rows.Scan(&sessionID); err != nil {
-			log.Err(err).Msg("Failed to scan session ID")
-			respondWithError(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		sessionIDs = append(sessionIDs, sessionID)
-	}
+	totalPages := (totalSessions + pageSize - 1) / pageSize
+	listing.begin(PaginationResponse{
+		Page:       page,
+		PageSize:   pageSize,
+		Total:      totalSessions,
+		TotalPages: totalPages,
+		GroupBy:    "session",
+	})
 
 	if len(sessionIDs) == 0 {
-		respondWithJSON(w, APIResponse{
-			Data:       map[string]*ChatConversation{},
-			Pagination: PaginationResponse{Page: page, PageSize: pageSize, Total: 0, TotalPages: 0, GroupBy: "session"},
-		})
+		listing.finish()
 		return
 	}
 
-	placeholders := make([]string, len(sessionIDs))
-	sessionArgs := make([]interface{}, len(sessionIDs))
-	for i, id := range sessionIDs {
-		placeholders[i] = fmt.Sprintf("$%d", i+1)
-		sessionArgs[i] = id
-	}
-
-	chatsQuery := fmt.Sprintf(`
-		SELECT id, session_id, message
-		FROM n8n_chat_histories
-		WHERE session_id IN (%s)
-		ORDER BY %s
-	`, strings.Join(placeholders, ","), orderClause)
-
-	chatsRows, err := db.Query(chatsQuery, sessionArgs...)
+	details, err := loadSessionDetails(r.Context(), sessionIDs, messageLimit)
 	if err != nil {
-		log.Err(err).Msg("Failed to query chats")
-		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		listing.fail(err, "Failed to load session details")
 		return
 	}
-	defer chatsRows.Close()
-
-	groupedChats := make(map[string]*ChatConversation)
-	for chatsRows.Next() {
-		var chat Chat
-		var messageJSON []byte
-
-		if err := chatsRows.Scan(&chat.ID, &chat.SessionID, &messageJSON); err != nil {
-			log.Err(err).Msg("Failed to scan chat row")
-			respondWithError(w, "Internal server error", http.StatusInternalServerError)
-			return
+	listing.sessionDetails(details)
+
+	// Each session contributes its newest messages only. Rows arrive grouped by session, so each
+	// conversation can be written out as soon as the next one starts.
+	var sessionArgs queryArgs
+	sessions := sessionArgs.add(sessionIDs)
+	latest := selectFrom(&sessionArgs, "n8n_chat_histories h", chatColumns()).
+		where("h.session_id = s.session_id").
+		order("h.id", descending).
+		first(messageLimit)
+	chatsQuery := selectFrom(&sessionArgs, "unnest("+sessions+"::text[]) AS s(session_id) CROSS JOIN LATERAL ("+latest.sql()+") AS m", "m.*").
+		order("m.session_id", ascending).
+		order("m.id", sortOrder).
+		sql()
+
+	explainQuery(r.Context(), "chats", chatsQuery, sessionArgs...)
+	index := make(map[string]int, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		index[sessionID] = i
+	}
+	served, current, inSession := 0, "", 0
+	var budget responseBudget
+	err = queryChats(r.Context(), chatsQuery, sessionArgs, func(chat Chat) error {
+		if chat.SessionID != current {
+			current, inSession = chat.SessionID, 0
 		}
-		if err := json.Unmarshal(messageJSON, &chat.Message); err != nil {
-			log.Err(err).Msg("Failed to unmarshal message JSON")
-			respondWithError(w, "Internal server error", http.StatusInternalServerError)
-			return
+		inSession++
+		i := index[chat.SessionID]
+		if i == 0 && inSession <= window.Skip {
+			return nil
 		}
-
-		if groupedChats[chat.SessionID] == nil {
-			groupedChats[chat.SessionID] = &ChatConversation{
-				SessionID: chat.SessionID,
-				Messages:  []Message{},
-			}
+		if !budget.spend(chat) {
+			cursor := listingCursor{Offset: window.Offset + i, Limit: window.Limit - i, Skip: inSession - 1}
+			listing.truncate(cursor.encode())
+			return errResponseLimit
 		}
-		groupedChats[chat.SessionID].Messages = append(groupedChats[chat.SessionID].Messages, chat.Message)
-	}
-
-	var totalSessions int
-	var countQuery string
-	if searchTerm != "" {
-		countQuery = `SELECT COUNT(DISTINCT session_id) FROM n8n_chat_histories WHERE message::text ILIKE $1 OR session_id ILIKE $1`
-		err = db.QueryRow(countQuery, "%"+searchTerm+"%").Scan(&totalSessions)
-	} else {
-		countQuery = `SELECT COUNT(DISTINCT session_id) FROM n8n_chat_histories`
-		err = db.QueryRow(countQuery).Scan(&totalSessions)
-	}
-	if err != nil {
-		log.Err(err).Msg("Failed to count sessions")
-		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		listing.sessionMessage(chat)
+		served++
+		return nil
+	})
+	if err != nil && !errors.Is(err, errResponseLimit) {
+		listing.fail(err, "Failed to query chats")
 		return
 	}
 
-	totalPages := (totalSessions + pageSize - 1) / pageSize
-
-	response := APIResponse{
-		Data: groupedChats,
-		Pagination: PaginationResponse{
-			Page:       page,
-			PageSize:   pageSize,
-			Total:      totalSessions,
-			TotalPages: totalPages,
-			GroupBy:    "session",
-		},
-	}
-	respondWithJSON(w, response)
+	countRowsServed(r.Context(), served)
+	listing.finish()
 }
 
-
 func respondWithJSON(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
 }
 
+func respondWithJSONStatus(w http.ResponseWriter, data interface{}, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(data)
+}
+
+// respondWithQueryError responds to a failed database operation, reporting timeouts as 504
+func respondWithQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		respondWithError(w, "Query timed out", http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, errRegionMismatch) {
+		respondWithError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	respondWithError(w, "Internal server error", http.StatusInternalServerError)
+}
+
 func respondWithError(w http.ResponseWriter, message string, statusCode int) {
 	log.Error().Str("error", message).Int("statusCode", statusCode).Msg("Request error")
 	w.Header().Set("Content-Type", "application/json")
@@ -346,30 +348,11 @@ func respondWithError(w http.ResponseWriter, message string, statusCode int) {
 func initDB() error {
 	var err error
 
-	// Read database URL from environment variable
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		// Fallback to individual environment variables if DATABASE_URL is not set
-		host := getEnvOrDefault("DB_HOST", "localhost")
-		port := getEnvOrDefault("DB_PORT", "5432")
-		user := getEnvOrDefault("DB_USER", "postgres")
-		password := getEnvOrDefault("DB_PASSWORD", "")
-		dbname := getEnvOrDefault("DB_NAME", "postgres")
-		sslmode := getEnvOrDefault("DB_SSLMODE", "disable")
-
-		dbURL = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-			host, port, user, password, dbname, sslmode)
-	}
-
-	db, err = sql.Open("postgres", dbURL)
-	if err != nil {
-		log.Err(err).Msg("failed to open database connection")
-		return err
-	}
+	db = openDB()
 
 	// Configure connection pool
-	db.SetMaxOpenConns(1)
-	db.SetMaxIdleConns(1)
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxOpenConns)
 	db.SetConnMaxLifetime(5 * time.Minute)
 
 	if err = db.Ping(); err != nil {
@@ -381,6 +364,36 @@ func initDB() error {
 	return nil
 }
 
+// databaseURL returns the connection string of the history database
+func databaseURL() string {
+	// Read database URL from environment variable
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		// Fallback to individual environment variables if DATABASE_URL is not set.
+		// DB_HOST may be the directory of a unix socket, such as /var/run/postgresql.
+		settings := []string{
+			"host=" + quoteDSNValue(getEnvOrDefault("DB_HOST", "localhost")),
+			"port=" + quoteDSNValue(getEnvOrDefault("DB_PORT", "5432")),
+			"user=" + quoteDSNValue(getEnvOrDefault("DB_USER", "postgres")),
+			"dbname=" + quoteDSNValue(getEnvOrDefault("DB_NAME", "postgres")),
+			"sslmode=" + quoteDSNValue(getEnvOrDefault("DB_SSLMODE", "disable")),
+		}
+		optional := []struct{ key, variable string }{
+			{"password", "DB_PASSWORD"},
+			{"sslrootcert", "DB_SSLROOTCERT"},
+			{"sslcert", "DB_SSLCERT"},
+			{"sslkey", "DB_SSLKEY"},
+		}
+		for _, setting := range optional {
+			if value := os.Getenv(setting.variable); value != "" {
+				settings = append(settings, setting.key+"="+quoteDSNValue(value))
+			}
+		}
+		dbURL = strings.Join(settings, " ")
+	}
+	return dbURL
+}
+
 // getEnvOrDefault returns the value of the environment variable or a default value
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -389,6 +402,37 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvDuration parses the environment variable as a duration (e.g. "30m"), falling back to a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// legacyAPIMiddleware serves the unversioned /api/... routes as aliases of /api/v1/..., flagging
+// the responses as deprecated and pointing to the versioned route
+func legacyAPIMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/api/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		versionedPath := "/api/v1" + strings.TrimPrefix(r.URL.Path, "/api")
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", versionedPath))
+
+		versioned := new(http.Request)
+		*versioned = *r
+		versioned.URL = new(url.URL)
+		*versioned.URL = *r.URL
+		versioned.URL.Path = versionedPath
+		versioned.URL.RawPath = ""
+		next.ServeHTTP(w, versioned)
+	})
+}
+
 func originCheckMiddleware(next http.Handler) http.Handler {
 	allowedOrigin := os.Getenv("CHAT_URL") // e.g. "https://chats.n8n.hyperjump.tech"
 
@@ -421,28 +465,382 @@ func main() {
 		log.Info().Msg("Loaded .env file successfully")
 	}
 
+	if err := setupLogging(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid log configuration")
+	}
+
+	if err := resolveSecretReferences(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to resolve secret references")
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBenchCommand(os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("Benchmark failed")
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "decrypt-artifact" {
+		if err := runDecryptCommand(os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("Failed to decrypt artifact")
+		}
+		return
+	}
+
+	loadFeatureFlags()
+	loadRequestLimits()
+	loadSearchConfig()
+	loadDataRegion()
+	loadPoolSize()
+	loadReadOnlyMode()
+	loadAPIKeys()
+
+	if err := loadRequestLogConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid request log configuration")
+	}
+
+	if err := loadSLOConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid SLO configuration")
+	}
+
+	if err := loadArtifactEncryption(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid artifact encryption configuration")
+	}
+
+	if err := loadArtifactStorage(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid artifact storage configuration")
+	}
+
+	// Dimensions can be read from mapped columns, so the mapping is loaded first
+	if err := loadColumnMapping(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid column mapping")
+	}
+
+	if err := loadVirtualFields(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid virtual fields")
+	}
+
+	if err := loadWorkflowConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid workflow configuration")
+	}
+
+	if err := loadChannelConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid channel configuration")
+	}
+
+	if err := loadExecutionConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid execution configuration")
+	}
+
+	if err := loadN8NAPIConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid n8n API configuration")
+	}
+
+	if err := loadEndUserConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid end user configuration")
+	}
+
+	if err := loadTimestampConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid timestamp configuration")
+	}
+
+	if err := loadRedaction(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid redaction configuration")
+	}
+
+	if err := loadSecretRules(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid secret scan configuration")
+	}
+
+	if err := loadProcessors(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid message processor configuration")
+	}
+
+	if err := loadPolicyRules(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid content policy configuration")
+	}
+
+	if err := loadPolicyClassifier(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid content policy classifier configuration")
+	}
+
+	if err := loadFunnelConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid funnel configuration")
+	}
+
+	if err := loadEmbeddingConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid embedding configuration")
+	}
+
+	if err := loadAlertChannels(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid alert configuration")
+	}
+
+	if err := initCloudSQL(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("Failed to set up the Cloud SQL connector")
+	}
+
+	if err := initDBCredentials(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("Failed to obtain database credentials")
+	}
+
+	if err := checkDBCertificates(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid database TLS configuration")
+	}
+
 	if err := initDB(); err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize database")
 	}
 	defer db.Close()
 
+	if len(os.Args) > 1 && os.Args[1] == "db-setup" {
+		if err := runDBSetupCommand(context.Background()); err != nil {
+			log.Fatal().Err(err).Msg("Database setup failed")
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		if err := runBackupCommand(context.Background(), os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("Backup failed")
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := runRestoreCommand(context.Background(), os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("Restore failed")
+		}
+		return
+	}
+
+	if readOnly {
+		log.Warn().Msg("Skipping schema migrations in read-only mode, features relying on missing tables will fail")
+	} else if err := ensureSchema(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to prepare database schema")
+	}
+
+	if err := verifyColumnMapping(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("Invalid column mapping")
+	}
+
+	if err := loadDataSources(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid data sources")
+	}
+
+	if err := loadSourceDiscovery(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid source discovery configuration")
+	}
+
+	if searchUnaccent && !readOnly {
+		if err := ensureUnaccentSearch(context.Background()); err != nil {
+			log.Fatal().Err(err).Msg("Failed to prepare accent-insensitive search")
+		}
+	}
+
+	if featureEnabled("duplicates") && !readOnly {
+		if err := ensureDuplicateDetection(context.Background()); err != nil {
+			log.Warn().Err(err).Msg("Disabling duplicate detection, install pg_trgm or add -duplicates to FEATURE_FLAGS")
+			featureFlags["duplicates"] = false
+		}
+	}
+
+	if err := initStateStore(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize state store")
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/chats", GetChatsHandler)
+	mux.HandleFunc("/api/v1/chats", GetChatsHandler)
+	mux.HandleFunc("GET /api/v1/chats/by-id/{id}", GetMessageHandler)
+	mux.HandleFunc("GET /api/v1/chats/tail", requireFeature("tail", TailChatsHandler))
+	mux.HandleFunc("GET /api/v1/sources", GetSourcesHandler)
+	mux.HandleFunc("GET /api/v1/sources/chats", GetSourceChatsHandler)
+	mux.HandleFunc("/api/v1/analysis/tool-failures", GetToolFailuresHandler)
+	mux.HandleFunc("GET /api/v1/analysis/topics", GetTopicsHandler)
+	mux.HandleFunc("GET /api/v1/analysis/funnel", GetFunnelHandler)
+	mux.HandleFunc("/api/v1/facets", GetFacetsHandler)
+	mux.HandleFunc("GET /api/v1/sessions/compare", requireFeature("compare", CompareSessionsHandler))
+	mux.HandleFunc("POST /api/v1/sessions/merge", requireFeature("merge", requireAdmin(MergeSessionsHandler)))
+	mux.HandleFunc("GET /api/v1/analysis/duplicates", requireFeature("duplicates", GetDuplicatesHandler))
+	mux.HandleFunc("GET /api/v1/feedback", requireFeature("feedback", GetFeedbackHandler))
+	mux.HandleFunc("POST /api/v1/feedback", requireFeature("feedback", CreateFeedbackHandler))
+	mux.HandleFunc("GET /api/v1/stats/quality", requireFeature("feedback", GetQualityStatsHandler))
+	mux.HandleFunc("GET /api/v1/stats/cardinality", GetCardinalityHandler)
+	mux.HandleFunc("GET /api/v1/stats/heatmap", GetHeatmapHandler)
+	mux.HandleFunc("GET /api/v1/stats/channels", GetChannelStatsHandler)
+	mux.HandleFunc("GET /api/v1/stats/growth", GetGrowthHandler)
+	mux.HandleFunc("GET /api/v1/stats/languages", requireFeature("languages", GetLanguageStatsHandler))
+	mux.HandleFunc("GET /api/v1/stats/policy", requireFeature("policy", GetPolicyStatsHandler))
+	mux.HandleFunc("GET /api/v1/sessions/{id}/messages", GetSessionMessagesHandler)
+	mux.HandleFunc("GET /api/v1/sessions/{id}/steps", GetSessionStepsHandler)
+	mux.HandleFunc("GET /api/v1/sessions/{id}/executions", GetSessionExecutionsHandler)
+	mux.HandleFunc("GET /api/v1/sessions/{id}/workflow", GetSessionWorkflowHandler)
+	mux.HandleFunc("GET /api/v1/n8n/workflows", GetMemoryWorkflowsHandler)
+	mux.HandleFunc("GET /api/v1/sessions/{id}/timeline", GetSessionTimelineHandler)
+	mux.HandleFunc("GET /api/v1/sessions/{id}/transcript", GetSessionTranscriptHandler)
+	mux.HandleFunc("GET /api/v1/sessions/{id}/neighbors", GetSessionNeighborsHandler)
+	mux.HandleFunc("GET /api/v1/sessions/{id}/pins", GetSessionPinsHandler)
+	mux.HandleFunc("PUT /api/v1/sessions/{id}/pins/{messageId}", PinMessageHandler)
+	mux.HandleFunc("DELETE /api/v1/sessions/{id}/pins/{messageId}", UnpinMessageHandler)
+	mux.HandleFunc("GET /api/v1/sessions/{id}/notes", GetSessionNotesHandler)
+	mux.HandleFunc("POST /api/v1/sessions/{id}/notes", CreateSessionNoteHandler)
+	mux.HandleFunc("PUT /api/v1/sessions/{id}/notes/{noteId}", UpdateSessionNoteHandler)
+	mux.HandleFunc("DELETE /api/v1/sessions/{id}/notes/{noteId}", DeleteSessionNoteHandler)
+	mux.HandleFunc("POST /api/v1/sessions/{id}/replay", requireFeature("replays", requireAdmin(CreateSessionReplayHandler)))
+	mux.HandleFunc("GET /api/v1/sessions/{id}/replays", requireFeature("replays", GetSessionReplaysHandler))
+	mux.HandleFunc("GET /api/v1/replays/{id}", requireFeature("replays", GetSessionReplayHandler))
+	mux.HandleFunc("GET /api/v1/replays/{id}/comparison", requireFeature("replays", CompareSessionReplayHandler))
+	mux.HandleFunc("POST /api/v1/sessions/{id}/archive", ArchiveSessionHandler)
+	mux.HandleFunc("POST /api/v1/sessions/{id}/unarchive", UnarchiveSessionHandler)
+	mux.HandleFunc("GET /api/v1/sessions/{id}/review", requireFeature("review", GetSessionReviewHandler))
+	mux.HandleFunc("PUT /api/v1/sessions/{id}/review", requireFeature("review", PutSessionReviewHandler))
+	mux.HandleFunc("POST /api/v1/review/next", requireFeature("review", NextReviewHandler))
+	mux.HandleFunc("GET /api/v1/stats/review", requireFeature("review", GetReviewStatsHandler))
+	mux.HandleFunc("GET /api/v1/sessions/{id}/tags", requireFeature("tags", GetSessionTagsHandler))
+	mux.HandleFunc("PUT /api/v1/sessions/{id}/tags", requireFeature("tags", PutSessionTagsHandler))
+	mux.HandleFunc("GET /api/v1/datasets/eval", requireFeature("datasets", GetEvalDatasetHandler))
+	mux.HandleFunc("GET /api/v1/analysis/pairs", requireFeature("datasets", GetPromptPairsHandler))
+	mux.HandleFunc("GET /api/v1/analysis/secrets", requireFeature("secrets", requireAdmin(GetSecretFindingsHandler)))
+	mux.HandleFunc("POST /api/v1/analysis/secrets/scan", requireFeature("secrets", requireAdmin(ScanSecretsHandler)))
+	mux.HandleFunc("POST /api/v1/analysis/secrets/{id}/redact", requireFeature("secrets", requireAdmin(RedactSecretHandler)))
+	mux.HandleFunc("POST /api/v1/analysis/secrets/{id}/dismiss", requireFeature("secrets", requireAdmin(DismissSecretHandler)))
+	mux.HandleFunc("GET /api/v1/analysis/policy", requireFeature("policy", GetPolicyFlagsHandler))
+	mux.HandleFunc("POST /api/v1/sessions/{id}/share", requireFeature("sharing", CreateShareLinkHandler))
+	mux.HandleFunc("GET /api/v1/annotations/export", ExportAnnotationsHandler)
+	mux.HandleFunc("POST /api/v1/annotations/import", requireAdmin(ImportAnnotationsHandler))
+	mux.HandleFunc("POST /api/v1/exports", requireFeature("exports", CreateExportHandler))
+	mux.HandleFunc("GET /api/v1/exports/{id}", requireFeature("exports", GetExportHandler))
+	mux.HandleFunc("GET /api/v1/exports/{id}/download", requireFeature("exports", DownloadExportHandler))
+	mux.HandleFunc("GET /api/v1/alerts", requireFeature("alerts", requireAdmin(GetAlertRulesHandler)))
+	mux.HandleFunc("POST /api/v1/alerts", requireFeature("alerts", requireAdmin(CreateAlertRuleHandler)))
+	mux.HandleFunc("GET /api/v1/alerts/{id}", requireFeature("alerts", requireAdmin(GetAlertRuleHandler)))
+	mux.HandleFunc("PUT /api/v1/alerts/{id}", requireFeature("alerts", requireAdmin(UpdateAlertRuleHandler)))
+	mux.HandleFunc("DELETE /api/v1/alerts/{id}", requireFeature("alerts", requireAdmin(DeleteAlertRuleHandler)))
+	mux.HandleFunc("GET /api/v1/config", GetConfigHandler)
+	mux.HandleFunc("GET /api/v1/version", GetVersionHandler)
+	mux.HandleFunc("GET /api/v1/me", GetIdentityHandler)
+	mux.HandleFunc("GET /api/v1/preferences", GetPreferencesHandler)
+	mux.HandleFunc("GET /api/v1/end-users/{id}", GetEndUserHandler)
+	mux.HandleFunc("POST /api/v1/compliance/sar", requireAdmin(SubjectAccessHandler))
+	mux.HandleFunc("PUT /api/v1/preferences", PutPreferencesHandler)
+	// With ADMIN_PORT the admin endpoints move to the internal listener
+	adminPort := os.Getenv("ADMIN_PORT")
+	if adminPort == "" {
+		registerAdminRoutes(mux, requireAdmin)
+	}
+
+	ctx := context.Background()
+	startUsageFlush(ctx)
+
+	if discovery != nil {
+		startSourceDiscovery(ctx)
+	}
+
+	if os.Getenv("SLO_ALERTS") == "true" {
+		startSLOAlerts(ctx)
+	}
+
+	if err := initLeaderElection(ctx); err != nil {
+		log.Fatal().Err(err).Msg("Failed to start leader election")
+	}
+
+	// Every worker writes its results or progress to the database
+	if featureEnabled("duplicates") && !readOnly {
+		startWorker(ctx, "duplicates", getEnvDuration("DUPLICATES_INTERVAL", time.Hour), newDuplicateJob().run)
+	}
+
+	if featureEnabled("summary") && !readOnly {
+		startWorker(ctx, "sessions-summary", getEnvDuration("SUMMARY_INTERVAL", time.Minute), newSessionSummaryJob().run)
+	}
+
+	if featureEnabled("languages") && !readOnly {
+		startWorker(ctx, "session-languages", getEnvDuration("LANGUAGE_INTERVAL", 5*time.Minute), newLanguageJob().run)
+	}
+
+	// Retention relies on the activity the summary worker records
+	if featureEnabled("summary") && !readOnly {
+		startWorker(ctx, "retention", getEnvDuration("RETENTION_INTERVAL", time.Hour), newRetentionJob().run)
+	}
+
+	if !readOnly {
+		startWorker(ctx, "stats-snapshots", getEnvDuration("STATS_SNAPSHOT_INTERVAL", time.Hour), statsSnapshotJob{}.run)
+	}
+
+	if featureEnabled("anomalies") && !readOnly {
+		startWorker(ctx, "traffic-anomalies", getEnvDuration("ANOMALY_INTERVAL", 5*time.Minute), newAnomalyJob().run)
+	}
+
+	if featureEnabled("alerts") && !readOnly {
+		startWorker(ctx, "alert-rules", getEnvDuration("ALERT_RULES_INTERVAL", time.Minute), alertRuleJob{}.run)
+	}
+
+	if featureEnabled("exports") && !readOnly {
+		startWorker(ctx, "exports", getEnvDuration("EXPORTS_POLL_INTERVAL", 10*time.Second), newExportJob().run)
+	}
+
+	if featureEnabled("replays") && !readOnly {
+		startWorker(ctx, "session-replays", getEnvDuration("REPLAY_POLL_INTERVAL", 10*time.Second), newReplayJob().run)
+	}
+
+	if featureEnabled("secrets") && !readOnly {
+		startWorker(ctx, "secret-scan", getEnvDuration("SECRET_SCAN_INTERVAL", 15*time.Minute), newSecretScanJob().run)
+	}
+
+	if featureEnabled("policy") && !readOnly {
+		startWorker(ctx, "policy-flags", getEnvDuration("POLICY_INTERVAL", 5*time.Minute), newPolicyJob().run)
+	}
+
+	if processorsFor(IngestStage) {
+		if readOnly {
+			log.Warn().Msg("Ingest processors are disabled in read-only mode")
+		} else {
+			startWorker(ctx, "message-processors", getEnvDuration("PROCESSOR_INTERVAL", 10*time.Second), newProcessorJob().run)
+		}
+	}
+
+	sinks, err := newEventSinks()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid event stream configuration")
+	}
+	if readOnly && len(sinks) > 0 {
+		log.Warn().Msg("Event publishing is disabled in read-only mode")
+		for _, sink := range sinks {
+			sink.Close()
+		}
+		sinks = nil
+	}
+	for _, sink := range sinks {
+		defer sink.Close()
+		startWorker(ctx, sink.Name()+"-publisher", getEnvDuration("EVENTS_POLL_INTERVAL", 5*time.Second), newEventPublisher(sink).run)
+	}
 
 	port := getEnvOrDefault("PORT", "8080")
 	chatURL := os.Getenv("CHAT_URL")
 
-	secureMux := originCheckMiddleware(mux)
+	// Shared sessions are opened and embedded from anywhere, so they skip the origin check
+	rootMux := http.NewServeMux()
+	rootMux.Handle("/", originCheckMiddleware(sloMiddleware(mux)))
+	rootMux.HandleFunc("GET /api/v1/shared/{token}", requireFeature("sharing", GetSharedSessionHandler))
+	rootMux.HandleFunc("GET /healthz", HealthHandler)
+	rootMux.HandleFunc("GET /embed/{token}", requireFeature("sharing", GetEmbedHandler))
+
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   []string{chatURL},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key", "Range", "If-Range"},
+		ExposedHeaders:   []string{"Deprecation", "Link", "X-Page", "X-Page-Size", "X-Total-Count", "X-Total-Pages", "Accept-Ranges", "Content-Range", "Content-Disposition", "ETag"},
 		AllowCredentials: true,
 	})
 
-	handler := corsHandler.Handler(secureMux)
+	replayTarget = queryTimeoutMiddleware(rootMux)
+	handler := requestLogMiddleware(corsHandler.Handler(requestLimitsMiddleware(legacyAPIMiddleware(usageMiddleware(replayLogMiddleware(readOnlyMiddleware(regionMiddleware(maintenanceMiddleware(queryTimeoutMiddleware(rootMux))))))))))
+
+	build := buildVersion()
+	log.Info().Str("version", build.Version).Str("commit", build.Commit).Msgf("Server starting on port %s", port)
 
-	log.Info().Msgf("Server starting on port %s", port)
+	if adminPort != "" {
+		go serveAdminPort(adminPort)
+	}
 
 	if err := http.ListenAndServe(":"+port, handler); err != nil {
 		log.Fatal().Err(err).Msg("Server failed to start")
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maintenanceKey is the shared state key of the maintenance switch, so it applies to every replica
+	maintenanceKey = "maintenance"
+	// maintenanceRefresh is how long an instance trusts its cached copy of the switch
+	maintenanceRefresh = 5 * time.Second
+)
+
+// MaintenanceState is the maintenance switch with the message shown to clients
+type MaintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	ETA     *time.Time `json:"eta,omitempty"`
+}
+
+// MaintenanceResponse is returned by every non-exempt endpoint during maintenance
+type MaintenanceResponse struct {
+	Error       string     `json:"error"`
+	Maintenance bool       `json:"maintenance"`
+	Message     string     `json:"message,omitempty"`
+	ETA         *time.Time `json:"eta,omitempty"`
+}
+
+var maintenance = struct {
+	sync.Mutex
+	state     MaintenanceState
+	fetchedAt time.Time
+}{}
+
+// currentMaintenance returns the maintenance state, refreshing it from the shared store when stale.
+// MAINTENANCE_MODE=true enables maintenance until an admin turns it off.
+func currentMaintenance(ctx context.Context) MaintenanceState {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	if time.Since(maintenance.fetchedAt) < maintenanceRefresh {
+		return maintenance.state
+	}
+
+	state := MaintenanceState{Enabled: os.Getenv("MAINTENANCE_MODE") == "true"}
+	value, found, err := sharedState.Get(ctx, maintenanceKey)
+	if err != nil {
+		// Keep serving with the last known state rather than failing every request
+		log.Err(err).Msg("Failed to read maintenance state")
+		return maintenance.state
+	}
+	if found {
+		if err := json.Unmarshal(value, &state); err != nil {
+			log.Err(err).Msg("Failed to decode maintenance state")
+		}
+	}
+
+	maintenance.state = state
+	maintenance.fetchedAt = time.Now()
+	return state
+}
+
+// maintenanceMiddleware answers 503 while maintenance is on, except for health checks and admin endpoints
+func maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || strings.HasPrefix(r.URL.Path, "/api/v1/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		state := currentMaintenance(r.Context())
+		if !state.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if state.ETA != nil {
+			if wait := time.Until(*state.ETA); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			}
+		}
+		message := state.Message
+		if message == "" {
+			message = "The service is undergoing maintenance, please try again later"
+		}
+		respondWithJSONStatus(w, MaintenanceResponse{
+			Error:       "Service unavailable",
+			Maintenance: true,
+			Message:     message,
+			ETA:         state.ETA,
+		}, http.StatusServiceUnavailable)
+	})
+}
+
+func GetMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, DataResponse{Data: currentMaintenance(r.Context())})
+}
+
+// PutMaintenanceHandler switches maintenance mode on or off for every replica
+func PutMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var state MaintenanceState
+	if !decodeJSONBody(w, r, &state) {
+		return
+	}
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		log.Err(err).Msg("Failed to encode maintenance state")
+		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// The switch stays until changed again; a year is merely the longest-lived value the store keeps
+	if err := sharedState.Set(r.Context(), maintenanceKey, value, 365*24*time.Hour); err != nil {
+		log.Err(err).Msg("Failed to store maintenance state")
+		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, "maintenance.update", state); err != nil {
+		log.Err(err).Msg("Failed to record maintenance audit entry")
+	}
+
+	maintenance.Lock()
+	maintenance.state = state
+	maintenance.fetchedAt = time.Now()
+	maintenance.Unlock()
+
+	log.Info().Bool("enabled", state.Enabled).Msg("Maintenance mode updated")
+	respondWithJSON(w, DataResponse{Data: state})
+}
+
+// HealthHandler reports whether the service can reach its database. It is exempt from maintenance mode.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if err := db.PingContext(r.Context()); err != nil {
+		log.Err(err).Msg("Health check failed")
+		respondWithError(w, "Database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	respondWithJSON(w, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// workerStats counts the runs of a background worker on this instance
+type workerStats struct {
+	runs         int
+	failures     int
+	lastDuration time.Duration
+}
+
+var (
+	workerStatsMu sync.Mutex
+	workerRuns    = map[string]*workerStats{}
+)
+
+// recordWorkerRun adds a completed worker run to the metrics
+func recordWorkerRun(name string, duration time.Duration, err error) {
+	workerStatsMu.Lock()
+	defer workerStatsMu.Unlock()
+	stats := workerRuns[name]
+	if stats == nil {
+		stats = &workerStats{}
+		workerRuns[name] = stats
+	}
+	stats.runs++
+	if err != nil {
+		stats.failures++
+	}
+	stats.lastDuration = duration
+}
+
+// MetricsHandler serves the metrics of this instance in the Prometheus text format: the build, the
+// Go runtime, the database pool and the background workers
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	build := buildVersion()
+	writeMetric(w, "n8n_chat_history_build_info", "gauge", "Version of the running build",
+		fmt.Sprintf(`{version=%q,commit=%q}`, build.Version, build.Commit), 1)
+
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	writeMetric(w, "go_goroutines", "gauge", "Number of goroutines", "", float64(runtime.NumGoroutine()))
+	writeMetric(w, "go_memstats_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects", "", float64(memory.HeapAlloc))
+	writeMetric(w, "go_memstats_sys_bytes", "gauge", "Bytes obtained from the system", "", float64(memory.Sys))
+	writeMetric(w, "go_gc_cycles_total", "counter", "Completed garbage collection cycles", "", float64(memory.NumGC))
+
+	pool := db.Stats()
+	writeMetric(w, "n8n_chat_history_db_max_open_connections", "gauge", "Size of the database connection pool", "", float64(pool.MaxOpenConnections))
+	writeMetric(w, "n8n_chat_history_db_open_connections", "gauge", "Open database connections", "", float64(pool.OpenConnections))
+	writeMetric(w, "n8n_chat_history_db_in_use_connections", "gauge", "Database connections in use", "", float64(pool.InUse))
+	writeMetric(w, "n8n_chat_history_db_idle_connections", "gauge", "Idle database connections", "", float64(pool.Idle))
+	writeMetric(w, "n8n_chat_history_db_wait_count_total", "counter", "Queries that waited for a connection", "", float64(pool.WaitCount))
+	writeMetric(w, "n8n_chat_history_db_wait_seconds_total", "counter", "Time spent waiting for a connection", "", pool.WaitDuration.Seconds())
+
+	workerStatsMu.Lock()
+	names := make([]string, 0, len(workerRuns))
+	for name := range workerRuns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var runs, failures, durations []string
+	for _, name := range names {
+		stats := workerRuns[name]
+		label := fmt.Sprintf(`{worker=%q}`, name)
+		runs = append(runs, fmt.Sprintf("%s %d", label, stats.runs))
+		failures = append(failures, fmt.Sprintf("%s %d", label, stats.failures))
+		durations = append(durations, fmt.Sprintf("%s %g", label, stats.lastDuration.Seconds()))
+	}
+	workerStatsMu.Unlock()
+	writeMetricSeries(w, "n8n_chat_history_worker_runs_total", "counter", "Worker runs on this instance", runs)
+	writeMetricSeries(w, "n8n_chat_history_worker_failures_total", "counter", "Worker runs that failed", failures)
+	writeMetricSeries(w, "n8n_chat_history_worker_last_duration_seconds", "gauge", "Duration of the last worker run", durations)
+}
+
+// writeMetric writes a metric with a single sample
+func writeMetric(w io.Writer, name, kind, help, labels string, value float64) {
+	writeMetricSeries(w, name, kind, help, []string{fmt.Sprintf("%s %g", labels, value)})
+}
+
+// writeMetricSeries writes a metric with one sample per entry of series, each its labels and value
+func writeMetricSeries(w io.Writer, name, kind, help string, series []string) {
+	if len(series) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, sample := range series {
+		fmt.Fprintf(w, "%s%s\n", name, sample)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// msgpackField is a key of a MessagePack map whose key order matters
+type msgpackField struct {
+	key   string
+	value interface{}
+}
+
+// msgpackObject is a MessagePack map written in field order, used for the structs of the listing
+type msgpackObject []msgpackField
+
+// appendMsgpack encodes v, which may be any value produced by decoding JSON into interface{}, or a msgpackObject
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch value := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if value {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int:
+		return appendMsgpackInt(b, int64(value)), nil
+	case int64:
+		return appendMsgpackInt(b, value), nil
+	case float64:
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(value)), nil
+	case string:
+		return appendMsgpackString(b, value), nil
+	case []interface{}:
+		if value == nil {
+			return append(b, 0xc0), nil
+		}
+		b = appendMsgpackHeader(b, len(value), 0x90, 0xdc, 0xdd)
+		for _, item := range value {
+			if b, err = appendMsgpack(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		if value == nil {
+			return append(b, 0xc0), nil
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b = appendMsgpackHeader(b, len(keys), 0x80, 0xde, 0xdf)
+		for _, key := range keys {
+			b = appendMsgpackString(b, key)
+			if b, err = appendMsgpack(b, value[key]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case msgpackObject:
+		b = appendMsgpackHeader(b, len(value), 0x80, 0xde, 0xdf)
+		for _, field := range value {
+			b = appendMsgpackString(b, field.key)
+			if b, err = appendMsgpack(b, field.value); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("cannot encode %T as MessagePack", v)
+	}
+}
+
+// appendMsgpackInt encodes an integer in its smallest signed form
+func appendMsgpackInt(b []byte, value int64) []byte {
+	switch {
+	case value >= 0 && value <= math.MaxInt8:
+		return append(b, byte(value))
+	case value < 0 && value >= -32:
+		return append(b, byte(value))
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(value))
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(value))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(value))
+	}
+}
+
+func appendMsgpackString(b []byte, value string) []byte {
+	switch n := len(value); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, value...)
+}
+
+// appendMsgpackHeader writes the length prefix of an array or map, given its fix, 16-bit and 32-bit markers
+func appendMsgpackHeader(b []byte, n int, fix, marker16, marker32 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, marker16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, marker32), uint32(n))
+	}
+}
+
+// msgpackMessage mirrors the JSON encoding of Message
+func msgpackMessage(message Message) msgpackObject {
+	return msgpackObject{
+		{"type", message.Type},
+		{"content", message.Content},
+		{"tool_calls", message.ToolCalls},
+		{"additional_kwargs", message.AdditionalKwargs},
+		{"response_metadata", message.ResponseMetadata},
+		{"invalid_tool_calls", message.InvalidToolCalls},
+	}
+}
+
+// msgpackPagination mirrors the JSON encoding of PaginationResponse
+func msgpackPagination(pagination PaginationResponse) msgpackObject {
+	object := msgpackObject{
+		{"page", pagination.Page},
+		{"pageSize", pagination.PageSize},
+		{"total", pagination.Total},
+		{"totalPages", pagination.TotalPages},
+		{"groupBy", pagination.GroupBy},
+	}
+	if pagination.Partial {
+		object = append(object, msgpackField{"partial", true}, msgpackField{"cursor", pagination.Cursor})
+	}
+	return object
+}
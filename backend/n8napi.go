@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// postgresMemoryNode is the type of the n8n node that keeps chat memory in Postgres, and
+// defaultMemoryTable the table it writes to unless configured otherwise
+const (
+	postgresMemoryNode = "@n8n/n8n-nodes-langchain.memoryPostgresChat"
+	defaultMemoryTable = "n8n_chat_histories"
+)
+
+// n8nWorkflowsPageSize is the largest page the n8n API serves
+const n8nWorkflowsPageSize = 250
+
+// errWorkflowNotFound is returned when n8n does not know a workflow
+var errWorkflowNotFound = errors.New("workflow not found")
+
+// n8nClient reads workflows through the public REST API of n8n
+type n8nClient struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+// n8nAPI is the configured client, nil when no API key is set
+var n8nAPI *n8nClient
+
+// n8nWorkflow is the part of an n8n workflow the service uses
+type n8nWorkflow struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Active    bool      `json:"active"`
+	VersionID string    `json:"versionId"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Nodes     []struct {
+		Name       string                 `json:"name"`
+		Type       string                 `json:"type"`
+		Disabled   bool                   `json:"disabled"`
+		Parameters map[string]interface{} `json:"parameters"`
+	} `json:"nodes"`
+}
+
+// SessionWorkflow is the workflow a session belongs to, as n8n knows it now
+type SessionWorkflow struct {
+	SessionID  string    `json:"sessionId"`
+	WorkflowID string    `json:"workflowId"`
+	Name       string    `json:"name"`
+	VersionID  string    `json:"versionId,omitempty"`
+	Active     bool      `json:"active"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	URL        string    `json:"url"`
+}
+
+// MemoryWorkflow is a workflow with Postgres chat memory nodes writing to the history table
+type MemoryWorkflow struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Active    bool      `json:"active"`
+	VersionID string    `json:"versionId,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Nodes     []string  `json:"nodes"`
+	URL       string    `json:"url"`
+}
+
+// loadN8NAPIConfig reads N8N_API_KEY, which enables the client for the n8n instance at N8N_URL.
+// It runs after loadExecutionConfig, which reads N8N_URL.
+func loadN8NAPIConfig() error {
+	key := os.Getenv("N8N_API_KEY")
+	if key == "" {
+		return nil
+	}
+	if n8nURL == "" {
+		return errors.New("N8N_API_KEY needs N8N_URL")
+	}
+	n8nAPI = &n8nClient{
+		url:    n8nURL + "/api/v1",
+		key:    key,
+		client: &http.Client{Timeout: getEnvDuration("N8N_API_TIMEOUT", 15*time.Second)},
+	}
+	return nil
+}
+
+// get decodes the response to a GET request of the API into result
+func (c *n8nClient) get(ctx context.Context, path string, query url.Values, result interface{}) error {
+	endpoint := c.url + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("X-N8N-API-KEY", c.key)
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return errWorkflowNotFound
+	}
+	if response.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("n8n API responded with status %d: %s", response.StatusCode, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// workflow returns a single workflow
+func (c *n8nClient) workflow(ctx context.Context, id string) (n8nWorkflow, error) {
+	var workflow n8nWorkflow
+	err := c.get(ctx, "/workflows/"+url.PathEscape(id), nil, &workflow)
+	return workflow, err
+}
+
+// workflows returns every workflow, or only the active ones, following the cursor of the API
+func (c *n8nClient) workflows(ctx context.Context, activeOnly bool) ([]n8nWorkflow, error) {
+	query := url.Values{"limit": {strconv.Itoa(n8nWorkflowsPageSize)}}
+	if activeOnly {
+		query.Set("active", "true")
+	}
+	var workflows []n8nWorkflow
+	for {
+		var page struct {
+			Data       []n8nWorkflow `json:"data"`
+			NextCursor string        `json:"nextCursor"`
+		}
+		if err := c.get(ctx, "/workflows", query, &page); err != nil {
+			return nil, err
+		}
+		workflows = append(workflows, page.Data...)
+		if page.NextCursor == "" {
+			return workflows, nil
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+}
+
+// memoryNodes returns the names of the enabled Postgres chat memory nodes of a workflow writing to
+// the history table. Whether their credentials point at this database is not known.
+func (w n8nWorkflow) memoryNodes() []string {
+	var names []string
+	for _, node := range w.Nodes {
+		if node.Type != postgresMemoryNode || node.Disabled {
+			continue
+		}
+		table, _ := node.Parameters["tableName"].(string)
+		if table == "" || table == defaultMemoryTable {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+// workflowURL returns the editor URL of a workflow
+func workflowURL(id string) string {
+	return n8nURL + "/workflow/" + url.PathEscape(id)
+}
+
+// GetSessionWorkflowHandler enriches a session with the name and version of the workflow it
+// belongs to, found with the WORKFLOW_* settings and looked up in n8n
+func GetSessionWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	if n8nAPI == nil {
+		respondWithError(w, "The n8n API is not configured", http.StatusBadRequest)
+		return
+	}
+	if !workflowConfig.enabled() {
+		respondWithError(w, "Workflow grouping is not configured", http.StatusBadRequest)
+		return
+	}
+	sessionID := r.PathValue("id")
+
+	var args queryArgs
+	var workflowID sql.NullString
+	err := db.QueryRowContext(r.Context(), fmt.Sprintf(`
+		SELECT MAX(%s)
+		FROM n8n_chat_histories
+		WHERE session_id = %s
+		HAVING COUNT(*) > 0
+	`, workflowConfig.rowExpr(&args), args.add(sessionID)), args...).Scan(&workflowID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to query session workflow")
+		respondWithQueryError(w, err)
+		return
+	}
+	if workflowID.String == "" {
+		respondWithError(w, "No workflow found for the session", http.StatusNotFound)
+		return
+	}
+
+	workflow, err := n8nAPI.workflow(r.Context(), workflowID.String)
+	if errors.Is(err, errWorkflowNotFound) {
+		respondWithError(w, "Workflow not found in n8n", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Str("workflowId", workflowID.String).Msg("Failed to fetch workflow from n8n")
+		respondWithError(w, "Failed to fetch the workflow from n8n", http.StatusBadGateway)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: SessionWorkflow{
+		SessionID:  sessionID,
+		WorkflowID: workflow.ID,
+		Name:       workflow.Name,
+		VersionID:  workflow.VersionID,
+		Active:     workflow.Active,
+		UpdatedAt:  workflow.UpdatedAt,
+		URL:        workflowURL(workflow.ID),
+	}})
+}
+
+// GetMemoryWorkflowsHandler lists the active workflows of n8n with Postgres chat memory writing
+// to the history table, or with includeInactive=true the inactive ones too
+func GetMemoryWorkflowsHandler(w http.ResponseWriter, r *http.Request) {
+	if n8nAPI == nil {
+		respondWithError(w, "The n8n API is not configured", http.StatusBadRequest)
+		return
+	}
+	includeInactive := r.URL.Query().Get("includeInactive") == "true"
+
+	workflows, err := n8nAPI.workflows(r.Context(), !includeInactive)
+	if err != nil {
+		log.Err(err).Msg("Failed to list workflows from n8n")
+		respondWithError(w, "Failed to list the workflows of n8n", http.StatusBadGateway)
+		return
+	}
+
+	memoryWorkflows := []MemoryWorkflow{}
+	for _, workflow := range workflows {
+		nodes := workflow.memoryNodes()
+		if len(nodes) == 0 {
+			continue
+		}
+		memoryWorkflows = append(memoryWorkflows, MemoryWorkflow{
+			ID:        workflow.ID,
+			Name:      workflow.Name,
+			Active:    workflow.Active,
+			VersionID: workflow.VersionID,
+			UpdatedAt: workflow.UpdatedAt,
+			Nodes:     nodes,
+			URL:       workflowURL(workflow.ID),
+		})
+	}
+
+	respondWithJSON(w, DataResponse{Data: memoryWorkflows})
+}
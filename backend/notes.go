@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxNoteLength bounds the text of a session note
+const maxNoteLength = 10000
+
+// SessionNote is freeform triage context attached to a session, such as "refund issued, ticket
+// #1234". Notes can only be changed by their author.
+type SessionNote struct {
+	ID        int64     `json:"id"`
+	SessionID string    `json:"sessionId"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// validate trims the body of a note and checks its length
+func (n *SessionNote) validate() error {
+	n.Body = strings.TrimSpace(n.Body)
+	if n.Body == "" {
+		return errors.New("body is required")
+	}
+	if len(n.Body) > maxNoteLength {
+		return fmt.Errorf("body must be at most %d characters", maxNoteLength)
+	}
+	return nil
+}
+
+func GetSessionNotesHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, session_id, author, body, created_at, updated_at
+		FROM chat_history_session_notes
+		WHERE session_id = $1
+		ORDER BY id
+	`, sessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to query notes")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	notes := []SessionNote{}
+	for rows.Next() {
+		var note SessionNote
+		if err := rows.Scan(&note.ID, &note.SessionID, &note.Author, &note.Body, &note.CreatedAt, &note.UpdatedAt); err != nil {
+			log.Err(err).Msg("Failed to scan note")
+			respondWithQueryError(w, err)
+			return
+		}
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate notes")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: notes})
+}
+
+func CreateSessionNoteHandler(w http.ResponseWriter, r *http.Request) {
+	var note SessionNote
+	if !decodeJSONBody(w, r, &note) {
+		return
+	}
+	note.SessionID, note.Author = r.PathValue("id"), requestIdentity(r)
+	if note.Author == "" {
+		respondWithError(w, noteIdentityError, http.StatusUnauthorized)
+		return
+	}
+	if err := note.validate(); err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM n8n_chat_histories WHERE session_id = $1)`, note.SessionID).Scan(&exists); err != nil {
+		log.Err(err).Msg("Failed to check session")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !exists {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	err := db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_session_notes (session_id, author, body) VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at
+	`, note.SessionID, note.Author, note.Body).Scan(&note.ID, &note.CreatedAt, &note.UpdatedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to create note")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSONStatus(w, DataResponse{Data: note}, http.StatusCreated)
+}
+
+// UpdateSessionNoteHandler replaces the body of a note written by the requester
+func UpdateSessionNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := noteIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	var note SessionNote
+	if !decodeJSONBody(w, r, &note) {
+		return
+	}
+	if err := note.validate(); err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkNoteAuthor(w, r, noteID) {
+		return
+	}
+
+	err := db.QueryRowContext(r.Context(), `
+		UPDATE chat_history_session_notes SET body = $2, updated_at = now()
+		WHERE id = $1
+		RETURNING id, session_id, author, body, created_at, updated_at
+	`, noteID, note.Body).Scan(&note.ID, &note.SessionID, &note.Author, &note.Body, &note.CreatedAt, &note.UpdatedAt)
+	if err != nil {
+		log.Err(err).Int64("note", noteID).Msg("Failed to update note")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: note})
+}
+
+// DeleteSessionNoteHandler removes a note written by the requester
+func DeleteSessionNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID, ok := noteIDFromPath(w, r)
+	if !ok || !checkNoteAuthor(w, r, noteID) {
+		return
+	}
+
+	if _, err := db.ExecContext(r.Context(), `DELETE FROM chat_history_session_notes WHERE id = $1`, noteID); err != nil {
+		log.Err(err).Int64("note", noteID).Msg("Failed to delete note")
+		respondWithQueryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// noteIDFromPath parses the note ID of the path, responding 400 when it is invalid
+func noteIDFromPath(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	noteID, err := strconv.ParseInt(r.PathValue("noteId"), 10, 64)
+	if err != nil {
+		respondWithError(w, "Invalid note ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return noteID, true
+}
+
+// noteIdentityError is the response to anonymous note changes, as authors are matched by identity
+const noteIdentityError = "Notes need a signed-in user or an API key"
+
+// checkNoteAuthor responds 401 to anonymous requests, 404 when the note is not on the session of
+// the path, and 403 when it was written by someone else
+func checkNoteAuthor(w http.ResponseWriter, r *http.Request, noteID int64) bool {
+	identity := requestIdentity(r)
+	if identity == "" {
+		respondWithError(w, noteIdentityError, http.StatusUnauthorized)
+		return false
+	}
+
+	var author string
+	err := db.QueryRowContext(r.Context(), `SELECT author FROM chat_history_session_notes WHERE id = $1 AND session_id = $2`,
+		noteID, r.PathValue("id")).Scan(&author)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, "Note not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		log.Err(err).Int64("note", noteID).Msg("Failed to load note")
+		respondWithQueryError(w, err)
+		return false
+	}
+	if author != identity {
+		respondWithError(w, "Notes can only be changed by their author", http.StatusForbidden)
+		return false
+	}
+	return true
+}
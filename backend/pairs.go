@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PromptPair is a human message with the AI answer that followed it, for fine-tuning and RAG
+// evaluation sets. Context holds the messages before the prompt in the OpenAI role format.
+type PromptPair struct {
+	SessionID  string        `json:"sessionId"`
+	PromptID   int           `json:"promptId"`
+	Prompt     string        `json:"prompt"`
+	ResponseID int           `json:"responseId"`
+	Response   string        `json:"response"`
+	Context    []EvalMessage `json:"context,omitempty"`
+	SentAt     *time.Time    `json:"sentAt,omitempty"`
+}
+
+// GetPromptPairsHandler streams the prompt/response pairs of the sessions matching the listing
+// filters as JSONL, in message order. The answer is the first AI message with content before the
+// next human message, so tool calls in between are skipped. context sets how many preceding
+// messages come with each pair, and from and to select prompts by the timestamp at
+// MESSAGE_TIMESTAMP_PATH or, without one, sessions by their last activity. Pass the promptId of
+// the last pair as after to continue a cut-off download.
+func GetPromptPairsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	location, err := parseTimezone(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseTimeRange(query, location)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (from != nil || to != nil) && len(messageTimestampPath) == 0 && !featureEnabled("summary") {
+		respondWithError(w, "from and to need MESSAGE_TIMESTAMP_PATH or the session summary", http.StatusBadRequest)
+		return
+	}
+	contextSize, _ := strconv.Atoi(query.Get("context"))
+	if contextSize < 0 || contextSize > 100 {
+		respondWithError(w, "context must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	after, _ := strconv.Atoi(query.Get("after"))
+
+	var args queryArgs
+	timestamp := "NULL::timestamptz"
+	if len(messageTimestampPath) > 0 {
+		timestamp = messageTimestampExpr("h.message", &args)
+	}
+	conditions := []string{"h.message->>'type' = 'human'", "COALESCE(h.message->>'content', '') <> ''"}
+	// The listing filters select sessions, so a search match anywhere brings in all of their pairs
+	if sessionConditions := filter.conditions(&args); len(sessionConditions) > 0 {
+		conditions = append(conditions, "h."+sessionHasMessage(strings.Join(sessionConditions, " AND ")))
+	}
+	if after > 0 {
+		conditions = append(conditions, "h.id > "+args.add(after))
+	}
+	if len(messageTimestampPath) > 0 {
+		if from != nil {
+			conditions = append(conditions, timestamp+" >= "+args.add(*from))
+		}
+		if to != nil {
+			conditions = append(conditions, timestamp+" < "+args.add(*to))
+		}
+	} else {
+		var activity []string
+		if from != nil {
+			activity = append(activity, "last_activity >= "+args.add(*from))
+		}
+		if to != nil {
+			activity = append(activity, "last_activity < "+args.add(*to))
+		}
+		if len(activity) > 0 {
+			conditions = append(conditions, "h.session_id IN (SELECT session_id FROM chat_history_sessions_summary "+joinWhere(activity)+")")
+		}
+	}
+	limitClause := ""
+	if limit > 0 {
+		limitClause = "LIMIT " + args.add(limit)
+	}
+
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT h.session_id, h.id, h.message, a.id, a.message, %s, COALESCE(c.messages, '[]'::jsonb)
+		FROM n8n_chat_histories h
+		JOIN LATERAL (
+			SELECT id, message
+			FROM n8n_chat_histories a
+			WHERE a.session_id = h.session_id AND a.id > h.id
+				AND a.message->>'type' = 'ai' AND COALESCE(a.message->>'content', '') <> ''
+				AND NOT EXISTS (
+					SELECT 1 FROM n8n_chat_histories n
+					WHERE n.session_id = h.session_id AND n.id > h.id AND n.id < a.id AND n.message->>'type' = 'human'
+				)
+			ORDER BY id
+			LIMIT 1
+		) a ON true
+		LEFT JOIN LATERAL (
+			SELECT jsonb_agg(p.message ORDER BY p.id) AS messages
+			FROM (
+				SELECT id, message
+				FROM n8n_chat_histories p
+				WHERE p.session_id = h.session_id AND p.id < h.id
+					AND p.message->>'type' IN ('system', 'human', 'ai') AND COALESCE(p.message->>'content', '') <> ''
+				ORDER BY id DESC
+				LIMIT %s
+			) p
+		) c ON true
+		%s
+		ORDER BY h.id
+		%s
+	`, timestamp, args.add(contextSize), joinWhere(conditions), limitClause), args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query prompt pairs")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="prompt-pairs.jsonl"`)
+	writer := bufio.NewWriter(w)
+	defer writer.Flush()
+	encoder := json.NewEncoder(writer)
+
+	for rows.Next() {
+		var pair PromptPair
+		var promptJSON, responseJSON, contextJSON []byte
+		if err := rows.Scan(&pair.SessionID, &pair.PromptID, &promptJSON, &pair.ResponseID, &responseJSON, &pair.SentAt, &contextJSON); err != nil {
+			// Headers are already sent, so the pairs are cut short rather than turned into an error response
+			log.Err(err).Msg("Failed to scan prompt pair")
+			return
+		}
+		// The messages go through the read processors and redaction like every other response
+		var prompt, response Message
+		var messages []Message
+		if err := json.Unmarshal(promptJSON, &prompt); err != nil {
+			log.Err(err).Msg("Failed to decode prompt")
+			return
+		}
+		if err := json.Unmarshal(responseJSON, &response); err != nil {
+			log.Err(err).Msg("Failed to decode prompt response")
+			return
+		}
+		if err := json.Unmarshal(contextJSON, &messages); err != nil {
+			log.Err(err).Msg("Failed to decode prompt pair context")
+			return
+		}
+		read := []*Message{&prompt, &response}
+		for i := range messages {
+			read = append(read, &messages[i])
+		}
+		for _, message := range read {
+			if err := readMessage(r.Context(), pair.SessionID, message); err != nil {
+				log.Err(err).Msg("Failed to process prompt pair")
+				return
+			}
+		}
+		pair.Prompt, pair.Response = prompt.Content, response.Content
+		for _, message := range messages {
+			pair.Context = append(pair.Context, EvalMessage{Role: evalRoles[message.Type], Content: message.Content})
+		}
+		if err := encoder.Encode(pair); err != nil {
+			log.Err(err).Msg("Failed to write prompt pair")
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate prompt pairs")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+)
+
+// dbMaxOpenConns is the size of the connection pool, set by DB_MAX_OPEN_CONNS
+var dbMaxOpenConns = 4
+
+// listingSlots bounds the listings that run their count next to their page query. A page keeps
+// its connection while its rows are streamed and needs the count before the first row is written,
+// so such a listing holds two connections at once. With at most half the pool in these listings
+// they can never all wait on each other; the others run the count first, as a one-connection pool
+// always does.
+var listingSlots chan struct{}
+
+// loadPoolSize reads DB_MAX_OPEN_CONNS
+func loadPoolSize() {
+	if size, err := strconv.Atoi(os.Getenv("DB_MAX_OPEN_CONNS")); err == nil && size > 0 {
+		dbMaxOpenConns = size
+	}
+	listingSlots = make(chan struct{}, dbMaxOpenConns/2)
+}
+
+// countAndQueryChats runs a count and a query selecting chatColumns, concurrently when a listing
+// slot is free. begin receives the count before visit receives the first row. When one query
+// fails the other is cancelled.
+func countAndQueryChats(ctx context.Context, countQuery string, countArgs queryArgs, query string, args queryArgs, begin func(total int), visit func(Chat) error) error {
+	var total int
+	select {
+	case listingSlots <- struct{}{}:
+		defer func() { <-listingSlots }()
+	default:
+		explainQuery(ctx, "count", countQuery, countArgs...)
+		if err := db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+			return err
+		}
+		begin(total)
+		explainQuery(ctx, "chats", query, args...)
+		return queryChats(ctx, query, args, visit)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var countErr error
+	counted := make(chan struct{})
+	go func() {
+		defer close(counted)
+		explainQuery(ctx, "count", countQuery, countArgs...)
+		if countErr = db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); countErr != nil {
+			cancel()
+		}
+	}()
+
+	// The page keeps its connection while waiting for the count, before its first row is passed on
+	begun := false
+	awaitCount := func() error {
+		if !begun {
+			<-counted
+			if countErr != nil {
+				return countErr
+			}
+			begun = true
+			begin(total)
+		}
+		return nil
+	}
+
+	explainQuery(ctx, "chats", query, args...)
+	err := queryChats(ctx, query, args, func(chat Chat) error {
+		if err := awaitCount(); err != nil {
+			return err
+		}
+		return visit(chat)
+	})
+	if err != nil {
+		cancel()
+		<-counted
+		if countErr != nil && !errors.Is(countErr, context.Canceled) {
+			return countErr
+		}
+		return err
+	}
+	return awaitCount()
+}
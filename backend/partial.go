@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// errResponseLimit stops a listing query once the response reached MAX_RESPONSE_ROWS or
+// MAX_RESPONSE_BYTES
+var errResponseLimit = errors.New("response limit reached")
+
+// listingCursor selects the rows of a listing page. Offset and Limit count rows, or sessions when
+// grouping by session, and Skip counts the messages of the first session that were already served.
+// A truncated response returns the cursor of the rows it left out, which the client passes back as
+// ?cursor= along with its other parameters.
+type listingCursor struct {
+	Offset int `json:"o"`
+	Limit  int `json:"l"`
+	Skip   int `json:"s,omitempty"`
+}
+
+func (c listingCursor) encode() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// parseListingCursor decodes a cursor returned by a truncated response
+func parseListingCursor(value string) (listingCursor, error) {
+	var cursor listingCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	if err := json.Unmarshal(decoded, &cursor); err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	if cursor.Offset < 0 || cursor.Limit < 1 || cursor.Limit > maxPageSize || cursor.Skip < 0 || cursor.Skip > limits.MaxSessionMessages {
+		return cursor, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// responseBudget counts the rows of a listing response and their stored size against the limits
+type responseBudget struct {
+	rows  int
+	bytes int
+}
+
+// spend accounts for a row, reporting false when it would exceed a limit. The first row always
+// fits, so a client following cursors makes progress even past an oversized message.
+func (b *responseBudget) spend(chat Chat) bool {
+	if b.rows > 0 && (b.rows+1 > limits.MaxResponseRows || b.bytes+chat.size > limits.MaxResponseBytes) {
+		return false
+	}
+	b.rows++
+	b.bytes += chat.size
+	return true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxMessageContext is the largest number of messages returned on either side of a permalink
+const maxMessageContext = 50
+
+// MessageContext is the response of the permalink endpoint: a message with the messages of its
+// session around it
+type MessageContext struct {
+	SessionID string `json:"sessionId"`
+	Message   Chat   `json:"message"`
+	Position  int    `json:"position"`
+	Total     int    `json:"total"`
+	Before    []Chat `json:"before"`
+	After     []Chat `json:"after"`
+}
+
+// messagePermalink returns the API path of a message and its context
+func messagePermalink(id int64) string {
+	return "/api/v1/chats/by-id/" + strconv.FormatInt(id, 10)
+}
+
+// GetMessageHandler returns a message by ID with up to before/after messages of its session
+// around it, 5 each by default
+func GetMessageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	before, after := 5, 5
+	for name, target := range map[string]*int{"before": &before, "after": &after} {
+		if value := query.Get(name); value != "" {
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 0 || count > maxMessageContext {
+				respondWithError(w, name+" must be between 0 and "+strconv.Itoa(maxMessageContext), http.StatusBadRequest)
+				return
+			}
+			*target = count
+		}
+	}
+
+	response := MessageContext{Before: []Chat{}, After: []Chat{}}
+	err = db.QueryRowContext(r.Context(), `
+		SELECT session_id,
+			(SELECT COUNT(*) FROM n8n_chat_histories s WHERE s.session_id = h.session_id AND s.id < h.id),
+			(SELECT COUNT(*) FROM n8n_chat_histories s WHERE s.session_id = h.session_id)
+		FROM n8n_chat_histories h
+		WHERE id = $1
+	`, id).Scan(&response.SessionID, &response.Position, &response.Total)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Int64("id", id).Msg("Failed to locate message")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	chats, err := queryMessageWindow(r.Context(), response.SessionID, id, before, after)
+	if err != nil {
+		log.Err(err).Int64("id", id).Msg("Failed to load message context")
+		respondWithQueryError(w, err)
+		return
+	}
+	for _, chat := range chats {
+		switch {
+		case int64(chat.ID) < id:
+			response.Before = append(response.Before, chat)
+		case int64(chat.ID) > id:
+			response.After = append(response.After, chat)
+		default:
+			response.Message = chat
+		}
+	}
+
+	respondWithJSON(w, DataResponse{Data: response})
+}
+
+// queryMessageWindow returns the message id with up to before and after messages of its session
+// around it, in insertion order
+func queryMessageWindow(ctx context.Context, sessionID string, id int64, before, after int) ([]Chat, error) {
+	columns := chatColumns()
+	return loadChats(ctx, `
+		(SELECT `+columns+` FROM n8n_chat_histories WHERE session_id = $1 AND id < $2 ORDER BY id DESC LIMIT $3)
+		UNION ALL
+		(SELECT `+columns+` FROM n8n_chat_histories WHERE session_id = $1 AND id >= $2 ORDER BY id LIMIT $4)
+		ORDER BY id
+	`, sessionID, id, before, after+1)
+}
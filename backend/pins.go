@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MessagePin marks a key message of a session for teammates. Index is the position of the message
+// in the session, which locates it in the messages of the session listing.
+type MessagePin struct {
+	MessageID int64     `json:"messageId"`
+	Index     int       `json:"index"`
+	PinnedBy  string    `json:"pinnedBy"`
+	PinnedAt  time.Time `json:"pinnedAt"`
+}
+
+// loadPins returns the pins of the given sessions in message order, keyed by session
+func loadPins(ctx context.Context, sessionIDs []string) (map[string][]MessagePin, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.session_id, p.message_id, p.pinned_by, p.pinned_at,
+			(SELECT COUNT(*) FROM n8n_chat_histories h WHERE h.session_id = p.session_id AND h.id < p.message_id)
+		FROM chat_history_pinned_messages p
+		WHERE p.session_id = ANY($1)
+		ORDER BY p.session_id, p.message_id
+	`, sessionIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := make(map[string][]MessagePin)
+	for rows.Next() {
+		var sessionID string
+		var pin MessagePin
+		if err := rows.Scan(&sessionID, &pin.MessageID, &pin.PinnedBy, &pin.PinnedAt, &pin.Index); err != nil {
+			return nil, err
+		}
+		pins[sessionID] = append(pins[sessionID], pin)
+	}
+	return pins, rows.Err()
+}
+
+// loadSessionDetails returns the pins of the given sessions and the number of their messages that
+// the per-session message limit leaves out
+func loadSessionDetails(ctx context.Context, sessionIDs []string, messageLimit int) (map[string]SessionDetails, error) {
+	pins, err := loadPins(ctx, sessionIDs)
+	if err != nil {
+		return nil, err
+	}
+	details := make(map[string]SessionDetails, len(sessionIDs))
+	for sessionID, pinned := range pins {
+		details[sessionID] = SessionDetails{Pinned: pinned}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT session_id, COUNT(*) - $2
+		FROM n8n_chat_histories
+		WHERE session_id = ANY($1)
+		GROUP BY session_id
+		HAVING COUNT(*) > $2
+	`, sessionIDs, messageLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sessionID string
+		var omitted int
+		if err := rows.Scan(&sessionID, &omitted); err != nil {
+			return nil, err
+		}
+		sessionDetails := details[sessionID]
+		sessionDetails.Omitted = omitted
+		details[sessionID] = sessionDetails
+	}
+	return details, rows.Err()
+}
+
+func GetSessionPinsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	pins, err := loadPins(r.Context(), []string{sessionID})
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to load pins")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	pinned := pins[sessionID]
+	if pinned == nil {
+		pinned = []MessagePin{}
+	}
+	respondWithJSON(w, DataResponse{Data: pinned})
+}
+
+// PinMessageHandler pins a message of a session. Pinning a pinned message keeps the original pin.
+func PinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	messageID, err := strconv.ParseInt(r.PathValue("messageId"), 10, 64)
+	if err != nil {
+		respondWithError(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var index int
+	err = db.QueryRowContext(r.Context(), `
+		SELECT (SELECT COUNT(*) FROM n8n_chat_histories s WHERE s.session_id = h.session_id AND s.id < h.id)
+		FROM n8n_chat_histories h
+		WHERE h.id = $1 AND h.session_id = $2
+	`, messageID, sessionID).Scan(&index)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, "Message not found in session", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to check pinned message")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	pin := MessagePin{MessageID: messageID, Index: index}
+	err = db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_pinned_messages (session_id, message_id, pinned_by) VALUES ($1, $2, $3)
+		ON CONFLICT (session_id, message_id) DO UPDATE SET session_id = EXCLUDED.session_id
+		RETURNING pinned_by, pinned_at
+	`, sessionID, messageID, auditActor(r)).Scan(&pin.PinnedBy, &pin.PinnedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to pin message")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: pin})
+}
+
+func UnpinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.ParseInt(r.PathValue("messageId"), 10, 64)
+	if err != nil {
+		respondWithError(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM chat_history_pinned_messages WHERE session_id = $1 AND message_id = $2`,
+		r.PathValue("id"), messageID)
+	if err != nil {
+		log.Err(err).Msg("Failed to unpin message")
+		respondWithQueryError(w, err)
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		respondWithError(w, "Message is not pinned", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
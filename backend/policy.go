@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// policyCheckpoint names the progress of the policy worker in the checkpoint table
+	policyCheckpoint = "policy-flags"
+	// policyExcerptContext is the number of characters kept on each side of a match
+	policyExcerptContext = 40
+)
+
+// PolicyRule flags messages containing any of Words, as whole words in any case, or matching any
+// of Patterns. WordsFile names a file with more words, one per line. Roles limits the rule to
+// messages of those types; without it every human and AI message is checked.
+type PolicyRule struct {
+	Name      string   `json:"name"`
+	Words     []string `json:"words,omitempty"`
+	WordsFile string   `json:"wordsFile,omitempty"`
+	Patterns  []string `json:"patterns,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+
+	expressions []*regexp.Regexp
+}
+
+// appliesTo reports whether messages of the given type are checked by the rule
+func (rule PolicyRule) appliesTo(role string) bool {
+	if len(rule.Roles) == 0 {
+		return role == "human" || role == "ai"
+	}
+	for _, allowed := range rule.Roles {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns an excerpt around the first match of the rule in text
+func (rule PolicyRule) match(text string) (string, bool) {
+	for _, expression := range rule.expressions {
+		if location := expression.FindStringIndex(text); location != nil {
+			return policyExcerpt(text, location[0], location[1]), true
+		}
+	}
+	return "", false
+}
+
+// policyExcerpt cuts the match at start:end out of text with some context on each side
+func policyExcerpt(text string, start, end int) string {
+	from, to := max(start-policyExcerptContext, 0), min(end+policyExcerptContext, len(text))
+	// Move inwards to rune boundaries so the excerpt stays valid UTF-8
+	for from < start && !utf8.RuneStart(text[from]) {
+		from++
+	}
+	for to < len(text) && to > end && !utf8.RuneStart(text[to]) {
+		to--
+	}
+	excerpt := text[from:to]
+	if from > 0 {
+		excerpt = "…" + excerpt
+	}
+	if to < len(text) {
+		excerpt += "…"
+	}
+	return excerpt
+}
+
+// policyRules are the configured rules, in the order they are checked
+var policyRules []PolicyRule
+
+// loadPolicyRules reads POLICY_RULES, a JSON array of rules
+func loadPolicyRules() error {
+	value := strings.TrimSpace(os.Getenv("POLICY_RULES"))
+	if value == "" {
+		return nil
+	}
+
+	var rules []PolicyRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return fmt.Errorf("POLICY_RULES: %w", err)
+	}
+	names := make(map[string]bool)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" || names[rule.Name] || strings.HasPrefix(rule.Name, classifierRulePrefix) {
+			return fmt.Errorf("POLICY_RULES: every rule needs a unique name not starting with %q", classifierRulePrefix)
+		}
+		names[rule.Name] = true
+
+		words := rule.Words
+		if rule.WordsFile != "" {
+			content, err := os.ReadFile(rule.WordsFile)
+			if err != nil {
+				return fmt.Errorf("POLICY_RULES: rule %q: %w", rule.Name, err)
+			}
+			for _, line := range strings.Split(string(content), "\n") {
+				if word := strings.TrimSpace(line); word != "" && !strings.HasPrefix(word, "#") {
+					words = append(words, word)
+				}
+			}
+		}
+		if len(words) > 0 {
+			quoted := make([]string, len(words))
+			for j, word := range words {
+				quoted[j] = regexp.QuoteMeta(word)
+			}
+			rule.expressions = append(rule.expressions, regexp.MustCompile(`(?i)\b(?:`+strings.Join(quoted, "|")+`)\b`))
+		}
+		for _, pattern := range rule.Patterns {
+			expression, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("POLICY_RULES: rule %q: %w", rule.Name, err)
+			}
+			rule.expressions = append(rule.expressions, expression)
+		}
+		if len(rule.expressions) == 0 {
+			return fmt.Errorf("POLICY_RULES: rule %q has no words or patterns", rule.Name)
+		}
+	}
+	policyRules = rules
+	return nil
+}
+
+// classifierRulePrefix starts the rule name of flags raised by the classifier, followed by the category
+const classifierRulePrefix = "classifier:"
+
+// policyClassifier asks a model behind an OpenAI-compatible chat completions API whether a
+// message breaks the content policy
+type policyClassifier struct {
+	url        string
+	key        string
+	model      string
+	categories []string
+	roles      map[string]bool
+	client     *http.Client
+}
+
+// classifier is the configured classifier, nil when no model is set
+var classifier *policyClassifier
+
+// loadPolicyClassifier reads POLICY_CLASSIFIER_MODEL, which enables the classifier, with
+// POLICY_CLASSIFIER_API_URL, POLICY_CLASSIFIER_API_KEY, the categories to look for in
+// POLICY_CLASSIFIER_CATEGORIES and the message types to send in POLICY_CLASSIFIER_ROLES
+func loadPolicyClassifier() error {
+	model := os.Getenv("POLICY_CLASSIFIER_MODEL")
+	if model == "" {
+		return nil
+	}
+	classifier = &policyClassifier{
+		url:    getEnvOrDefault("POLICY_CLASSIFIER_API_URL", "https://api.openai.com/v1/chat/completions"),
+		key:    os.Getenv("POLICY_CLASSIFIER_API_KEY"),
+		model:  model,
+		roles:  map[string]bool{},
+		client: &http.Client{Timeout: getEnvDuration("POLICY_CLASSIFIER_TIMEOUT", 30*time.Second)},
+	}
+	for _, category := range strings.Split(getEnvOrDefault("POLICY_CLASSIFIER_CATEGORIES", "harassment,hate,sexual,self-harm,violence"), ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			classifier.categories = append(classifier.categories, category)
+		}
+	}
+	if len(classifier.categories) == 0 {
+		return errors.New("POLICY_CLASSIFIER_CATEGORIES must name at least one category")
+	}
+	for _, role := range strings.Split(getEnvOrDefault("POLICY_CLASSIFIER_ROLES", "ai"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			classifier.roles[role] = true
+		}
+	}
+	return nil
+}
+
+// policyVerdict is the answer the classifier is asked to give
+type policyVerdict struct {
+	Flagged  bool   `json:"flagged"`
+	Category string `json:"category"`
+	Reason   string `json:"reason"`
+}
+
+// classify returns the verdict of the model on text
+func (c *policyClassifier) classify(ctx context.Context, text string) (policyVerdict, error) {
+	prompt := fmt.Sprintf(`You review chat messages for content policy violations in these categories: %s.
+Answer with a JSON object {"flagged": boolean, "category": string, "reason": string}, where category is one of the
+categories when flagged and reason explains the decision in one sentence.`, strings.Join(c.categories, ", "))
+	payload, err := json.Marshal(map[string]interface{}{
+		"model": c.model,
+		"messages": []map[string]string{
+			{"role": "system", "content": prompt},
+			{"role": "user", "content": text},
+		},
+		"response_format": map[string]string{"type": "json_object"},
+		"temperature":     0,
+	})
+	if err != nil {
+		return policyVerdict{}, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return policyVerdict{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if c.key != "" {
+		request.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return policyVerdict{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return policyVerdict{}, fmt.Errorf("classifier API responded with status %d: %s", response.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var result struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return policyVerdict{}, err
+	}
+	if len(result.Choices) == 0 {
+		return policyVerdict{}, errors.New("classifier API returned no choices")
+	}
+	var verdict policyVerdict
+	if err := json.Unmarshal([]byte(result.Choices[0].Message.Content), &verdict); err != nil {
+		return policyVerdict{}, fmt.Errorf("classifier returned an invalid verdict: %w", err)
+	}
+	if verdict.Flagged {
+		// Categories outside the configured ones are kept apart rather than trusted
+		known := false
+		for _, category := range c.categories {
+			known = known || category == verdict.Category
+		}
+		if !known {
+			verdict.Category = "other"
+		}
+	}
+	return verdict, nil
+}
+
+// PolicyFlag is a message flagged by a policy rule or by the classifier
+type PolicyFlag struct {
+	ID        int64     `json:"id"`
+	MessageID int64     `json:"messageId"`
+	SessionID string    `json:"sessionId"`
+	Role      string    `json:"role"`
+	Rule      string    `json:"rule"`
+	Excerpt   string    `json:"excerpt"`
+	FlaggedAt time.Time `json:"flaggedAt"`
+}
+
+// policyJob checks the messages added since its checkpoint against the policy rules
+type policyJob struct {
+	batchSize int
+}
+
+// newPolicyJob reads POLICY_BATCH_SIZE from the environment. Batches are small by default, as
+// the classifier is called once per message.
+func newPolicyJob() policyJob {
+	job := policyJob{batchSize: 200}
+	if batchSize, err := strconv.Atoi(os.Getenv("POLICY_BATCH_SIZE")); err == nil && batchSize > 0 {
+		job.batchSize = batchSize
+	}
+	return job
+}
+
+// run catches up with the chat table, one batch of rows at a time
+func (j policyJob) run(ctx context.Context) error {
+	if len(policyRules) == 0 && classifier == nil {
+		return nil
+	}
+	for {
+		processed, err := j.checkBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if processed < j.batchSize {
+			return nil
+		}
+	}
+}
+
+// checkBatch flags the next batch of chat rows. A failed classifier call fails the batch, so it
+// is retried on the next run rather than skipped.
+func (j policyJob) checkBatch(ctx context.Context) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var checkpoint int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT last_id FROM chat_history_publish_checkpoints WHERE publisher = $1 FOR UPDATE
+	`, policyCheckpoint).Scan(&checkpoint); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, session_id, COALESCE(message->>'type', ''), COALESCE(message->>'content', '')
+		FROM n8n_chat_histories
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+	`, checkpoint, j.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	var messages []PolicyFlag
+	lastID := checkpoint
+	for rows.Next() {
+		var message PolicyFlag
+		if err := rows.Scan(&message.MessageID, &message.SessionID, &message.Role, &message.Excerpt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		lastID = message.MessageID
+		messages = append(messages, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	var flags []PolicyFlag
+	for _, message := range messages {
+		content := message.Excerpt
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+		for _, rule := range policyRules {
+			if !rule.appliesTo(message.Role) {
+				continue
+			}
+			if excerpt, matched := rule.match(content); matched {
+				flag := message
+				flag.Rule, flag.Excerpt = rule.Name, excerpt
+				flags = append(flags, flag)
+			}
+		}
+		if classifier != nil && classifier.roles[message.Role] {
+			verdict, err := classifier.classify(ctx, content)
+			if err != nil {
+				return 0, fmt.Errorf("classifying message %d: %w", message.MessageID, err)
+			}
+			if verdict.Flagged {
+				flag := message
+				flag.Rule, flag.Excerpt = classifierRulePrefix+verdict.Category, verdict.Reason
+				flags = append(flags, flag)
+			}
+		}
+	}
+
+	for _, flag := range flags {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO chat_history_policy_flags (message_id, session_id, role, rule, excerpt)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (message_id, rule) DO NOTHING
+		`, flag.MessageID, flag.SessionID, flag.Role, flag.Rule, flag.Excerpt); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE chat_history_publish_checkpoints SET last_id = $2, updated_at = now() WHERE publisher = $1
+	`, policyCheckpoint, lastID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if len(flags) > 0 {
+		log.Info().Int("flags", len(flags)).Int64("lastId", lastID).Msg("Flagged messages against the content policy")
+	}
+	return len(messages), nil
+}
+
+// policyFlagCondition returns the condition selecting sessions with a message flagged by rule,
+// or by any rule when it is "any"
+func policyFlagCondition(args *queryArgs, rule string) string {
+	if rule == "any" {
+		return "session_id IN (SELECT session_id FROM chat_history_policy_flags)"
+	}
+	return "session_id IN (SELECT session_id FROM chat_history_policy_flags WHERE rule = " + args.add(rule) + ")"
+}
+
+// GetPolicyFlagsHandler lists flagged messages, newest first, for the sessions matching the
+// listing filters. rule and role narrow down the flags, and before takes the id of the last flag
+// of the previous page.
+func GetPolicyFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 500 {
+		limit = 100
+	}
+
+	var args queryArgs
+	var conditions []string
+	if sessionConditions := filter.conditions(&args); len(sessionConditions) > 0 {
+		conditions = append(conditions, fmt.Sprintf("session_id IN (SELECT session_id FROM n8n_chat_histories %s)", joinWhere(sessionConditions)))
+	}
+	if rule := query.Get("rule"); rule != "" {
+		conditions = append(conditions, "rule = "+args.add(rule))
+	}
+	if role := query.Get("role"); role != "" {
+		conditions = append(conditions, "role = "+args.add(role))
+	}
+	if before, err := strconv.ParseInt(query.Get("before"), 10, 64); err == nil && before > 0 {
+		conditions = append(conditions, "id < "+args.add(before))
+	}
+
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT id, message_id, session_id, role, rule, excerpt, flagged_at
+		FROM chat_history_policy_flags
+		%s
+		ORDER BY id DESC
+		LIMIT %s
+	`, joinWhere(conditions), args.add(limit)), args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query policy flags")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	flags := []PolicyFlag{}
+	for rows.Next() {
+		var flag PolicyFlag
+		if err := rows.Scan(&flag.ID, &flag.MessageID, &flag.SessionID, &flag.Role, &flag.Rule, &flag.Excerpt, &flag.FlaggedAt); err != nil {
+			log.Err(err).Msg("Failed to scan policy flag")
+			respondWithQueryError(w, err)
+			return
+		}
+		flags = append(flags, flag)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate policy flags")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: flags})
+}
+
+// PolicyRuleCount is the number of flagged messages and sessions of a rule and message type
+type PolicyRuleCount struct {
+	Rule     string `json:"rule"`
+	Role     string `json:"role"`
+	Messages int    `json:"messages"`
+	Sessions int    `json:"sessions"`
+}
+
+// PolicyStats summarises the flags of the sessions matching the filters
+type PolicyStats struct {
+	FlaggedMessages int               `json:"flaggedMessages"`
+	FlaggedSessions int               `json:"flaggedSessions"`
+	Rules           []PolicyRuleCount `json:"rules"`
+}
+
+// GetPolicyStatsHandler counts the flagged messages and sessions per rule and message type
+func GetPolicyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseChatFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Filter conditions refer to chat columns, so they select sessions from the chat table
+	var args queryArgs
+	sessions := ""
+	if conditions := filter.conditions(&args); len(conditions) > 0 {
+		sessions = fmt.Sprintf("WHERE session_id IN (SELECT session_id FROM n8n_chat_histories %s)", joinWhere(conditions))
+	}
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT rule, role, COUNT(DISTINCT message_id), COUNT(DISTINCT session_id),
+			(SELECT COUNT(DISTINCT message_id) FROM chat_history_policy_flags %[1]s),
+			(SELECT COUNT(DISTINCT session_id) FROM chat_history_policy_flags %[1]s)
+		FROM chat_history_policy_flags
+		%[1]s
+		GROUP BY rule, role
+		ORDER BY COUNT(DISTINCT message_id) DESC, rule, role
+	`, sessions), args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query policy stats")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	stats := PolicyStats{Rules: []PolicyRuleCount{}}
+	for rows.Next() {
+		var count PolicyRuleCount
+		if err := rows.Scan(&count.Rule, &count.Role, &count.Messages, &count.Sessions, &stats.FlaggedMessages, &stats.FlaggedSessions); err != nil {
+			log.Err(err).Msg("Failed to scan policy stats")
+			respondWithQueryError(w, err)
+			return
+		}
+		stats.Rules = append(stats.Rules, count)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate policy stats")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: stats})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxPinnedSessions bounds the sessions a user can pin
+const maxPinnedSessions = 100
+
+// Preferences are the UI settings of a user. DefaultFilters holds the filter parameters of the
+// chat listing as a query string, such as tag=vip&lang=de.
+type Preferences struct {
+	PageSize       int        `json:"pageSize,omitempty"`
+	DefaultFilters string     `json:"defaultFilters"`
+	Theme          string     `json:"theme"`
+	PinnedSessions []string   `json:"pinnedSessions"`
+	UpdatedAt      *time.Time `json:"updatedAt,omitempty"`
+}
+
+// validThemes lists the themes of the frontend
+var validThemes = map[string]bool{"": true, "system": true, "light": true, "dark": true}
+
+// validate checks the preferences a user sends
+func (p *Preferences) validate() error {
+	if p.PageSize < 0 || p.PageSize > maxPageSize {
+		return fmt.Errorf("pageSize must be between 1 and %d", maxPageSize)
+	}
+	query, err := url.ParseQuery(p.DefaultFilters)
+	if err != nil {
+		return errors.New("defaultFilters must be a query string")
+	}
+	if _, err := parseChatFilter(query); err != nil {
+		return fmt.Errorf("defaultFilters: %w", err)
+	}
+	if !validThemes[p.Theme] {
+		return errors.New("theme must be system, light or dark")
+	}
+	if p.PinnedSessions == nil {
+		p.PinnedSessions = []string{}
+	}
+	if len(p.PinnedSessions) > maxPinnedSessions {
+		return fmt.Errorf("at most %d sessions can be pinned", maxPinnedSessions)
+	}
+	return nil
+}
+
+// preferencesOwner returns the identity preferences are stored under: the SSO user, or the API
+// key for clients without one
+func preferencesOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if user := requestUser(r); user != "" {
+		return "user:" + user, true
+	}
+	if key, ok := r.Context().Value(usageRowsKey{}).(string); ok && key != anonymousUsage {
+		return "api-key:" + key, true
+	}
+	respondWithError(w, "Preferences need an authenticated user", http.StatusUnauthorized)
+	return "", false
+}
+
+// GetPreferencesHandler returns the preferences of the requesting user, empty until first saved
+func GetPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := preferencesOwner(w, r)
+	if !ok {
+		return
+	}
+
+	preferences := Preferences{PinnedSessions: []string{}}
+	var stored []byte
+	var updatedAt time.Time
+	err := db.QueryRowContext(r.Context(), `
+		SELECT preferences, updated_at FROM chat_history_preferences WHERE owner = $1
+	`, owner).Scan(&stored, &updatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Err(err).Msg("Failed to load preferences")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err == nil {
+		if err := json.Unmarshal(stored, &preferences); err != nil {
+			log.Err(err).Msg("Failed to decode preferences")
+			respondWithError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		preferences.UpdatedAt = &updatedAt
+	}
+
+	respondWithJSON(w, DataResponse{Data: preferences})
+}
+
+// PutPreferencesHandler replaces the preferences of the requesting user
+func PutPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := preferencesOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var preferences Preferences
+	if !decodeJSONBody(w, r, &preferences) {
+		return
+	}
+	if err := preferences.validate(); err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	preferences.UpdatedAt = nil
+
+	stored, _ := json.Marshal(preferences)
+	var updatedAt time.Time
+	err := db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_preferences (owner, preferences) VALUES ($1, $2)
+		ON CONFLICT (owner) DO UPDATE SET preferences = EXCLUDED.preferences, updated_at = now()
+		RETURNING updated_at
+	`, owner, string(stored)).Scan(&updatedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to store preferences")
+		respondWithQueryError(w, err)
+		return
+	}
+	preferences.UpdatedAt = &updatedAt
+
+	respondWithJSON(w, DataResponse{Data: preferences})
+}
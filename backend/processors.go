@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"plugin"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ProcessorStage is when a processor runs
+type ProcessorStage string
+
+const (
+	// ReadStage runs on every message the API returns or publishes. Changes are not stored.
+	ReadStage ProcessorStage = "read"
+	// IngestStage runs once on every new row, and its changes are written back to the chat table
+	IngestStage ProcessorStage = "ingest"
+
+	// processorCheckpoint names the progress of the ingest processors in the checkpoint table
+	processorCheckpoint = "message-processors"
+)
+
+// Processor normalizes, enriches or redacts chat messages. The message is the stored JSON document
+// decoded with numbers as json.Number, and the processor changes it in place.
+type Processor interface {
+	Process(ctx context.Context, stage ProcessorStage, sessionID string, message map[string]interface{}) error
+}
+
+// ProcessorFactory builds a compiled-in processor from the config of its PROCESSORS entry
+type ProcessorFactory func(config json.RawMessage) (Processor, error)
+
+// processorFactories holds the compiled-in processors by name. Deployments add their own with
+// RegisterProcessor from an init function in a file of their build.
+var processorFactories = map[string]ProcessorFactory{
+	"move":   newMoveProcessor,
+	"script": newScriptProcessor,
+}
+
+// RegisterProcessor makes a compiled-in processor available to PROCESSORS under name
+func RegisterProcessor(name string, factory ProcessorFactory) {
+	processorFactories[name] = factory
+}
+
+// ProcessorConfig is an entry of PROCESSORS. Name selects a compiled-in processor and Plugin the
+// path of a Go plugin instead; Stages defaults to read.
+type ProcessorConfig struct {
+	Name   string           `json:"name,omitempty"`
+	Plugin string           `json:"plugin,omitempty"`
+	Stages []ProcessorStage `json:"stages,omitempty"`
+	Config json.RawMessage  `json:"config,omitempty"`
+}
+
+// configuredProcessor is a processor with the stages it is enabled for
+type configuredProcessor struct {
+	name      string
+	processor Processor
+	stages    map[ProcessorStage]bool
+}
+
+// processors are the configured processors, in the order they run
+var processors []configuredProcessor
+
+// loadProcessors reads PROCESSORS, a JSON array of processors in the order they run, or the file
+// named by PROCESSORS_FILE holding the array
+func loadProcessors() error {
+	value := strings.TrimSpace(os.Getenv("PROCESSORS"))
+	if path := os.Getenv("PROCESSORS_FILE"); path != "" {
+		if value != "" {
+			return errors.New("set either PROCESSORS or PROCESSORS_FILE")
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("PROCESSORS_FILE: %w", err)
+		}
+		value = strings.TrimSpace(string(content))
+	}
+	if value == "" {
+		return nil
+	}
+
+	var configs []ProcessorConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return fmt.Errorf("PROCESSORS: %w", err)
+	}
+	for i, config := range configs {
+		configured := configuredProcessor{stages: map[ProcessorStage]bool{}}
+		var err error
+		switch {
+		case config.Name != "" && config.Plugin != "":
+			return fmt.Errorf("PROCESSORS: entry %d sets both name and plugin", i)
+		case config.Plugin != "":
+			configured.name = config.Plugin
+			configured.processor, err = openPluginProcessor(config.Plugin, config.Config)
+		case config.Name != "":
+			factory, ok := processorFactories[config.Name]
+			if !ok {
+				return fmt.Errorf("PROCESSORS: unknown processor %q", config.Name)
+			}
+			configured.name = config.Name
+			configured.processor, err = factory(config.Config)
+		default:
+			return fmt.Errorf("PROCESSORS: entry %d needs a name or a plugin", i)
+		}
+		if err != nil {
+			return fmt.Errorf("PROCESSORS: %s: %w", configured.name, err)
+		}
+
+		if len(config.Stages) == 0 {
+			config.Stages = []ProcessorStage{ReadStage}
+		}
+		for _, stage := range config.Stages {
+			if stage != ReadStage && stage != IngestStage {
+				return fmt.Errorf("PROCESSORS: %s: stage must be read or ingest", configured.name)
+			}
+			configured.stages[stage] = true
+		}
+		processors = append(processors, configured)
+		log.Info().Str("processor", configured.name).Interface("stages", config.Stages).Msg("Message processor loaded")
+	}
+	return nil
+}
+
+// processorsFor reports whether any processor runs in stage
+func processorsFor(stage ProcessorStage) bool {
+	for _, configured := range processors {
+		if configured.stages[stage] {
+			return true
+		}
+	}
+	return false
+}
+
+// runProcessors passes a decoded message through the processors of stage
+func runProcessors(ctx context.Context, stage ProcessorStage, sessionID string, document map[string]interface{}) error {
+	for _, configured := range processors {
+		if !configured.stages[stage] {
+			continue
+		}
+		if err := configured.processor.Process(ctx, stage, sessionID, document); err != nil {
+			return fmt.Errorf("processor %s: %w", configured.name, err)
+		}
+	}
+	return nil
+}
+
+// processRawMessage passes a message in its stored JSON form through the processors of stage
+func processRawMessage(ctx context.Context, stage ProcessorStage, sessionID string, raw json.RawMessage) (json.RawMessage, error) {
+	if !processorsFor(stage) {
+		return raw, nil
+	}
+	decoded, err := decodeMessageDocument(raw)
+	if err != nil {
+		return nil, err
+	}
+	document, ok := decoded.(map[string]interface{})
+	if !ok {
+		return raw, nil
+	}
+	if err := runProcessors(ctx, stage, sessionID, document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// processMessage passes a decoded message through the read processors
+func processMessage(ctx context.Context, sessionID string, message *Message) error {
+	if !processorsFor(ReadStage) {
+		return nil
+	}
+	raw, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	processed, err := processRawMessage(ctx, ReadStage, sessionID, raw)
+	if err != nil {
+		return err
+	}
+	*message = Message{}
+	return json.Unmarshal(processed, message)
+}
+
+// readMessage prepares a message read from the database for a response: it runs the read
+// processors and strips REDACT_PATHS
+func readMessage(ctx context.Context, sessionID string, message *Message) error {
+	if err := processMessage(ctx, sessionID, message); err != nil {
+		return err
+	}
+	redactMessage(message)
+	return nil
+}
+
+// pluginProcessor calls the Process function of a Go plugin. Plugins cannot share types with
+// this package, so they export functions with standard types only:
+//
+//	func Configure(config json.RawMessage) error // optional
+//	func Process(ctx context.Context, stage string, sessionID string, message map[string]interface{}) error
+type pluginProcessor struct {
+	process func(ctx context.Context, stage string, sessionID string, message map[string]interface{}) error
+}
+
+func (p pluginProcessor) Process(ctx context.Context, stage ProcessorStage, sessionID string, message map[string]interface{}) error {
+	return p.process(ctx, string(stage), sessionID, message)
+}
+
+// openPluginProcessor loads the Go plugin at path, which must be built with the same Go version
+// and dependency versions as the service
+func openPluginProcessor(path string, config json.RawMessage) (Processor, error) {
+	opened, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if symbol, err := opened.Lookup("Configure"); err == nil {
+		configure, ok := symbol.(func(json.RawMessage) error)
+		if !ok {
+			return nil, fmt.Errorf("Configure has type %s", reflect.TypeOf(symbol))
+		}
+		if err := configure(config); err != nil {
+			return nil, err
+		}
+	}
+	symbol, err := opened.Lookup("Process")
+	if err != nil {
+		return nil, err
+	}
+	process, ok := symbol.(func(context.Context, string, string, map[string]interface{}) error)
+	if !ok {
+		return nil, fmt.Errorf("Process has type %s", reflect.TypeOf(symbol))
+	}
+	return pluginProcessor{process: process}, nil
+}
+
+// moveProcessor moves the value at one path of a message to another, such as a model name that
+// some workflows store under a different key
+type moveProcessor struct {
+	from, to []string
+}
+
+func newMoveProcessor(config json.RawMessage) (Processor, error) {
+	var settings struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.Unmarshal(config, &settings); err != nil {
+		return nil, err
+	}
+	from, err := parseJSONPath(settings.From)
+	if err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+	to, err := parseJSONPath(settings.To)
+	if err != nil {
+		return nil, fmt.Errorf("to: %w", err)
+	}
+	return moveProcessor{from: from, to: to}, nil
+}
+
+// Process leaves messages without a value at the source path, and values at the target path, alone
+func (p moveProcessor) Process(ctx context.Context, stage ProcessorStage, sessionID string, message map[string]interface{}) error {
+	parent := message
+	for _, key := range p.from[:len(p.from)-1] {
+		child, ok := parent[key].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		parent = child
+	}
+	value, ok := parent[p.from[len(p.from)-1]]
+	if !ok {
+		return nil
+	}
+
+	target := message
+	for _, key := range p.to[:len(p.to)-1] {
+		child, ok := target[key].(map[string]interface{})
+		if !ok {
+			if target[key] != nil {
+				return nil
+			}
+			child = map[string]interface{}{}
+			target[key] = child
+		}
+		target = child
+	}
+	if _, exists := target[p.to[len(p.to)-1]]; exists {
+		return nil
+	}
+	target[p.to[len(p.to)-1]] = value
+	delete(parent, p.from[len(p.from)-1])
+	return nil
+}
+
+// processorJob runs the ingest processors on the rows added since its checkpoint and stores the
+// messages they changed
+type processorJob struct {
+	batchSize int
+}
+
+// newProcessorJob reads PROCESSOR_BATCH_SIZE from the environment
+func newProcessorJob() processorJob {
+	job := processorJob{batchSize: 1000}
+	if batchSize, err := strconv.Atoi(os.Getenv("PROCESSOR_BATCH_SIZE")); err == nil && batchSize > 0 {
+		job.batchSize = batchSize
+	}
+	return job
+}
+
+// run catches up with the chat table, one batch of rows at a time
+func (j processorJob) run(ctx context.Context) error {
+	for {
+		processed, err := j.processBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if processed < j.batchSize {
+			return nil
+		}
+	}
+}
+
+// processBatch runs the ingest processors on the next batch of chat rows. A failing processor
+// fails the batch, so no row is skipped.
+func (j processorJob) processBatch(ctx context.Context) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var checkpoint int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT last_id FROM chat_history_publish_checkpoints WHERE publisher = $1 FOR UPDATE
+	`, processorCheckpoint).Scan(&checkpoint); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, session_id, message FROM n8n_chat_histories WHERE id > $1 ORDER BY id LIMIT $2
+	`, checkpoint, j.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	type processedRow struct {
+		id      int64
+		message json.RawMessage
+	}
+	var changed []processedRow
+	lastID, processed := checkpoint, 0
+	for rows.Next() {
+		var id int64
+		var sessionID string
+		var raw json.RawMessage
+		if err := rows.Scan(&id, &sessionID, &raw); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		lastID = id
+		processed++
+
+		// Both sides are compared in the form json.Marshal gives, as jsonb does not keep key order
+		decoded, err := decodeMessageDocument(raw)
+		if err != nil {
+			log.Warn().Err(err).Int64("messageId", id).Msg("Skipping undecodable message in processors")
+			continue
+		}
+		original, _ := json.Marshal(decoded)
+		message, err := processRawMessage(ctx, IngestStage, sessionID, original)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("message %d: %w", id, err)
+		}
+		if !bytes.Equal(message, original) {
+			changed = append(changed, processedRow{id: id, message: message})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if processed == 0 {
+		return 0, nil
+	}
+
+	for _, row := range changed {
+		if _, err := tx.ExecContext(ctx, `UPDATE n8n_chat_histories SET message = $2 WHERE id = $1`, row.id, string(row.message)); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE chat_history_publish_checkpoints SET last_id = $2, updated_at = now() WHERE publisher = $1
+	`, processorCheckpoint, lastID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if len(changed) > 0 {
+		log.Info().Int("messages", len(changed)).Int64("lastId", lastID).Msg("Stored messages changed by processors")
+	}
+	return processed, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// protobufListing encodes the listing with the schema in proto/chat_history.proto. The messages
+// are small enough to be written by hand with protowire, which keeps generated code out of the
+// tree; the free-form message fields use the well-known Struct and ListValue types.
+//
+// Top-level repeated fields need no length prefix, so chats are streamed as they are scanned.
+// A session map entry is length-prefixed, so only the messages of the current session are held.
+type protobufListing struct {
+	*responseStream
+	groupBy        string
+	pagination     PaginationResponse
+	currentSession string
+	sessionBuf     []byte
+	inSession      bool
+}
+
+func newProtobufListing(w http.ResponseWriter, groupBy string) *protobufListing {
+	return &protobufListing{responseStream: newResponseStream(w, listingContentType(formatProtobuf)), groupBy: groupBy}
+}
+
+func (l *protobufListing) begin(pagination PaginationResponse) {
+	l.pagination = pagination
+}
+
+func (l *protobufListing) chat(chat Chat) {
+	encoded, err := appendProtoChat(nil, chat)
+	if err != nil {
+		l.fail(err, "Failed to encode protobuf chat")
+		return
+	}
+	l.write(protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), encoded))
+}
+
+// sessionDetails ignores the details, which the Conversation message has no fields for
+func (l *protobufListing) sessionDetails(map[string]SessionDetails) {}
+
+func (l *protobufListing) sessionMessage(chat Chat) {
+	if l.inSession && chat.SessionID != l.currentSession {
+		l.writeSession()
+	}
+	if !l.inSession {
+		l.currentSession, l.inSession = chat.SessionID, true
+		l.sessionBuf = appendProtoString(l.sessionBuf[:0], 1, chat.SessionID)
+	}
+
+	encoded, err := appendProtoMessage(nil, chat.Message)
+	if err != nil {
+		l.fail(err, "Failed to encode protobuf message")
+		return
+	}
+	l.sessionBuf = protowire.AppendTag(l.sessionBuf, 2, protowire.BytesType)
+	l.sessionBuf = protowire.AppendBytes(l.sessionBuf, encoded)
+}
+
+// writeSession emits the buffered conversation as a map entry of SessionsResponse.data
+func (l *protobufListing) writeSession() {
+	entry := appendProtoString(nil, 1, l.currentSession)
+	entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, l.sessionBuf)
+	l.write(protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), entry))
+	l.inSession = false
+}
+
+func (l *protobufListing) truncate(cursor string) {
+	l.pagination.Partial, l.pagination.Cursor = true, cursor
+}
+
+func (l *protobufListing) finish() {
+	if l.inSession {
+		l.writeSession()
+	}
+
+	pagination := l.pagination
+	var encoded []byte
+	encoded = appendProtoVarint(encoded, 1, int64(pagination.Page))
+	encoded = appendProtoVarint(encoded, 2, int64(pagination.PageSize))
+	encoded = appendProtoVarint(encoded, 3, int64(pagination.Total))
+	encoded = appendProtoVarint(encoded, 4, int64(pagination.TotalPages))
+	encoded = appendProtoString(encoded, 5, pagination.GroupBy)
+	if pagination.Partial {
+		encoded = appendProtoVarint(encoded, 6, 1)
+		encoded = appendProtoString(encoded, 7, pagination.Cursor)
+	}
+	l.write(protowire.AppendBytes(protowire.AppendTag(nil, 2, protowire.BytesType), encoded))
+	l.flush()
+}
+
+// appendProtoChat encodes a Chat message
+func appendProtoChat(b []byte, chat Chat) ([]byte, error) {
+	message, err := appendProtoMessage(nil, chat.Message)
+	if err != nil {
+		return nil, err
+	}
+	b = appendProtoVarint(b, 1, int64(chat.ID))
+	b = appendProtoString(b, 2, chat.SessionID)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendBytes(b, message), nil
+}
+
+// appendProtoMessage encodes a Message message
+func appendProtoMessage(b []byte, message Message) ([]byte, error) {
+	b = appendProtoString(b, 1, message.Type)
+	b = appendProtoString(b, 2, message.Content)
+
+	lists := []struct {
+		number protowire.Number
+		values []interface{}
+	}{{3, message.ToolCalls}, {6, message.InvalidToolCalls}}
+	for _, list := range lists {
+		if list.values == nil {
+			continue
+		}
+		value, err := structpb.NewList(list.values)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = appendProtoEmbedded(b, list.number, value); err != nil {
+			return nil, err
+		}
+	}
+
+	structs := []struct {
+		number protowire.Number
+		fields map[string]interface{}
+	}{{4, message.AdditionalKwargs}, {5, message.ResponseMetadata}}
+	for _, object := range structs {
+		if object.fields == nil {
+			continue
+		}
+		value, err := structpb.NewStruct(object.fields)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = appendProtoEmbedded(b, object.number, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// appendProtoEmbedded encodes a generated message, such as a well-known type, as a field
+func appendProtoEmbedded(b []byte, number protowire.Number, message proto.Message) ([]byte, error) {
+	encoded, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendBytes(b, encoded), nil
+}
+
+// appendProtoString encodes a string field, omitting the proto3 default
+func appendProtoString(b []byte, number protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+// appendProtoVarint encodes an int64 field, omitting the proto3 default
+func appendProtoVarint(b []byte, number protowire.Number, value int64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(value))
+}
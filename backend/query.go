@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+)
+
+// sortDirection is the direction of an ORDER BY term
+type sortDirection bool
+
+const (
+	ascending  sortDirection = false
+	descending sortDirection = true
+)
+
+// parseSortDirection reads the sortOrder parameter, which is ascending unless it is "desc"
+func parseSortDirection(value string) sortDirection {
+	if value == "desc" {
+		return descending
+	}
+	return ascending
+}
+
+func (d sortDirection) sql() string {
+	if d == descending {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+// selectQuery assembles a SELECT statement. Values are only ever added as placeholders to the
+// shared argument list, numbered in the order the clauses are added, so the SQL text depends on
+// the shape of a request alone and the statement the driver prepares for it is reused by all
+// requests of that shape.
+type selectQuery struct {
+	args       *queryArgs
+	distinctOn string
+	columns    []string
+	from       string
+	conditions []string
+	groupBy    []string
+	orderBy    []string
+	limit      string
+	offset     string
+}
+
+// selectFrom starts a query of columns from a table, a join or a subquery
+func selectFrom(args *queryArgs, from string, columns ...string) *selectQuery {
+	return &selectQuery{args: args, from: from, columns: columns}
+}
+
+// distinct keeps the first row of every value of column
+func (q *selectQuery) distinct(column string) *selectQuery {
+	q.distinctOn = column
+	return q
+}
+
+// where adds conditions that every row must meet
+func (q *selectQuery) where(conditions ...string) *selectQuery {
+	q.conditions = append(q.conditions, conditions...)
+	return q
+}
+
+// filter adds the conditions of a chat filter
+func (q *selectQuery) filter(f ChatFilter) *selectQuery {
+	return q.where(f.conditions(q.args)...)
+}
+
+func (q *selectQuery) group(columns ...string) *selectQuery {
+	q.groupBy = append(q.groupBy, columns...)
+	return q
+}
+
+// order adds a sort term; terms apply in the order they are added
+func (q *selectQuery) order(expr string, direction sortDirection) *selectQuery {
+	q.orderBy = append(q.orderBy, expr+" "+direction.sql())
+	return q
+}
+
+// orderNullsLast adds a sort term that places NULL after every value in either direction
+func (q *selectQuery) orderNullsLast(expr string, direction sortDirection) *selectQuery {
+	q.orderBy = append(q.orderBy, expr+" "+direction.sql()+" NULLS LAST")
+	return q
+}
+
+// first limits the query to n rows
+func (q *selectQuery) first(n int) *selectQuery {
+	q.limit = q.args.add(n)
+	return q
+}
+
+// page limits the query to one page of rows
+func (q *selectQuery) page(pageSize, offset int) *selectQuery {
+	q.limit = q.args.add(pageSize)
+	q.offset = q.args.add(offset)
+	return q
+}
+
+func (q *selectQuery) sql() string {
+	var b strings.Builder
+	b.WriteString("SELECT ")
+	if q.distinctOn != "" {
+		b.WriteString("DISTINCT ON (" + q.distinctOn + ") ")
+	}
+	b.WriteString(strings.Join(q.columns, ", "))
+	b.WriteString(" FROM " + q.from)
+	if where := joinWhere(q.conditions); where != "" {
+		b.WriteString(" " + where)
+	}
+	if len(q.groupBy) > 0 {
+		b.WriteString(" GROUP BY " + strings.Join(q.groupBy, ", "))
+	}
+	if len(q.orderBy) > 0 {
+		b.WriteString(" ORDER BY " + strings.Join(q.orderBy, ", "))
+	}
+	if q.limit != "" {
+		b.WriteString(" LIMIT " + q.limit)
+	}
+	if q.offset != "" {
+		b.WriteString(" OFFSET " + q.offset)
+	}
+	return b.String()
+}
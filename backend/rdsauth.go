@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+)
+
+// rdsTokenLifetime is how long a generated token is reused. RDS accepts a token for 15 minutes,
+// but it is only checked when a connection is opened, so reuse stops well before that.
+const rdsTokenLifetime = 10 * time.Minute
+
+// rdsIAMCredentials authenticates with RDS IAM auth tokens instead of a password. A token is
+// generated from the AWS credentials of the task whenever a connection is opened and the cached
+// one is about to expire.
+type rdsIAMCredentials struct {
+	endpoint string // host:port of the instance
+	region   string
+	user     string
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// newRDSIAMCredentials reads the instance from the connection string. DB_IAM_REGION overrides
+// the region of the AWS configuration.
+func newRDSIAMCredentials(ctx context.Context) (*rdsIAMCredentials, error) {
+	values, err := parseDSN(databaseURL())
+	if err != nil {
+		return nil, err
+	}
+	if values["host"] == "" || values["user"] == "" {
+		return nil, errors.New("RDS IAM auth needs the host and user of the connection string")
+	}
+	port := values["port"]
+	if port == "" {
+		port = "5432"
+	}
+
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	region := getEnvOrDefault("DB_IAM_REGION", cfg.Region)
+	if region == "" {
+		return nil, errors.New("DB_IAM_REGION or AWS_REGION is required for RDS IAM auth")
+	}
+
+	return &rdsIAMCredentials{endpoint: net.JoinHostPort(values["host"], port), region: region, user: values["user"]}, nil
+}
+
+func (c *rdsIAMCredentials) credentials(ctx context.Context) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == "" || time.Now().After(c.expiresAt) {
+		cfg, err := loadAWSConfig(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		token, err := auth.BuildAuthToken(ctx, c.endpoint, c.region, c.user, cfg.Credentials)
+		if err != nil {
+			return "", "", err
+		}
+		c.token, c.expiresAt = token, time.Now().Add(rdsTokenLifetime)
+	}
+	return c.user, c.token, nil
+}
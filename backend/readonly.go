@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// readOnly is set by READ_ONLY=true. Mutating endpoints are refused, the background workers and
+// schema migrations are skipped, and every database connection starts its transactions read-only,
+// so a viewer pointed at a production n8n database cannot write to it even through a bug.
+var readOnly bool
+
+// loadReadOnlyMode reads READ_ONLY
+func loadReadOnlyMode() {
+	readOnly = getEnvOrDefault("READ_ONLY", "false") == "true"
+	if readOnly {
+		log.Info().Msg("Read-only mode, mutating endpoints and background workers are disabled")
+	}
+}
+
+// readOnlyMiddleware answers 403 to every request that may change data while in read-only mode
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if readOnly {
+				respondWithError(w, "The service is read-only", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// redactablePaths lists the message keys redacted paths may start with. The type and content of
+// a message are what the API is for, so they cannot be stripped.
+var redactablePaths = map[string]bool{
+	"additional_kwargs":  true,
+	"response_metadata":  true,
+	"tool_calls":         true,
+	"invalid_tool_calls": true,
+}
+
+// redactedPaths are the paths stripped from every message before it leaves the service
+var redactedPaths [][]string
+
+// loadRedaction reads REDACT_PATHS, comma-separated paths into messages such as
+// additional_kwargs.api_key or tool_calls.*.args.password. A * matches every key of an object or
+// element of an array, and a number an element by index.
+func loadRedaction() error {
+	for _, field := range strings.Split(os.Getenv("REDACT_PATHS"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		path, err := parseJSONPath(field)
+		if err != nil {
+			return fmt.Errorf("REDACT_PATHS: %w", err)
+		}
+		if !redactablePaths[path[0]] || len(path) < 2 {
+			return fmt.Errorf("REDACT_PATHS: %q must point inside additional_kwargs, response_metadata, tool_calls or invalid_tool_calls", field)
+		}
+		redactedPaths = append(redactedPaths, path)
+	}
+	return nil
+}
+
+// overlapsRedactedPath reports whether path equals, sits under or contains a redacted path, so
+// that reading or matching the value at path could reveal a redacted value
+func overlapsRedactedPath(path []string) bool {
+	for _, redacted := range redactedPaths {
+		overlaps := true
+		for i := 0; i < len(path) && i < len(redacted); i++ {
+			if path[i] != redacted[i] && path[i] != "*" && redacted[i] != "*" {
+				overlaps = false
+				break
+			}
+		}
+		if overlaps {
+			return true
+		}
+	}
+	return false
+}
+
+// redactMessage strips the redacted paths from message
+func redactMessage(message *Message) {
+	for _, path := range redactedPaths {
+		switch path[0] {
+		case "additional_kwargs":
+			stripPath(message.AdditionalKwargs, path[1:])
+		case "response_metadata":
+			stripPath(message.ResponseMetadata, path[1:])
+		case "tool_calls":
+			stripPath(message.ToolCalls, path[1:])
+		case "invalid_tool_calls":
+			stripPath(message.InvalidToolCalls, path[1:])
+		}
+	}
+}
+
+// redactRawMessage strips the redacted paths from a message in its stored JSON form
+func redactRawMessage(raw json.RawMessage) (json.RawMessage, error) {
+	if len(redactedPaths) == 0 {
+		return raw, nil
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(raw, &document); err != nil {
+		return nil, err
+	}
+	for _, path := range redactedPaths {
+		stripPath(document, path)
+	}
+	return json.Marshal(document)
+}
+
+// stripPath removes the value at path below value. Array elements are only descended into, as
+// removing one would shift the others.
+func stripPath(value interface{}, path []string) {
+	key, rest := path[0], path[1:]
+	switch node := value.(type) {
+	case map[string]interface{}:
+		if key == "*" {
+			for name, child := range node {
+				if len(rest) == 0 {
+					delete(node, name)
+				} else {
+					stripPath(child, rest)
+				}
+			}
+			return
+		}
+		if len(rest) == 0 {
+			delete(node, key)
+		} else if child, ok := node[key]; ok {
+			stripPath(child, rest)
+		}
+	case []interface{}:
+		if len(rest) == 0 {
+			return
+		}
+		if key == "*" {
+			for _, child := range node {
+				stripPath(child, rest)
+			}
+			return
+		}
+		if index, err := strconv.Atoi(key); err == nil && index >= 0 && index < len(node) {
+			stripPath(node[index], rest)
+		}
+	}
+}
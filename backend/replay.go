@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FailedRequest is a GET request that was answered with an error status, kept to be replayed
+type FailedRequest struct {
+	ID        int64     `json:"id"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query"`
+	Accept    string    `json:"accept,omitempty"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReplayResult is the response of a failed request when it is sent again
+type ReplayResult struct {
+	Request     FailedRequest   `json:"request"`
+	Status      int             `json:"status"`
+	ContentType string          `json:"contentType"`
+	Body        json.RawMessage `json:"body,omitempty"`
+	Text        string          `json:"text,omitempty"`
+}
+
+// replayTarget serves replayed requests, set in main to the routes behind the middlewares that
+// only concern the original client
+var replayTarget http.Handler
+
+type replayKey struct{}
+
+// statusRecorder remembers the status and the start of an error body written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.status >= 400 && len(s.body) < 1024 {
+		s.body = append(s.body, data[:min(len(data), 1024-len(s.body))]...)
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// replayLogMiddleware stores the normalized parameters of API reads that failed when
+// REQUEST_REPLAY_LOG=true, so issues reported by users can be reproduced by an admin.
+// Headers are not stored, credentials never end up in the table.
+func replayLogMiddleware(next http.Handler) http.Handler {
+	if getEnvOrDefault("REQUEST_REPLAY_LOG", "false") != "true" || readOnly {
+		return next
+	}
+	retention := getEnvDuration("REQUEST_REPLAY_RETENTION", 7*24*time.Hour)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, "/api/v1/") ||
+			strings.HasPrefix(r.URL.Path, "/api/v1/admin/") || r.Context().Value(replayKey{}) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status < 400 {
+			return
+		}
+
+		var response ErrorResponse
+		json.Unmarshal(recorder.body, &response)
+		failed := FailedRequest{
+			Path:   r.URL.Path,
+			Query:  r.URL.Query().Encode(),
+			Accept: r.Header.Get("Accept"),
+			Status: recorder.status,
+			Error:  response.Error,
+		}
+		go recordFailedRequest(failed, retention)
+	})
+}
+
+// recordFailedRequest stores a failed request and drops those older than the retention
+func recordFailedRequest(failed FailedRequest, retention time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `
+		WITH recorded AS (
+			INSERT INTO chat_history_failed_requests (path, query, accept, status, error)
+			VALUES ($1, $2, $3, $4, $5)
+		)
+		DELETE FROM chat_history_failed_requests WHERE created_at < now() - $6 * interval '1 second'
+	`, failed.Path, failed.Query, failed.Accept, failed.Status, failed.Error, int64(retention.Seconds()))
+	if err != nil {
+		log.Err(err).Msg("Failed to record failed request")
+	}
+}
+
+// GetFailedRequestsHandler lists the most recent failed requests
+func GetFailedRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > 500 {
+		limit = 100
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, path, query, accept, status, error, created_at
+		FROM chat_history_failed_requests
+		ORDER BY id DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		log.Err(err).Msg("Failed to query failed requests")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	requests := []FailedRequest{}
+	for rows.Next() {
+		var failed FailedRequest
+		if err := rows.Scan(&failed.ID, &failed.Path, &failed.Query, &failed.Accept, &failed.Status,
+			&failed.Error, &failed.CreatedAt); err != nil {
+			log.Err(err).Msg("Failed to scan failed request row")
+			respondWithQueryError(w, err)
+			return
+		}
+		requests = append(requests, failed)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate failed request rows")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: requests})
+}
+
+// ReplayFailedRequestHandler sends a failed request again and returns the response it gets now.
+// Chat listings are replayed with ?debug=explain, so the result includes the query plans.
+func ReplayFailedRequestHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+
+	failed := FailedRequest{ID: id}
+	err = db.QueryRowContext(r.Context(), `
+		SELECT path, query, accept, status, error, created_at
+		FROM chat_history_failed_requests
+		WHERE id = $1
+	`, id).Scan(&failed.Path, &failed.Query, &failed.Accept, &failed.Status, &failed.Error, &failed.CreatedAt)
+	if err == sql.ErrNoRows {
+		respondWithError(w, "Failed request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to load failed request")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	query, _ := url.ParseQuery(failed.Query)
+	if failed.Path == "/api/v1/chats" && (failed.Accept == "" || negotiateFormatIsJSON(failed.Accept)) {
+		query.Set("debug", "explain")
+	}
+	target := &url.URL{Path: failed.Path, RawQuery: query.Encode()}
+
+	// The admin's credentials authorize the debug output of the replayed request
+	replay := httptest.NewRequest(http.MethodGet, target.String(), nil).WithContext(context.WithValue(r.Context(), replayKey{}, true))
+	replay.Header.Set("Authorization", r.Header.Get("Authorization"))
+	if failed.Accept != "" {
+		replay.Header.Set("Accept", failed.Accept)
+	}
+	recorder := httptest.NewRecorder()
+	replayTarget.ServeHTTP(recorder, replay)
+
+	result := ReplayResult{Request: failed, Status: recorder.Code, ContentType: recorder.Header().Get("Content-Type")}
+	if body := recorder.Body.Bytes(); json.Valid(body) {
+		result.Body = body
+	} else {
+		result.Text = string(body)
+	}
+	respondWithJSON(w, DataResponse{Data: result})
+}
+
+// negotiateFormatIsJSON reports whether an Accept header selects the JSON listing
+func negotiateFormatIsJSON(accept string) bool {
+	format, ok := negotiateListingFormat(accept)
+	return ok && format == formatJSON
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// routeSampling is the share of successful reads logged for paths starting with prefix
+type routeSampling struct {
+	prefix string
+	rate   float64
+}
+
+// requestLogConfig decides which requests are logged. Successful writes are always logged.
+type requestLogConfig struct {
+	// errorRate is the share of responses with status 400 or above that are logged
+	errorRate float64
+	// readRate is the share of successful GET and HEAD requests that are logged
+	readRate float64
+	// routes override readRate, longest prefix first
+	routes []routeSampling
+}
+
+// requestLogging holds the configured request log sampling, logging every request by default
+var requestLogging = requestLogConfig{errorRate: 1, readRate: 1}
+
+// loadRequestLogConfig reads LOG_SAMPLE_ERRORS, LOG_SAMPLE_READS and LOG_ROUTE_SAMPLING, the
+// latter comma-separated path prefixes with their rate such as "/healthz=0,/api/v1/chats=0.01"
+func loadRequestLogConfig() error {
+	config := requestLogConfig{errorRate: 1, readRate: 1}
+	for key, target := range map[string]*float64{"LOG_SAMPLE_ERRORS": &config.errorRate, "LOG_SAMPLE_READS": &config.readRate} {
+		value := os.Getenv(key)
+		if value == "" {
+			continue
+		}
+		rate, err := parseSampleRate(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		*target = rate
+	}
+
+	for _, entry := range strings.Split(os.Getenv("LOG_ROUTE_SAMPLING"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, value, found := strings.Cut(entry, "=")
+		if !found || !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("LOG_ROUTE_SAMPLING: entries must look like /path=rate, got %q", entry)
+		}
+		rate, err := parseSampleRate(value)
+		if err != nil {
+			return fmt.Errorf("LOG_ROUTE_SAMPLING: %s: %w", prefix, err)
+		}
+		config.routes = append(config.routes, routeSampling{prefix: prefix, rate: rate})
+	}
+	sort.SliceStable(config.routes, func(i, j int) bool { return len(config.routes[i].prefix) > len(config.routes[j].prefix) })
+	requestLogging = config
+	return nil
+}
+
+// parseSampleRate reads a share between 0 and 1
+func parseSampleRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("sample rate must be between 0 and 1, got %q", value)
+	}
+	return rate, nil
+}
+
+// sampleRate returns the share of requests like this one that are logged
+func (c requestLogConfig) sampleRate(r *http.Request, status int) float64 {
+	if status >= 400 {
+		return c.errorRate
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return 1
+	}
+	for _, route := range c.routes {
+		if strings.HasPrefix(r.URL.Path, route.prefix) {
+			return route.rate
+		}
+	}
+	return c.readRate
+}
+
+// requestLogMiddleware logs one line per request with its status and duration, sampled as
+// configured. Every line carries its sample rate, so counts can be extrapolated.
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		rate := requestLogging.sampleRate(r, status)
+		if rate == 0 || (rate < 1 && rand.Float64() >= rate) {
+			return
+		}
+
+		level := zerolog.InfoLevel
+		if status >= 500 {
+			level = zerolog.ErrorLevel
+		} else if status >= 400 {
+			level = zerolog.WarnLevel
+		}
+		log.WithLevel(level).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("query", r.URL.RawQuery).
+			Str("referer", r.Referer()).
+			Str("origin", r.Header.Get("Origin")).
+			Int("status", status).
+			Dur("duration", time.Since(started)).
+			Float64("sampleRate", rate).
+			Msg("Request handled")
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// dataRegion is the region the history database resides in, set by DATA_REGION. Requests and
+// exports labeled for a region are refused unless it matches, so data subject to residency rules
+// is never read on behalf of another region.
+var dataRegion string
+
+// errRegionMismatch matches the errors of work refused for its region label
+var errRegionMismatch = errors.New("region mismatch")
+
+// regionError refuses work labeled for another region than its source
+type regionError struct{ label, region string }
+
+func (e regionError) Error() string {
+	if e.region == "" {
+		return fmt.Sprintf("request is labeled for region %s but the data source has no region", e.label)
+	}
+	return fmt.Sprintf("request is labeled for region %s but the data source is in %s", e.label, e.region)
+}
+
+func (e regionError) Is(target error) bool { return target == errRegionMismatch }
+
+// regionKey is the context key of the region label of the work being done
+type regionKey struct{}
+
+// multiRegionPaths are the routes that read several sources. The sources check the label
+// themselves, so these routes are not refused as a whole for the region of the history database.
+var multiRegionPaths = map[string]bool{
+	"/api/v1/sources/chats": true,
+}
+
+// loadDataRegion reads DATA_REGION
+func loadDataRegion() {
+	dataRegion = normalizeRegion(os.Getenv("DATA_REGION"))
+}
+
+// normalizeRegion makes region labels and the regions of sources comparable
+func normalizeRegion(region string) string {
+	return strings.ToLower(strings.TrimSpace(region))
+}
+
+// checkRegion accepts unlabeled work and work labeled for the region of the history database
+func checkRegion(label string) error {
+	return checkSourceRegion(label, dataRegion)
+}
+
+// checkSourceRegion accepts unlabeled work and work labeled for the region of a source. A source
+// without a region cannot serve labeled work, as its residency is unknown.
+func checkSourceRegion(label, region string) error {
+	label, region = normalizeRegion(label), normalizeRegion(region)
+	if label == "" || label == region {
+		return nil
+	}
+	return regionError{label: label, region: region}
+}
+
+// withRegion labels the work done with ctx for a region
+func withRegion(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, regionKey{}, normalizeRegion(label))
+}
+
+// contextRegion returns the region label of the work done with ctx, empty when unlabeled
+func contextRegion(ctx context.Context) string {
+	label, _ := ctx.Value(regionKey{}).(string)
+	return label
+}
+
+// requestRegion returns the region a request is labeled for, from the X-Data-Region header or
+// the region query parameter
+func requestRegion(r *http.Request) string {
+	if region := r.Header.Get("X-Data-Region"); region != "" {
+		return normalizeRegion(region)
+	}
+	return normalizeRegion(r.URL.Query().Get("region"))
+}
+
+// regionMiddleware labels the request context with the region of the request, which the reads
+// of chat rows check against their source. Routes that only read the history database are
+// refused with 403 up front when it is in another region.
+func regionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		label := requestRegion(r)
+		if label == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !multiRegionPaths[r.URL.Path] {
+			if err := checkRegion(label); err != nil {
+				respondWithError(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(withRegion(r.Context(), label)))
+	})
+}
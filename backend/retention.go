@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxRetentionDays bounds the retention period, about ten years
+const maxRetentionDays = 3650
+
+// RetentionSettings control the pruning of old sessions. Days of 0 keeps every session. Sessions
+// carrying one of the exempt tags are never pruned.
+type RetentionSettings struct {
+	Days       int        `json:"days"`
+	ExemptTags []string   `json:"exemptTags"`
+	UpdatedBy  string     `json:"updatedBy,omitempty"`
+	UpdatedAt  *time.Time `json:"updatedAt,omitempty"`
+}
+
+// retentionTables lists the tables holding per-session data that is pruned with the messages. The
+// turns of session replays, which copy the messages sent and answered, go with their replay.
+var retentionTables = []string{
+	"chat_history_session_tags",
+	"chat_history_feedback",
+	"chat_history_reviews",
+	"chat_history_session_languages",
+	"chat_history_pinned_messages",
+	"chat_history_session_notes",
+	"chat_history_archived_sessions",
+	"chat_history_secret_findings",
+	"chat_history_policy_flags",
+	"chat_history_duplicates",
+	"chat_history_session_replays",
+	"chat_history_sessions_summary",
+	"n8n_chat_histories",
+}
+
+// loadRetentionSettings returns the stored settings, which schema setup seeds with retention off
+func loadRetentionSettings(ctx context.Context) (RetentionSettings, error) {
+	settings := RetentionSettings{ExemptTags: []string{}}
+	var updatedAt time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT days, exempt_tags, updated_by, updated_at FROM chat_history_retention_settings
+	`).Scan(&settings.Days, pgArray(&settings.ExemptTags), &settings.UpdatedBy, &updatedAt)
+	if err != nil {
+		return settings, err
+	}
+	settings.UpdatedAt = &updatedAt
+	return settings, nil
+}
+
+func GetRetentionSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	settings, err := loadRetentionSettings(r.Context())
+	if err != nil {
+		log.Err(err).Msg("Failed to load retention settings")
+		respondWithQueryError(w, err)
+		return
+	}
+	respondWithJSON(w, DataResponse{Data: settings})
+}
+
+// PutRetentionSettingsHandler replaces the retention settings
+func PutRetentionSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var settings RetentionSettings
+	if !decodeJSONBody(w, r, &settings) {
+		return
+	}
+	if settings.Days < 0 || settings.Days > maxRetentionDays {
+		respondWithError(w, "days must be between 0 and "+strconv.Itoa(maxRetentionDays), http.StatusBadRequest)
+		return
+	}
+	settings.ExemptTags = normalizeTags(settings.ExemptTags)
+	settings.UpdatedBy = auditActor(r)
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Err(err).Msg("Failed to begin retention transaction")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var updatedAt time.Time
+	err = tx.QueryRowContext(r.Context(), `
+		UPDATE chat_history_retention_settings SET days = $1, exempt_tags = $2, updated_by = $3, updated_at = now()
+		RETURNING updated_at
+	`, settings.Days, settings.ExemptTags, settings.UpdatedBy).Scan(&updatedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to store retention settings")
+		respondWithQueryError(w, err)
+		return
+	}
+	settings.UpdatedAt = &updatedAt
+	if err := recordAudit(tx, r, "retention.update", settings); err != nil {
+		log.Err(err).Msg("Failed to record retention audit entry")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Err(err).Msg("Failed to commit retention settings")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: settings})
+}
+
+// retentionJob deletes sessions without activity for the retention period, in batches. Activity
+// is the last_activity of the session summary: n8n stores no timestamps, so a session counts as
+// active from when the summary worker first saw it.
+type retentionJob struct {
+	batchSize int
+}
+
+// newRetentionJob reads RETENTION_BATCH_SIZE from the environment
+func newRetentionJob() retentionJob {
+	job := retentionJob{batchSize: 500}
+	if batchSize, err := strconv.Atoi(os.Getenv("RETENTION_BATCH_SIZE")); err == nil && batchSize > 0 {
+		job.batchSize = batchSize
+	}
+	return job
+}
+
+func (j retentionJob) run(ctx context.Context) error {
+	settings, err := loadRetentionSettings(ctx)
+	if err != nil {
+		return err
+	}
+	if settings.Days == 0 {
+		return nil
+	}
+
+	pruned := 0
+	for {
+		count, err := j.pruneBatch(ctx, settings)
+		if err != nil {
+			return err
+		}
+		pruned += count
+		if count < j.batchSize {
+			break
+		}
+	}
+	if pruned > 0 {
+		log.Info().Int("sessions", pruned).Int("days", settings.Days).Strs("exemptTags", settings.ExemptTags).Msg("Pruned expired sessions")
+	}
+	return nil
+}
+
+// pruneBatch deletes up to batchSize expired sessions and returns how many it deleted. Sessions
+// with messages the summary has not counted yet are active again and skipped, and only the
+// messages up to the last one counted are deleted, so a message arriving meanwhile survives.
+func (j retentionJob) pruneBatch(ctx context.Context, settings RetentionSettings) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var sessionIDs []string
+	var lastIDs []int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(array_agg(session_id), '{}'), COALESCE(array_agg(last_id), '{}') FROM (
+			SELECT s.session_id, s.last_id
+			FROM chat_history_sessions_summary s
+			WHERE s.last_activity < now() - $1 * interval '1 day'
+				AND NOT EXISTS (
+					SELECT 1 FROM chat_history_session_tags t WHERE t.session_id = s.session_id AND t.tag = ANY($2)
+				)
+				AND NOT EXISTS (
+					SELECT 1 FROM n8n_chat_histories h WHERE h.session_id = s.session_id AND h.id > s.last_id
+				)
+			ORDER BY s.last_activity
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		) AS expired
+	`, settings.Days, settings.ExemptTags, j.batchSize).Scan(pgArray(&sessionIDs), pgArray(&lastIDs))
+	if err != nil {
+		return 0, err
+	}
+	if len(sessionIDs) == 0 {
+		return 0, nil
+	}
+
+	for _, table := range retentionTables {
+		statement := `DELETE FROM ` + table + ` WHERE session_id = ANY($1)`
+		args := []interface{}{sessionIDs}
+		if table == "n8n_chat_histories" {
+			statement = `
+				DELETE FROM n8n_chat_histories h
+				USING unnest($1::text[], $2::bigint[]) AS expired (session_id, last_id)
+				WHERE h.session_id = expired.session_id AND h.id <= expired.last_id
+			`
+			args = append(args, lastIDs)
+		}
+		if _, err := tx.ExecContext(ctx, statement, args...); err != nil {
+			return 0, fmt.Errorf("pruning %s: %w", table, err)
+		}
+	}
+	return len(sessionIDs), tx.Commit()
+}
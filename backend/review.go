@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxReviewClaimAttempts bounds the retries of /review/next when other reviewers claim the same
+// session first
+const maxReviewClaimAttempts = 5
+
+// validReviewStatuses lists the states of the review workflow. Sessions without a review record
+// are unreviewed.
+var validReviewStatuses = map[string]bool{"unreviewed": true, "in_review": true, "done": true}
+
+// SessionReview is the review state of a session
+type SessionReview struct {
+	SessionID   string     `json:"sessionId"`
+	Status      string     `json:"status"`
+	Assignee    string     `json:"assignee"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	UpdatedAt   *time.Time `json:"updatedAt,omitempty"`
+}
+
+// ReviewStats is the response of the review stats endpoint
+type ReviewStats struct {
+	Interval   string                `json:"interval"`
+	Timezone   string                `json:"timezone"`
+	ByStatus   map[string]int        `json:"byStatus"`
+	Throughput []ReviewCount         `json:"throughput"`
+	ByAssignee []ReviewCount         `json:"byAssignee"`
+	Duration   ReviewDurationSummary `json:"duration"`
+}
+
+// ReviewCount is the number of reviews completed in a time bucket or by an assignee
+type ReviewCount struct {
+	Key       string `json:"key"`
+	Completed int    `json:"completed"`
+}
+
+// ReviewDurationSummary describes the time from claiming a session to completing its review
+type ReviewDurationSummary struct {
+	MedianSeconds float64 `json:"medianSeconds"`
+	P90Seconds    float64 `json:"p90Seconds"`
+}
+
+const reviewColumns = `session_id, status, assignee, started_at, completed_at, updated_at`
+
+func scanReview(row interface{ Scan(...interface{}) error }) (SessionReview, error) {
+	var review SessionReview
+	var startedAt, completedAt, updatedAt sql.NullTime
+	err := row.Scan(&review.SessionID, &review.Status, &review.Assignee, &startedAt, &completedAt, &updatedAt)
+	for _, field := range []struct {
+		value  sql.NullTime
+		target **time.Time
+	}{{startedAt, &review.StartedAt}, {completedAt, &review.CompletedAt}, {updatedAt, &review.UpdatedAt}} {
+		if field.value.Valid {
+			*field.target = &field.value.Time
+		}
+	}
+	return review, err
+}
+
+// loadReview returns the review state of a session, unreviewed when it has no record
+func loadReview(ctx context.Context, sessionID string) (SessionReview, error) {
+	review, err := scanReview(db.QueryRowContext(ctx, `SELECT `+reviewColumns+` FROM chat_history_reviews WHERE session_id = $1`, sessionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return SessionReview{SessionID: sessionID, Status: "unreviewed"}, nil
+	}
+	return review, err
+}
+
+func GetSessionReviewHandler(w http.ResponseWriter, r *http.Request) {
+	review, err := loadReview(r.Context(), r.PathValue("id"))
+	if err != nil {
+		log.Err(err).Msg("Failed to load session review")
+		respondWithQueryError(w, err)
+		return
+	}
+	respondWithJSON(w, DataResponse{Data: review})
+}
+
+// PutSessionReviewHandler sets the status and assignee of a session. Moving to in_review stamps
+// the start of the review and moving to done its completion.
+func PutSessionReviewHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	var request SessionReview
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+	if !validReviewStatuses[request.Status] {
+		respondWithError(w, "status must be unreviewed, in_review or done", http.StatusBadRequest)
+		return
+	}
+	request.Assignee = strings.TrimSpace(request.Assignee)
+	if !checkReviewAssignee(w, r, request.Assignee) {
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM n8n_chat_histories WHERE session_id = $1)`, sessionID).Scan(&exists); err != nil {
+		log.Err(err).Msg("Failed to check session")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !exists {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Err(err).Msg("Failed to begin review transaction")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	review, err := scanReview(tx.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_reviews AS r (session_id, status, assignee, started_at, completed_at)
+		VALUES ($1, $2, $3,
+			CASE WHEN $2 <> 'unreviewed' THEN now() END,
+			CASE WHEN $2 = 'done' THEN now() END)
+		ON CONFLICT (session_id) DO UPDATE SET
+			status = EXCLUDED.status,
+			assignee = EXCLUDED.assignee,
+			started_at = CASE
+				WHEN EXCLUDED.status = 'unreviewed' THEN NULL
+				ELSE COALESCE(r.started_at, now())
+			END,
+			completed_at = CASE WHEN EXCLUDED.status = 'done' THEN COALESCE(r.completed_at, now()) END,
+			updated_at = now()
+		RETURNING `+reviewColumns,
+		sessionID, request.Status, request.Assignee))
+	if err != nil {
+		log.Err(err).Msg("Failed to update session review")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := recordAudit(tx, r, "sessions.review", review); err != nil {
+		log.Err(err).Msg("Failed to record review audit entry")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Err(err).Msg("Failed to commit review transaction")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: review})
+}
+
+// NextReviewHandler claims the oldest unreviewed session matching the filters for the assignee in
+// the body, or the SSO user, setting it in review. A session claimed concurrently by someone else
+// is skipped.
+func NextReviewHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Assignee string `json:"assignee"`
+	}
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+	request.Assignee = strings.TrimSpace(request.Assignee)
+	if request.Assignee == "" {
+		request.Assignee = requestUser(r)
+	}
+	if request.Assignee == "" {
+		respondWithError(w, "assignee is required", http.StatusBadRequest)
+		return
+	}
+	if !checkReviewAssignee(w, r, request.Assignee) {
+		return
+	}
+	filter, err := parseChatFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args queryArgs
+	candidateQuery := fmt.Sprintf(`
+		SELECT session_id
+		FROM (
+			SELECT session_id, MIN(id) AS first_id FROM n8n_chat_histories %s GROUP BY session_id
+		) AS s
+		WHERE NOT EXISTS (
+			SELECT 1 FROM chat_history_reviews r WHERE r.session_id = s.session_id AND r.status <> 'unreviewed'
+		)
+		ORDER BY first_id
+		LIMIT 1
+	`, filter.whereClause(&args))
+
+	for attempt := 0; attempt < maxReviewClaimAttempts; attempt++ {
+		var sessionID string
+		err := db.QueryRowContext(r.Context(), candidateQuery, args...).Scan(&sessionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, "No unreviewed sessions", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Err(err).Msg("Failed to find next session to review")
+			respondWithQueryError(w, err)
+			return
+		}
+
+		// The conditional upsert only succeeds while the session is still unreviewed
+		review, err := scanReview(db.QueryRowContext(r.Context(), `
+			INSERT INTO chat_history_reviews AS r (session_id, status, assignee, started_at)
+			VALUES ($1, 'in_review', $2, now())
+			ON CONFLICT (session_id) DO UPDATE SET
+				status = 'in_review', assignee = EXCLUDED.assignee, started_at = now(), completed_at = NULL, updated_at = now()
+				WHERE r.status = 'unreviewed'
+			RETURNING `+reviewColumns,
+			sessionID, request.Assignee))
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			log.Err(err).Msg("Failed to claim session for review")
+			respondWithQueryError(w, err)
+			return
+		}
+		if err := recordAudit(db, r, "sessions.review", review); err != nil {
+			log.Err(err).Msg("Failed to record review audit entry")
+		}
+		respondWithJSON(w, DataResponse{Data: review})
+		return
+	}
+
+	respondWithError(w, "Review queue is busy, try again", http.StatusConflict)
+}
+
+// GetReviewStatsHandler reports the review backlog and the throughput of completed reviews
+func GetReviewStatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	interval, err := parseStatsInterval(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	location, err := parseTimezone(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseTimeRange(query, location)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats := ReviewStats{Interval: interval, Timezone: location.String(), ByStatus: map[string]int{}}
+
+	// Sessions without a record count as unreviewed
+	var unreviewed, inReview, done int
+	if err := db.QueryRowContext(r.Context(), `
+		SELECT
+			(SELECT COUNT(DISTINCT session_id) FROM n8n_chat_histories)
+				- (SELECT COUNT(*) FROM chat_history_reviews WHERE status <> 'unreviewed'),
+			(SELECT COUNT(*) FROM chat_history_reviews WHERE status = 'in_review'),
+			(SELECT COUNT(*) FROM chat_history_reviews WHERE status = 'done')
+	`).Scan(&unreviewed, &inReview, &done); err != nil {
+		log.Err(err).Msg("Failed to count reviews by status")
+		respondWithQueryError(w, err)
+		return
+	}
+	stats.ByStatus["unreviewed"], stats.ByStatus["in_review"], stats.ByStatus["done"] = unreviewed, inReview, done
+
+	completedWhere := func(args *queryArgs) string {
+		conditions := []string{"status = 'done'", "completed_at IS NOT NULL"}
+		if from != nil {
+			conditions = append(conditions, "completed_at >= "+args.add(*from))
+		}
+		if to != nil {
+			conditions = append(conditions, "completed_at < "+args.add(*to))
+		}
+		return joinWhere(conditions)
+	}
+
+	var throughputArgs queryArgs
+	bucket := "date_trunc(" + throughputArgs.add(interval) + ", completed_at, " + throughputArgs.add(location.String()) + ")"
+	if stats.Throughput, err = queryReviewCounts(r.Context(), fmt.Sprintf(`
+		SELECT %s, COUNT(*) FROM chat_history_reviews %s GROUP BY 1 ORDER BY 1
+	`, bucket, completedWhere(&throughputArgs)), throughputArgs); err != nil {
+		log.Err(err).Msg("Failed to query review throughput")
+		respondWithQueryError(w, err)
+		return
+	}
+	for i := range stats.Throughput {
+		if start, err := time.Parse(time.RFC3339Nano, stats.Throughput[i].Key); err == nil {
+			stats.Throughput[i].Key = start.In(location).Format(time.RFC3339)
+		}
+	}
+
+	var assigneeArgs queryArgs
+	if stats.ByAssignee, err = queryReviewCounts(r.Context(), fmt.Sprintf(`
+		SELECT assignee, COUNT(*) FROM chat_history_reviews %s GROUP BY 1 ORDER BY 2 DESC, 1
+	`, completedWhere(&assigneeArgs)), assigneeArgs); err != nil {
+		log.Err(err).Msg("Failed to query reviews by assignee")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	var durationArgs queryArgs
+	var median, p90 sql.NullFloat64
+	if err := db.QueryRowContext(r.Context(), fmt.Sprintf(`
+		SELECT
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM completed_at - started_at)),
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM completed_at - started_at))
+		FROM chat_history_reviews
+		%s
+	`, completedWhere(&durationArgs)), durationArgs...).Scan(&median, &p90); err != nil {
+		log.Err(err).Msg("Failed to query review durations")
+		respondWithQueryError(w, err)
+		return
+	}
+	stats.Duration = ReviewDurationSummary{MedianSeconds: median.Float64, P90Seconds: p90.Float64}
+
+	respondWithJSON(w, DataResponse{Data: stats})
+}
+
+// queryReviewCounts runs a query returning (key, completed) rows
+func queryReviewCounts(ctx context.Context, query string, args queryArgs) ([]ReviewCount, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []ReviewCount{}
+	for rows.Next() {
+		var count ReviewCount
+		if err := rows.Scan(&count.Key, &count.Completed); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// checkReviewAssignee responds with an error unless assignee can be assigned sessions
+func checkReviewAssignee(w http.ResponseWriter, r *http.Request, assignee string) bool {
+	err := checkAssignee(r.Context(), assignee)
+	if errors.Is(err, errUnknownAssignee) {
+		respondWithError(w, "Unknown assignee", http.StatusBadRequest)
+		return false
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to check assignee")
+		respondWithQueryError(w, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// schemaStatements create the sidecar tables owned by this service. They must be idempotent,
+// as they run on every startup; the n8n_chat_histories table itself is never altered.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS chat_history_audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		action TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		details JSONB NOT NULL DEFAULT '{}'::jsonb,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_duplicates (
+		session_id TEXT PRIMARY KEY,
+		group_id TEXT NOT NULL,
+		detected_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_feedback (
+		id BIGSERIAL PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		message_id BIGINT,
+		rating TEXT NOT NULL CHECK (rating IN ('positive', 'negative')),
+		reason TEXT NOT NULL DEFAULT '',
+		source TEXT NOT NULL DEFAULT 'user',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_feedback_session_idx ON chat_history_feedback (session_id)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_session_tags (
+		session_id TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (session_id, tag)
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_session_tags_tag_idx ON chat_history_session_tags (tag)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_publish_checkpoints (
+		publisher TEXT PRIMARY KEY,
+		last_id BIGINT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_exports (
+		id TEXT PRIMARY KEY,
+		format TEXT NOT NULL,
+		query TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'completed', 'failed')),
+		error TEXT NOT NULL DEFAULT '',
+		rows BIGINT NOT NULL DEFAULT 0,
+		size_bytes BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		completed_at TIMESTAMPTZ,
+		expires_at TIMESTAMPTZ
+	)`,
+	`ALTER TABLE chat_history_exports ADD COLUMN IF NOT EXISTS encrypted BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE chat_history_exports ADD COLUMN IF NOT EXISTS heartbeat_at TIMESTAMPTZ`,
+	`ALTER TABLE chat_history_exports ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS chat_history_failed_requests (
+		id BIGSERIAL PRIMARY KEY,
+		path TEXT NOT NULL,
+		query TEXT NOT NULL DEFAULT '',
+		accept TEXT NOT NULL DEFAULT '',
+		status INTEGER NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_failed_requests_created_at_idx ON chat_history_failed_requests (created_at)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_sessions_summary (
+		session_id TEXT PRIMARY KEY,
+		message_count BIGINT NOT NULL,
+		first_id BIGINT NOT NULL,
+		last_id BIGINT NOT NULL,
+		last_activity TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`INSERT INTO chat_history_publish_checkpoints (publisher, last_id) VALUES ('sessions-summary', 0) ON CONFLICT DO NOTHING`,
+	`CREATE TABLE IF NOT EXISTS chat_history_api_usage (
+		api_key TEXT NOT NULL,
+		month TEXT NOT NULL,
+		requests BIGINT NOT NULL DEFAULT 0,
+		rows BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (api_key, month)
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_session_languages (
+		session_id TEXT PRIMARY KEY,
+		language TEXT NOT NULL,
+		confidence REAL NOT NULL DEFAULT 0,
+		detected_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_session_languages_language_idx ON chat_history_session_languages (language)`,
+	`INSERT INTO chat_history_publish_checkpoints (publisher, last_id) VALUES ('session-languages', 0) ON CONFLICT DO NOTHING`,
+	`CREATE TABLE IF NOT EXISTS chat_history_traffic_samples (
+		id BIGSERIAL PRIMARY KEY,
+		sampled_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_id BIGINT NOT NULL,
+		messages BIGINT NOT NULL,
+		sessions BIGINT NOT NULL,
+		seconds DOUBLE PRECISION NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_traffic_samples_sampled_at_idx ON chat_history_traffic_samples (sampled_at)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_alert_rules (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		filter TEXT NOT NULL DEFAULT '',
+		pattern TEXT NOT NULL DEFAULT '',
+		threshold INTEGER NOT NULL DEFAULT 1,
+		window_seconds BIGINT NOT NULL,
+		actions JSONB NOT NULL DEFAULT '[]'::jsonb,
+		enabled BOOLEAN NOT NULL DEFAULT true,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_triggered_at TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_alert_rule_hits (
+		id BIGSERIAL PRIMARY KEY,
+		rule_id BIGINT NOT NULL REFERENCES chat_history_alert_rules (id) ON DELETE CASCADE,
+		matches BIGINT NOT NULL,
+		message_ids BIGINT[] NOT NULL DEFAULT '{}',
+		session_ids TEXT[] NOT NULL DEFAULT '{}',
+		evaluated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_alert_rule_hits_rule_idx ON chat_history_alert_rule_hits (rule_id, evaluated_at)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_reviews (
+		session_id TEXT PRIMARY KEY,
+		status TEXT NOT NULL DEFAULT 'unreviewed' CHECK (status IN ('unreviewed', 'in_review', 'done')),
+		assignee TEXT NOT NULL DEFAULT '',
+		started_at TIMESTAMPTZ,
+		completed_at TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_reviews_status_idx ON chat_history_reviews (status, assignee)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_teams (
+		name TEXT PRIMARY KEY,
+		sso_groups TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_users (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		team TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_preferences (
+		owner TEXT PRIMARY KEY,
+		preferences JSONB NOT NULL DEFAULT '{}'::jsonb,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_archived_sessions (
+		session_id TEXT PRIMARY KEY,
+		archived_by TEXT NOT NULL DEFAULT '',
+		archived_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_pinned_messages (
+		session_id TEXT NOT NULL,
+		message_id BIGINT NOT NULL,
+		pinned_by TEXT NOT NULL DEFAULT '',
+		pinned_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (session_id, message_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_session_notes (
+		id BIGSERIAL PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		author TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_session_notes_session_idx ON chat_history_session_notes (session_id)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_retention_settings (
+		singleton BOOLEAN PRIMARY KEY DEFAULT true CHECK (singleton),
+		days INTEGER NOT NULL DEFAULT 0,
+		exempt_tags TEXT[] NOT NULL DEFAULT '{}',
+		updated_by TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`INSERT INTO chat_history_retention_settings (singleton) VALUES (true) ON CONFLICT DO NOTHING`,
+	`CREATE TABLE IF NOT EXISTS chat_history_stats_snapshots (
+		day DATE PRIMARY KEY,
+		rows BIGINT NOT NULL,
+		sessions BIGINT NOT NULL,
+		table_bytes BIGINT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_session_replays (
+		id TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		replay_session_id TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'completed', 'failed')),
+		error TEXT NOT NULL DEFAULT '',
+		delay_ms BIGINT NOT NULL DEFAULT 0,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		completed_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_session_replays_session_idx ON chat_history_session_replays (session_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_session_replay_turns (
+		replay_id TEXT NOT NULL REFERENCES chat_history_session_replays (id) ON DELETE CASCADE,
+		turn INTEGER NOT NULL,
+		message_id BIGINT NOT NULL,
+		input TEXT NOT NULL,
+		output TEXT NOT NULL DEFAULT '',
+		status INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms BIGINT NOT NULL DEFAULT 0,
+		sent_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (replay_id, turn)
+	)`,
+	`CREATE TABLE IF NOT EXISTS chat_history_secret_findings (
+		id BIGSERIAL PRIMARY KEY,
+		message_id BIGINT NOT NULL,
+		session_id TEXT NOT NULL,
+		rule TEXT NOT NULL,
+		field TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		preview TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'open',
+		found_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		resolved_at TIMESTAMPTZ,
+		resolved_by TEXT,
+		UNIQUE (message_id, rule, fingerprint)
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_secret_findings_status_idx ON chat_history_secret_findings (status, id)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_secret_findings_session_id_idx ON chat_history_secret_findings (session_id)`,
+	`INSERT INTO chat_history_publish_checkpoints (publisher, last_id) VALUES ('secret-scan', 0) ON CONFLICT DO NOTHING`,
+	`CREATE TABLE IF NOT EXISTS chat_history_policy_flags (
+		id BIGSERIAL PRIMARY KEY,
+		message_id BIGINT NOT NULL,
+		session_id TEXT NOT NULL,
+		role TEXT NOT NULL,
+		rule TEXT NOT NULL,
+		excerpt TEXT NOT NULL,
+		flagged_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		UNIQUE (message_id, rule)
+	)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_policy_flags_session_id_idx ON chat_history_policy_flags (session_id)`,
+	`CREATE INDEX IF NOT EXISTS chat_history_policy_flags_rule_idx ON chat_history_policy_flags (rule)`,
+	`INSERT INTO chat_history_publish_checkpoints (publisher, last_id) VALUES ('policy-flags', 0) ON CONFLICT DO NOTHING`,
+	// Backs the turnIndex virtual field; a function keeps the correlated count free of table aliases
+	`CREATE OR REPLACE FUNCTION chat_history_turn_index(p_session_id TEXT, p_id BIGINT) RETURNS BIGINT
+		LANGUAGE sql STABLE AS $$
+			SELECT COUNT(*) FROM n8n_chat_histories WHERE session_id = p_session_id AND id <= p_id AND message->>'type' = 'human'
+		$$`,
+	// Rules watch the messages that arrive after the watcher was first deployed
+	`INSERT INTO chat_history_publish_checkpoints (publisher, last_id)
+		SELECT 'alert-rules', COALESCE(MAX(id), 0) FROM n8n_chat_histories
+		ON CONFLICT DO NOTHING`,
+	// Ingest processors leave the rows stored before this version was deployed as they are
+	`INSERT INTO chat_history_publish_checkpoints (publisher, last_id)
+		SELECT 'message-processors', COALESCE(MAX(id), 0) FROM n8n_chat_histories
+		ON CONFLICT DO NOTHING`,
+}
+
+// ensureSchema creates the sidecar tables if they do not exist yet
+func ensureSchema() error {
+	for _, statement := range schemaStatements {
+		if _, err := db.Exec(statement); err != nil {
+			log.Err(err).Msg("failed to apply schema statement")
+			return err
+		}
+	}
+
+	log.Info().Msg("Database schema is up to date")
+	return nil
+}
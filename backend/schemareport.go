@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// timestampSampleSize is the number of latest messages checked for a timestamp
+const timestampSampleSize = 1000
+
+// SchemaReport describes the history table as the service sees it, and which optional features
+// it supports, so operators can tell why a feature is unavailable
+type SchemaReport struct {
+	Table         string          `json:"table"`
+	EstimatedRows int64           `json:"estimatedRows"`
+	Columns       []SchemaColumn  `json:"columns"`
+	Indexes       []SchemaIndex   `json:"indexes"`
+	Features      []SchemaFeature `json:"features"`
+}
+
+// SchemaColumn is a column of the history table. Field is the API field it is read as: a core
+// field, or a field of COLUMN_MAPPING.
+type SchemaColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	Field    string `json:"field,omitempty"`
+}
+
+// SchemaIndex is an index of the history table. Invalid indexes are left by interrupted builds
+// and serve no query.
+type SchemaIndex struct {
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+	Valid      bool   `json:"valid"`
+}
+
+// SchemaFeature reports whether an optional feature is available, with what provides it or
+// what is missing
+type SchemaFeature struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	Detail    string `json:"detail"`
+}
+
+// GetSchemaHandler inspects the history table and reports its columns, its indexes and the
+// optional features they allow
+func GetSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var table sql.NullString
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass('n8n_chat_histories')::text`).Scan(&table); err != nil {
+		log.Err(err).Msg("Failed to look up the history table")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !table.Valid {
+		respondWithError(w, "Table n8n_chat_histories does not exist", http.StatusNotFound)
+		return
+	}
+
+	report := SchemaReport{Table: "n8n_chat_histories"}
+	if err := db.QueryRowContext(ctx, `SELECT reltuples::bigint FROM pg_class WHERE oid = 'n8n_chat_histories'::regclass`).Scan(&report.EstimatedRows); err != nil {
+		log.Err(err).Msg("Failed to estimate history table rows")
+		respondWithQueryError(w, err)
+		return
+	}
+	report.EstimatedRows = max(report.EstimatedRows, 0)
+
+	var err error
+	if report.Columns, err = schemaColumns(ctx); err != nil {
+		log.Err(err).Msg("Failed to read history table columns")
+		respondWithQueryError(w, err)
+		return
+	}
+	indexes, err := tableIndexes(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to read history table indexes")
+		respondWithQueryError(w, err)
+		return
+	}
+	report.Indexes = []SchemaIndex{}
+	for name, index := range indexes {
+		report.Indexes = append(report.Indexes, SchemaIndex{Name: name, Definition: index.definition, Valid: index.valid})
+	}
+	sort.Slice(report.Indexes, func(i, j int) bool { return report.Indexes[i].Name < report.Indexes[j].Name })
+
+	timestamps, err := timestampFeature(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to sample message timestamps")
+		respondWithQueryError(w, err)
+		return
+	}
+	trigram, err := trigramFeature(ctx, indexes)
+	if err != nil {
+		log.Err(err).Msg("Failed to check the pg_trgm extension")
+		respondWithQueryError(w, err)
+		return
+	}
+	report.Features = []SchemaFeature{
+		timestamps,
+		fullTextFeature(indexes),
+		trigram,
+		recommendedIndexFeature("sessionIndex", "n8n_chat_histories_session_id_idx", indexes),
+	}
+
+	respondWithJSON(w, DataResponse{Data: report})
+}
+
+// schemaColumns returns the columns of the history table with their types, in table order
+func schemaColumns(ctx context.Context) ([]SchemaColumn, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT attname, format_type(atttypid, atttypmod), NOT attnotnull
+		FROM pg_attribute
+		WHERE attrelid = 'n8n_chat_histories'::regclass AND attnum > 0 AND NOT attisdropped
+		ORDER BY attnum
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := make(map[string]string, len(coreColumns)+len(columnMapping))
+	for field, column := range coreColumns {
+		fields[column] = field
+	}
+	for _, mapped := range columnMapping {
+		fields[mapped.Column] = mapped.Field
+	}
+
+	columns := []SchemaColumn{}
+	for rows.Next() {
+		var column SchemaColumn
+		if err := rows.Scan(&column.Name, &column.Type, &column.Nullable); err != nil {
+			return nil, err
+		}
+		column.Field = fields[column.Name]
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// timestampFeature checks MESSAGE_TIMESTAMP_PATH against the latest messages, as a path that no
+// workflow writes to leaves the timestamp features empty
+func timestampFeature(ctx context.Context) (SchemaFeature, error) {
+	feature := SchemaFeature{Name: "timestamps"}
+	if len(messageTimestampPath) == 0 {
+		feature.Detail = "MESSAGE_TIMESTAMP_PATH is not set, and n8n stores no timestamps"
+		return feature, nil
+	}
+	path := strings.Join(messageTimestampPath, ".")
+
+	var args queryArgs
+	var found, sampled int
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT COUNT(*) FILTER (WHERE %s IS NOT NULL), COUNT(*)
+		FROM (SELECT message FROM n8n_chat_histories ORDER BY id DESC LIMIT %d) AS latest
+	`, messageTimestampExpr("message", &args), timestampSampleSize), args...).Scan(&found, &sampled)
+	if err != nil {
+		return feature, err
+	}
+	switch {
+	case sampled == 0:
+		feature.Available = true
+		feature.Detail = fmt.Sprintf("read from %s; the table has no messages to check yet", path)
+	case found == 0:
+		feature.Detail = fmt.Sprintf("none of the latest %d messages has a timestamp at %s", sampled, path)
+	default:
+		feature.Available = true
+		feature.Detail = fmt.Sprintf("read from %s, found on %d of the latest %d messages", path, found, sampled)
+	}
+	return feature, nil
+}
+
+// fullTextFeature looks for a full-text index on the table. Search matches substrings, so such an
+// index only serves queries run against the database directly.
+func fullTextFeature(indexes map[string]existingIndex) SchemaFeature {
+	feature := SchemaFeature{Name: "fullTextIndex", Detail: "no valid to_tsvector index on the table"}
+	for name, index := range indexes {
+		if index.valid && strings.Contains(index.definition, "to_tsvector") {
+			feature.Available = true
+			feature.Detail = "index " + name
+			break
+		}
+	}
+	return feature
+}
+
+// trigramFeature reports the trigram index serving content search with the current search
+// settings, and whether db-setup can build it
+func trigramFeature(ctx context.Context, indexes map[string]existingIndex) (SchemaFeature, error) {
+	name := "n8n_chat_histories_message_trgm_idx"
+	if searchUnaccent {
+		name = "n8n_chat_histories_message_unaccent_trgm_idx"
+	}
+	feature := recommendedIndexFeature("trigramIndex", name, indexes)
+	if feature.Available {
+		return feature, nil
+	}
+
+	var installed bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')`).Scan(&installed); err != nil {
+		return feature, err
+	}
+	if !installed {
+		feature.Detail = "the pg_trgm extension is not installed; db-setup installs it and builds the index"
+	}
+	return feature, nil
+}
+
+// recommendedIndexFeature reports whether a valid index serves the purpose of a recommended index
+func recommendedIndexFeature(feature, name string, indexes map[string]existingIndex) SchemaFeature {
+	for _, index := range recommendedIndexes {
+		if index.name != name {
+			continue
+		}
+		if coveredBy := index.coveredBy(indexes); coveredBy != "" {
+			return SchemaFeature{Name: feature, Available: true, Detail: "index " + coveredBy}
+		}
+		return SchemaFeature{Name: feature, Detail: fmt.Sprintf("no index for %s; db-setup builds %s", index.purpose, index.name)}
+	}
+	return SchemaFeature{Name: feature, Detail: "unknown index " + name}
+}
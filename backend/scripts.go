@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// scriptProcessor evaluates expr-lang expressions against every message, for teams that want to
+// customize messages without building a Go plugin. Expressions see the message as message, its
+// session as sessionId and the stage as stage; missing keys are reached safely with ?. and ??.
+//
+//	{"name": "script", "config": {
+//		"when": "message.type == 'ai'",
+//		"set": {"additional_kwargs.model": "message.response_metadata?.model_name ?? 'unknown'"},
+//		"redact": {"content": "sessionId startsWith 'vip-'"}
+//	}}
+//
+// When is a condition the other expressions only run under. Set stores the result of each
+// expression at its path, unless it is nil, and redact replaces the value at each path with
+// [REDACTED] when its condition holds.
+type scriptProcessor struct {
+	when   *vm.Program
+	set    []scriptAssignment
+	redact []scriptAssignment
+}
+
+// scriptAssignment is an expression with the message path its result applies to
+type scriptAssignment struct {
+	path    []string
+	program *vm.Program
+}
+
+// scriptEnv declares the variables expressions may use, so typos fail at startup
+var scriptEnv = map[string]interface{}{
+	"message":   map[string]interface{}{},
+	"sessionId": "",
+	"stage":     "",
+}
+
+func newScriptProcessor(config json.RawMessage) (Processor, error) {
+	var settings struct {
+		When   string            `json:"when"`
+		Set    map[string]string `json:"set"`
+		Redact map[string]string `json:"redact"`
+	}
+	if err := json.Unmarshal(config, &settings); err != nil {
+		return nil, err
+	}
+	if len(settings.Set) == 0 && len(settings.Redact) == 0 {
+		return nil, errors.New("script needs set or redact expressions")
+	}
+
+	var processor scriptProcessor
+	if settings.When != "" {
+		program, err := expr.Compile(settings.When, expr.Env(scriptEnv), expr.AsBool())
+		if err != nil {
+			return nil, fmt.Errorf("when: %w", err)
+		}
+		processor.when = program
+	}
+	var err error
+	if processor.set, err = compileAssignments(settings.Set); err != nil {
+		return nil, err
+	}
+	if processor.redact, err = compileAssignments(settings.Redact, expr.AsBool()); err != nil {
+		return nil, err
+	}
+	return processor, nil
+}
+
+// compileAssignments compiles expressions keyed by message path, in path order
+func compileAssignments(sources map[string]string, options ...expr.Option) ([]scriptAssignment, error) {
+	paths := make([]string, 0, len(sources))
+	for path := range sources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var assignments []scriptAssignment
+	for _, field := range paths {
+		path, err := parseJSONPath(field)
+		if err != nil {
+			return nil, err
+		}
+		if path[0] == "type" {
+			return nil, fmt.Errorf("%s: the message type cannot be changed", field)
+		}
+		program, err := expr.Compile(sources[field], append([]expr.Option{expr.Env(scriptEnv)}, options...)...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		assignments = append(assignments, scriptAssignment{path: path, program: program})
+	}
+	return assignments, nil
+}
+
+// Process evaluates every expression against the message as it was before any of them ran
+func (p scriptProcessor) Process(ctx context.Context, stage ProcessorStage, sessionID string, message map[string]interface{}) error {
+	env := map[string]interface{}{
+		"message":   plainJSONValue(message),
+		"sessionId": sessionID,
+		"stage":     string(stage),
+	}
+	if p.when != nil {
+		matched, err := expr.Run(p.when, env)
+		if err != nil {
+			return fmt.Errorf("when: %w", err)
+		}
+		if matched != true {
+			return nil
+		}
+	}
+
+	for _, assignment := range p.set {
+		value, err := expr.Run(assignment.program, env)
+		if err != nil {
+			return fmt.Errorf("set %s: %w", assignment.path, err)
+		}
+		if value != nil {
+			setPath(message, assignment.path, value)
+		}
+	}
+	for _, assignment := range p.redact {
+		redact, err := expr.Run(assignment.program, env)
+		if err != nil {
+			return fmt.Errorf("redact %s: %w", assignment.path, err)
+		}
+		if redact == true && hasPath(message, assignment.path) {
+			setPath(message, assignment.path, redactedSecret)
+		}
+	}
+	return nil
+}
+
+// plainJSONValue copies a decoded message with json.Number values turned into float64, so
+// expressions can compare and compute with them
+func plainJSONValue(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(node))
+		for key, child := range node {
+			copied[key] = plainJSONValue(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(node))
+		for i, child := range node {
+			copied[i] = plainJSONValue(child)
+		}
+		return copied
+	case json.Number:
+		number, _ := node.Float64()
+		return number
+	}
+	return value
+}
+
+// setPath stores value at path below document, creating the objects on the way. Values that are
+// not objects are not replaced by one.
+func setPath(document map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := document[key].(map[string]interface{})
+		if !ok {
+			if document[key] != nil {
+				return
+			}
+			child = map[string]interface{}{}
+			document[key] = child
+		}
+		document = child
+	}
+	document[path[len(path)-1]] = value
+}
+
+// hasPath reports whether document has a value at path
+func hasPath(document map[string]interface{}, path []string) bool {
+	for _, key := range path[:len(path)-1] {
+		child, ok := document[key].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		document = child
+	}
+	_, ok := document[path[len(path)-1]]
+	return ok
+}
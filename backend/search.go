@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// searchUnaccent is set by SEARCH_UNACCENT=true. Search then ignores diacritics as well as case,
+// so "resume" finds "résumé", using the unaccent extension through an immutable wrapper that
+// expression indexes accept.
+var searchUnaccent bool
+
+// loadSearchConfig reads SEARCH_UNACCENT
+func loadSearchConfig() {
+	searchUnaccent = getEnvOrDefault("SEARCH_UNACCENT", "false") == "true"
+}
+
+// unaccentStatements install the extension and the wrapper. unaccent itself is only stable, as
+// its dictionary could change, which keeps it out of index expressions.
+var unaccentStatements = []string{
+	`CREATE EXTENSION IF NOT EXISTS unaccent`,
+	`CREATE OR REPLACE FUNCTION chat_history_unaccent(text) RETURNS text
+		LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT
+		AS $$ SELECT public.unaccent('public.unaccent'::regdictionary, $1) $$`,
+}
+
+// ensureUnaccentSearch prepares the database for accent-insensitive search
+func ensureUnaccentSearch(ctx context.Context) error {
+	for _, statement := range unaccentStatements {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("SEARCH_UNACCENT needs the unaccent extension: %w", err)
+		}
+	}
+	return nil
+}
+
+// searchCondition matches rows whose message or session ID contains term, ignoring accents with
+// unaccent
+func searchCondition(args *queryArgs, term string, unaccent bool) string {
+	placeholder := args.add("%" + term + "%")
+	if unaccent {
+		return fmt.Sprintf("(%s LIKE chat_history_unaccent(lower(%s)) OR session_id ILIKE %s)",
+			unaccentedMessage, placeholder, placeholder)
+	}
+	return fmt.Sprintf("(message::text ILIKE %s OR session_id ILIKE %s)", placeholder, placeholder)
+}
+
+// unaccentedMessage is the searched expression with SEARCH_UNACCENT, matching its index
+const unaccentedMessage = "chat_history_unaccent(lower(message::text))"
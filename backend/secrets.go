@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/rs/zerolog/log"
+)
+
+// resolveSecretReferences replaces environment variables that reference a secret store with the
+// secret itself, so DATABASE_URL, ADMIN_TOKEN and the like never appear in plain text in task
+// definitions. It runs once at startup, before any configuration is read. Supported references:
+//
+//	aws-sm://<secret id or ARN>             the secret string of a Secrets Manager secret
+//	aws-sm://<secret id or ARN>#<key>       one key of a secret holding a JSON object
+//	aws-ssm://<parameter name>              an SSM parameter, decrypted if it is a SecureString
+func resolveSecretReferences() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		scheme, reference, found := strings.Cut(value, "://")
+		if !found || (scheme != "aws-sm" && scheme != "aws-ssm") {
+			continue
+		}
+
+		var secret string
+		var err error
+		if scheme == "aws-sm" {
+			secret, err = resolveSecretsManagerReference(ctx, reference)
+		} else {
+			secret, err = resolveSSMReference(ctx, reference)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		os.Setenv(name, secret)
+		log.Info().Str("variable", name).Str("source", scheme).Msg("Resolved secret reference")
+	}
+	return nil
+}
+
+// resolveSecretsManagerReference reads a Secrets Manager secret, or one key of it
+func resolveSecretsManagerReference(ctx context.Context, reference string) (string, error) {
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	secretID, key, hasKey := strings.Cut(reference, "#")
+	output, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+	secret := aws.ToString(output.SecretString)
+	if !hasKey {
+		return secret, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object", secretID)
+	}
+	value, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", secretID, key)
+	}
+	if text, isString := value.(string); isString {
+		return text, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// resolveSSMReference reads an SSM parameter
+func resolveSSMReference(ctx context.Context, name string) (string, error) {
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := ssm.NewFromConfig(cfg).GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.Parameter.Value), nil
+}
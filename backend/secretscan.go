@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// secretScanCheckpoint names the progress of the secret scanner in the checkpoint table
+	secretScanCheckpoint = "secret-scan"
+	// redactedSecret replaces a secret in a redacted message
+	redactedSecret = "[REDACTED]"
+)
+
+// secretRule is a pattern for one kind of credential. When the pattern has a capture group, the
+// first group is the secret and the rest of the match only gives context. Matches below
+// minEntropy bits per character are ignored, which keeps generic rules off ordinary words.
+type secretRule struct {
+	name       string
+	pattern    *regexp.Regexp
+	minEntropy float64
+}
+
+// secretRules are the credential formats the scanner looks for, in the style of gitleaks
+var secretRules = []secretRule{
+	{name: "aws-access-key", pattern: regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`)},
+	{name: "github-token", pattern: regexp.MustCompile(`\b(gh[pousr]_[0-9A-Za-z]{36,255})\b`)},
+	{name: "github-fine-grained-token", pattern: regexp.MustCompile(`\b(github_pat_[0-9A-Za-z_]{82})\b`)},
+	{name: "gitlab-token", pattern: regexp.MustCompile(`\b(glpat-[0-9A-Za-z_-]{20})\b`)},
+	{name: "slack-token", pattern: regexp.MustCompile(`\b(xox[baprs]-[0-9A-Za-z-]{10,})\b`)},
+	{name: "slack-webhook", pattern: regexp.MustCompile(`(https://hooks\.slack\.com/services/[0-9A-Za-z_/]{20,})`)},
+	{name: "stripe-key", pattern: regexp.MustCompile(`\b((?:sk|rk)_live_[0-9A-Za-z]{24,})\b`)},
+	{name: "anthropic-key", pattern: regexp.MustCompile(`\b(sk-ant-[0-9A-Za-z_-]{32,})`)},
+	{name: "openai-key", pattern: regexp.MustCompile(`\b(sk-(?:proj-|svcacct-)?[0-9A-Za-z_-]{32,})`)},
+	{name: "google-api-key", pattern: regexp.MustCompile(`\b(AIza[0-9A-Za-z_-]{35})\b`)},
+	{name: "private-key", pattern: regexp.MustCompile(`(-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----)`)},
+	{name: "jwt", pattern: regexp.MustCompile(`\b(eyJ[0-9A-Za-z_-]{10,}\.eyJ[0-9A-Za-z_-]{10,}\.[0-9A-Za-z_-]{10,})`)},
+	{name: "url-credentials", pattern: regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^\s:/@"']+:([^\s/@"']{3,})@`)},
+	{
+		name:       "generic-secret",
+		pattern:    regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|secret|api[_-]?key|access[_-]?token|auth[_-]?token|client[_-]?secret)\b["']?\s*[:=]\s*["']?([^\s"',;]{8,})`),
+		minEntropy: 3,
+	},
+}
+
+// loadSecretRules adds the rules in SECRET_SCAN_RULES, a JSON object of rule names to regular
+// expressions, to the built-in ones. A rule with a built-in name replaces it.
+func loadSecretRules() error {
+	raw := os.Getenv("SECRET_SCAN_RULES")
+	if raw == "" {
+		return nil
+	}
+	var patterns map[string]string
+	if err := json.Unmarshal([]byte(raw), &patterns); err != nil {
+		return fmt.Errorf("SECRET_SCAN_RULES: %w", err)
+	}
+	names := make([]string, 0, len(patterns))
+	for name := range patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pattern, err := regexp.Compile(patterns[name])
+		if err != nil {
+			return fmt.Errorf("SECRET_SCAN_RULES: rule %q: %w", name, err)
+		}
+		rule := secretRule{name: name, pattern: pattern}
+		if index := secretRuleIndex(name); index >= 0 {
+			secretRules[index] = rule
+		} else {
+			secretRules = append(secretRules, rule)
+		}
+	}
+	return nil
+}
+
+// secretRuleIndex returns the position of the named rule in secretRules, or -1
+func secretRuleIndex(name string) int {
+	for i, rule := range secretRules {
+		if rule.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// secretMatch is a secret found in a string, by byte offsets
+type secretMatch struct {
+	start, end int
+	secret     string
+}
+
+// find returns the secrets in text matched by the rule
+func (rule secretRule) find(text string) []secretMatch {
+	var matches []secretMatch
+	for _, indexes := range rule.pattern.FindAllStringSubmatchIndex(text, -1) {
+		start, end := indexes[0], indexes[1]
+		if len(indexes) >= 4 && indexes[2] >= 0 {
+			start, end = indexes[2], indexes[3]
+		}
+		secret := text[start:end]
+		if secret == "" || secret == redactedSecret || shannonEntropy(secret) < rule.minEntropy {
+			continue
+		}
+		matches = append(matches, secretMatch{start: start, end: end, secret: secret})
+	}
+	return matches
+}
+
+// shannonEntropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// secretFingerprint identifies a secret without storing it
+func secretFingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// maskSecret keeps enough of a secret to recognise it: the first four characters of long ones
+func maskSecret(secret string) string {
+	runes := []rune(secret)
+	if len(runes) < 16 {
+		return strings.Repeat("*", 8)
+	}
+	return string(runes[:4]) + strings.Repeat("*", 8)
+}
+
+// SecretFinding is a likely credential in a chat message. Only a fingerprint and a masked preview
+// of the secret are stored, so the findings do not leak what they point at.
+type SecretFinding struct {
+	ID          int64      `json:"id"`
+	MessageID   int64      `json:"messageId"`
+	SessionID   string     `json:"sessionId"`
+	Rule        string     `json:"rule"`
+	Field       string     `json:"field"`
+	Preview     string     `json:"preview"`
+	Status      string     `json:"status"`
+	FoundAt     time.Time  `json:"foundAt"`
+	ResolvedAt  *time.Time `json:"resolvedAt,omitempty"`
+	ResolvedBy  *string    `json:"resolvedBy,omitempty"`
+	fingerprint string
+}
+
+// decodeMessageDocument decodes a stored message keeping numbers as they were written
+func decodeMessageDocument(raw []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var document interface{}
+	err := decoder.Decode(&document)
+	return document, err
+}
+
+// walkStrings calls visit with every string below value and its dotted path. When visit returns
+// a different string, it replaces the original.
+func walkStrings(value interface{}, path string, visit func(path, text string) string) interface{} {
+	switch node := value.(type) {
+	case string:
+		return visit(path, node)
+	case map[string]interface{}:
+		for key, child := range node {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			node[key] = walkStrings(child, childPath, visit)
+		}
+	case []interface{}:
+		for i, child := range node {
+			node[i] = walkStrings(child, path+"."+strconv.Itoa(i), visit)
+		}
+	}
+	return value
+}
+
+// scanDocument returns the secrets in every string of a decoded message
+func scanDocument(document interface{}) []SecretFinding {
+	var findings []SecretFinding
+	seen := make(map[string]bool)
+	walkStrings(document, "", func(path, text string) string {
+		for _, rule := range secretRules {
+			for _, match := range rule.find(text) {
+				fingerprint := secretFingerprint(match.secret)
+				if seen[rule.name+fingerprint] {
+					continue
+				}
+				seen[rule.name+fingerprint] = true
+				findings = append(findings, SecretFinding{
+					Rule:        rule.name,
+					Field:       path,
+					Preview:     maskSecret(match.secret),
+					fingerprint: fingerprint,
+				})
+			}
+		}
+		return text
+	})
+	return findings
+}
+
+// redactDocument replaces the secrets of rule with the given fingerprint in every string of a
+// decoded message, and reports how many it replaced
+func redactDocument(document interface{}, rule secretRule, fingerprint string) (interface{}, int) {
+	replaced := 0
+	document = walkStrings(document, "", func(path, text string) string {
+		matches := rule.find(text)
+		for i := len(matches) - 1; i >= 0; i-- {
+			if secretFingerprint(matches[i].secret) == fingerprint {
+				text = text[:matches[i].start] + redactedSecret + text[matches[i].end:]
+				replaced++
+			}
+		}
+		return text
+	})
+	return document, replaced
+}
+
+// secretScanJob scans the messages added since its checkpoint for credentials
+type secretScanJob struct {
+	batchSize int
+}
+
+// newSecretScanJob reads SECRET_SCAN_BATCH_SIZE from the environment
+func newSecretScanJob() secretScanJob {
+	job := secretScanJob{batchSize: 2000}
+	if batchSize, err := strconv.Atoi(os.Getenv("SECRET_SCAN_BATCH_SIZE")); err == nil && batchSize > 0 {
+		job.batchSize = batchSize
+	}
+	return job
+}
+
+// run catches up with the chat table, one batch of rows at a time
+func (j secretScanJob) run(ctx context.Context) error {
+	_, _, err := j.catchUp(ctx)
+	return err
+}
+
+// catchUp scans batches until the checkpoint reaches the end of the chat table and returns the
+// number of messages scanned and of new findings
+func (j secretScanJob) catchUp(ctx context.Context) (int, int, error) {
+	var scanned, found int
+	for {
+		processed, findings, err := j.scanBatch(ctx)
+		scanned += processed
+		found += findings
+		if err != nil || processed < j.batchSize {
+			return scanned, found, err
+		}
+	}
+}
+
+// scanBatch scans the next batch of chat rows and records their findings. A secret already
+// recorded for a message is not recorded again, so rescans keep the status of earlier findings.
+func (j secretScanJob) scanBatch(ctx context.Context) (int, int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var checkpoint int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT last_id FROM chat_history_publish_checkpoints WHERE publisher = $1 FOR UPDATE
+	`, secretScanCheckpoint).Scan(&checkpoint); err != nil {
+		return 0, 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, session_id, message FROM n8n_chat_histories WHERE id > $1 ORDER BY id LIMIT $2
+	`, checkpoint, j.batchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	type scannedMessage struct {
+		id        int64
+		sessionID string
+		findings  []SecretFinding
+	}
+	var messages []scannedMessage
+	lastID, processed := checkpoint, 0
+	for rows.Next() {
+		var message scannedMessage
+		var raw []byte
+		if err := rows.Scan(&message.id, &message.sessionID, &raw); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		lastID = message.id
+		processed++
+		document, err := decodeMessageDocument(raw)
+		if err != nil {
+			log.Warn().Err(err).Int64("messageId", message.id).Msg("Skipping undecodable message in secret scan")
+			continue
+		}
+		if message.findings = scanDocument(document); len(message.findings) > 0 {
+			messages = append(messages, message)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if processed == 0 {
+		return 0, 0, nil
+	}
+
+	found := 0
+	for _, message := range messages {
+		for _, finding := range message.findings {
+			result, err := tx.ExecContext(ctx, `
+				INSERT INTO chat_history_secret_findings (message_id, session_id, rule, field, fingerprint, preview)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (message_id, rule, fingerprint) DO NOTHING
+			`, message.id, message.sessionID, finding.Rule, finding.Field, finding.fingerprint, finding.Preview)
+			if err != nil {
+				return 0, 0, err
+			}
+			inserted, _ := result.RowsAffected()
+			found += int(inserted)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE chat_history_publish_checkpoints SET last_id = $2, updated_at = now() WHERE publisher = $1
+	`, secretScanCheckpoint, lastID); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	if found > 0 {
+		log.Warn().Int("findings", found).Int64("lastId", lastID).Msg("Found likely secrets in chat messages")
+	}
+	return processed, found, nil
+}
+
+// SecretScanReport lists secret findings with the number of findings per rule
+type SecretScanReport struct {
+	Findings []SecretFinding `json:"findings"`
+	Rules    map[string]int  `json:"rules"`
+}
+
+// GetSecretFindingsHandler lists the findings of the secret scanner, newest first. status selects
+// open (the default), redacted, dismissed or all findings, and rule and sessionId narrow them
+// down further. The rule counts cover every finding with the status, regardless of rule and session.
+func GetSecretFindingsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status == "" {
+		status = "open"
+	}
+	if status != "open" && status != "redacted" && status != "dismissed" && status != "all" {
+		respondWithError(w, "status must be open, redacted, dismissed or all", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 500 {
+		limit = 100
+	}
+
+	var args queryArgs
+	var statusConditions []string
+	if status != "all" {
+		statusConditions = append(statusConditions, "status = "+args.add(status))
+	}
+	countQuery := fmt.Sprintf(`SELECT rule, COUNT(*) FROM chat_history_secret_findings %s GROUP BY rule`, joinWhere(statusConditions))
+	countArgs := append(queryArgs{}, args...)
+
+	conditions := statusConditions
+	if rule := query.Get("rule"); rule != "" {
+		conditions = append(conditions, "rule = "+args.add(rule))
+	}
+	if sessionID := query.Get("sessionId"); sessionID != "" {
+		conditions = append(conditions, "session_id = "+args.add(sessionID))
+	}
+
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT id, message_id, session_id, rule, field, preview, status, found_at, resolved_at, resolved_by
+		FROM chat_history_secret_findings
+		%s
+		ORDER BY id DESC
+		LIMIT %s
+	`, joinWhere(conditions), args.add(limit)), args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query secret findings")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	report := SecretScanReport{Findings: []SecretFinding{}, Rules: map[string]int{}}
+	for rows.Next() {
+		var finding SecretFinding
+		if err := rows.Scan(&finding.ID, &finding.MessageID, &finding.SessionID, &finding.Rule, &finding.Field, &finding.Preview,
+			&finding.Status, &finding.FoundAt, &finding.ResolvedAt, &finding.ResolvedBy); err != nil {
+			log.Err(err).Msg("Failed to scan secret finding")
+			respondWithQueryError(w, err)
+			return
+		}
+		report.Findings = append(report.Findings, finding)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate secret findings")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	countRows, err := db.QueryContext(r.Context(), countQuery, countArgs...)
+	if err != nil {
+		log.Err(err).Msg("Failed to count secret findings")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer countRows.Close()
+	for countRows.Next() {
+		var rule string
+		var count int
+		if err := countRows.Scan(&rule, &count); err != nil {
+			log.Err(err).Msg("Failed to scan secret finding count")
+			respondWithQueryError(w, err)
+			return
+		}
+		report.Rules[rule] = count
+	}
+	if err := countRows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate secret finding counts")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: report})
+}
+
+// ScanSecretsHandler runs the secret scanner now instead of waiting for the worker. With
+// full=true it starts over from the first message, which picks up rules added since. Batches
+// commit as they go, so a scan cut short by the request timeout is finished by the worker.
+func ScanSecretsHandler(w http.ResponseWriter, r *http.Request) {
+	full, _ := strconv.ParseBool(r.URL.Query().Get("full"))
+	if full {
+		if _, err := db.ExecContext(r.Context(), `
+			UPDATE chat_history_publish_checkpoints SET last_id = 0, updated_at = now() WHERE publisher = $1
+		`, secretScanCheckpoint); err != nil {
+			log.Err(err).Msg("Failed to reset secret scan checkpoint")
+			respondWithQueryError(w, err)
+			return
+		}
+	}
+
+	scanned, found, err := newSecretScanJob().catchUp(r.Context())
+	if err != nil {
+		log.Err(err).Msg("Failed to scan messages for secrets")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := recordAudit(db, r, "secrets.scan", map[string]interface{}{"full": full, "scanned": scanned, "findings": found}); err != nil {
+		log.Err(err).Msg("Failed to record secret scan audit entry")
+	}
+
+	respondWithJSON(w, DataResponse{Data: map[string]int{"scanned": scanned, "findings": found}})
+}
+
+// RedactSecretHandler replaces the secret of a finding with [REDACTED] wherever it appears in
+// the message. Other open findings of the message that the rewrite removed are resolved as well.
+func RedactSecretHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, "Invalid finding ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Err(err).Msg("Failed to begin secret redaction")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var finding SecretFinding
+	err = tx.QueryRowContext(r.Context(), `
+		SELECT id, message_id, session_id, rule, field, fingerprint, preview, status
+		FROM chat_history_secret_findings
+		WHERE id = $1
+		FOR UPDATE
+	`, id).Scan(&finding.ID, &finding.MessageID, &finding.SessionID, &finding.Rule, &finding.Field, &finding.fingerprint, &finding.Preview, &finding.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, "Finding not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to load secret finding")
+		respondWithQueryError(w, err)
+		return
+	}
+	if finding.Status != "open" {
+		respondWithError(w, "Finding is already "+finding.Status, http.StatusConflict)
+		return
+	}
+	index := secretRuleIndex(finding.Rule)
+	if index < 0 {
+		respondWithError(w, "Rule "+finding.Rule+" is no longer configured", http.StatusConflict)
+		return
+	}
+
+	var raw []byte
+	err = tx.QueryRowContext(r.Context(), `SELECT message FROM n8n_chat_histories WHERE id = $1 FOR UPDATE`, finding.MessageID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, "Message no longer exists", http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to load message for redaction")
+		respondWithQueryError(w, err)
+		return
+	}
+	document, err := decodeMessageDocument(raw)
+	if err != nil {
+		log.Err(err).Msg("Failed to decode message for redaction")
+		respondWithError(w, "Message is not valid JSON", http.StatusUnprocessableEntity)
+		return
+	}
+	document, replaced := redactDocument(document, secretRules[index], finding.fingerprint)
+	if replaced > 0 {
+		redacted, err := json.Marshal(document)
+		if err != nil {
+			log.Err(err).Msg("Failed to encode redacted message")
+			respondWithError(w, "Failed to encode redacted message", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.ExecContext(r.Context(), `UPDATE n8n_chat_histories SET message = $2 WHERE id = $1`, finding.MessageID, string(redacted)); err != nil {
+			log.Err(err).Msg("Failed to update redacted message")
+			respondWithQueryError(w, err)
+			return
+		}
+	}
+
+	// Overlapping rules match the same secret, so the findings still present decide what is left open
+	remaining := make(map[string]bool)
+	for _, left := range scanDocument(document) {
+		remaining[left.Rule+":"+left.fingerprint] = true
+	}
+	rows, err := tx.QueryContext(r.Context(), `
+		SELECT id, rule, fingerprint FROM chat_history_secret_findings WHERE message_id = $1 AND status = 'open'
+	`, finding.MessageID)
+	if err != nil {
+		log.Err(err).Msg("Failed to load open secret findings")
+		respondWithQueryError(w, err)
+		return
+	}
+	resolved := []int64{finding.ID}
+	for rows.Next() {
+		var other SecretFinding
+		if err := rows.Scan(&other.ID, &other.Rule, &other.fingerprint); err != nil {
+			rows.Close()
+			log.Err(err).Msg("Failed to scan open secret finding")
+			respondWithQueryError(w, err)
+			return
+		}
+		if other.ID != finding.ID && !remaining[other.Rule+":"+other.fingerprint] {
+			resolved = append(resolved, other.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate open secret findings")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	actor := auditActor(r)
+	if _, err := tx.ExecContext(r.Context(), `
+		UPDATE chat_history_secret_findings SET status = 'redacted', resolved_at = now(), resolved_by = $2 WHERE id = ANY($1)
+	`, resolved, actor); err != nil {
+		log.Err(err).Msg("Failed to resolve secret findings")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := recordAudit(tx, r, "secrets.redact", map[string]interface{}{
+		"findings":  resolved,
+		"messageId": finding.MessageID,
+		"sessionId": finding.SessionID,
+		"rule":      finding.Rule,
+		"replaced":  replaced,
+	}); err != nil {
+		log.Err(err).Msg("Failed to record secret redaction audit entry")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Err(err).Msg("Failed to commit secret redaction")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: map[string]interface{}{"resolved": resolved, "replaced": replaced}})
+}
+
+// DismissSecretHandler closes a finding that is not a real secret without touching the message
+func DismissSecretHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		respondWithError(w, "Invalid finding ID", http.StatusBadRequest)
+		return
+	}
+
+	var finding SecretFinding
+	err = db.QueryRowContext(r.Context(), `
+		UPDATE chat_history_secret_findings
+		SET status = 'dismissed', resolved_at = now(), resolved_by = $2
+		WHERE id = $1 AND status = 'open'
+		RETURNING id, message_id, session_id, rule, field, preview, status, found_at, resolved_at, resolved_by
+	`, id, auditActor(r)).Scan(&finding.ID, &finding.MessageID, &finding.SessionID, &finding.Rule, &finding.Field, &finding.Preview,
+		&finding.Status, &finding.FoundAt, &finding.ResolvedAt, &finding.ResolvedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, "Open finding not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to dismiss secret finding")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := recordAudit(db, r, "secrets.dismiss", map[string]interface{}{"id": id}); err != nil {
+		log.Err(err).Msg("Failed to record secret dismissal audit entry")
+	}
+
+	respondWithJSON(w, DataResponse{Data: finding})
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SessionReplay re-sends the human turns of a session to the n8n chat webhook, one at a time, so
+// a changed workflow can be tested against real conversations. n8n keeps the new conversation in
+// its chat memory under ReplaySessionID; the turns record what was sent and answered.
+type SessionReplay struct {
+	ID              string       `json:"id"`
+	SessionID       string       `json:"sessionId"`
+	ReplaySessionID string       `json:"replaySessionId"`
+	Status          string       `json:"status"` // pending, running, completed or failed
+	Error           string       `json:"error,omitempty"`
+	DelayMs         int64        `json:"delayMs"`
+	CreatedBy       string       `json:"createdBy"`
+	CreatedAt       time.Time    `json:"createdAt"`
+	CompletedAt     *time.Time   `json:"completedAt,omitempty"`
+	Turns           []ReplayTurn `json:"turns"`
+}
+
+// ReplayTurn is a human message of the original session sent again, with the webhook's answer
+type ReplayTurn struct {
+	Turn       int       `json:"turn"`
+	MessageID  int       `json:"messageId"`
+	Input      string    `json:"input"`
+	Output     string    `json:"output"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	SentAt     time.Time `json:"sentAt"`
+}
+
+var errReplayNotFound = errors.New("replay not found")
+
+// replayWebhook is the n8n chat webhook replays are sent to, empty when replays are not configured
+func replayWebhook() string {
+	return os.Getenv("REPLAY_WEBHOOK_URL")
+}
+
+// CreateSessionReplayHandler queues a replay of a session. The delayMs parameter sets the pause
+// between turns and defaults to REPLAY_DELAY.
+func CreateSessionReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if replayWebhook() == "" {
+		respondWithError(w, "Replay webhook is not configured", http.StatusBadRequest)
+		return
+	}
+	sessionID := r.PathValue("id")
+
+	delay := getEnvDuration("REPLAY_DELAY", 2*time.Second)
+	if value := r.URL.Query().Get("delayMs"); value != "" {
+		delayMs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || delayMs < 0 || delayMs > time.Hour.Milliseconds() {
+			respondWithError(w, "delayMs must be between 0 and 3600000", http.StatusBadRequest)
+			return
+		}
+		delay = time.Duration(delayMs) * time.Millisecond
+	}
+
+	var humanTurns int
+	err := db.QueryRowContext(r.Context(), `
+		SELECT COUNT(*) FROM n8n_chat_histories WHERE session_id = $1 AND message->>'type' = 'human'
+	`, sessionID).Scan(&humanTurns)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to count session turns")
+		respondWithQueryError(w, err)
+		return
+	}
+	if humanTurns == 0 {
+		respondWithError(w, "Session not found or without human messages", http.StatusNotFound)
+		return
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		log.Err(err).Msg("Failed to generate replay id")
+		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	replay := SessionReplay{
+		ID:        hex.EncodeToString(idBytes),
+		SessionID: sessionID,
+		Status:    "pending",
+		DelayMs:   delay.Milliseconds(),
+		CreatedBy: auditActor(r),
+		Turns:     []ReplayTurn{},
+	}
+	replay.ReplaySessionID = sessionID + ":replay:" + replay.ID
+
+	err = db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_session_replays (id, session_id, replay_session_id, delay_ms, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at
+	`, replay.ID, replay.SessionID, replay.ReplaySessionID, replay.DelayMs, replay.CreatedBy).Scan(&replay.CreatedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to create replay")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	log.Info().Str("replay", replay.ID).Str("sessionId", sessionID).Int("turns", humanTurns).Msg("Replay queued")
+	respondWithJSONStatus(w, DataResponse{Data: replay}, http.StatusAccepted)
+}
+
+// loadSessionReplay returns a replay with the turns sent so far, or errReplayNotFound
+func loadSessionReplay(ctx context.Context, id string) (SessionReplay, error) {
+	replay := SessionReplay{Turns: []ReplayTurn{}}
+	var completedAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT id, session_id, replay_session_id, status, error, delay_ms, created_by, created_at, completed_at
+		FROM chat_history_session_replays
+		WHERE id = $1
+	`, id).Scan(&replay.ID, &replay.SessionID, &replay.ReplaySessionID, &replay.Status, &replay.Error, &replay.DelayMs,
+		&replay.CreatedBy, &replay.CreatedAt, &completedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return replay, errReplayNotFound
+	}
+	if err != nil {
+		return replay, err
+	}
+	if completedAt.Valid {
+		replay.CompletedAt = &completedAt.Time
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT turn, message_id, input, output, status, error, duration_ms, sent_at
+		FROM chat_history_session_replay_turns
+		WHERE replay_id = $1
+		ORDER BY turn
+	`, id)
+	if err != nil {
+		return replay, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var turn ReplayTurn
+		if err := rows.Scan(&turn.Turn, &turn.MessageID, &turn.Input, &turn.Output, &turn.Status, &turn.Error,
+			&turn.DurationMs, &turn.SentAt); err != nil {
+			return replay, err
+		}
+		replay.Turns = append(replay.Turns, turn)
+	}
+	return replay, rows.Err()
+}
+
+func GetSessionReplayHandler(w http.ResponseWriter, r *http.Request) {
+	replay, err := loadSessionReplay(r.Context(), r.PathValue("id"))
+	if errors.Is(err, errReplayNotFound) {
+		respondWithError(w, "Replay not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to load replay")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: replay})
+}
+
+// GetSessionReplaysHandler lists the replays of a session, newest first, without their turns
+func GetSessionReplaysHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, session_id, replay_session_id, status, error, delay_ms, created_by, created_at, completed_at
+		FROM chat_history_session_replays
+		WHERE session_id = $1
+		ORDER BY created_at DESC
+	`, r.PathValue("id"))
+	if err != nil {
+		log.Err(err).Msg("Failed to list replays")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	replays := []SessionReplay{}
+	for rows.Next() {
+		var replay SessionReplay
+		var completedAt sql.NullTime
+		if err := rows.Scan(&replay.ID, &replay.SessionID, &replay.ReplaySessionID, &replay.Status, &replay.Error,
+			&replay.DelayMs, &replay.CreatedBy, &replay.CreatedAt, &completedAt); err != nil {
+			log.Err(err).Msg("Failed to scan replay")
+			respondWithQueryError(w, err)
+			return
+		}
+		if completedAt.Valid {
+			replay.CompletedAt = &completedAt.Time
+		}
+		replays = append(replays, replay)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to list replays")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: replays})
+}
+
+// replayJob runs queued replays
+type replayJob struct {
+	client *http.Client
+}
+
+// newReplayJob reads REPLAY_TURN_TIMEOUT, how long the webhook may take to answer a turn
+func newReplayJob() replayJob {
+	return replayJob{client: &http.Client{Timeout: getEnvDuration("REPLAY_TURN_TIMEOUT", 2*time.Minute)}}
+}
+
+// run claims pending replays one at a time until none are left
+func (j replayJob) run(ctx context.Context) error {
+	for {
+		var replay SessionReplay
+		err := db.QueryRowContext(ctx, `
+			UPDATE chat_history_session_replays SET status = 'running'
+			WHERE id = (
+				SELECT id FROM chat_history_session_replays
+				WHERE status = 'pending'
+				ORDER BY created_at
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, session_id, replay_session_id, delay_ms
+		`).Scan(&replay.ID, &replay.SessionID, &replay.ReplaySessionID, &replay.DelayMs)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		status, message := "completed", ""
+		turns, err := j.replay(ctx, replay)
+		if err != nil {
+			log.Err(err).Str("replay", replay.ID).Msg("Replay failed")
+			status, message = "failed", err.Error()
+		} else {
+			log.Info().Str("replay", replay.ID).Int("turns", turns).Msg("Replay completed")
+		}
+		if _, err := db.ExecContext(ctx, `
+			UPDATE chat_history_session_replays SET status = $2, error = $3, completed_at = now()
+			WHERE id = $1
+		`, replay.ID, status, message); err != nil {
+			return err
+		}
+	}
+}
+
+// replay sends the human turns of the original session in order, pausing between them, and
+// records every answer. It stops at the first failed turn, as the following ones would be sent
+// to a conversation missing a reply.
+func (j replayJob) replay(ctx context.Context, replay SessionReplay) (int, error) {
+	chats, err := loadSessionMessages(ctx, replay.SessionID)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, turn := range splitTurns(chats) {
+		if turn.Human == nil {
+			continue
+		}
+		if sent > 0 {
+			select {
+			case <-ctx.Done():
+				return sent, ctx.Err()
+			case <-time.After(time.Duration(replay.DelayMs) * time.Millisecond):
+			}
+		}
+
+		result := ReplayTurn{Turn: sent, MessageID: turn.Human.ID, Input: turn.Human.Message.Content, SentAt: time.Now().UTC()}
+		result.Output, result.Status, err = j.send(ctx, replay.ReplaySessionID, result.Input)
+		result.DurationMs = time.Since(result.SentAt).Milliseconds()
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO chat_history_session_replay_turns (replay_id, turn, message_id, input, output, status, error, duration_ms, sent_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`, replay.ID, result.Turn, result.MessageID, result.Input, result.Output, result.Status, result.Error,
+			result.DurationMs, result.SentAt); err != nil {
+			return sent, err
+		}
+		if result.Error != "" {
+			return sent, fmt.Errorf("turn %d: %s", result.Turn, result.Error)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// replayRequest is the body the n8n chat trigger expects for a new message
+type replayRequest struct {
+	Action    string `json:"action"`
+	SessionID string `json:"sessionId"`
+	ChatInput string `json:"chatInput"`
+}
+
+// send posts a message to the chat webhook and returns the answer. Workflows answering with a
+// JSON object carry it in output, or text; any other body is taken as the answer itself.
+func (j replayJob) send(ctx context.Context, sessionID, input string) (string, int, error) {
+	payload, err := json.Marshal(replayRequest{Action: "sendMessage", SessionID: sessionID, ChatInput: input})
+	if err != nil {
+		return "", 0, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, replayWebhook(), bytes.NewReader(payload))
+	if err != nil {
+		return "", 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := j.client.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return "", response.StatusCode, err
+	}
+	if response.StatusCode/100 != 2 {
+		return strings.TrimSpace(string(body)), response.StatusCode, fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+
+	var answer struct {
+		Output *string `json:"output"`
+		Text   *string `json:"text"`
+	}
+	if json.Unmarshal(body, &answer) == nil {
+		if answer.Output != nil {
+			return *answer.Output, response.StatusCode, nil
+		}
+		if answer.Text != nil {
+			return *answer.Text, response.StatusCode, nil
+		}
+	}
+	return strings.TrimSpace(string(body)), response.StatusCode, nil
+}
+
+// ReplayTurnComparison sets a replayed answer against the original one. Divergence runs from 0,
+// an identical answer, to 1: it is one minus the similarity of the answers, by embeddings when
+// configured and by shared words otherwise, averaged with the overlap of the tools called when
+// either answer called one. Failed turns diverge fully.
+type ReplayTurnComparison struct {
+	Turn                int        `json:"turn"`
+	MessageID           int        `json:"messageId"`
+	Input               string     `json:"input"`
+	Original            string     `json:"original"`
+	Replayed            string     `json:"replayed"`
+	Error               string     `json:"error,omitempty"`
+	LengthDelta         int        `json:"lengthDelta"`
+	TextSimilarity      float64    `json:"textSimilarity"`
+	EmbeddingSimilarity *float64   `json:"embeddingSimilarity,omitempty"`
+	OriginalToolCalls   []string   `json:"originalToolCalls"`
+	ReplayedToolCalls   []string   `json:"replayedToolCalls"`
+	MissingToolCalls    []string   `json:"missingToolCalls"`
+	AddedToolCalls      []string   `json:"addedToolCalls"`
+	Divergence          float64    `json:"divergence"`
+	Diff                []DiffPart `json:"diff,omitempty"`
+}
+
+// ReplayComparison is the response of the replay comparison endpoint. Tool calls of the replay
+// are read from the chat memory n8n kept under the replay session, so they are only known when
+// the workflow stores tool calls there.
+type ReplayComparison struct {
+	ReplayID        string                 `json:"replayId"`
+	SessionID       string                 `json:"sessionId"`
+	ReplaySessionID string                 `json:"replaySessionId"`
+	Status          string                 `json:"status"`
+	Embeddings      bool                   `json:"embeddings"`
+	MeanDivergence  float64                `json:"meanDivergence"`
+	MaxDivergence   float64                `json:"maxDivergence"`
+	Turns           []ReplayTurnComparison `json:"turns"`
+}
+
+// CompareSessionReplayHandler scores every replayed turn against the original answer. With
+// diff=true each turn carries a word-level diff of the two answers.
+func CompareSessionReplayHandler(w http.ResponseWriter, r *http.Request) {
+	replay, err := loadSessionReplay(r.Context(), r.PathValue("id"))
+	if errors.Is(err, errReplayNotFound) {
+		respondWithError(w, "Replay not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to load replay")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	original, err := loadSessionMessages(r.Context(), replay.SessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", replay.SessionID).Msg("Failed to load session")
+		respondWithQueryError(w, err)
+		return
+	}
+	replayed, err := loadSessionMessages(r.Context(), replay.ReplaySessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", replay.ReplaySessionID).Msg("Failed to load session")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	comparison := compareReplay(replay, splitTurns(original), splitTurns(replayed), r.URL.Query().Get("diff") == "true")
+	if embeddings != nil {
+		if err := scoreReplayEmbeddings(r.Context(), &comparison); err != nil {
+			log.Err(err).Str("replay", replay.ID).Msg("Failed to embed replay answers")
+			respondWithError(w, "Failed to compute embeddings", http.StatusBadGateway)
+			return
+		}
+	}
+	for _, turn := range comparison.Turns {
+		comparison.MeanDivergence += turn.Divergence / float64(len(comparison.Turns))
+		comparison.MaxDivergence = max(comparison.MaxDivergence, turn.Divergence)
+	}
+
+	respondWithJSON(w, DataResponse{Data: comparison})
+}
+
+// compareReplay matches every replayed turn with the original turn of its human message and, by
+// position, with the turn n8n stored for it under the replay session
+func compareReplay(replay SessionReplay, original, replayed []Turn, withDiff bool) ReplayComparison {
+	comparison := ReplayComparison{
+		ReplayID:        replay.ID,
+		SessionID:       replay.SessionID,
+		ReplaySessionID: replay.ReplaySessionID,
+		Status:          replay.Status,
+		Turns:           []ReplayTurnComparison{},
+	}
+	originalByMessage := map[int]*Turn{}
+	for i := range original {
+		if original[i].Human != nil {
+			originalByMessage[original[i].Human.ID] = &original[i]
+		}
+	}
+	var replayedTurns []*Turn
+	for i := range replayed {
+		if replayed[i].Human != nil {
+			replayedTurns = append(replayedTurns, &replayed[i])
+		}
+	}
+
+	for _, turn := range replay.Turns {
+		originalTurn := originalByMessage[turn.MessageID]
+		var replayedTurn *Turn
+		if turn.Turn < len(replayedTurns) {
+			replayedTurn = replayedTurns[turn.Turn]
+		}
+		result := ReplayTurnComparison{
+			Turn:              turn.Turn,
+			MessageID:         turn.MessageID,
+			Input:             turn.Input,
+			Original:          originalTurn.aiResponse(),
+			Replayed:          turn.Output,
+			Error:             turn.Error,
+			OriginalToolCalls: originalTurn.toolCallNames(),
+			ReplayedToolCalls: replayedTurn.toolCallNames(),
+		}
+		if result.Replayed == "" {
+			result.Replayed = replayedTurn.aiResponse()
+		}
+		result.LengthDelta = len([]rune(result.Replayed)) - len([]rune(result.Original))
+		diff, similarity := diffWords(result.Original, result.Replayed)
+		result.TextSimilarity = similarity
+		if withDiff {
+			result.Diff = diff
+		}
+		result.MissingToolCalls, result.AddedToolCalls = diffToolCalls(result.OriginalToolCalls, result.ReplayedToolCalls)
+		result.Divergence = result.divergence()
+		comparison.Turns = append(comparison.Turns, result)
+	}
+	return comparison
+}
+
+// scoreReplayEmbeddings adds the embedding similarity of the answered turns and scores them again
+func scoreReplayEmbeddings(ctx context.Context, comparison *ReplayComparison) error {
+	var texts []string
+	var turns []*ReplayTurnComparison
+	for i := range comparison.Turns {
+		turn := &comparison.Turns[i]
+		// The API rejects empty inputs, and such turns are scored by their words alone
+		if turn.Error == "" && strings.TrimSpace(turn.Original) != "" && strings.TrimSpace(turn.Replayed) != "" {
+			texts = append(texts, turn.Original, turn.Replayed)
+			turns = append(turns, turn)
+		}
+	}
+	comparison.Embeddings = true
+	if len(texts) == 0 {
+		return nil
+	}
+	vectors, err := embeddings.embed(ctx, texts)
+	if err != nil {
+		return err
+	}
+	for i, turn := range turns {
+		similarity := cosineSimilarity(vectors[2*i], vectors[2*i+1])
+		turn.EmbeddingSimilarity = &similarity
+		turn.Divergence = turn.divergence()
+	}
+	return nil
+}
+
+// divergence scores how far the replayed answer strayed from the original one
+func (c ReplayTurnComparison) divergence() float64 {
+	if c.Error != "" {
+		return 1
+	}
+	similarity := c.TextSimilarity
+	if c.EmbeddingSimilarity != nil {
+		similarity = max(*c.EmbeddingSimilarity, 0)
+	}
+	if called := len(c.OriginalToolCalls) + len(c.ReplayedToolCalls); called > 0 {
+		shared := (called - len(c.MissingToolCalls) - len(c.AddedToolCalls)) / 2
+		overlap := float64(shared) / float64(called-shared)
+		similarity = (similarity + overlap) / 2
+	}
+	return 1 - similarity
+}
+
+// toolCallNames lists the tools called by the AI messages of a turn, in order
+func (t *Turn) toolCallNames() []string {
+	names := []string{}
+	if t == nil {
+		return names
+	}
+	for _, chat := range t.Messages {
+		if chat.Message.Type != "ai" {
+			continue
+		}
+		for _, call := range chat.Message.ToolCalls {
+			names = append(names, toolCallField(call, "name"))
+		}
+	}
+	return names
+}
+
+// diffToolCalls returns the calls of original missing from replayed and the calls replayed added,
+// counting repeated calls of a tool
+func diffToolCalls(original, replayed []string) (missing, added []string) {
+	counts := map[string]int{}
+	for _, name := range original {
+		counts[name]++
+	}
+	added = []string{}
+	for _, name := range replayed {
+		if counts[name] > 0 {
+			counts[name]--
+		} else {
+			added = append(added, name)
+		}
+	}
+	missing = []string{}
+	for _, name := range original {
+		if counts[name] > 0 {
+			counts[name]--
+			missing = append(missing, name)
+		}
+	}
+	return missing, added
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxDiffCells bounds the table of the word-level diff, which holds one cell per pair of words of
+// the two responses, to about 1 MB per turn
+const maxDiffCells = 250000
+
+// Turn is a human message together with every message that followed it until the next human message
+type Turn struct {
+	Human    *Chat  `json:"human"`
+	Messages []Chat `json:"messages"`
+}
+
+// TurnComparison holds the same turn index from two sessions
+type TurnComparison struct {
+	Index      int        `json:"index"`
+	A          *Turn      `json:"a"`
+	B          *Turn      `json:"b"`
+	SameHuman  bool       `json:"sameHuman"`
+	Similarity float64    `json:"similarity"`
+	Diff       []DiffPart `json:"diff,omitempty"`
+}
+
+// DiffPart is one segment of a word-level diff between two AI responses
+type DiffPart struct {
+	Op   string `json:"op"` // equal, insert or delete
+	Text string `json:"text"`
+}
+
+// SessionComparison is the response of the compare endpoint
+type SessionComparison struct {
+	SessionA string           `json:"sessionA"`
+	SessionB string           `json:"sessionB"`
+	Turns    []TurnComparison `json:"turns"`
+}
+
+// loadSessionMessages returns all messages of a session in insertion order
+func loadSessionMessages(ctx context.Context, sessionID string) ([]Chat, error) {
+	return loadChats(ctx, `
+		SELECT `+chatColumns()+`
+		FROM n8n_chat_histories
+		WHERE session_id = $1
+		ORDER BY id ASC
+	`, sessionID)
+}
+
+// splitTurns groups messages into turns. Messages before the first human message form a turn without Human.
+func splitTurns(chats []Chat) []Turn {
+	var turns []Turn
+	for i := range chats {
+		if chats[i].Message.Type == "human" || len(turns) == 0 {
+			turns = append(turns, Turn{Messages: []Chat{}})
+		}
+		current := &turns[len(turns)-1]
+		if chats[i].Message.Type == "human" {
+			current.Human = &chats[i]
+		} else {
+			current.Messages = append(current.Messages, chats[i])
+		}
+	}
+	return turns
+}
+
+// aiResponse joins the content of the AI messages of a turn
+func (t *Turn) aiResponse() string {
+	if t == nil {
+		return ""
+	}
+	var parts []string
+	for _, chat := range t.Messages {
+		if chat.Message.Type == "ai" && chat.Message.Content != "" {
+			parts = append(parts, chat.Message.Content)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func CompareSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sessionA, sessionB := query.Get("a"), query.Get("b")
+	if sessionA == "" || sessionB == "" {
+		respondWithError(w, "Both a and b session ids are required", http.StatusBadRequest)
+		return
+	}
+
+	chatsA, err := loadSessionMessages(r.Context(), sessionA)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionA).Msg("Failed to load session")
+		respondWithQueryError(w, err)
+		return
+	}
+	chatsB, err := loadSessionMessages(r.Context(), sessionB)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionB).Msg("Failed to load session")
+		respondWithQueryError(w, err)
+		return
+	}
+	if len(chatsA) == 0 || len(chatsB) == 0 {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	turnsA, turnsB := splitTurns(chatsA), splitTurns(chatsB)
+	comparison := SessionComparison{SessionA: sessionA, SessionB: sessionB, Turns: []TurnComparison{}}
+	for i := 0; i < len(turnsA) || i < len(turnsB); i++ {
+		turn := TurnComparison{Index: i}
+		if i < len(turnsA) {
+			turn.A = &turnsA[i]
+		}
+		if i < len(turnsB) {
+			turn.B = &turnsB[i]
+		}
+		if turn.A != nil && turn.B != nil && turn.A.Human != nil && turn.B.Human != nil {
+			turn.SameHuman = strings.TrimSpace(turn.A.Human.Message.Content) == strings.TrimSpace(turn.B.Human.Message.Content)
+		}
+		turn.Diff, turn.Similarity = diffWords(turn.A.aiResponse(), turn.B.aiResponse())
+		comparison.Turns = append(comparison.Turns, turn)
+	}
+
+	respondWithJSON(w, DataResponse{Data: comparison})
+}
+
+// diffWords computes a word-level diff of two texts along with their similarity (0 to 1, by shared words).
+// Texts whose diff table would exceed maxDiffCells only get a similarity score.
+func diffWords(a, b string) ([]DiffPart, float64) {
+	wordsA, wordsB := strings.Fields(a), strings.Fields(b)
+	if len(wordsA) == 0 && len(wordsB) == 0 {
+		return nil, 1
+	}
+	width := len(wordsB) + 1
+	if (len(wordsA)+1)*width > maxDiffCells {
+		return nil, bagSimilarity(wordsA, wordsB)
+	}
+
+	// Longest common subsequence table, filled from the end so the diff can be read front to back.
+	// Cell (i, j) sits at i*width+j of a single allocation.
+	lcs := make([]int32, (len(wordsA)+1)*width)
+	for i := len(wordsA) - 1; i >= 0; i-- {
+		for j := len(wordsB) - 1; j >= 0; j-- {
+			if wordsA[i] == wordsB[j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else {
+				lcs[i*width+j] = max(lcs[(i+1)*width+j], lcs[i*width+j+1])
+			}
+		}
+	}
+
+	var parts []DiffPart
+	appendPart := func(op, word string) {
+		if n := len(parts); n > 0 && parts[n-1].Op == op {
+			parts[n-1].Text += " " + word
+			return
+		}
+		parts = append(parts, DiffPart{Op: op, Text: word})
+	}
+
+	i, j := 0, 0
+	for i < len(wordsA) && j < len(wordsB) {
+		switch {
+		case wordsA[i] == wordsB[j]:
+			appendPart("equal", wordsA[i])
+			i++
+			j++
+		case lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+			appendPart("delete", wordsA[i])
+			i++
+		default:
+			appendPart("insert", wordsB[j])
+			j++
+		}
+	}
+	for ; i < len(wordsA); i++ {
+		appendPart("delete", wordsA[i])
+	}
+	for ; j < len(wordsB); j++ {
+		appendPart("insert", wordsB[j])
+	}
+
+	similarity := 2 * float64(lcs[0]) / float64(len(wordsA)+len(wordsB))
+	return parts, similarity
+}
+
+// bagSimilarity is the Dice coefficient of two word multisets
+func bagSimilarity(wordsA, wordsB []string) float64 {
+	counts := make(map[string]int, len(wordsA))
+	for _, word := range wordsA {
+		counts[word]++
+	}
+	shared := 0
+	for _, word := range wordsB {
+		if counts[word] > 0 {
+			counts[word]--
+			shared++
+		}
+	}
+	return 2 * float64(shared) / float64(len(wordsA)+len(wordsB))
+}
+
+// MergeSessionsRequest is the body of the merge endpoint
+type MergeSessionsRequest struct {
+	From string `json:"from"`
+	Into string `json:"into"`
+}
+
+// MergeSessionsResponse reports the outcome of a merge
+type MergeSessionsResponse struct {
+	From          string `json:"from"`
+	Into          string `json:"into"`
+	MovedMessages int64  `json:"movedMessages"`
+}
+
+// MergeSessionsHandler moves every message of one session into another, e.g. when n8n issued a
+// new session id mid-conversation. Messages keep their ids, so ordering is preserved.
+func MergeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	var request MergeSessionsRequest
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+	request.From = strings.TrimSpace(request.From)
+	request.Into = strings.TrimSpace(request.Into)
+	if request.From == "" || request.Into == "" {
+		respondWithError(w, "Both from and into session ids are required", http.StatusBadRequest)
+		return
+	}
+	if request.From == request.Into {
+		respondWithError(w, "Cannot merge a session into itself", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Err(err).Msg("Failed to begin merge transaction")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var targetExists bool
+	if err := tx.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM n8n_chat_histories WHERE session_id = $1)`, request.Into).Scan(&targetExists); err != nil {
+		log.Err(err).Msg("Failed to check merge target")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !targetExists {
+		respondWithError(w, "Target session not found", http.StatusNotFound)
+		return
+	}
+
+	result, err := tx.ExecContext(r.Context(), `UPDATE n8n_chat_histories SET session_id = $1 WHERE session_id = $2`, request.Into, request.From)
+	if err != nil {
+		log.Err(err).Msg("Failed to merge sessions")
+		respondWithQueryError(w, err)
+		return
+	}
+	moved, _ := result.RowsAffected()
+	if moved == 0 {
+		respondWithError(w, "Source session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := mergeSessionRows(r.Context(), tx, request.From, request.Into); err != nil {
+		log.Err(err).Msg("Failed to move session data")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	if err := refreshSessionSummaries(r.Context(), tx, request.From, request.Into); err != nil {
+		log.Err(err).Msg("Failed to update session summary")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	response := MergeSessionsResponse{From: request.From, Into: request.Into, MovedMessages: moved}
+	if err := recordAudit(tx, r, "sessions.merge", response); err != nil {
+		log.Err(err).Msg("Failed to record merge audit entry")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Err(err).Msg("Failed to commit merge transaction")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	log.Info().Str("from", request.From).Str("into", request.Into).Int64("moved", moved).Msg("Sessions merged")
+	respondWithJSON(w, DataResponse{Data: response})
+}
+
+// movedSessionTables hold rows of their own per message or note, which simply follow the merged
+// messages as message IDs survive the merge
+var movedSessionTables = []string{
+	"chat_history_pinned_messages",
+	"chat_history_session_notes",
+	"chat_history_feedback",
+	"chat_history_secret_findings",
+	"chat_history_policy_flags",
+	"chat_history_session_replays",
+}
+
+// unitedSessionTables hold at most one row per session, or per session and key column. Rows of
+// the merged session are moved unless the target already has one, which then wins.
+var unitedSessionTables = []struct {
+	table string
+	key   string
+}{
+	{table: "chat_history_session_tags", key: "tag"},
+	{table: "chat_history_archived_sessions"},
+	{table: "chat_history_reviews"},
+	{table: "chat_history_session_languages"},
+}
+
+// mergeSessionRows moves what the service keeps about session from to session into, so the tags,
+// reviews, feedback and findings of a merged session are not left behind on an id that is gone
+func mergeSessionRows(ctx context.Context, tx *sql.Tx, from, into string) error {
+	for _, table := range movedSessionTables {
+		if _, err := tx.ExecContext(ctx, `UPDATE `+table+` SET session_id = $1 WHERE session_id = $2`, into, from); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	for _, united := range unitedSessionTables {
+		conflict := "existing.session_id = $1"
+		if united.key != "" {
+			conflict += " AND existing." + united.key + " = " + united.table + "." + united.key
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE `+united.table+` SET session_id = $1
+			WHERE session_id = $2 AND NOT EXISTS (SELECT 1 FROM `+united.table+` AS existing WHERE `+conflict+`)
+		`, into, from); err != nil {
+			return fmt.Errorf("%s: %w", united.table, err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+united.table+` WHERE session_id = $1`, from); err != nil {
+			return fmt.Errorf("%s: %w", united.table, err)
+		}
+	}
+	return nil
+}
+
+// SessionNeighbors is the response of the neighbors endpoint. Previous and Next are null at either
+// end of the listing.
+type SessionNeighbors struct {
+	SessionID string  `json:"sessionId"`
+	Previous  *string `json:"previous"`
+	Next      *string `json:"next"`
+	Position  int     `json:"position"`
+}
+
+// GetSessionNeighborsHandler returns the sessions listed before and after a session under the
+// filters of the session listing, which orders sessions by ID. Position counts from 1 and tells
+// where the session is, or would be, in that listing.
+func GetSessionNeighborsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	filter, err := parseChatFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var args queryArgs
+	conditions := filter.conditions(&args)
+	current := args.add(sessionID)
+	where := func(condition string) string {
+		return joinWhere(append(append([]string{}, conditions...), condition))
+	}
+
+	var exists bool
+	neighbors := SessionNeighbors{SessionID: sessionID}
+	err = db.QueryRowContext(r.Context(), fmt.Sprintf(`
+		SELECT
+			EXISTS (SELECT 1 FROM n8n_chat_histories WHERE session_id = %[1]s),
+			(SELECT MAX(session_id) FROM n8n_chat_histories %[2]s),
+			(SELECT MIN(session_id) FROM n8n_chat_histories %[3]s),
+			(SELECT COUNT(DISTINCT session_id) FROM n8n_chat_histories %[2]s) + 1
+	`, current, where("session_id < "+current), where("session_id > "+current)), args...).
+		Scan(&exists, &neighbors.Previous, &neighbors.Next, &neighbors.Position)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to query session neighbors")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !exists {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: neighbors})
+}
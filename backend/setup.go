@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// recommendedIndex is an index on n8n_chat_histories that the listing queries depend on. n8n
+// creates the table with a primary key only, which leaves every filter a sequential scan.
+type recommendedIndex struct {
+	name       string
+	purpose    string
+	definition string
+	// covered matches the definition of an existing index that already serves the purpose
+	covered func(indexdef string) bool
+	// prepare installs what the index definition relies on, such as extensions
+	prepare func(ctx context.Context) error
+	// column must exist for the index to apply
+	column string
+	// enabled reports whether the index serves the current configuration, nil for always
+	enabled func() bool
+}
+
+var recommendedIndexes = []recommendedIndex{
+	{
+		name:       "n8n_chat_histories_session_id_idx",
+		purpose:    "session lookups and grouping",
+		definition: "(session_id)",
+		covered: func(indexdef string) bool {
+			return strings.Contains(indexdef, "USING btree (session_id")
+		},
+		column: "session_id",
+	},
+	{
+		name:       "n8n_chat_histories_message_trgm_idx",
+		purpose:    "content search",
+		definition: "USING gin ((message::text) gin_trgm_ops)",
+		covered: func(indexdef string) bool {
+			return strings.Contains(indexdef, "gin_trgm_ops") && strings.Contains(indexdef, "(message)::text")
+		},
+		prepare: func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, `CREATE EXTENSION IF NOT EXISTS pg_trgm`)
+			return err
+		},
+		column:  "message",
+		enabled: func() bool { return !searchUnaccent },
+	},
+	{
+		name:       "n8n_chat_histories_message_unaccent_trgm_idx",
+		purpose:    "accent-insensitive content search",
+		definition: "USING gin ((" + unaccentedMessage + ") gin_trgm_ops)",
+		covered: func(indexdef string) bool {
+			return strings.Contains(indexdef, "gin_trgm_ops") && strings.Contains(indexdef, "chat_history_unaccent(lower((message)::text))")
+		},
+		prepare: func(ctx context.Context) error {
+			if _, err := db.ExecContext(ctx, `CREATE EXTENSION IF NOT EXISTS pg_trgm`); err != nil {
+				return err
+			}
+			return ensureUnaccentSearch(ctx)
+		},
+		column:  "message",
+		enabled: func() bool { return searchUnaccent },
+	},
+	{
+		name:       "n8n_chat_histories_created_at_idx",
+		purpose:    "date range filters",
+		definition: "(created_at)",
+		covered: func(indexdef string) bool {
+			return strings.Contains(indexdef, "USING btree (created_at")
+		},
+		column: "created_at",
+	},
+}
+
+// runDBSetupCommand implements `db-setup`, which creates the recommended indexes that are missing.
+// Indexes are built concurrently, so it can run against a live database, and it is safe to re-run:
+// an index left invalid by an interrupted build is dropped and built again.
+func runDBSetupCommand(ctx context.Context) error {
+	if readOnly {
+		return errors.New("db-setup cannot run in read-only mode")
+	}
+
+	var table sql.NullString
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass('n8n_chat_histories')::text`).Scan(&table); err != nil {
+		return err
+	}
+	if !table.Valid {
+		return errors.New("table n8n_chat_histories does not exist, run a chat workflow in n8n first")
+	}
+
+	var estimatedRows int64
+	if err := db.QueryRowContext(ctx, `SELECT reltuples::bigint FROM pg_class WHERE oid = 'n8n_chat_histories'::regclass`).Scan(&estimatedRows); err != nil {
+		return err
+	}
+	fmt.Printf("n8n_chat_histories: about %d rows\n", max(estimatedRows, 0))
+
+	columns, err := tableColumns(ctx)
+	if err != nil {
+		return err
+	}
+	indexes, err := tableIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range recommendedIndexes {
+		if index.enabled != nil && !index.enabled() {
+			continue
+		}
+		if !columns[index.column] {
+			fmt.Printf("skip    %s: no %s column\n", index.name, index.column)
+			continue
+		}
+
+		if existing, exists := indexes[index.name]; exists && !existing.valid {
+			fmt.Printf("drop    %s: invalid, left by an interrupted build\n", index.name)
+			if _, err := db.ExecContext(ctx, `DROP INDEX CONCURRENTLY IF EXISTS `+index.name); err != nil {
+				return err
+			}
+		} else if coveredBy := index.coveredBy(indexes); coveredBy != "" {
+			fmt.Printf("ok      %s: %s\n", index.purpose, coveredBy)
+			continue
+		}
+
+		if index.prepare != nil {
+			if err := index.prepare(ctx); err != nil {
+				fmt.Printf("skip    %s: %v\n", index.name, err)
+				continue
+			}
+		}
+
+		started := time.Now()
+		statement := fmt.Sprintf(`CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON n8n_chat_histories %s`, index.name, index.definition)
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("%s: %w", index.name, err)
+		}
+		fmt.Printf("create  %s for %s in %s\n", index.name, index.purpose, time.Since(started).Round(time.Millisecond))
+	}
+
+	// Fresh statistics let the planner pick the new indexes right away
+	if _, err := db.ExecContext(ctx, `ANALYZE n8n_chat_histories`); err != nil {
+		return err
+	}
+	fmt.Println("analyze n8n_chat_histories")
+	return nil
+}
+
+// coveredBy returns the name of a valid existing index that serves the purpose of index
+func (index recommendedIndex) coveredBy(indexes map[string]existingIndex) string {
+	for name, existing := range indexes {
+		if existing.valid && index.covered(existing.definition) {
+			return name
+		}
+	}
+	return ""
+}
+
+// existingIndex is an index found on n8n_chat_histories
+type existingIndex struct {
+	definition string
+	valid      bool
+}
+
+// tableIndexes returns the indexes of n8n_chat_histories by name
+func tableIndexes(ctx context.Context) (map[string]existingIndex, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.relname, pg_get_indexdef(i.indexrelid), i.indisvalid
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE i.indrelid = 'n8n_chat_histories'::regclass
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := map[string]existingIndex{}
+	for rows.Next() {
+		var name string
+		var index existingIndex
+		if err := rows.Scan(&name, &index.definition, &index.valid); err != nil {
+			return nil, err
+		}
+		indexes[name] = index
+	}
+	return indexes, rows.Err()
+}
+
+// tableColumns returns the column names of n8n_chat_histories
+func tableColumns(ctx context.Context) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT attname FROM pg_attribute
+		WHERE attrelid = 'n8n_chat_histories'::regclass AND attnum > 0 AND NOT attisdropped
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
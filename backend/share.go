@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// shareTokenPayload is the signed content of a share token
+type shareTokenPayload struct {
+	SessionID string `json:"sid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// ShareLink is returned when a session is shared
+type ShareLink struct {
+	URL       string    `json:"url"`
+	EmbedURL  string    `json:"embedUrl"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SharedSession is the read-only view of a shared conversation
+type SharedSession struct {
+	SessionID string    `json:"sessionId"`
+	Messages  []Message `json:"messages"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+var errInvalidShareToken = errors.New("invalid or expired share link")
+
+// shareSecret returns the HMAC key for share tokens; sharing is disabled when SHARE_SECRET is unset
+func shareSecret() []byte {
+	return []byte(os.Getenv("SHARE_SECRET"))
+}
+
+// signShareToken encodes the payload and appends its HMAC-SHA256 signature
+func signShareToken(payload shareTokenPayload) (string, error) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payloadJSON)
+
+	mac := hmac.New(sha256.New, shareSecret())
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyShareToken checks the signature and expiry of a token and returns its payload
+func verifyShareToken(token string) (shareTokenPayload, error) {
+	var payload shareTokenPayload
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found || len(shareSecret()) == 0 {
+		return payload, errInvalidShareToken
+	}
+
+	expected := hmac.New(sha256.New, shareSecret())
+	expected.Write([]byte(encoded))
+	actual, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(actual, expected.Sum(nil)) {
+		return payload, errInvalidShareToken
+	}
+
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payloadJSON, &payload) != nil {
+		return payload, errInvalidShareToken
+	}
+	if time.Now().Unix() > payload.ExpiresAt {
+		return payload, errInvalidShareToken
+	}
+	return payload, nil
+}
+
+// publicBaseURL returns PUBLIC_URL, or the scheme and host the request was made to
+func publicBaseURL(r *http.Request) string {
+	if baseURL := os.Getenv("PUBLIC_URL"); baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// CreateShareLinkHandler issues a signed read-only link to one session. The TTL can be given
+// as ?ttl=1h, defaulting to SHARE_DEFAULT_TTL and capped at SHARE_MAX_TTL.
+func CreateShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if len(shareSecret()) == 0 {
+		respondWithError(w, "Sharing is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	sessionID := r.PathValue("id")
+	ttl := getEnvDuration("SHARE_DEFAULT_TTL", 24*time.Hour)
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			respondWithError(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+	if maxTTL := getEnvDuration("SHARE_MAX_TTL", 30*24*time.Hour); ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM n8n_chat_histories WHERE session_id = $1)`, sessionID).Scan(&exists); err != nil {
+		log.Err(err).Msg("Failed to check session")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !exists {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := signShareToken(shareTokenPayload{SessionID: sessionID, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		log.Err(err).Msg("Failed to sign share token")
+		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := recordAudit(db, r, "sessions.share", map[string]interface{}{"sessionId": sessionID, "expiresAt": expiresAt}); err != nil {
+		log.Err(err).Msg("Failed to record share audit entry")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSONStatus(w, DataResponse{Data: ShareLink{
+		URL:       publicBaseURL(r) + "/api/v1/shared/" + token,
+		EmbedURL:  publicBaseURL(r) + "/embed/" + token,
+		Token:     token,
+		ExpiresAt: expiresAt,
+	}}, http.StatusCreated)
+}
+
+// GetSharedSessionHandler serves a shared session. It is mounted outside the origin check,
+// as the signed token is the only credential required.
+func GetSharedSessionHandler(w http.ResponseWriter, r *http.Request) {
+	payload, err := verifyShareToken(r.PathValue("token"))
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	chats, err := loadSessionMessages(r.Context(), payload.SessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", payload.SessionID).Msg("Failed to load shared session")
+		respondWithQueryError(w, err)
+		return
+	}
+	if len(chats) == 0 {
+		respondWithError(w, errInvalidShareToken.Error(), http.StatusNotFound)
+		return
+	}
+
+	session := SharedSession{SessionID: payload.SessionID, Messages: []Message{}, ExpiresAt: time.Unix(payload.ExpiresAt, 0)}
+	for _, chat := range chats {
+		session.Messages = append(session.Messages, chat.Message)
+	}
+	respondWithJSON(w, DataResponse{Data: session})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram percentiles are estimated from
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+}
+
+// latencySlot holds the requests of a route within one minute. The histogram has a bucket per
+// bound of latencyBuckets and a last one for the requests slower than every bound.
+type latencySlot struct {
+	minute  int64
+	buckets [13]int64
+	total   int64
+	slow    int64
+	max     time.Duration
+}
+
+// sloTracker keeps the latencies of every route over a rolling window of minutes. Latencies are
+// kept in memory per instance, so each replica reports its own traffic.
+type sloTracker struct {
+	window    int
+	objective float64
+	target    time.Duration
+	targets   map[string]time.Duration
+
+	mu      sync.Mutex
+	routes  map[string][]latencySlot
+	alerted map[string]time.Time
+}
+
+// slo tracks the latencies served by this instance
+var slo = &sloTracker{
+	window:    60,
+	objective: 0.99,
+	target:    time.Second,
+	targets:   map[string]time.Duration{},
+	routes:    map[string][]latencySlot{},
+	alerted:   map[string]time.Time{},
+}
+
+// loadSLOConfig reads SLO_WINDOW, the rolling window in minutes up to a day, SLO_OBJECTIVE, the
+// share of requests that must be served within their target, SLO_LATENCY_TARGET and
+// SLO_ROUTE_TARGETS, comma-separated routes with their own target such as "GET /api/v1/chats=500ms".
+// A target of off leaves the route untracked, as the long-polling tail route is by default.
+func loadSLOConfig() error {
+	slo.targets["GET /api/v1/chats/tail"] = 0
+	if window := getEnvDuration("SLO_WINDOW", time.Hour); window >= time.Minute && window <= 24*time.Hour {
+		slo.window = int(window / time.Minute)
+	} else {
+		return fmt.Errorf("SLO_WINDOW must be between 1m and 24h, got %s", window)
+	}
+	if value := os.Getenv("SLO_OBJECTIVE"); value != "" {
+		objective, err := strconv.ParseFloat(value, 64)
+		if err != nil || objective <= 0 || objective >= 1 {
+			return fmt.Errorf("SLO_OBJECTIVE must be between 0 and 1, got %q", value)
+		}
+		slo.objective = objective
+	}
+	slo.target = getEnvDuration("SLO_LATENCY_TARGET", time.Second)
+
+	for _, entry := range strings.Split(os.Getenv("SLO_ROUTE_TARGETS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, value, found := strings.Cut(entry, "=")
+		if value == "off" {
+			slo.targets[strings.TrimSpace(route)] = 0
+			continue
+		}
+		target, err := time.ParseDuration(value)
+		if !found || err != nil || target <= 0 {
+			return fmt.Errorf("SLO_ROUTE_TARGETS: entries must look like \"GET /path=500ms\", got %q", entry)
+		}
+		slo.targets[strings.TrimSpace(route)] = target
+	}
+	return nil
+}
+
+// targetOf returns the latency target of route, 0 when it is not tracked
+func (t *sloTracker) targetOf(route string) time.Duration {
+	if target, ok := t.targets[route]; ok {
+		return target
+	}
+	return t.target
+}
+
+// record adds a request of route served in duration
+func (t *sloTracker) record(route string, duration time.Duration, at time.Time) {
+	target := t.targetOf(route)
+	if target == 0 {
+		return
+	}
+	minute := at.Unix() / 60
+	bucket := sort.Search(len(latencyBuckets), func(i int) bool { return duration <= latencyBuckets[i] })
+	slow := duration > target
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slots := t.routes[route]
+	if slots == nil {
+		slots = make([]latencySlot, t.window)
+		t.routes[route] = slots
+	}
+	slot := &slots[minute%int64(t.window)]
+	if slot.minute != minute {
+		*slot = latencySlot{minute: minute}
+	}
+	slot.buckets[bucket]++
+	slot.total++
+	if slow {
+		slot.slow++
+	}
+	slot.max = max(slot.max, duration)
+}
+
+// RouteSLO is the latency of a route over the rolling window. BudgetBurned is the share of the
+// error budget spent by requests slower than the target; 1 means the objective is missed.
+type RouteSLO struct {
+	Route        string  `json:"route"`
+	Requests     int64   `json:"requests"`
+	P95Ms        float64 `json:"p95Ms"`
+	P99Ms        float64 `json:"p99Ms"`
+	TargetMs     float64 `json:"targetMs"`
+	Slow         int64   `json:"slow"`
+	BudgetBurned float64 `json:"budgetBurned"`
+}
+
+// SLOReport is the latency of every route served by this instance
+type SLOReport struct {
+	Window    string     `json:"window"`
+	Objective float64    `json:"objective"`
+	Routes    []RouteSLO `json:"routes"`
+}
+
+// report summarizes the routes that served requests within the window ending at now
+func (t *sloTracker) report(now time.Time) SLOReport {
+	report := SLOReport{
+		Window:    (time.Duration(t.window) * time.Minute).String(),
+		Objective: t.objective,
+		Routes:    []RouteSLO{},
+	}
+	oldest := now.Unix()/60 - int64(t.window) + 1
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for route, slots := range t.routes {
+		var merged latencySlot
+		for _, slot := range slots {
+			if slot.minute < oldest || slot.total == 0 {
+				continue
+			}
+			for i, count := range slot.buckets {
+				merged.buckets[i] += count
+			}
+			merged.total += slot.total
+			merged.slow += slot.slow
+			merged.max = max(merged.max, slot.max)
+		}
+		if merged.total == 0 {
+			continue
+		}
+		report.Routes = append(report.Routes, RouteSLO{
+			Route:        route,
+			Requests:     merged.total,
+			P95Ms:        milliseconds(merged.percentile(0.95)),
+			P99Ms:        milliseconds(merged.percentile(0.99)),
+			TargetMs:     milliseconds(t.targetOf(route)),
+			Slow:         merged.slow,
+			BudgetBurned: float64(merged.slow) / (float64(merged.total) * (1 - t.objective)),
+		})
+	}
+	sort.Slice(report.Routes, func(i, j int) bool { return report.Routes[i].Route < report.Routes[j].Route })
+	return report
+}
+
+// percentile estimates the latency below which the share q of requests were served, as the upper
+// bound of the bucket holding it, or the slowest request for the last bucket
+func (s latencySlot) percentile(q float64) time.Duration {
+	rank := int64(float64(s.total)*q + 0.5)
+	var seen int64
+	for i, count := range s.buckets {
+		seen += count
+		if seen >= rank && i < len(latencyBuckets) {
+			return min(latencyBuckets[i], s.max)
+		}
+	}
+	return s.max
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// sloMiddleware records the latency of the requests matching a route of mux, named by its pattern
+func sloMiddleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		started := time.Now()
+		mux.ServeHTTP(w, r)
+		if route != "" {
+			slo.record(route, time.Since(started), started)
+		}
+	})
+}
+
+// GetSLOHandler reports the p95 and p99 latencies of every route over the rolling window
+func GetSLOHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, DataResponse{Data: slo.report(time.Now())})
+}
+
+// startSLOAlerts checks every minute whether a route burned its error budget, alerting the
+// default channels at most once per window and route. Routes with fewer than
+// SLO_ALERT_MIN_REQUESTS requests in the window are not alerted on. Unlike the workers, every
+// instance checks its own latencies.
+func startSLOAlerts(ctx context.Context) {
+	minRequests := int64(100)
+	if value, err := strconv.ParseInt(os.Getenv("SLO_ALERT_MIN_REQUESTS"), 10, 64); err == nil && value > 0 {
+		minRequests = value
+	}
+	hostname, _ := os.Hostname()
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, route := range slo.burned(now, minRequests) {
+					sendAlert(ctx, Alert{
+						Kind: "slo:" + route.Route,
+						Message: fmt.Sprintf("%s burned its latency budget: %d of %d requests took longer than %gms (p99 %gms)",
+							route.Route, route.Slow, route.Requests, route.TargetMs, route.P99Ms),
+						Details: map[string]interface{}{
+							"route":        route.Route,
+							"instance":     hostname,
+							"requests":     route.Requests,
+							"slow":         route.Slow,
+							"p95Ms":        route.P95Ms,
+							"p99Ms":        route.P99Ms,
+							"targetMs":     route.TargetMs,
+							"objective":    slo.objective,
+							"budgetBurned": route.BudgetBurned,
+						},
+					})
+				}
+			}
+		}
+	}()
+	log.Info().Int64("minRequests", minRequests).Msg("SLO alerts started")
+}
+
+// burned returns the routes that spent their error budget and were not alerted on within the window
+func (t *sloTracker) burned(now time.Time, minRequests int64) []RouteSLO {
+	var burned []RouteSLO
+	for _, route := range t.report(now).Routes {
+		if route.Requests < minRequests || route.BudgetBurned < 1 {
+			continue
+		}
+		t.mu.Lock()
+		last, alerted := t.alerted[route.Route]
+		if !alerted || now.Sub(last) >= time.Duration(t.window)*time.Minute {
+			t.alerted[route.Route] = now
+			burned = append(burned, route)
+		}
+		t.mu.Unlock()
+	}
+	return burned
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxGrowthDays bounds the days of snapshots returned by the growth endpoint
+const maxGrowthDays = 3650
+
+// StatsSnapshot is the size of the history table on a day. The added values are the growth since
+// the previous snapshot and are left out for the first one.
+type StatsSnapshot struct {
+	Day           string `json:"day"`
+	Rows          int64  `json:"rows"`
+	Sessions      int64  `json:"sessions"`
+	TableBytes    int64  `json:"tableBytes"`
+	RowsAdded     *int64 `json:"rowsAdded,omitempty"`
+	SessionsAdded *int64 `json:"sessionsAdded,omitempty"`
+	BytesAdded    *int64 `json:"bytesAdded,omitempty"`
+}
+
+// statsSnapshotJob records one snapshot per UTC day. It runs more often than daily so that a
+// missed run is made up for on the same day.
+type statsSnapshotJob struct{}
+
+func (statsSnapshotJob) run(ctx context.Context) error {
+	day := time.Now().UTC().Format(time.DateOnly)
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM chat_history_stats_snapshots WHERE day = $1)`, day).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO chat_history_stats_snapshots (day, rows, sessions, table_bytes)
+		SELECT $1, COUNT(*), COUNT(DISTINCT session_id), pg_total_relation_size('n8n_chat_histories')
+		FROM n8n_chat_histories
+		ON CONFLICT (day) DO NOTHING
+	`, day)
+	return err
+}
+
+// GetGrowthHandler returns the daily snapshots of the last days, 90 by default, oldest first
+func GetGrowthHandler(w http.ResponseWriter, r *http.Request) {
+	days := 90
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxGrowthDays {
+			respondWithError(w, "days must be between 1 and "+strconv.Itoa(maxGrowthDays), http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	// One snapshot before the window is read so that the first day has its growth
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT to_char(day, 'YYYY-MM-DD'), rows, sessions, table_bytes
+		FROM chat_history_stats_snapshots, (SELECT (now() AT TIME ZONE 'UTC')::date - ($1::int - 1) AS window_start) AS w
+		WHERE day >= (
+			SELECT COALESCE(MAX(day), window_start) FROM chat_history_stats_snapshots
+			WHERE day < window_start
+		)
+		ORDER BY day
+	`, days)
+	if err != nil {
+		log.Err(err).Msg("Failed to query stats snapshots")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	windowStart := time.Now().UTC().AddDate(0, 0, -(days - 1)).Format(time.DateOnly)
+	snapshots := []StatsSnapshot{}
+	var previous *StatsSnapshot
+	for rows.Next() {
+		var snapshot StatsSnapshot
+		if err := rows.Scan(&snapshot.Day, &snapshot.Rows, &snapshot.Sessions, &snapshot.TableBytes); err != nil {
+			log.Err(err).Msg("Failed to scan stats snapshot")
+			respondWithQueryError(w, err)
+			return
+		}
+		if previous != nil {
+			rowsAdded, sessionsAdded, bytesAdded := snapshot.Rows-previous.Rows, snapshot.Sessions-previous.Sessions, snapshot.TableBytes-previous.TableBytes
+			snapshot.RowsAdded, snapshot.SessionsAdded, snapshot.BytesAdded = &rowsAdded, &sessionsAdded, &bytesAdded
+		}
+		previous = &snapshot
+		if snapshot.Day >= windowStart {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate stats snapshots")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: snapshots})
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// maxFanOutRows bounds how deep the fan-out listing pages, as every source returns all rows up to
+// the end of the requested page for the merge
+const maxFanOutRows = 5000
+
+// dataSource is a database holding n8n chat histories. The first source is the history database
+// of the service; DATA_SOURCES adds others, which are only read by the fan-out listing.
+type dataSource struct {
+	DataSourceInfo
+	pool    *sql.DB
+	timeout time.Duration
+	// parent is the configured source whose database a discovered table was found in
+	parent string
+}
+
+// dataSources lists the configured sources, starting with the default one
+var dataSources []dataSource
+
+// discoveredSources lists the tables found by source discovery, replaced on every run
+var (
+	discoveredSources   []dataSource
+	discoveredSourcesMu sync.RWMutex
+)
+
+// currentDataSources returns the configured sources followed by the discovered ones
+func currentDataSources() []dataSource {
+	discoveredSourcesMu.RLock()
+	defer discoveredSourcesMu.RUnlock()
+	return append(append([]dataSource{}, dataSources...), discoveredSources...)
+}
+
+// dataSourceConfig is an entry of DATA_SOURCES
+type dataSourceConfig struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Table   string `json:"table"`
+	Region  string `json:"region"`
+	Timeout string `json:"timeout"`
+}
+
+// loadDataSources reads DATA_SOURCES, a JSON array of {name, url, table, region, timeout}, and
+// opens a small pool per source. SOURCE_TIMEOUT is the timeout of sources that set none.
+func loadDataSources() error {
+	defaultTimeout := getEnvDuration("SOURCE_TIMEOUT", 10*time.Second)
+	dataSources = []dataSource{{
+		DataSourceInfo: DataSourceInfo{Name: "default", Table: "n8n_chat_histories", Region: dataRegion},
+		pool:           db,
+		timeout:        defaultTimeout,
+	}}
+
+	raw := os.Getenv("DATA_SOURCES")
+	if raw == "" {
+		return nil
+	}
+	var configs []dataSourceConfig
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		return fmt.Errorf("DATA_SOURCES must be a JSON array of sources: %w", err)
+	}
+
+	names := map[string]bool{"default": true}
+	for _, config := range configs {
+		if !fieldNamePattern.MatchString(config.Name) {
+			return fmt.Errorf("DATA_SOURCES: invalid source name %q", config.Name)
+		}
+		if names[config.Name] {
+			return fmt.Errorf("DATA_SOURCES: source %q is defined twice", config.Name)
+		}
+		names[config.Name] = true
+		if config.URL == "" {
+			return fmt.Errorf("DATA_SOURCES: source %q has no url", config.Name)
+		}
+		if config.Table == "" {
+			config.Table = "n8n_chat_histories"
+		}
+		if !columnNamePattern.MatchString(config.Table) {
+			return fmt.Errorf("DATA_SOURCES: invalid table name %q of source %q", config.Table, config.Name)
+		}
+		timeout := defaultTimeout
+		if config.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("DATA_SOURCES: invalid timeout %q of source %q", config.Timeout, config.Name)
+			}
+		}
+
+		pool, err := sql.Open("pgx", config.URL)
+		if err != nil {
+			return fmt.Errorf("DATA_SOURCES: source %q: %w", config.Name, err)
+		}
+		pool.SetMaxOpenConns(2)
+		pool.SetConnMaxLifetime(5 * time.Minute)
+		dataSources = append(dataSources, dataSource{
+			DataSourceInfo: DataSourceInfo{Name: config.Name, Table: config.Table, Region: normalizeRegion(config.Region)},
+			pool:           pool,
+			timeout:        timeout,
+		})
+	}
+	log.Info().Int("sources", len(dataSources)).Msg("Loaded data sources")
+	return nil
+}
+
+// dataSourceInfos describes the configured sources for the runtime configuration
+func dataSourceInfos() []DataSourceInfo {
+	sources := currentDataSources()
+	infos := make([]DataSourceInfo, len(sources))
+	for i, source := range sources {
+		infos[i] = source.DataSourceInfo
+	}
+	return infos
+}
+
+// SourceChat is a chat of the fan-out listing, labeled with its source
+type SourceChat struct {
+	Source string `json:"source"`
+	Chat
+}
+
+// SourceResult reports how a source answered the fan-out listing. Sources that failed or timed
+// out carry the error and contribute no rows.
+type SourceResult struct {
+	Name       string `json:"name"`
+	Total      int    `json:"total"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// FanOutResponse is the document of the fan-out listing
+type FanOutResponse struct {
+	Data       []SourceChat       `json:"data"`
+	Pagination PaginationResponse `json:"pagination"`
+	Sources    []SourceResult     `json:"sources"`
+}
+
+// GetSourceChatsHandler lists the chats of every source as one listing. The sources are queried
+// in parallel, each within its own timeout, and their rows merged by id, with the source name
+// breaking ties. Only the sessionId and search filters are supported, as the other filters rely
+// on tables the service keeps in its own database. sources=a,b limits the listing to the named
+// sources. A source that fails is reported in sources rather than failing the request, unless
+// every source failed.
+func GetSourceChatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(query.Get("pageSize"))
+	if pageSize < 1 || pageSize > maxPageSize {
+		pageSize = defaultPageSize
+	}
+	sortOrder := parseSortDirection(query.Get("sortOrder"))
+	depth := page * pageSize
+	if depth > maxFanOutRows {
+		respondWithError(w, fmt.Sprintf("The fan-out listing is limited to the first %d rows", maxFanOutRows), http.StatusBadRequest)
+		return
+	}
+
+	filter := ChatFilter{
+		SessionID: strings.TrimSpace(query.Get("sessionId")),
+		Search:    strings.TrimSpace(query.Get("search")),
+		Archived:  "all",
+	}
+	if utf8.RuneCountInString(filter.Search) > limits.MaxSearchLength {
+		respondWithError(w, fmt.Sprintf("search must be at most %d characters", limits.MaxSearchLength), http.StatusBadRequest)
+		return
+	}
+
+	sources := currentDataSources()
+	if names := query.Get("sources"); names != "" {
+		selected, err := selectDataSources(sources, strings.Split(names, ","))
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sources = selected
+	}
+
+	// A request labeled for a region only reads the sources residing there, which each source
+	// checks again before reading
+	if region := contextRegion(r.Context()); region != "" {
+		var inRegion []dataSource
+		for _, source := range sources {
+			if source.Region == region {
+				inRegion = append(inRegion, source)
+			}
+		}
+		sources = inRegion
+	}
+
+	results := make([]SourceResult, len(sources))
+	chats := make([][]SourceChat, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source dataSource) {
+			defer wg.Done()
+			start := time.Now()
+			results[i].Name = source.Name
+			total, rows, err := source.queryChats(r.Context(), filter, sortOrder, depth)
+			results[i].DurationMs = time.Since(start).Milliseconds()
+			if err != nil {
+				log.Err(err).Str("source", source.Name).Msg("Failed to query data source")
+				results[i].Error = sourceError(err)
+				return
+			}
+			results[i].Total, chats[i] = total, rows
+		}(i, source)
+	}
+	wg.Wait()
+
+	failed, total := 0, 0
+	var merged []SourceChat
+	for i, result := range results {
+		if result.Error != "" {
+			failed++
+			continue
+		}
+		total += result.Total
+		merged = append(merged, chats[i]...)
+	}
+	if failed > 0 && failed == len(results) {
+		respondWithError(w, "Every data source failed", http.StatusBadGateway)
+		return
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		a, b := merged[i], merged[j]
+		if a.ID != b.ID {
+			return (a.ID < b.ID) != (sortOrder == descending)
+		}
+		return a.Source < b.Source
+	})
+	offset := (page - 1) * pageSize
+	data := []SourceChat{}
+	if offset < len(merged) {
+		data = merged[offset:min(offset+pageSize, len(merged))]
+	}
+
+	countRowsServed(r.Context(), len(data))
+	respondWithJSON(w, FanOutResponse{
+		Data: data,
+		Pagination: PaginationResponse{
+			Page:       page,
+			PageSize:   pageSize,
+			Total:      total,
+			TotalPages: (total + pageSize - 1) / pageSize,
+			GroupBy:    "simple",
+		},
+		Sources: results,
+	})
+}
+
+// queryChats counts the chats of the source matching filter and returns the first limit of them
+func (s dataSource) queryChats(ctx context.Context, filter ChatFilter, sortOrder sortDirection, limit int) (int, []SourceChat, error) {
+	if err := checkSourceRegion(contextRegion(ctx), s.Region); err != nil {
+		return 0, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	table := s.tableIdentifier()
+	if s.pool != db {
+		filter.PlainSearch = true
+	}
+
+	var total int
+	var countArgs queryArgs
+	countQuery := selectFrom(&countArgs, table, "COUNT(*)").filter(filter).sql()
+	if err := s.pool.QueryRowContext(ctx, countQuery, countArgs...).Scan(&total); err != nil {
+		return 0, nil, err
+	}
+
+	// Mapped columns are a setting of the default source, so only the columns n8n creates are read
+	var args queryArgs
+	rows, err := s.pool.QueryContext(ctx, selectFrom(&args, table, "id", "session_id", "message").
+		filter(filter).
+		order("id", sortOrder).
+		first(limit).
+		sql(), args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	chats := []SourceChat{}
+	for rows.Next() {
+		chat := SourceChat{Source: s.Name}
+		var messageJSON []byte
+		if err := rows.Scan(&chat.ID, &chat.SessionID, &messageJSON); err != nil {
+			return 0, nil, err
+		}
+		if err := json.Unmarshal(messageJSON, &chat.Message); err != nil {
+			return 0, nil, err
+		}
+		if err := readMessage(ctx, chat.SessionID, &chat.Message); err != nil {
+			return 0, nil, err
+		}
+		chats = append(chats, chat)
+	}
+	return total, chats, rows.Err()
+}
+
+// tableIdentifier returns the quoted table of the source, qualified with its schema when known
+func (s dataSource) tableIdentifier() string {
+	if s.Schema != "" {
+		return pgx.Identifier{s.Schema, s.Table}.Sanitize()
+	}
+	return pgx.Identifier{s.Table}.Sanitize()
+}
+
+// selectDataSources returns the sources with the given names, in the order of sources
+func selectDataSources(sources []dataSource, names []string) ([]dataSource, error) {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[strings.TrimSpace(name)] = true
+	}
+	var selected []dataSource
+	for _, source := range sources {
+		if wanted[source.Name] {
+			selected = append(selected, source)
+			delete(wanted, source.Name)
+		}
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("unknown source %q", name)
+	}
+	return selected, nil
+}
+
+// sourceError describes the failure of a source without the details of its connection
+func sourceError(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timed out"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	if errors.Is(err, errRegionMismatch) {
+		return "outside the requested region"
+	}
+	return "query failed"
+}
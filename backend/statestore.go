@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// stateStore holds state that has to be consistent across replicas: cached values, counters
+// and locks. A single instance can use the in-memory store; several replicas need Redis.
+type stateStore interface {
+	// Get returns the value stored under key, reporting false when it is missing or expired
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value under key for ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Incr increments the counter under key, which expires window after its first increment
+	Incr(ctx context.Context, key string, window time.Duration) (int64, error)
+	// TryLock acquires the lock under key for at most ttl, reporting false when it is held elsewhere
+	TryLock(ctx context.Context, key string, ttl time.Duration) (unlock func(), acquired bool, err error)
+}
+
+// sharedState is the store used by the service, chosen at startup
+var sharedState stateStore = newMemoryStore()
+
+// initStateStore connects to Redis when REDIS_URL is set and keeps the in-memory store otherwise
+func initStateStore() error {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		log.Info().Msg("Using in-memory state store")
+		return nil
+	}
+
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return err
+	}
+
+	sharedState = &redisStore{client: client, prefix: getEnvOrDefault("REDIS_PREFIX", "n8n-chat-history:")}
+	log.Info().Msg("Using Redis state store")
+	return nil
+}
+
+// memoryEntry is a value of the in-memory store with its expiry
+type memoryEntry struct {
+	value     []byte
+	counter   int64
+	expiresAt time.Time
+}
+
+// memoryStore implements stateStore within the process
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]*memoryEntry)}
+}
+
+// entry returns the live entry under key, dropping it if expired. The caller must hold mu.
+func (s *memoryStore) entry(key string) *memoryEntry {
+	entry, ok := s.entries[key]
+	if ok && time.Now().After(entry.expiresAt) {
+		delete(s.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (s *memoryStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry := s.entry(key); entry != nil {
+		return entry.value, true, nil
+	}
+	return nil, false, nil
+}
+
+func (s *memoryStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = &memoryEntry{value: value, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryStore) Incr(_ context.Context, key string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.entry(key)
+	if entry == nil {
+		entry = &memoryEntry{expiresAt: time.Now().Add(window)}
+		s.entries[key] = entry
+	}
+	entry.counter++
+	return entry.counter, nil
+}
+
+func (s *memoryStore) TryLock(_ context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entry(key) != nil {
+		return nil, false, nil
+	}
+	entry := &memoryEntry{expiresAt: time.Now().Add(ttl)}
+	s.entries[key] = entry
+
+	unlock := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.entries[key] == entry {
+			delete(s.entries, key)
+		}
+	}
+	return unlock, true, nil
+}
+
+// redisStore implements stateStore on Redis, namespacing every key with prefix
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// releaseLockScript deletes a lock only if it still holds the token of the caller
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (s *redisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+func (s *redisStore) Incr(ctx context.Context, key string, window time.Duration) (int64, error) {
+	pipe := s.client.TxPipeline()
+	incr := pipe.Incr(ctx, s.prefix+key)
+	pipe.ExpireNX(ctx, s.prefix+key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (s *redisStore) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	acquired, err := s.client.SetNX(ctx, s.prefix+key, token, ttl).Result()
+	if err != nil || !acquired {
+		return nil, false, err
+	}
+
+	unlock := func() {
+		if err := releaseLockScript.Run(context.Background(), s.client, []string{s.prefix + key}, token).Err(); err != nil {
+			log.Err(err).Str("key", key).Msg("Failed to release lock")
+		}
+	}
+	return unlock, true, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+	// Timezone names of ?tz= must resolve in minimal images without a zoneinfo database
+	_ "time/tzdata"
+
+	"github.com/rs/zerolog/log"
+)
+
+// QualityCounts holds feedback totals for one group of the quality report
+type QualityCounts struct {
+	Key           string  `json:"key"`
+	Positive      int     `json:"positive"`
+	Negative      int     `json:"negative"`
+	Total         int     `json:"total"`
+	PositiveRatio float64 `json:"positiveRatio"`
+}
+
+// QualityStats is the response of the quality stats endpoint
+type QualityStats struct {
+	Interval string          `json:"interval"`
+	Timezone string          `json:"timezone"`
+	Overall  QualityCounts   `json:"overall"`
+	Timeline []QualityCounts `json:"timeline"`
+	ByModel  []QualityCounts `json:"byModel"`
+	ByTool   []QualityCounts `json:"byTool"`
+}
+
+// validStatsIntervals lists the accepted bucket sizes for time series, as understood by date_trunc
+var validStatsIntervals = map[string]bool{"hour": true, "day": true, "week": true, "month": true}
+
+// parseTimezone reads the tz parameter, an IANA timezone such as Asia/Jakarta defaulting to UTC.
+// Time buckets start at midnight of that timezone, and plain dates are read in it.
+func parseTimezone(query url.Values) (*time.Location, error) {
+	name := query.Get("tz")
+	if name == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		return nil, fmt.Errorf("invalid tz %q", name)
+	}
+	return location, nil
+}
+
+// parseTimeRange reads the optional from/to parameters, accepting RFC 3339 timestamps or plain
+// dates, which start at midnight in location
+func parseTimeRange(query url.Values, location *time.Location) (from, to *time.Time, err error) {
+	parse := func(name string) (*time.Time, error) {
+		value := query.Get(name)
+		if value == "" {
+			return nil, nil
+		}
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, value, location); err == nil {
+				return &t, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid %s date %q", name, value)
+	}
+
+	if from, err = parse("from"); err != nil {
+		return nil, nil, err
+	}
+	if to, err = parse("to"); err != nil {
+		return nil, nil, err
+	}
+	if from != nil && to != nil && to.Before(*from) {
+		return nil, nil, errors.New("to must not be before from")
+	}
+	return from, to, nil
+}
+
+// parseStatsInterval reads the interval parameter, defaulting to day
+func parseStatsInterval(query url.Values) (string, error) {
+	interval := query.Get("interval")
+	if interval == "" {
+		return "day", nil
+	}
+	if !validStatsIntervals[interval] {
+		return "", fmt.Errorf("invalid interval %q", interval)
+	}
+	return interval, nil
+}
+
+func GetQualityStatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	interval, err := parseStatsInterval(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	location, err := parseTimezone(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseTimeRange(query, location)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	modelPath, err := parseJSONPath(getEnvOrDefault("QUALITY_MODEL_PATH", "response_metadata.model_name"))
+	if err != nil {
+		log.Err(err).Msg("Invalid QUALITY_MODEL_PATH")
+		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Every breakdown shares the same feedback selection
+	feedbackWhere := func(args *queryArgs) string {
+		var conditions []string
+		if from != nil {
+			conditions = append(conditions, "f.created_at >= "+args.add(*from))
+		}
+		if to != nil {
+			conditions = append(conditions, "f.created_at < "+args.add(*to))
+		}
+		return joinWhere(conditions)
+	}
+	const counts = `COUNT(*) FILTER (WHERE f.rating = 'positive'), COUNT(*) FILTER (WHERE f.rating = 'negative')`
+
+	stats := QualityStats{Interval: interval, Timezone: location.String()}
+
+	var overallArgs queryArgs
+	overall, err := queryQualityCounts(r.Context(), fmt.Sprintf(`
+		SELECT 'overall', %s FROM chat_history_feedback f %s
+	`, counts, feedbackWhere(&overallArgs)), overallArgs)
+	if err != nil {
+		log.Err(err).Msg("Failed to query overall quality")
+		respondWithQueryError(w, err)
+		return
+	}
+	stats.Overall = overall[0]
+
+	var timelineArgs queryArgs
+	bucket := "date_trunc(" + timelineArgs.add(interval) + ", f.created_at, " + timelineArgs.add(location.String()) + ")"
+	stats.Timeline, err = queryQualityCounts(r.Context(), fmt.Sprintf(`
+		SELECT %s, %s
+		FROM chat_history_feedback f
+		%s
+		GROUP BY %s
+		ORDER BY %s
+	`, bucket, counts, feedbackWhere(&timelineArgs), bucket, bucket), timelineArgs)
+	if err != nil {
+		log.Err(err).Msg("Failed to query quality timeline")
+		respondWithQueryError(w, err)
+		return
+	}
+	localizeBuckets(stats.Timeline, location)
+
+	// Message feedback is attributed to that message's model, session feedback to the latest model used
+	var modelArgs queryArgs
+	modelExpr := "h.message #>> " + modelArgs.add(modelPath)
+	stats.ByModel, err = queryQualityCounts(r.Context(), fmt.Sprintf(`
+		SELECT COALESCE(m.model, 'unknown'), %s
+		FROM chat_history_feedback f
+		LEFT JOIN LATERAL (
+			SELECT %s AS model
+			FROM n8n_chat_histories h
+			WHERE h.session_id = f.session_id
+				AND (f.message_id IS NULL OR h.id = f.message_id)
+				AND %s IS NOT NULL
+			ORDER BY h.id DESC
+			LIMIT 1
+		) m ON true
+		%s
+		GROUP BY 1
+		ORDER BY COUNT(*) DESC
+	`, counts, modelExpr, modelExpr, feedbackWhere(&modelArgs)), modelArgs)
+	if err != nil {
+		log.Err(err).Msg("Failed to query quality by model")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	// Feedback counts once for every distinct tool called during the session
+	var toolArgs queryArgs
+	stats.ByTool, err = queryQualityCounts(r.Context(), fmt.Sprintf(`
+		SELECT t.tool, %s
+		FROM chat_history_feedback f
+		JOIN LATERAL (
+			SELECT DISTINCT call->>'name' AS tool
+			FROM n8n_chat_histories h, jsonb_array_elements(%s) AS call
+			WHERE h.session_id = f.session_id AND call->>'name' IS NOT NULL
+		) t ON true
+		%s
+		GROUP BY 1
+		ORDER BY COUNT(*) DESC
+	`, counts, jsonbArray("h.message->'tool_calls'"), feedbackWhere(&toolArgs)), toolArgs)
+	if err != nil {
+		log.Err(err).Msg("Failed to query quality by tool")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: stats})
+}
+
+// queryQualityCounts runs a query returning (key, positive, negative) rows
+func queryQualityCounts(ctx context.Context, query string, args queryArgs) ([]QualityCounts, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []QualityCounts{}
+	for rows.Next() {
+		var counts QualityCounts
+		if err := rows.Scan(&counts.Key, &counts.Positive, &counts.Negative); err != nil {
+			return nil, err
+		}
+		counts.Total = counts.Positive + counts.Negative
+		if counts.Total > 0 {
+			counts.PositiveRatio = float64(counts.Positive) / float64(counts.Total)
+		}
+		results = append(results, counts)
+	}
+	return results, rows.Err()
+}
+
+// localizeBuckets rewrites bucket keys, which the driver reports as UTC timestamps, with the
+// offset of the requested timezone so each bucket reads as its local start
+func localizeBuckets(buckets []QualityCounts, location *time.Location) {
+	for i := range buckets {
+		if start, err := time.Parse(time.RFC3339Nano, buckets[i].Key); err == nil {
+			buckets[i].Key = start.In(location).Format(time.RFC3339)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TraceStep is a step of an agent run: a reasoning turn, a tool invocation with its results, a
+// tool call the model failed to make, or a tool result no call claimed
+type TraceStep struct {
+	Type      string        `json:"type"` // reasoning, tool, tool_failure or tool_result
+	MessageID int           `json:"messageId"`
+	Content   string        `json:"content,omitempty"`
+	Tool      string        `json:"tool,omitempty"`
+	CallID    string        `json:"callId,omitempty"`
+	Args      interface{}   `json:"args,omitempty"`
+	Results   []TraceResult `json:"results,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// TraceResult is a tool message answering a tool invocation
+type TraceResult struct {
+	MessageID int    `json:"messageId"`
+	Content   string `json:"content"`
+}
+
+// TraceTurn is a human or AI message that opens or closes a run
+type TraceTurn struct {
+	MessageID int    `json:"messageId"`
+	Content   string `json:"content"`
+}
+
+// TraceRun is what the agent did for one human message: the steps it took and the answer it gave.
+// Messages stored before the first human message form a run without input.
+type TraceRun struct {
+	Input       *TraceTurn  `json:"input,omitempty"`
+	Steps       []TraceStep `json:"steps"`
+	FinalAnswer *TraceTurn  `json:"finalAnswer,omitempty"`
+}
+
+// SessionTrace is the response of the steps endpoint
+type SessionTrace struct {
+	SessionID string     `json:"sessionId"`
+	Runs      []TraceRun `json:"runs"`
+}
+
+// GetSessionStepsHandler returns a session as an execution trace of agent runs, for a trace view
+// where every tool invocation can be expanded to its arguments and results
+func GetSessionStepsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	chats, err := loadSessionMessages(r.Context(), sessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to load session messages")
+		respondWithQueryError(w, err)
+		return
+	}
+	if len(chats) == 0 {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	toolCallIDs, err := loadToolCallIDs(r.Context(), sessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to load tool call ids")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: SessionTrace{
+		SessionID: sessionID,
+		Runs:      traceRuns(threadMessages(chats, toolCallIDs)),
+	}})
+}
+
+// traceRuns splits threaded messages into runs at every human message. The last AI message of a
+// run is its final answer, unless it calls tools; earlier AI text becomes reasoning steps.
+// System messages are left out, as they are not part of what the agent did.
+func traceRuns(messages []ThreadedMessage) []TraceRun {
+	runs := []TraceRun{}
+	var run *TraceRun
+	startRun := func(input *TraceTurn) {
+		runs = append(runs, TraceRun{Input: input, Steps: []TraceStep{}})
+		run = &runs[len(runs)-1]
+	}
+
+	for _, message := range messages {
+		switch message.Message.Type {
+		case "human":
+			startRun(&TraceTurn{MessageID: message.ID, Content: message.Message.Content})
+			continue
+		case "system":
+			continue
+		}
+		if run == nil {
+			startRun(nil)
+		}
+		if run.FinalAnswer != nil {
+			run.Steps = append(run.Steps, TraceStep{Type: "reasoning", MessageID: run.FinalAnswer.MessageID, Content: run.FinalAnswer.Content})
+			run.FinalAnswer = nil
+		}
+
+		switch message.Message.Type {
+		case "ai":
+			if len(message.ToolCalls) == 0 && len(message.Message.InvalidToolCalls) == 0 {
+				run.FinalAnswer = &TraceTurn{MessageID: message.ID, Content: message.Message.Content}
+				continue
+			}
+			if message.Message.Content != "" {
+				run.Steps = append(run.Steps, TraceStep{Type: "reasoning", MessageID: message.ID, Content: message.Message.Content})
+			}
+			for _, call := range message.ToolCalls {
+				step := TraceStep{Type: "tool", MessageID: message.ID, Tool: call.Name, CallID: call.ID, Args: call.Args, Results: []TraceResult{}}
+				for _, result := range call.Results {
+					step.Results = append(step.Results, TraceResult{MessageID: result.ID, Content: result.Message.Content})
+				}
+				run.Steps = append(run.Steps, step)
+			}
+			for _, call := range message.Message.InvalidToolCalls {
+				run.Steps = append(run.Steps, TraceStep{
+					Type:      "tool_failure",
+					MessageID: message.ID,
+					Tool:      toolCallField(call, "name"),
+					CallID:    toolCallField(call, "id"),
+					Error:     toolCallField(call, "error"),
+				})
+			}
+		case "tool":
+			run.Steps = append(run.Steps, TraceStep{
+				Type:      "tool_result",
+				MessageID: message.ID,
+				Results:   []TraceResult{{MessageID: message.ID, Content: message.Message.Content}},
+			})
+		}
+	}
+	return runs
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// responseStream writes a response body piece by piece as rows are scanned, so listings never
+// hold a whole page of messages in memory
+type responseStream struct {
+	w           http.ResponseWriter
+	buf         *bufio.Writer
+	contentType string
+	started     bool
+	err         error
+}
+
+func newResponseStream(w http.ResponseWriter, contentType string) *responseStream {
+	return &responseStream{w: w, buf: bufio.NewWriterSize(w, 32*1024), contentType: contentType}
+}
+
+// write appends encoded output to the body
+func (s *responseStream) write(data []byte) {
+	s.start()
+	if s.err == nil {
+		_, s.err = s.buf.Write(data)
+	}
+}
+
+// raw appends literal output such as `{"data":[` or a separating comma
+func (s *responseStream) raw(text string) {
+	s.start()
+	if s.err == nil {
+		_, s.err = s.buf.WriteString(text)
+	}
+}
+
+// start commits the response status and headers on the first write
+func (s *responseStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.w.Header().Set("Content-Type", s.contentType)
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// flush writes the remaining output, logging when the client went away mid-response
+func (s *responseStream) flush() {
+	if s.err == nil {
+		s.start()
+		s.err = s.buf.Flush()
+	}
+	if s.err != nil {
+		log.Err(s.err).Msg("Failed to write streamed response")
+	}
+}
+
+// fail reports err to the client. Before anything was written this is a regular error response;
+// afterwards the status is already sent, so the connection is aborted to leave the client with a
+// truncated body rather than a document that looks complete.
+func (s *responseStream) fail(err error, message string) {
+	log.Err(err).Msg(message)
+	if !s.started {
+		respondWithQueryError(s.w, err)
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// listingWriter renders a page of the chat listing in the negotiated format
+type listingWriter interface {
+	// begin receives the pagination metadata, which is known before the first row
+	begin(pagination PaginationResponse)
+	// chat writes one row of the simple listing
+	chat(chat Chat)
+	// sessionDetails receives the details of the sessions on the page, before their rows
+	sessionDetails(details map[string]SessionDetails)
+	// sessionMessage writes one message of the session listing. Rows arrive grouped by session.
+	sessionMessage(chat Chat)
+	// truncate marks the page as cut short at the response limits, to be continued with cursor
+	truncate(cursor string)
+	// finish completes the document
+	finish()
+	// fail reports an error, see responseStream.fail
+	fail(err error, message string)
+}
+
+// SessionDetails are written with each session of the session listing. Omitted counts the older
+// messages left out by the per-session message limit, which Pinned indexes include.
+type SessionDetails struct {
+	Pinned  []MessagePin
+	Omitted int
+}
+
+// jsonListing writes the APIResponse envelope incrementally
+type jsonListing struct {
+	*responseStream
+	groupBy        string
+	pagination     PaginationResponse
+	rows           int
+	currentSession string
+	details        map[string]SessionDetails
+	plans          *queryPlans
+}
+
+func newJSONListing(w http.ResponseWriter, groupBy string, plans *queryPlans) *jsonListing {
+	return &jsonListing{responseStream: newResponseStream(w, "application/json"), groupBy: groupBy, plans: plans}
+}
+
+// value appends the JSON encoding of v
+func (l *jsonListing) value(v interface{}) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		l.err = err
+		return
+	}
+	l.write(encoded)
+}
+
+// open writes the start of the envelope before the first row
+func (l *jsonListing) open() {
+	if l.started {
+		return
+	}
+	if l.groupBy == "session" {
+		l.raw(`{"data":{`)
+	} else {
+		l.raw(`{"data":[`)
+	}
+}
+
+func (l *jsonListing) begin(pagination PaginationResponse) {
+	l.pagination = pagination
+}
+
+func (l *jsonListing) chat(chat Chat) {
+	l.open()
+	if l.rows > 0 {
+		l.raw(",")
+	}
+	l.rows++
+	l.value(chat)
+}
+
+func (l *jsonListing) sessionDetails(details map[string]SessionDetails) {
+	l.details = details
+}
+
+func (l *jsonListing) sessionMessage(chat Chat) {
+	l.open()
+	if l.rows > 0 && chat.SessionID == l.currentSession {
+		l.raw(",")
+	} else {
+		if l.rows > 0 {
+			l.raw("]},")
+		}
+		l.currentSession = chat.SessionID
+		l.value(chat.SessionID)
+		l.raw(`:{"sessionId":`)
+		l.value(chat.SessionID)
+		details := l.details[chat.SessionID]
+		l.raw(`,"pinned":`)
+		if details.Pinned != nil {
+			l.value(details.Pinned)
+		} else {
+			l.raw("[]")
+		}
+		if details.Omitted > 0 {
+			l.raw(`,"omittedMessages":`)
+			l.value(details.Omitted)
+		}
+		l.raw(`,"messages":[`)
+	}
+	l.rows++
+	l.value(chat.Message)
+}
+
+func (l *jsonListing) truncate(cursor string) {
+	l.pagination.Partial, l.pagination.Cursor = true, cursor
+}
+
+func (l *jsonListing) finish() {
+	l.open()
+	if l.groupBy == "session" {
+		if l.rows > 0 {
+			l.raw("]}")
+		}
+		l.raw(`},"pagination":`)
+	} else {
+		l.raw(`],"pagination":`)
+	}
+	l.value(l.pagination)
+	if l.plans != nil {
+		l.raw(`,"debug":`)
+		l.value(l.plans.debugInfo())
+	}
+	l.raw("}\n")
+	l.flush()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// summaryCheckpoint names the progress of the summary worker in the checkpoint table it shares
+	// with the event publishers
+	summaryCheckpoint = "sessions-summary"
+	// summaryBatchSize is the number of chat rows folded into the summary per statement
+	summaryBatchSize = 50000
+)
+
+// sessionSummaryJob maintains chat_history_sessions_summary incrementally from the rows added
+// since its checkpoint. n8n owns the chat table, so this replaces triggers. last_activity is when
+// the worker first saw the latest message, as n8n stores no timestamps.
+//
+// Ids are handed out before their rows commit, so a row can become visible after rows with higher
+// ids were already folded. Every run therefore also recounts the sessions of the rows within
+// rescanWindow ids below the checkpoint, and sessions are always recounted rather than
+// incremented, which keeps rows seen twice from being counted twice.
+type sessionSummaryJob struct {
+	rescanWindow int64
+}
+
+// newSessionSummaryJob reads SUMMARY_RESCAN_WINDOW from the environment
+func newSessionSummaryJob() sessionSummaryJob {
+	job := sessionSummaryJob{rescanWindow: 1000}
+	if window, err := strconv.ParseInt(os.Getenv("SUMMARY_RESCAN_WINDOW"), 10, 64); err == nil && window >= 0 {
+		job.rescanWindow = window
+	}
+	return job
+}
+
+// run catches up with the chat table, one batch per transaction
+func (j sessionSummaryJob) run(ctx context.Context) error {
+	for {
+		folded, err := j.foldBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if folded < summaryBatchSize {
+			return nil
+		}
+	}
+}
+
+// foldBatch recounts the sessions of the next batch of chat rows and of the rescan window, and
+// advances the checkpoint past the batch. The checkpoint row is locked for the transaction, which
+// keeps session merges from interleaving.
+func (j sessionSummaryJob) foldBatch(ctx context.Context) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	checkpoint, err := lockSummaryCheckpoint(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	var lastID int64
+	var folded, recounted int
+	err = tx.QueryRowContext(ctx, `
+		WITH batch AS (
+			SELECT id, session_id FROM n8n_chat_histories WHERE id > $1 ORDER BY id LIMIT $2
+		), bound AS (
+			SELECT COALESCE(MAX(id), $1) AS last_id FROM batch
+		), touched AS (
+			SELECT session_id FROM batch
+			UNION
+			SELECT session_id FROM n8n_chat_histories WHERE id > $1 - $3 AND id <= $1
+		), counted AS (
+			SELECT h.session_id, COUNT(*) AS message_count, MIN(h.id) AS first_id, MAX(h.id) AS last_id
+			FROM n8n_chat_histories h
+			JOIN touched t ON t.session_id = h.session_id
+			WHERE h.id <= (SELECT last_id FROM bound)
+			GROUP BY h.session_id
+		), folded AS (
+			INSERT INTO chat_history_sessions_summary AS s (session_id, message_count, first_id, last_id, last_activity)
+			SELECT session_id, message_count, first_id, last_id, now() FROM counted
+			ON CONFLICT (session_id) DO UPDATE SET
+				message_count = EXCLUDED.message_count,
+				first_id = EXCLUDED.first_id,
+				last_id = EXCLUDED.last_id,
+				last_activity = CASE
+					WHEN EXCLUDED.message_count <> s.message_count OR EXCLUDED.last_id <> s.last_id THEN EXCLUDED.last_activity
+					ELSE s.last_activity
+				END
+			RETURNING 1
+		)
+		SELECT (SELECT last_id FROM bound), (SELECT COUNT(*) FROM batch), (SELECT COUNT(*) FROM folded)
+	`, checkpoint, summaryBatchSize, j.rescanWindow).Scan(&lastID, &folded, &recounted)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE chat_history_publish_checkpoints SET last_id = $2, updated_at = now() WHERE publisher = $1
+	`, summaryCheckpoint, lastID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if folded > 0 {
+		log.Info().Int("rows", folded).Int("sessions", recounted).Int64("lastId", lastID).Msg("Updated session summary")
+	}
+	return folded, nil
+}
+
+// lockSummaryCheckpoint returns the last chat row included in the summary, locking it until tx ends
+func lockSummaryCheckpoint(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var checkpoint int64
+	err := tx.QueryRowContext(ctx, `
+		SELECT last_id FROM chat_history_publish_checkpoints WHERE publisher = $1 FOR UPDATE
+	`, summaryCheckpoint).Scan(&checkpoint)
+	return checkpoint, err
+}
+
+// refreshSessionSummaries recounts sessions whose rows were changed in tx, up to the checkpoint so
+// the worker does not count the newer rows twice
+func refreshSessionSummaries(ctx context.Context, tx *sql.Tx, sessionIDs ...string) error {
+	checkpoint, err := lockSummaryCheckpoint(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM chat_history_sessions_summary WHERE session_id = ANY($1)
+	`, sessionIDs); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO chat_history_sessions_summary (session_id, message_count, first_id, last_id, last_activity)
+		SELECT session_id, COUNT(*), MIN(id), MAX(id), now()
+		FROM n8n_chat_histories
+		WHERE session_id = ANY($1) AND id <= $2
+		GROUP BY session_id
+	`, sessionIDs, checkpoint)
+	return err
+}
+
+// querySessionPage returns the number of sessions matching filter and the IDs of one page of them.
+// Unfiltered listings are served from the summary table, joined with the sessions of the rows the
+// worker has not folded yet, as scanning the chat table for distinct sessions is the slowest query
+// of the listing.
+func querySessionPage(ctx context.Context, filter ChatFilter, sortOrder sortDirection, pageSize, offset int) (int, []string, error) {
+	var countArgs queryArgs
+	countQuery := selectFrom(&countArgs, "n8n_chat_histories", "COUNT(DISTINCT session_id)").filter(filter).sql()
+
+	var args queryArgs
+	sessionQuery := selectFrom(&args, "n8n_chat_histories", "session_id").
+		distinct("session_id").
+		filter(filter).
+		order("session_id", ascending).
+		order("id", sortOrder).
+		page(pageSize, offset).
+		sql()
+
+	if filter.onlyArchived() && featureEnabled("summary") && !readOnly {
+		// The archived state is the only condition and takes no arguments
+		countArgs, args = nil, nil
+		count := selectFrom(&countArgs, summarySessions(&countArgs), "COUNT(*)")
+		page := selectFrom(&args, summarySessions(&args), "session_id")
+		if condition := filter.archivedCondition(); condition != "" {
+			count.where(condition)
+			page.where(condition)
+		}
+		countQuery = count.sql()
+		sessionQuery = page.order("session_id", ascending).page(pageSize, offset).sql()
+	}
+
+	// Neither query keeps its connection while waiting for the other, so they can always run together
+	var total int
+	var sessionIDs []string
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		explainQuery(groupCtx, "count", countQuery, countArgs...)
+		return db.QueryRowContext(groupCtx, countQuery, countArgs...).Scan(&total)
+	})
+	group.Go(func() error {
+		explainQuery(groupCtx, "sessions", sessionQuery, args...)
+		rows, err := db.QueryContext(groupCtx, sessionQuery, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sessionID string
+			if err := rows.Scan(&sessionID); err != nil {
+				return err
+			}
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+		return rows.Err()
+	})
+	if err := group.Wait(); err != nil {
+		return 0, nil, err
+	}
+	return total, sessionIDs, nil
+}
+
+// summarySessions returns a subquery of every session: those in the summary and those of the rows
+// after its checkpoint, which are found through the primary key
+func summarySessions(args *queryArgs) string {
+	return `(
+		SELECT session_id FROM chat_history_sessions_summary
+		UNION
+		SELECT session_id FROM n8n_chat_histories
+		WHERE id > COALESCE((SELECT last_id FROM chat_history_publish_checkpoints WHERE publisher = ` + args.add(summaryCheckpoint) + `), 0)
+	) AS sessions`
+}
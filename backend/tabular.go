@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// csvColumns are the columns of the CSV listing; the free-form message fields hold JSON
+var csvColumns = []string{"id", "session_id", "type", "content", "tool_calls", "additional_kwargs", "response_metadata", "invalid_tool_calls"}
+
+// setPaginationHeaders reports pagination in headers for formats that have no envelope. Whether the
+// response was cut short is only known at its end, so it is reported in trailers.
+func setPaginationHeaders(w http.ResponseWriter, pagination PaginationResponse) {
+	w.Header().Set("Trailer", "X-Partial, X-Cursor")
+	w.Header().Set("X-Page", strconv.Itoa(pagination.Page))
+	w.Header().Set("X-Page-Size", strconv.Itoa(pagination.PageSize))
+	w.Header().Set("X-Total-Count", strconv.Itoa(pagination.Total))
+	w.Header().Set("X-Total-Pages", strconv.Itoa(pagination.TotalPages))
+}
+
+// ndjsonListing writes one chat per line. Both groupings produce the same rows, as every chat
+// carries its session id.
+type ndjsonListing struct {
+	*responseStream
+}
+
+func newNDJSONListing(w http.ResponseWriter) *ndjsonListing {
+	return &ndjsonListing{responseStream: newResponseStream(w, listingContentType(formatNDJSON))}
+}
+
+func (l *ndjsonListing) begin(pagination PaginationResponse) {
+	setPaginationHeaders(l.w, pagination)
+}
+
+func (l *ndjsonListing) chat(chat Chat) {
+	encoded, err := json.Marshal(chat)
+	if err != nil {
+		l.fail(err, "Failed to encode chat")
+		return
+	}
+	l.write(append(encoded, '\n'))
+}
+
+// sessionDetails ignores the details, as NDJSON rows are single messages
+func (l *ndjsonListing) sessionDetails(map[string]SessionDetails) {}
+
+func (l *ndjsonListing) sessionMessage(chat Chat) {
+	l.chat(chat)
+}
+
+// setPartialTrailers reports a truncated response in the trailers declared by setPaginationHeaders
+func setPartialTrailers(w http.ResponseWriter, cursor string) {
+	w.Header().Set("X-Partial", "true")
+	w.Header().Set("X-Cursor", cursor)
+}
+
+func (l *ndjsonListing) truncate(cursor string) {
+	setPartialTrailers(l.w, cursor)
+}
+
+func (l *ndjsonListing) finish() {
+	l.flush()
+}
+
+// csvListing writes one chat per row under a header row
+type csvListing struct {
+	*responseStream
+	row    bytes.Buffer
+	writer *csv.Writer
+}
+
+func newCSVListing(w http.ResponseWriter) *csvListing {
+	l := &csvListing{responseStream: newResponseStream(w, listingContentType(formatCSV))}
+	l.writer = csv.NewWriter(&l.row)
+	return l
+}
+
+func (l *csvListing) begin(pagination PaginationResponse) {
+	setPaginationHeaders(l.w, pagination)
+}
+
+func (l *csvListing) truncate(cursor string) {
+	setPartialTrailers(l.w, cursor)
+}
+
+// record writes one CSV line, starting with the header row
+func (l *csvListing) record(fields []string) {
+	if !l.started {
+		l.writer.Write(csvColumns)
+	}
+	l.writer.Write(fields)
+	l.writer.Flush()
+	l.write(l.row.Bytes())
+	l.row.Reset()
+}
+
+func (l *csvListing) chat(chat Chat) {
+	fields := []string{strconv.Itoa(chat.ID), csvSafe(chat.SessionID), chat.Message.Type, csvSafe(chat.Message.Content)}
+	for _, value := range []interface{}{chat.Message.ToolCalls, chat.Message.AdditionalKwargs, chat.Message.ResponseMetadata, chat.Message.InvalidToolCalls} {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			l.fail(err, "Failed to encode chat")
+			return
+		}
+		if string(encoded) == "null" {
+			encoded = nil
+		}
+		fields = append(fields, string(encoded))
+	}
+	l.record(fields)
+}
+
+// sessionDetails ignores the details, as CSV rows are single messages
+func (l *csvListing) sessionDetails(map[string]SessionDetails) {}
+
+func (l *csvListing) sessionMessage(chat Chat) {
+	l.chat(chat)
+}
+
+func (l *csvListing) finish() {
+	if !l.started {
+		l.writer.Write(csvColumns)
+		l.writer.Flush()
+		l.write(l.row.Bytes())
+	}
+	l.flush()
+}
+
+// csvSafe keeps spreadsheets from evaluating user-provided text as a formula
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
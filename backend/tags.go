@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SessionTags is the request and response body of the session tags endpoints
+type SessionTags struct {
+	SessionID string   `json:"sessionId"`
+	Tags      []string `json:"tags"`
+}
+
+// normalizeTags trims, lowercases and de-duplicates tags, dropping empty ones
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// loadSessionTags returns the tags of a session in alphabetical order
+func loadSessionTags(ctx context.Context, sessionID string) ([]string, error) {
+	tags := []string{}
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(array_agg(tag ORDER BY tag), '{}')
+		FROM chat_history_session_tags
+		WHERE session_id = $1
+	`, sessionID).Scan(pgArray(&tags))
+	return tags, err
+}
+
+func GetSessionTagsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	tags, err := loadSessionTags(r.Context(), sessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to load session tags")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: SessionTags{SessionID: sessionID, Tags: tags}})
+}
+
+// PutSessionTagsHandler replaces the tags of a session
+func PutSessionTagsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	var request SessionTags
+	if !decodeJSONBody(w, r, &request) {
+		return
+	}
+	tags := normalizeTags(request.Tags)
+
+	var exists bool
+	if err := db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM n8n_chat_histories WHERE session_id = $1)`, sessionID).Scan(&exists); err != nil {
+		log.Err(err).Msg("Failed to check session")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !exists {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Err(err).Msg("Failed to begin tags transaction")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(r.Context(), `DELETE FROM chat_history_session_tags WHERE session_id = $1`, sessionID); err != nil {
+		log.Err(err).Msg("Failed to clear session tags")
+		respondWithQueryError(w, err)
+		return
+	}
+	if _, err := tx.ExecContext(r.Context(), `
+		INSERT INTO chat_history_session_tags (session_id, tag)
+		SELECT $1, unnest($2::text[])
+	`, sessionID, tags); err != nil {
+		log.Err(err).Msg("Failed to insert session tags")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Err(err).Msg("Failed to commit tags transaction")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: SessionTags{SessionID: sessionID, Tags: tags}})
+}
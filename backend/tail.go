@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// tailPollInterval is how often the database is checked for new rows while a tail request waits
+const tailPollInterval = time.Second
+
+// TailResponse holds the rows that arrived after the requested id
+type TailResponse struct {
+	Data   []Chat `json:"data"`
+	LastID int    `json:"lastId"`
+}
+
+// TailChatsHandler long-polls a session: it returns as soon as rows newer than afterId exist, or an
+// empty result once the timeout expires, so clients can simply loop with the returned lastId.
+func TailChatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sessionID := query.Get("sessionId")
+	if sessionID == "" {
+		respondWithError(w, "sessionId is required", http.StatusBadRequest)
+		return
+	}
+	afterID, err := strconv.Atoi(query.Get("afterId"))
+	if err != nil || afterID < 0 {
+		respondWithError(w, "afterId must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	timeout := getEnvDuration("TAIL_TIMEOUT", 30*time.Second)
+	if value := query.Get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			respondWithError(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = parsed
+	}
+	if maxTimeout := getEnvDuration("TAIL_MAX_TIMEOUT", time.Minute); timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		chats, err := loadMessagesAfter(ctx, sessionID, afterID)
+		if err != nil && ctx.Err() == nil {
+			log.Err(err).Str("sessionId", sessionID).Msg("Failed to poll new messages")
+			respondWithQueryError(w, err)
+			return
+		}
+		if len(chats) > 0 {
+			respondWithJSON(w, TailResponse{Data: chats, LastID: chats[len(chats)-1].ID})
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			if r.Context().Err() == nil {
+				respondWithJSON(w, TailResponse{Data: []Chat{}, LastID: afterID})
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadMessagesAfter returns the messages of a session with an id greater than afterID, scanned
+// like the listing so mapped columns and virtual fields come along
+func loadMessagesAfter(ctx context.Context, sessionID string, afterID int) ([]Chat, error) {
+	return loadChats(ctx, `
+		SELECT `+chatColumns()+`
+		FROM n8n_chat_histories
+		WHERE session_id = $1 AND id > $2
+		ORDER BY id ASC
+		LIMIT 100
+	`, sessionID, afterID)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ThreadedToolCall is a tool call of an AI message with the tool messages that answered it
+type ThreadedToolCall struct {
+	ID      string      `json:"id,omitempty"`
+	Name    string      `json:"name"`
+	Args    interface{} `json:"args,omitempty"`
+	Results []Chat      `json:"results"`
+}
+
+// ThreadedMessage is a message of the threaded view. AI messages that call tools carry the calls
+// with their results, so tool messages only appear at the top level when no call claims them.
+type ThreadedMessage struct {
+	Chat
+	ToolCalls []ThreadedToolCall `json:"toolCalls,omitempty"`
+}
+
+// SessionMessages is the response of the session messages endpoint. Messages holds []Chat in the
+// flat view and []ThreadedMessage in the threaded one.
+type SessionMessages struct {
+	SessionID string      `json:"sessionId"`
+	View      string      `json:"view"`
+	Messages  interface{} `json:"messages"`
+}
+
+// GetSessionMessagesHandler returns every message of a session in insertion order. With
+// view=threaded, tool messages are nested under the tool call of the AI message that invoked
+// them, so the UI can render agent steps as a tree.
+func GetSessionMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	view := r.URL.Query().Get("view")
+	if view == "" {
+		view = "flat"
+	}
+	if view != "flat" && view != "threaded" {
+		respondWithError(w, "view must be flat or threaded", http.StatusBadRequest)
+		return
+	}
+
+	chats, err := loadSessionMessages(r.Context(), sessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to load session messages")
+		respondWithQueryError(w, err)
+		return
+	}
+	if len(chats) == 0 {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	response := SessionMessages{SessionID: sessionID, View: view, Messages: chats}
+	if view == "threaded" {
+		toolCallIDs, err := loadToolCallIDs(r.Context(), sessionID)
+		if err != nil {
+			log.Err(err).Str("sessionId", sessionID).Msg("Failed to load tool call ids")
+			respondWithQueryError(w, err)
+			return
+		}
+		response.Messages = threadMessages(chats, toolCallIDs)
+	}
+
+	respondWithJSON(w, DataResponse{Data: response})
+}
+
+// loadToolCallIDs returns the tool_call_id of the tool messages of a session by message id. The
+// message struct has no field for it, and older LangChain versions kept it in additional_kwargs.
+func loadToolCallIDs(ctx context.Context, sessionID string) (map[int]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(message->>'tool_call_id', message#>>'{additional_kwargs,tool_call_id}', '')
+		FROM n8n_chat_histories
+		WHERE session_id = $1 AND message->>'type' = 'tool'
+	`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var toolCallID string
+		if err := rows.Scan(&id, &toolCallID); err != nil {
+			return nil, err
+		}
+		ids[id] = toolCallID
+	}
+	return ids, rows.Err()
+}
+
+// threadMessages nests tool messages under the calls they answer. A tool message is matched by
+// its tool_call_id, or without one to the first unanswered call of the latest AI message; tool
+// messages matching no call stay at the top level.
+func threadMessages(chats []Chat, toolCallIDs map[int]string) []ThreadedMessage {
+	type callRef struct{ message, call int }
+	threaded := []ThreadedMessage{}
+	calls := make(map[string]callRef)
+	lastAI := -1
+
+	for _, chat := range chats {
+		switch chat.Message.Type {
+		case "ai":
+			message := ThreadedMessage{Chat: chat}
+			for i, call := range chat.Message.ToolCalls {
+				toolCall := ThreadedToolCall{ID: toolCallField(call, "id"), Name: toolCallField(call, "name"), Results: []Chat{}}
+				if fields, ok := call.(map[string]interface{}); ok {
+					toolCall.Args = fields["args"]
+				}
+				if toolCall.ID != "" {
+					calls[toolCall.ID] = callRef{message: len(threaded), call: i}
+				}
+				message.ToolCalls = append(message.ToolCalls, toolCall)
+			}
+			lastAI = len(threaded)
+			threaded = append(threaded, message)
+			continue
+
+		case "tool":
+			var call *ThreadedToolCall
+			if id := toolCallIDs[chat.ID]; id != "" {
+				if ref, ok := calls[id]; ok {
+					call = &threaded[ref.message].ToolCalls[ref.call]
+				}
+			} else if lastAI >= 0 {
+				call = firstUnanswered(threaded[lastAI].ToolCalls)
+			}
+			if call != nil {
+				call.Results = append(call.Results, chat)
+				continue
+			}
+		}
+		threaded = append(threaded, ThreadedMessage{Chat: chat})
+	}
+	return threaded
+}
+
+// firstUnanswered returns the first call without a result, or nil
+func firstUnanswered(calls []ThreadedToolCall) *ThreadedToolCall {
+	for i := range calls {
+		if len(calls[i].Results) == 0 {
+			return &calls[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// timelineSummaryLength is the number of characters of a message shown on the timeline
+const timelineSummaryLength = 120
+
+// TimelineEvent is a point on the timeline of a session: a human or AI turn, or a tool call that
+// the AI made or failed to make
+type TimelineEvent struct {
+	Type      string     `json:"type"` // human, ai, tool_call or tool_failure
+	MessageID int        `json:"messageId"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Summary   string     `json:"summary"`
+	Tool      string     `json:"tool,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// SessionTimeline is the response of the timeline endpoint. Start and end are only known when
+// messages carry a timestamp at MESSAGE_TIMESTAMP_PATH.
+type SessionTimeline struct {
+	SessionID string          `json:"sessionId"`
+	Start     *time.Time      `json:"start,omitempty"`
+	End       *time.Time      `json:"end,omitempty"`
+	Events    []TimelineEvent `json:"events"`
+}
+
+// GetSessionTimelineHandler condenses a session into the events shown above its transcript
+func GetSessionTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	var args queryArgs
+	timestamp := "NULL::timestamptz"
+	if len(messageTimestampPath) > 0 {
+		timestamp = messageTimestampExpr("message", &args)
+	}
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT id, message, %s
+		FROM n8n_chat_histories
+		WHERE session_id = %s
+		ORDER BY id
+	`, timestamp, args.add(sessionID)), args...)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to query session timeline")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	timeline := SessionTimeline{SessionID: sessionID, Events: []TimelineEvent{}}
+	found := false
+	for rows.Next() {
+		var id int
+		var messageJSON []byte
+		var sentAt *time.Time
+		if err := rows.Scan(&id, &messageJSON, &sentAt); err != nil {
+			log.Err(err).Msg("Failed to scan timeline message")
+			respondWithQueryError(w, err)
+			return
+		}
+		var message Message
+		if err := json.Unmarshal(messageJSON, &message); err != nil {
+			log.Err(err).Int("id", id).Msg("Failed to decode timeline message")
+			respondWithError(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := readMessage(r.Context(), sessionID, &message); err != nil {
+			log.Err(err).Int("id", id).Msg("Failed to process timeline message")
+			respondWithQueryError(w, err)
+			return
+		}
+		found = true
+
+		if sentAt != nil {
+			if timeline.Start == nil {
+				timeline.Start = sentAt
+			}
+			timeline.End = sentAt
+		}
+		timeline.Events = append(timeline.Events, timelineEvents(id, sentAt, message)...)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate timeline messages")
+		respondWithQueryError(w, err)
+		return
+	}
+	if !found {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: timeline})
+}
+
+// timelineEvents returns the events of one message. Tool results and system messages are left out,
+// as the calls they answer are already on the timeline.
+func timelineEvents(id int, sentAt *time.Time, message Message) []TimelineEvent {
+	var events []TimelineEvent
+	switch message.Type {
+	case "human":
+		events = append(events, TimelineEvent{Type: "human", MessageID: id, Timestamp: sentAt, Summary: truncateSummary(message.Content)})
+	case "ai":
+		if message.Content != "" {
+			events = append(events, TimelineEvent{Type: "ai", MessageID: id, Timestamp: sentAt, Summary: truncateSummary(message.Content)})
+		}
+		for _, call := range message.ToolCalls {
+			name := toolCallField(call, "name")
+			events = append(events, TimelineEvent{Type: "tool_call", MessageID: id, Timestamp: sentAt, Summary: name, Tool: name})
+		}
+		for _, call := range message.InvalidToolCalls {
+			name, callError := toolCallField(call, "name"), toolCallField(call, "error")
+			events = append(events, TimelineEvent{Type: "tool_failure", MessageID: id, Timestamp: sentAt, Summary: truncateSummary(callError), Tool: name, Error: callError})
+		}
+	}
+	return events
+}
+
+// toolCallField returns a string field of a tool call, or an empty string
+func toolCallField(call interface{}, field string) string {
+	if fields, ok := call.(map[string]interface{}); ok {
+		if value, ok := fields[field].(string); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// truncateSummary shortens text to timelineSummaryLength characters
+func truncateSummary(text string) string {
+	if utf8.RuneCountInString(text) <= timelineSummaryLength {
+		return text
+	}
+	return string([]rune(text)[:timelineSummaryLength-1]) + "…"
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryTimeoutMiddleware bounds the request context, and with it every database query of the
+// request. Clients may pass ?timeoutMs= to pick their own timeout up to QUERY_TIMEOUT_MAX, so
+// interactive queries can fail fast while exports run longer; QUERY_TIMEOUT applies otherwise.
+func queryTimeoutMiddleware(next http.Handler) http.Handler {
+	defaultTimeout := getEnvDuration("QUERY_TIMEOUT", 30*time.Second)
+	maxTimeout := getEnvDuration("QUERY_TIMEOUT_MAX", 5*time.Minute)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Long polling manages its own deadline, and export downloads stream files of any size
+		if r.URL.Path == "/api/v1/chats/tail" || isExportDownload(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := defaultTimeout
+		if value := r.URL.Query().Get("timeoutMs"); value != "" {
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms < 1 {
+				respondWithError(w, "timeoutMs must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+		if timeout > maxTimeout {
+			timeout = maxTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// isExportDownload reports whether path is /api/v1/exports/{id}/download
+func isExportDownload(path string) bool {
+	id, ok := strings.CutSuffix(strings.TrimPrefix(path, "/api/v1/exports/"), "/download")
+	return ok && strings.HasPrefix(path, "/api/v1/exports/") && id != "" && !strings.Contains(id, "/")
+}
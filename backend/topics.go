@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TopicTerm is a keyword or bigram with the number of times it was used and the number of
+// messages using it
+type TopicTerm struct {
+	Term     string `json:"term"`
+	Count    int    `json:"count"`
+	Messages int    `json:"messages"`
+}
+
+// TopicsResponse is the response of the topics endpoint
+type TopicsResponse struct {
+	Messages int         `json:"messages"`
+	Keywords []TopicTerm `json:"keywords"`
+	Bigrams  []TopicTerm `json:"bigrams"`
+}
+
+// stopwords lists the words too common to describe a topic, per language detected for sessions.
+// Messages of sessions without a detected language are checked against every list.
+var stopwords = map[string][]string{
+	"en": strings.Fields(`a about after all also am an and any are as at be because been but by can
+		could did do does doing for from get got had has have having he her here him his how i if in
+		into is it its just me more my no not now of on one or our out please so some than thank
+		thanks that the their them then there these they this to too up us very was we were what
+		when where which who why will with would yes you your hi hello ok okay`),
+	"id": strings.Fields(`ada adalah agar akan aku anda apa apakah atau bagaimana bahwa banyak belum
+		bisa boleh dalam dan dari dengan di dia ini itu jadi jika juga kak kalau kami kamu karena ke
+		kenapa ketika kita lagi lebih mau mereka mohon nya oleh pada saja sama saya sebagai sedang
+		sudah supaya tapi tetapi tidak tolong untuk yang ya ga gak nggak halo terima kasih`),
+	"es": strings.Fields(`a al algo como con cual cuando de del desde donde el ella en entre era es
+		esa ese esta este estoy fue gracias ha hay hola la las le lo los me mi muy más no nos o para
+		pero por porque que qué se si sin sobre su sus también te tengo tiene todo un una y ya yo`),
+	"pt": strings.Fields(`a ao aos as com como da das de do dos e ela ele em entre era essa esse esta
+		este estou eu foi há isso já lhe mais mas me meu minha muito na nas no nos não o obrigado
+		olá os ou para pela pelo por porque quando que se sem seu sua também tem tenho um uma você`),
+	"fr": strings.Fields(`a au aux avec bonjour ce ces comme dans de des du elle en est et être il ils
+		je la le les leur lui ma mais me merci mes moi mon ne nous on ou par pas plus pour qu que qui
+		sa se ses son sur ta te tes toi ton tu un une vos votre vous y ai`),
+	"de": strings.Fields(`aber als am an auch auf aus bei bin bitte bis das dass dem den der des die
+		ein eine einen einem einer es für hallo hat habe haben ich ihr ihre im in ist ja kann mein
+		meine mich mir mit nach nicht noch nur oder sich sie sind so und uns von vor war was wie wir
+		wird zu zum zur danke`),
+	"it": strings.Fields(`a al alla anche che chi ciao come con cosa da dal dei del della di e è ed gli
+		grazie ha ho i il in io la le lo ma mi mia mio ne nel nella non per più però perché quando
+		questo questa se si sono su sua suo ti tu un una uno vi`),
+	"nl": strings.Fields(`aan al als bij dan dat de den der deze die dit doen door een en er had heb
+		heeft hem het hij hoe hun ik in is ja je kan kunnen maar me met mij mijn na naar niet nog nu
+		of om onze ook op over te tot u uit van voor wat we wel wij zal ze zich zijn zo bedankt hallo`),
+}
+
+// stopwordSets holds the stopwords of every language as sets, along with their union under the
+// undetermined language
+var stopwordSets = buildStopwordSets()
+
+func buildStopwordSets() map[string]map[string]bool {
+	sets := map[string]map[string]bool{undeterminedLanguage: {}}
+	for language, words := range stopwords {
+		sets[language] = make(map[string]bool, len(words))
+		for _, word := range words {
+			sets[language][word] = true
+			sets[undeterminedLanguage][word] = true
+		}
+	}
+	return sets
+}
+
+// topicCounter accumulates the keywords and bigrams of messages
+type topicCounter struct {
+	messages int
+	keywords map[string]*TopicTerm
+	bigrams  map[string]*TopicTerm
+}
+
+func newTopicCounter() *topicCounter {
+	return &topicCounter{keywords: make(map[string]*TopicTerm), bigrams: make(map[string]*TopicTerm)}
+}
+
+// add counts the terms of one message. Bigrams are pairs of adjacent words that are both kept,
+// so "reset my password" yields the keywords reset and password but no bigram.
+func (c *topicCounter) add(content, language string) {
+	stop, ok := stopwordSets[language]
+	if !ok {
+		stop = stopwordSets[undeterminedLanguage]
+	}
+	c.messages++
+
+	seen := make(map[*TopicTerm]bool)
+	count := func(terms map[string]*TopicTerm, term string) {
+		entry := terms[term]
+		if entry == nil {
+			entry = &TopicTerm{Term: term}
+			terms[term] = entry
+		}
+		entry.Count++
+		if !seen[entry] {
+			seen[entry] = true
+			entry.Messages++
+		}
+	}
+
+	previous := ""
+	words := strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+	for _, word := range words {
+		word = strings.Trim(word, "'")
+		if utf8.RuneCountInString(word) < 2 || stop[word] || strings.IndexFunc(word, unicode.IsLetter) < 0 {
+			previous = ""
+			continue
+		}
+		count(c.keywords, word)
+		if previous != "" {
+			count(c.bigrams, previous+" "+word)
+		}
+		previous = word
+	}
+}
+
+// topTerms returns the limit most used terms, dropping those seen in a single message
+func topTerms(terms map[string]*TopicTerm, limit int) []TopicTerm {
+	top := []TopicTerm{}
+	for _, term := range terms {
+		if term.Messages > 1 {
+			top = append(top, *term)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Term < top[j].Term
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
+
+// GetTopicsHandler lists the most frequent keywords and bigrams of the latest human messages
+// matching the filters. Chat rows carry no timestamps, so from/to select the sessions by their
+// last activity as recorded in the session summary.
+func GetTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+	sample, _ := strconv.Atoi(query.Get("sample"))
+	if sample < 1 || sample > 100000 {
+		sample = 10000
+	}
+
+	filter, err := parseChatFilter(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	location, err := parseTimezone(query)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseTimeRange(query, location)
+	if err != nil {
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (from != nil || to != nil) && !featureEnabled("summary") {
+		respondWithError(w, "from and to need the session summary", http.StatusBadRequest)
+		return
+	}
+
+	var args queryArgs
+	conditions := append(filter.conditions(&args), "message->>'type' = 'human'", "COALESCE(message->>'content', '') <> ''")
+	var activity []string
+	if from != nil {
+		activity = append(activity, "last_activity >= "+args.add(*from))
+	}
+	if to != nil {
+		activity = append(activity, "last_activity < "+args.add(*to))
+	}
+	if len(activity) > 0 {
+		conditions = append(conditions, "session_id IN (SELECT session_id FROM chat_history_sessions_summary "+joinWhere(activity)+")")
+	}
+
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(`
+		SELECT h.content, COALESCE((SELECT language FROM chat_history_session_languages l WHERE l.session_id = h.session_id), '')
+		FROM (
+			SELECT session_id, message->>'content' AS content
+			FROM n8n_chat_histories
+			%s
+			ORDER BY id DESC
+			LIMIT %s
+		) AS h
+	`, joinWhere(conditions), args.add(sample)), args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query messages for topics")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	counter := newTopicCounter()
+	for rows.Next() {
+		var content, language string
+		if err := rows.Scan(&content, &language); err != nil {
+			log.Err(err).Msg("Failed to scan message for topics")
+			respondWithQueryError(w, err)
+			return
+		}
+		counter.add(content, language)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate messages for topics")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: TopicsResponse{
+		Messages: counter.messages,
+		Keywords: topTerms(counter.keywords, limit),
+		Bigrams:  topTerms(counter.bigrams, limit),
+	}})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/rs/zerolog/log"
+)
+
+// transcriptFormats lists the formats a session transcript can be rendered in
+var transcriptFormats = map[string]string{
+	"pdf":  "application/pdf",
+	"html": "text/html; charset=utf-8",
+}
+
+// transcriptRoles names the participant behind each message type
+var transcriptRoles = map[string]string{
+	"human":  "User",
+	"ai":     "Assistant",
+	"tool":   "Tool",
+	"system": "System",
+}
+
+// TranscriptMessage is a message of a transcript. Tool calls are reduced to their names, and tool
+// results to their size, so the conversation itself stays readable.
+type TranscriptMessage struct {
+	ID        int
+	Role      string
+	SentAt    *time.Time
+	Content   string
+	Collapsed bool // Content only describes a tool result
+	ToolCalls []string
+	Failures  []string
+}
+
+// Transcript is a session prepared for rendering as a document
+type Transcript struct {
+	SessionID    string
+	Participants []string
+	Start        *time.Time
+	End          *time.Time
+	GeneratedAt  time.Time
+	Messages     []TranscriptMessage
+}
+
+// loadTranscript reads a session in insertion order. Timestamps are only known when messages
+// carry one at MESSAGE_TIMESTAMP_PATH.
+func loadTranscript(ctx context.Context, sessionID string) (Transcript, error) {
+	transcript := Transcript{SessionID: sessionID, GeneratedAt: time.Now().UTC(), Messages: []TranscriptMessage{}}
+
+	var args queryArgs
+	timestamp := "NULL::timestamptz"
+	if len(messageTimestampPath) > 0 {
+		timestamp = messageTimestampExpr("message", &args)
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id, message, %s
+		FROM n8n_chat_histories
+		WHERE session_id = %s
+		ORDER BY id
+	`, timestamp, args.add(sessionID)), args...)
+	if err != nil {
+		return transcript, err
+	}
+	defer rows.Close()
+
+	seen := map[string]bool{}
+	for rows.Next() {
+		var id int
+		var messageJSON []byte
+		var sentAt *time.Time
+		if err := rows.Scan(&id, &messageJSON, &sentAt); err != nil {
+			return transcript, err
+		}
+		var message Message
+		if err := json.Unmarshal(messageJSON, &message); err != nil {
+			return transcript, fmt.Errorf("message %d: %w", id, err)
+		}
+		if err := readMessage(ctx, sessionID, &message); err != nil {
+			return transcript, err
+		}
+
+		role, ok := transcriptRoles[message.Type]
+		if !ok {
+			role = message.Type
+		}
+		if !seen[role] {
+			seen[role] = true
+			transcript.Participants = append(transcript.Participants, role)
+		}
+		if sentAt != nil {
+			if transcript.Start == nil {
+				transcript.Start = sentAt
+			}
+			transcript.End = sentAt
+		}
+
+		entry := TranscriptMessage{ID: id, Role: role, SentAt: sentAt, Content: message.Content}
+		if message.Type == "tool" {
+			entry.Content = fmt.Sprintf("Tool result (%d characters)", len([]rune(message.Content)))
+			entry.Collapsed = true
+		}
+		for _, call := range message.ToolCalls {
+			entry.ToolCalls = append(entry.ToolCalls, toolCallField(call, "name"))
+		}
+		for _, call := range message.InvalidToolCalls {
+			entry.Failures = append(entry.Failures, strings.TrimSpace(toolCallField(call, "name")+": "+toolCallField(call, "error")))
+		}
+		transcript.Messages = append(transcript.Messages, entry)
+	}
+	return transcript, rows.Err()
+}
+
+// GetSessionTranscriptHandler renders a session as a document to download. The format parameter
+// picks the document type: pdf, the default, or html.
+func GetSessionTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "pdf"
+	}
+	contentType, ok := transcriptFormats[format]
+	if !ok {
+		respondWithError(w, "format must be pdf or html", http.StatusBadRequest)
+		return
+	}
+
+	transcript, err := loadTranscript(r.Context(), sessionID)
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to load session transcript")
+		respondWithQueryError(w, err)
+		return
+	}
+	if len(transcript.Messages) == 0 {
+		respondWithError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	var document bytes.Buffer
+	render := renderTranscriptPDF
+	if format == "html" {
+		render = renderTranscriptHTML
+	}
+	if err := render(&document, transcript); err != nil {
+		log.Err(err).Str("sessionId", sessionID).Msg("Failed to render session transcript")
+		respondWithError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("session-%s.%s", unsafeFilenameChars.ReplaceAllString(sessionID, "_"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "html" {
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	}
+	w.Write(document.Bytes())
+}
+
+// transcriptTemplate renders a transcript as a chat-style page without external assets, so the
+// file can be opened and passed around on its own
+var transcriptTemplate = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Conversation {{.SessionID}}</title>
+<style>
+body { margin: 0; font-family: system-ui, -apple-system, "Segoe UI", sans-serif; font-size: 15px; background: #e5ddd5; color: #111b21; }
+header { position: sticky; top: 0; padding: 12px 20px; background: #075e54; color: #fff; }
+header h1 { margin: 0; font-size: 17px; font-weight: 600; }
+header p { margin: 2px 0 0; font-size: 12px; opacity: .85; }
+main { max-width: 860px; margin: 0 auto; padding: 16px 12px 32px; }
+.row { display: flex; margin: 4px 0; }
+.row.user { justify-content: flex-end; }
+.row.note { justify-content: center; }
+.bubble { max-width: 75%; padding: 7px 10px 5px; border-radius: 8px; background: #fff; box-shadow: 0 1px .5px rgba(11, 20, 26, .13); white-space: pre-wrap; word-wrap: break-word; }
+.user .bubble { background: #d9fdd3; }
+.note .bubble { max-width: 90%; background: #fff8c5; color: #54656f; font-size: 12px; text-align: center; }
+.role { display: block; margin-bottom: 2px; font-size: 12px; font-weight: 600; color: #027eb5; }
+.user .role { color: #1f7a4d; }
+.meta { display: block; margin-top: 3px; font-size: 11px; color: #667781; text-align: right; }
+.tools { display: block; margin-top: 4px; font-size: 12px; color: #54656f; font-style: italic; }
+.failure { display: block; margin-top: 4px; font-size: 12px; color: #b91c1c; }
+footer { padding: 12px; font-size: 11px; color: #54656f; text-align: center; }
+</style>
+</head>
+<body>
+<header>
+<h1>Conversation {{.SessionID}}</h1>
+<p>{{range $i, $p := .Participants}}{{if $i}}, {{end}}{{$p}}{{end}} &middot; {{len .Messages}} messages{{if .Start}} &middot; {{.Start.UTC.Format "2 Jan 2006 15:04"}} to {{.End.UTC.Format "2 Jan 2006 15:04 MST"}}{{end}}</p>
+</header>
+<main>
+{{range .Messages}}
+<div class="row {{if eq .Role "User"}}user{{else if .Collapsed}}note{{end}}">
+<div class="bubble">{{if not .Collapsed}}<span class="role">{{.Role}}</span>{{end}}{{.Content}}
+{{- if .ToolCalls}}<span class="tools">Called {{range $i, $call := .ToolCalls}}{{if $i}}, {{end}}{{$call}}{{end}}</span>{{end}}
+{{- range .Failures}}<span class="failure">Failed tool call {{.}}</span>{{end}}
+{{- if .SentAt}}<span class="meta" title="{{.SentAt.UTC.Format "2006-01-02 15:04:05 MST"}}">{{.SentAt.UTC.Format "15:04"}}</span>{{end}}</div>
+</div>
+{{end}}
+</main>
+<footer>Generated {{.GeneratedAt.Format "2 Jan 2006 15:04 MST"}}</footer>
+</body>
+</html>
+`))
+
+// renderTranscriptHTML writes the transcript as a standalone page
+func renderTranscriptHTML(w io.Writer, transcript Transcript) error {
+	return transcriptTemplate.Execute(w, transcript)
+}
+
+// renderTranscriptPDF writes the transcript as an A4 document. The standard PDF fonts only cover
+// Windows-1252, so characters outside it are rendered as question marks.
+func renderTranscriptPDF(w io.Writer, transcript Transcript) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	encode := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle("Conversation "+transcript.SessionID, true)
+	pdf.SetCreator("n8n-chat-history", true)
+	pdf.SetCreationDate(transcript.GeneratedAt)
+	pdf.SetMargins(18, 18, 18)
+	pdf.SetAutoPageBreak(true, 18)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.SetTextColor(120, 120, 120)
+		pdf.CellFormat(0, 4, encode("Session "+transcript.SessionID), "", 0, "L", false, 0, "")
+		pdf.SetX(18)
+		pdf.CellFormat(0, 4, fmt.Sprintf("Page %d of {nb}", pdf.PageNo()), "", 0, "R", false, 0, "")
+	})
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.SetTextColor(15, 23, 42)
+	pdf.MultiCell(0, 8, encode("Conversation "+transcript.SessionID), "", "L", false)
+	pdf.SetFont("Helvetica", "", 9)
+	pdf.SetTextColor(100, 116, 139)
+	details := []string{
+		"Participants: " + strings.Join(transcript.Participants, ", "),
+		fmt.Sprintf("Messages: %d", len(transcript.Messages)),
+	}
+	if transcript.Start != nil {
+		details = append(details, fmt.Sprintf("Period: %s to %s", transcript.Start.UTC().Format(time.RFC1123), transcript.End.UTC().Format(time.RFC1123)))
+	}
+	details = append(details, "Generated: "+transcript.GeneratedAt.Format(time.RFC1123))
+	for _, line := range details {
+		pdf.MultiCell(0, 5, encode(line), "", "L", false)
+	}
+	pdf.Ln(4)
+
+	for _, message := range transcript.Messages {
+		heading := message.Role
+		if message.SentAt != nil {
+			heading += "  " + message.SentAt.UTC().Format("2006-01-02 15:04:05 MST")
+		}
+		pdf.SetFont("Helvetica", "B", 9)
+		pdf.SetTextColor(71, 85, 105)
+		pdf.MultiCell(0, 5, encode(heading), "", "L", false)
+
+		if message.Content != "" {
+			pdf.SetFont("Helvetica", "", 10)
+			pdf.SetTextColor(15, 23, 42)
+			if message.Collapsed {
+				pdf.SetFont("Helvetica", "I", 9)
+				pdf.SetTextColor(100, 116, 139)
+			}
+			pdf.MultiCell(0, 5, encode(message.Content), "", "L", false)
+		}
+		pdf.SetFont("Helvetica", "I", 9)
+		pdf.SetTextColor(100, 116, 139)
+		if len(message.ToolCalls) > 0 {
+			pdf.MultiCell(0, 5, encode("Called "+strings.Join(message.ToolCalls, ", ")), "", "L", false)
+		}
+		for _, failure := range message.Failures {
+			pdf.SetTextColor(185, 28, 28)
+			pdf.MultiCell(0, 5, encode("Failed tool call "+failure), "", "L", false)
+		}
+		pdf.Ln(3)
+	}
+
+	return pdf.Output(w)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// anonymousUsage is the usage key of requests made without an API key, such as the frontend's
+const anonymousUsage = "anonymous"
+
+// APIUsage is the traffic of one API key in one month
+type APIUsage struct {
+	Key      string `json:"key"`
+	Month    string `json:"month"`
+	Requests int64  `json:"requests"`
+	Rows     int64  `json:"rows"`
+	Quota    int64  `json:"quota,omitempty"`
+}
+
+// apiKey identifies a team sharing the service. Usage is reported by name, never by secret.
+type apiKey struct {
+	name  string
+	key   string
+	quota int64 // monthly request quota, 0 for unlimited
+}
+
+// usageCount is the traffic of a key in a month
+type usageCount struct {
+	requests, rows int64
+}
+
+// usagePeriod identifies the counts of one key in one month
+type usagePeriod struct {
+	key, month string
+}
+
+// usageTracker counts requests and served rows per API key. Counts are kept in memory and
+// flushed to the database periodically, so tracking costs no query per request; with several
+// replicas quotas are enforced against the total as of the last flush plus local traffic.
+type usageTracker struct {
+	keys []apiKey
+
+	mu          sync.Mutex
+	pending     map[usagePeriod]usageCount // not yet flushed
+	stored      map[string]usageCount      // totals of all replicas as of the last flush
+	storedMonth string
+}
+
+var usage *usageTracker
+
+type usageRowsKey struct{}
+
+// loadAPIKeys reads API_KEYS, a comma-separated list of name:key pairs, and API_KEY_QUOTAS, a
+// comma-separated list of name=requests monthly quotas
+func loadAPIKeys() {
+	usage = &usageTracker{pending: map[usagePeriod]usageCount{}, stored: map[string]usageCount{}}
+
+	quotas := map[string]int64{}
+	for _, entry := range strings.Split(os.Getenv("API_KEY_QUOTAS"), ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(entry), "=")
+		quota, err := strconv.ParseInt(value, 10, 64)
+		if !found || err != nil || quota < 1 {
+			if entry != "" {
+				log.Warn().Str("entry", entry).Msg("Ignoring invalid API key quota")
+			}
+			continue
+		}
+		quotas[name] = quota
+	}
+
+	for _, entry := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		name, key, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || name == "" || key == "" {
+			if entry != "" {
+				log.Warn().Msg("Ignoring API key entry without name:key form")
+			}
+			continue
+		}
+		usage.keys = append(usage.keys, apiKey{name: name, key: key, quota: quotas[name]})
+	}
+	if len(usage.keys) > 0 {
+		log.Info().Int("keys", len(usage.keys)).Msg("Loaded API keys")
+	}
+}
+
+// identify returns the API key of r, or false for an unknown key
+func (u *usageTracker) identify(r *http.Request) (apiKey, bool) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return apiKey{name: anonymousUsage}, true
+	}
+	for _, candidate := range u.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate.key)) == 1 {
+			return candidate, true
+		}
+	}
+	return apiKey{}, false
+}
+
+// currentMonth returns the usage period of now
+func currentMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// admit counts a request of key, or reports false when its quota is used up
+func (u *usageTracker) admit(key apiKey) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	period := usagePeriod{key: key.name, month: currentMonth()}
+	count := u.pending[period]
+	if key.quota > 0 {
+		used := count.requests
+		if u.storedMonth == period.month {
+			used += u.stored[key.name].requests
+		}
+		if used >= key.quota {
+			return false
+		}
+	}
+	count.requests++
+	u.pending[period] = count
+	return true
+}
+
+// addRows counts rows served to key
+func (u *usageTracker) addRows(key string, rows int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	period := usagePeriod{key: key, month: currentMonth()}
+	count := u.pending[period]
+	count.rows += rows
+	u.pending[period] = count
+}
+
+// flush adds the pending counts to the database and refreshes the totals of the current month.
+// Counts that fail to be stored are kept for the next flush.
+func (u *usageTracker) flush(ctx context.Context) error {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = map[usagePeriod]usageCount{}
+	u.mu.Unlock()
+
+	var err error
+	for period, count := range pending {
+		if err == nil {
+			_, err = db.ExecContext(ctx, `
+				INSERT INTO chat_history_api_usage (api_key, month, requests, rows)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT (api_key, month) DO UPDATE SET
+					requests = chat_history_api_usage.requests + EXCLUDED.requests,
+					rows = chat_history_api_usage.rows + EXCLUDED.rows
+			`, period.key, period.month, count.requests, count.rows)
+			if err == nil {
+				continue
+			}
+		}
+		u.mu.Lock()
+		merged := u.pending[period]
+		merged.requests += count.requests
+		merged.rows += count.rows
+		u.pending[period] = merged
+		u.mu.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	month := currentMonth()
+	entries, err := queryUsage(ctx, month)
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]usageCount, len(entries))
+	for _, entry := range entries {
+		stored[entry.Key] = usageCount{requests: entry.Requests, rows: entry.Rows}
+	}
+
+	u.mu.Lock()
+	u.stored, u.storedMonth = stored, month
+	u.mu.Unlock()
+	return nil
+}
+
+// startUsageFlush flushes the usage counts every USAGE_FLUSH_INTERVAL. In read-only mode usage
+// is only tracked in memory.
+func startUsageFlush(ctx context.Context) {
+	if readOnly {
+		return
+	}
+	interval := getEnvDuration("USAGE_FLUSH_INTERVAL", 10*time.Second)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := usage.flush(ctx); err != nil {
+					log.Err(err).Msg("Failed to flush API usage")
+				}
+			}
+		}
+	}()
+}
+
+// usageMiddleware identifies the API key of every API request, enforces its monthly quota and
+// counts the request. Handlers report the rows they serve through countRowsServed.
+func usageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := usage.identify(r)
+		if !ok {
+			respondWithError(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if !usage.admit(key) {
+			now := time.Now().UTC()
+			nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			w.Header().Set("Retry-After", strconv.Itoa(int(nextMonth.Sub(now).Seconds())+1))
+			respondWithError(w, "Monthly quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), usageRowsKey{}, key.name)))
+	})
+}
+
+// countRowsServed adds rows to the usage of the API key of the request
+func countRowsServed(ctx context.Context, rows int) {
+	if key, ok := ctx.Value(usageRowsKey{}).(string); ok && rows > 0 {
+		usage.addRows(key, int64(rows))
+	}
+}
+
+// queryUsage returns the stored usage of every key in month
+func queryUsage(ctx context.Context, month string) ([]APIUsage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT api_key, month, requests, rows FROM chat_history_api_usage WHERE month = $1 ORDER BY requests DESC
+	`, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []APIUsage{}
+	for rows.Next() {
+		var entry APIUsage
+		if err := rows.Scan(&entry.Key, &entry.Month, &entry.Requests, &entry.Rows); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// GetUsageHandler reports requests and rows served per API key for ?month=YYYY-MM, by default
+// the current month
+func GetUsageHandler(w http.ResponseWriter, r *http.Request) {
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = currentMonth()
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		respondWithError(w, "month must be formatted as YYYY-MM", http.StatusBadRequest)
+		return
+	}
+
+	var entries []APIUsage
+	if readOnly {
+		// Nothing is stored, the counts of this instance are all there is
+		entries = []APIUsage{}
+		usage.mu.Lock()
+		for period, count := range usage.pending {
+			if period.month == month {
+				entries = append(entries, APIUsage{Key: period.key, Month: month, Requests: count.requests, Rows: count.rows})
+			}
+		}
+		usage.mu.Unlock()
+	} else {
+		if err := usage.flush(r.Context()); err != nil {
+			log.Err(err).Msg("Failed to flush API usage")
+		}
+		var err error
+		if entries, err = queryUsage(r.Context(), month); err != nil {
+			log.Err(err).Msg("Failed to query API usage")
+			respondWithQueryError(w, err)
+			return
+		}
+	}
+
+	for i := range entries {
+		for _, key := range usage.keys {
+			if key.name == entries[i].Key {
+				entries[i].Quota = key.quota
+			}
+		}
+	}
+	respondWithJSON(w, DataResponse{Data: entries})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// User is a person working with the service, such as a reviewer, identified by the login their
+// SSO proxy reports
+type User struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Team      string    `json:"team"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Team groups users. Users not registered explicitly join the first team mapped from one of the
+// SSO groups they belong to.
+type Team struct {
+	Name      string    `json:"name"`
+	SSOGroups []string  `json:"ssoGroups"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Identity is who a request was made by
+type Identity struct {
+	User   string   `json:"user"`
+	Name   string   `json:"name"`
+	Team   string   `json:"team"`
+	Groups []string `json:"groups"`
+	APIKey string   `json:"apiKey,omitempty"`
+}
+
+// requestUser returns the login reported by the SSO proxy in AUTH_USER_HEADER. The header is
+// only trusted when configured, as the proxy must be the sole way to reach the service.
+func requestUser(r *http.Request) string {
+	header := os.Getenv("AUTH_USER_HEADER")
+	if header == "" {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(header))
+}
+
+// requestGroups returns the comma-separated SSO groups reported in AUTH_GROUPS_HEADER
+func requestGroups(r *http.Request) []string {
+	groups := []string{}
+	header := os.Getenv("AUTH_GROUPS_HEADER")
+	if header == "" {
+		return groups
+	}
+	for _, group := range strings.Split(r.Header.Get(header), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// loadIdentity resolves the user of r with their name and team
+func loadIdentity(ctx context.Context, r *http.Request) (Identity, error) {
+	identity := Identity{User: requestUser(r), Groups: requestGroups(r)}
+	if key, ok := r.Context().Value(usageRowsKey{}).(string); ok && key != anonymousUsage {
+		identity.APIKey = key
+	}
+	if identity.User == "" {
+		return identity, nil
+	}
+
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(u.name, ''), COALESCE(NULLIF(u.team, ''), (
+			SELECT t.name FROM chat_history_teams t WHERE t.sso_groups && $2 ORDER BY t.name LIMIT 1
+		), '')
+		FROM (SELECT 1) AS one
+		LEFT JOIN chat_history_users u ON u.id = $1
+	`, identity.User, identity.Groups).Scan(&identity.Name, &identity.Team)
+	return identity, err
+}
+
+// GetIdentityHandler tells the frontend who it is acting as
+func GetIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	identity, err := loadIdentity(r.Context(), r)
+	if err != nil {
+		log.Err(err).Msg("Failed to resolve identity")
+		respondWithQueryError(w, err)
+		return
+	}
+	respondWithJSON(w, DataResponse{Data: identity})
+}
+
+func GetUsersHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT id, name, team, created_at FROM chat_history_users ORDER BY id`)
+	if err != nil {
+		log.Err(err).Msg("Failed to query users")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Team, &user.CreatedAt); err != nil {
+			log.Err(err).Msg("Failed to scan user")
+			respondWithQueryError(w, err)
+			return
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate users")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: users})
+}
+
+// PutUserHandler creates or updates a user
+func PutUserHandler(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if !decodeJSONBody(w, r, &user) {
+		return
+	}
+	user.ID = r.PathValue("id")
+	user.Name = strings.TrimSpace(user.Name)
+	user.Team = strings.TrimSpace(user.Team)
+
+	if user.Team != "" {
+		var exists bool
+		if err := db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM chat_history_teams WHERE name = $1)`, user.Team).Scan(&exists); err != nil {
+			log.Err(err).Msg("Failed to check team")
+			respondWithQueryError(w, err)
+			return
+		}
+		if !exists {
+			respondWithError(w, "Unknown team", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_users (id, name, team) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, team = EXCLUDED.team
+		RETURNING created_at
+	`, user.ID, user.Name, user.Team).Scan(&user.CreatedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to store user")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := recordAudit(db, r, "users.update", user); err != nil {
+		log.Err(err).Msg("Failed to record user audit entry")
+	}
+
+	respondWithJSON(w, DataResponse{Data: user})
+}
+
+func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	deleteNamed(w, r, `DELETE FROM chat_history_users WHERE id = $1`, "users.delete", "User not found")
+}
+
+func GetTeamsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT name, sso_groups, created_at FROM chat_history_teams ORDER BY name`)
+	if err != nil {
+		log.Err(err).Msg("Failed to query teams")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	teams := []Team{}
+	for rows.Next() {
+		var team Team
+		if err := rows.Scan(&team.Name, pgArray(&team.SSOGroups), &team.CreatedAt); err != nil {
+			log.Err(err).Msg("Failed to scan team")
+			respondWithQueryError(w, err)
+			return
+		}
+		teams = append(teams, team)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate teams")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, DataResponse{Data: teams})
+}
+
+// PutTeamHandler creates or updates a team and the SSO groups mapped to it
+func PutTeamHandler(w http.ResponseWriter, r *http.Request) {
+	var team Team
+	if !decodeJSONBody(w, r, &team) {
+		return
+	}
+	team.Name = r.PathValue("name")
+	groups := []string{}
+	for _, group := range team.SSOGroups {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	team.SSOGroups = groups
+
+	err := db.QueryRowContext(r.Context(), `
+		INSERT INTO chat_history_teams (name, sso_groups) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET sso_groups = EXCLUDED.sso_groups
+		RETURNING created_at
+	`, team.Name, team.SSOGroups).Scan(&team.CreatedAt)
+	if err != nil {
+		log.Err(err).Msg("Failed to store team")
+		respondWithQueryError(w, err)
+		return
+	}
+	if err := recordAudit(db, r, "teams.update", team); err != nil {
+		log.Err(err).Msg("Failed to record team audit entry")
+	}
+
+	respondWithJSON(w, DataResponse{Data: team})
+}
+
+// DeleteTeamHandler removes a team; its users stay registered without a team
+func DeleteTeamHandler(w http.ResponseWriter, r *http.Request) {
+	deleteNamed(w, r, `WITH cleared AS (
+		UPDATE chat_history_users SET team = '' WHERE team = $1
+	) DELETE FROM chat_history_teams WHERE name = $1`, "teams.delete", "Team not found")
+}
+
+// deleteNamed runs a delete keyed by the last path value and responds with 204, or 404 when
+// nothing was deleted
+func deleteNamed(w http.ResponseWriter, r *http.Request, statement, action, notFound string) {
+	key := r.PathValue("id")
+	if key == "" {
+		key = r.PathValue("name")
+	}
+	result, err := db.ExecContext(r.Context(), statement, key)
+	if err != nil {
+		log.Err(err).Str("action", action).Msg("Failed to delete")
+		respondWithQueryError(w, err)
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		respondWithError(w, notFound, http.StatusNotFound)
+		return
+	}
+	if err := recordAudit(db, r, action, map[string]string{"key": key}); err != nil {
+		log.Err(err).Str("action", action).Msg("Failed to record audit entry")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errUnknownAssignee is returned when users are registered and an assignee is not one of them
+var errUnknownAssignee = errors.New("unknown assignee")
+
+// checkAssignee accepts any assignee until users are registered, and registered users after
+func checkAssignee(ctx context.Context, assignee string) error {
+	if assignee == "" {
+		return nil
+	}
+	var known, anyUsers bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM chat_history_users WHERE id = $1), EXISTS (SELECT 1 FROM chat_history_users)
+	`, assignee).Scan(&known, &anyUsers)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if anyUsers && !known {
+		return errUnknownAssignee
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// vaultCredentials issues database credentials from the database secrets engine of HashiCorp
+// Vault. The lease is renewed while Vault allows it; once it reaches its max TTL, new credentials
+// are requested before the old ones expire and idle connections are recycled onto them.
+type vaultCredentials struct {
+	addr      string
+	token     string
+	namespace string
+	path      string // e.g. database/creds/chat-history
+	client    *http.Client
+
+	mu            sync.RWMutex
+	user          string
+	password      string
+	leaseID       string
+	leaseDuration time.Duration
+	renewable     bool
+}
+
+// vaultSecret is the part of a Vault secret response used here
+type vaultSecret struct {
+	LeaseID       string `json:"lease_id"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+	Data          struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"data"`
+}
+
+// newVaultCredentials reads the VAULT_* variables. It returns nil when VAULT_DB_ROLE is unset.
+func newVaultCredentials() (*vaultCredentials, error) {
+	role := os.Getenv("VAULT_DB_ROLE")
+	if role == "" {
+		return nil, nil
+	}
+
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, errors.New("VAULT_ADDR is required when VAULT_DB_ROLE is set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if tokenFile := os.Getenv("VAULT_TOKEN_FILE"); token == "" && tokenFile != "" {
+		content, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token == "" {
+		return nil, errors.New("VAULT_TOKEN or VAULT_TOKEN_FILE is required when VAULT_DB_ROLE is set")
+	}
+
+	return &vaultCredentials{
+		addr:      addr,
+		token:     token,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		path:      getEnvOrDefault("VAULT_DB_MOUNT", "database") + "/creds/" + role,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (v *vaultCredentials) credentials(context.Context) (string, string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.user, v.password, nil
+}
+
+// request calls the Vault HTTP API and decodes the secret in its response
+func (v *vaultCredentials) request(ctx context.Context, method, path string, body interface{}) (vaultSecret, error) {
+	var secret vaultSecret
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return secret, err
+		}
+		reader = strings.NewReader(string(payload))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+path, reader)
+	if err != nil {
+		return secret, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return secret, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return secret, fmt.Errorf("vault %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return secret, json.NewDecoder(resp.Body).Decode(&secret)
+}
+
+// issue requests new credentials and makes them current
+func (v *vaultCredentials) issue(ctx context.Context) error {
+	secret, err := v.request(ctx, http.MethodGet, v.path, nil)
+	if err != nil {
+		return err
+	}
+	if secret.Data.Username == "" {
+		return errors.New("vault returned no database credentials")
+	}
+
+	v.mu.Lock()
+	v.user, v.password = secret.Data.Username, secret.Data.Password
+	v.leaseID = secret.LeaseID
+	v.leaseDuration = time.Duration(secret.LeaseDuration) * time.Second
+	v.renewable = secret.Renewable
+	v.mu.Unlock()
+
+	log.Info().Str("user", secret.Data.Username).Dur("lease", v.leaseDuration).Msg("Issued database credentials from Vault")
+	return nil
+}
+
+// renew extends the current lease, reporting false when Vault grants less than the full
+// duration because the lease is about to reach its max TTL
+func (v *vaultCredentials) renew(ctx context.Context) (bool, error) {
+	v.mu.RLock()
+	leaseID, duration, renewable := v.leaseID, v.leaseDuration, v.renewable
+	v.mu.RUnlock()
+	if !renewable {
+		return false, nil
+	}
+
+	secret, err := v.request(ctx, http.MethodPut, "sys/leases/renew", map[string]interface{}{
+		"lease_id":  leaseID,
+		"increment": int(duration.Seconds()),
+	})
+	if err != nil {
+		return false, err
+	}
+	return time.Duration(secret.LeaseDuration)*time.Second >= duration, nil
+}
+
+// maintain keeps the credentials valid until ctx is done. Renewal happens at two thirds of the
+// lease, leaving the rest of it for connections still using the previous credentials.
+func (v *vaultCredentials) maintain(ctx context.Context) {
+	for {
+		v.mu.RLock()
+		wait := v.leaseDuration * 2 / 3
+		v.mu.RUnlock()
+		if wait <= 0 {
+			wait = time.Minute
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		renewed, err := v.renew(ctx)
+		if err != nil {
+			log.Err(err).Msg("Failed to renew Vault database lease")
+		}
+		if renewed {
+			continue
+		}
+
+		if err := v.issue(ctx); err != nil {
+			log.Err(err).Msg("Failed to rotate Vault database credentials")
+			continue
+		}
+		recycleIdleConnections(db, dbMaxOpenConns)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=1.2.3 -X main.commit=abc123 -X main.buildDate=2024-01-01T00:00:00Z"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// VersionInfo identifies the running build
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// buildVersion returns the build information, falling back to the VCS stamp Go embeds
+// in binaries built from a checkout when ldflags were not provided
+func buildVersion() VersionInfo {
+	info := VersionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+func GetVersionHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, DataResponse{Data: buildVersion()})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/jackc/pgx/v5"
+)
+
+// VirtualField is a field computed for every message instead of read from a column. Fields from a
+// JSON path or a built-in are computed by the database, so they can be filtered with
+// field[name]=value and sorted with sortBy=name like mapped columns. Fields from an expression are
+// computed after the message is read and only appear in responses.
+type VirtualField struct {
+	Name string
+	// sql computes the field from a row of the chat table, for path and built-in fields
+	sql string
+	// program computes the field from the message, for expression fields
+	program *vm.Program
+}
+
+// virtualFields holds the configured virtual fields sorted by name
+var virtualFields []VirtualField
+
+// virtualFieldBuiltins are the SQL expressions of the built-in virtual fields. turnIndex counts
+// the human messages of the session up to the message, so the first turn is 1.
+var virtualFieldBuiltins = map[string]string{
+	"turnIndex": "chat_history_turn_index(session_id, id)",
+}
+
+// virtualPathKeyPattern limits the keys of virtual field paths, which are written into the SQL
+var virtualPathKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// virtualFieldEnv declares the variables of virtual field expressions: the message, its session
+// and the mapped and SQL-computed fields
+var virtualFieldEnv = map[string]interface{}{
+	"message":   map[string]interface{}{},
+	"sessionId": "",
+	"fields":    map[string]interface{}{},
+}
+
+// loadVirtualFields reads VIRTUAL_FIELDS, a JSON object of field names to definitions with one of
+// path, a dotted path into the message, builtin, or expr, an expr-lang expression. It runs after
+// loadColumnMapping, as the names must not clash with mapped fields.
+func loadVirtualFields() error {
+	raw := os.Getenv("VIRTUAL_FIELDS")
+	if raw == "" {
+		return nil
+	}
+	var definitions map[string]struct {
+		Path    string `json:"path"`
+		Builtin string `json:"builtin"`
+		Expr    string `json:"expr"`
+	}
+	if err := json.Unmarshal([]byte(raw), &definitions); err != nil {
+		return fmt.Errorf("VIRTUAL_FIELDS must be a JSON object of field names to definitions: %w", err)
+	}
+
+	for name, definition := range definitions {
+		if !fieldNamePattern.MatchString(name) {
+			return fmt.Errorf("VIRTUAL_FIELDS: invalid field name %q", name)
+		}
+		if _, mapped := mappedColumn(name); mapped || coreColumns[name] != "" {
+			return fmt.Errorf("VIRTUAL_FIELDS: field %q is already a column", name)
+		}
+
+		field := VirtualField{Name: name}
+		switch {
+		case definition.Path != "" && definition.Builtin == "" && definition.Expr == "":
+			path, err := parseJSONPath(definition.Path)
+			if err != nil {
+				return fmt.Errorf("VIRTUAL_FIELDS: field %q: %w", name, err)
+			}
+			for _, key := range path {
+				if !virtualPathKeyPattern.MatchString(key) {
+					return fmt.Errorf("VIRTUAL_FIELDS: field %q: invalid path key %q", name, key)
+				}
+			}
+			field.sql = "message #>> '{" + strings.Join(path, ",") + "}'"
+		case definition.Builtin != "" && definition.Path == "" && definition.Expr == "":
+			sql, ok := virtualFieldBuiltins[definition.Builtin]
+			if !ok {
+				return fmt.Errorf("VIRTUAL_FIELDS: field %q: unknown builtin %q", name, definition.Builtin)
+			}
+			field.sql = sql
+		case definition.Expr != "" && definition.Path == "" && definition.Builtin == "":
+			program, err := expr.Compile(definition.Expr, expr.Env(virtualFieldEnv))
+			if err != nil {
+				return fmt.Errorf("VIRTUAL_FIELDS: field %q: %w", name, err)
+			}
+			field.program = program
+		default:
+			return fmt.Errorf("VIRTUAL_FIELDS: field %q needs exactly one of path, builtin or expr", name)
+		}
+		virtualFields = append(virtualFields, field)
+	}
+	sort.Slice(virtualFields, func(i, j int) bool { return virtualFields[i].Name < virtualFields[j].Name })
+	return nil
+}
+
+// fieldExpr returns the SQL expression of a mapped or database-computed virtual field, for
+// filtering and sorting
+func fieldExpr(name string) (string, bool) {
+	if column, ok := mappedColumn(name); ok {
+		return pgx.Identifier{column}.Sanitize(), true
+	}
+	for _, field := range virtualFields {
+		if field.Name == name && field.sql != "" {
+			return field.sql, true
+		}
+	}
+	return "", false
+}
+
+// fieldNames returns the names of the mapped and virtual fields
+func fieldNames() []string {
+	names := mappedFieldNames()
+	for _, field := range virtualFields {
+		names = append(names, field.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// computedFields reports whether any virtual field is computed from expressions
+func computedFields() bool {
+	for _, field := range virtualFields {
+		if field.program != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// computeFields evaluates the expression fields of a chat whose other fields are already set.
+// A failing expression leaves its field out rather than failing the response.
+func computeFields(chat *Chat) error {
+	raw, err := json.Marshal(chat.Message)
+	if err != nil {
+		return err
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(raw, &message); err != nil {
+		return err
+	}
+	fields := make(map[string]interface{}, len(chat.Fields))
+	for name, value := range chat.Fields {
+		fields[name] = value
+	}
+	env := map[string]interface{}{"message": message, "sessionId": chat.SessionID, "fields": fields}
+
+	if chat.Fields == nil {
+		chat.Fields = make(map[string]interface{}, len(virtualFields))
+	}
+	for _, field := range virtualFields {
+		if field.program == nil {
+			continue
+		}
+		value, err := expr.Run(field.program, env)
+		if err != nil {
+			continue
+		}
+		chat.Fields[field.Name] = value
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// DimensionConfig describes where a dimension of sessions, such as their workflow or channel, can
+// be found in the history table
+type DimensionConfig struct {
+	Column         string   // column mapped with COLUMN_MAPPING, e.g. user_id
+	MetadataPath   []string // JSONB path inside the message, e.g. additional_kwargs.workflow_id
+	SessionPattern string   // regular expression with one capture group applied to session_id
+}
+
+// WorkflowSummary is a single row of the groupBy=workflow listing
+type WorkflowSummary struct {
+	Workflow string `json:"workflow"`
+	Sessions int    `json:"sessions"`
+	Messages int    `json:"messages"`
+}
+
+var workflowConfig DimensionConfig
+
+// loadWorkflowConfig reads WORKFLOW_METADATA_PATH and WORKFLOW_SESSION_PATTERN from the environment
+func loadWorkflowConfig() (err error) {
+	workflowConfig, err = loadDimensionConfig("WORKFLOW")
+	return err
+}
+
+// loadDimensionConfig reads <prefix>_FIELD, <prefix>_METADATA_PATH and <prefix>_SESSION_PATTERN
+// from the environment. The field must be mapped with COLUMN_MAPPING.
+func loadDimensionConfig(prefix string) (DimensionConfig, error) {
+	var config DimensionConfig
+	if field := os.Getenv(prefix + "_FIELD"); field != "" {
+		column, ok := mappedColumn(field)
+		if !ok {
+			return config, fmt.Errorf("%s_FIELD: field %q is not in COLUMN_MAPPING", prefix, field)
+		}
+		config.Column = column
+	}
+
+	if field := os.Getenv(prefix + "_METADATA_PATH"); field != "" {
+		path, err := parseJSONPath(field)
+		if err != nil {
+			return config, fmt.Errorf("%s_METADATA_PATH: %w", prefix, err)
+		}
+		config.MetadataPath = path
+	}
+
+	if pattern := os.Getenv(prefix + "_SESSION_PATTERN"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return config, fmt.Errorf("%s_SESSION_PATTERN: %w", prefix, err)
+		}
+		if re.NumSubexp() != 1 {
+			return config, fmt.Errorf("%s_SESSION_PATTERN must contain exactly one capture group", prefix)
+		}
+		config.SessionPattern = pattern
+	}
+
+	return config, nil
+}
+
+// enabled reports whether any source of the dimension is configured
+func (c DimensionConfig) enabled() bool {
+	return c.Column != "" || len(c.MetadataPath) > 0 || c.SessionPattern != ""
+}
+
+// rowExpr returns the SQL expression extracting the value of the dimension from a single row.
+// A mapped column takes precedence over metadata, and metadata over the session id pattern.
+func (c DimensionConfig) rowExpr(args *queryArgs) string {
+	var sources []string
+	if c.Column != "" {
+		sources = append(sources, "NULLIF("+pgx.Identifier{c.Column}.Sanitize()+"::text, '')")
+	}
+	if len(c.MetadataPath) > 0 {
+		sources = append(sources, "NULLIF(message #>> "+args.add(c.MetadataPath)+", '')")
+	}
+	if c.SessionPattern != "" {
+		sources = append(sources, "substring(session_id from "+args.add(c.SessionPattern)+")")
+	}
+	return "COALESCE(" + strings.Join(sources, ", ") + ")"
+}
+
+func handleWorkflowGrouping(w http.ResponseWriter, r *http.Request, page, pageSize int, sortOrder sortDirection, offset int, filter ChatFilter, plans *queryPlans) {
+	if !workflowConfig.enabled() {
+		respondWithError(w, "Workflow grouping is not configured", http.StatusBadRequest)
+		return
+	}
+
+	// A session belongs to the workflow found on any of its messages
+	var args queryArgs
+	sessions := selectFrom(&args, "n8n_chat_histories", "session_id", "MAX("+workflowConfig.rowExpr(&args)+") AS workflow", "COUNT(*) AS messages").
+		filter(filter).
+		group("session_id")
+	workflowsQuery := selectFrom(&args, "("+sessions.sql()+") AS sessions", "COALESCE(workflow, '')", "COUNT(*)", "SUM(messages)").
+		group("workflow").
+		orderNullsLast("workflow", sortOrder).
+		page(pageSize, offset).
+		sql()
+
+	explainQuery(r.Context(), "workflows", workflowsQuery, args...)
+	rows, err := db.QueryContext(r.Context(), workflowsQuery, args...)
+	if err != nil {
+		log.Err(err).Msg("Failed to query workflows")
+		respondWithQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	workflows := []WorkflowSummary{}
+	for rows.Next() {
+		var workflow WorkflowSummary
+		if err := rows.Scan(&workflow.Workflow, &workflow.Sessions, &workflow.Messages); err != nil {
+			log.Err(err).Msg("Failed to scan workflow row")
+			respondWithQueryError(w, err)
+			return
+		}
+		workflows = append(workflows, workflow)
+	}
+	if err := rows.Err(); err != nil {
+		log.Err(err).Msg("Failed to iterate workflow rows")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	var totalWorkflows int
+	var countArgs queryArgs
+	perSession := selectFrom(&countArgs, "n8n_chat_histories", "MAX("+workflowConfig.rowExpr(&countArgs)+") AS workflow").
+		filter(filter).
+		group("session_id")
+	countQuery := selectFrom(&countArgs, "("+perSession.sql()+") AS sessions",
+		"COUNT(DISTINCT workflow) + COALESCE(MAX(CASE WHEN workflow IS NULL THEN 1 ELSE 0 END), 0)").sql()
+	explainQuery(r.Context(), "count", countQuery, countArgs...)
+	if err := db.QueryRowContext(r.Context(), countQuery, countArgs...).Scan(&totalWorkflows); err != nil {
+		log.Err(err).Msg("Failed to count workflows")
+		respondWithQueryError(w, err)
+		return
+	}
+
+	countRowsServed(r.Context(), len(workflows))
+	totalPages := (totalWorkflows + pageSize - 1) / pageSize
+
+	response := APIResponse{
+		Data: workflows,
+		Pagination: PaginationResponse{
+			Page:       page,
+			PageSize:   pageSize,
+			Total:      totalWorkflows,
+			TotalPages: totalPages,
+			GroupBy:    "workflow",
+		},
+		Debug: plans.debugInfo(),
+	}
+	respondWithJSON(w, response)
+}
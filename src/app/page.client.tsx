@@ -87,7 +87,7 @@ async function fetchChats({
   });
 
   const response = await fetch(
-    `${process.env.NEXT_PUBLIC_API_URL}/api/chats?${params}`
+    `${process.env.NEXT_PUBLIC_API_URL}/api/v1/chats?${params}`
   );
   const data = await response.json();
 